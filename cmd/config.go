@@ -0,0 +1,168 @@
+package cmd
+
+import (
+	"flag"
+	"fmt"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/tluo-github/cri-impl/config"
+	"github.com/tluo-github/cri-impl/pkg/authz"
+	"github.com/tluo-github/cri-impl/pkg/cri"
+	"github.com/tluo-github/cri-impl/server"
+	"k8s.io/klog"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// liveFields 可以通过 SIGHUP 在运行时重新加载的配置项, 其他配置项修改后需要重启守护进程
+var liveFields = map[string]bool{
+	"logLevel":                  true,
+	"authzPolicy":               true,
+	"containerLogMaxSize":       true,
+	"containerLogMaxFiles":      true,
+	"containerLogDriver":        true,
+	"containerLogDriverAddress": true,
+	"containerMemoryLimit":      true,
+	"containerCPULimit":         true,
+	"containerPidsLimit":        true,
+	"containerSecurity":         true,
+}
+
+var dumpFormat string
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "守护进程配置",
+}
+
+var configDumpCmd = &cobra.Command{
+	Use:   "dump",
+	Short: "输出合并默认值, 配置文件和命令行参数之后的完整配置",
+	Run: func(cmd *cobra.Command, args []string) {
+		c, err := loadConfig(cmd)
+		if err != nil {
+			klog.Fatalf("%v", err)
+		}
+		format := dumpFormat
+		if format == "" {
+			format = config.FormatOf(configFile)
+		}
+		out, err := c.Dump(format)
+		if err != nil {
+			klog.Fatalf("%v", err)
+		}
+		fmt.Print(string(out))
+	},
+}
+
+func init() {
+	configDumpCmd.Flags().StringVar(&dumpFormat, "format", "", "输出格式 (yaml, toml), 默认与 --config 相同")
+	configCmd.AddCommand(configDumpCmd)
+	rootCmd.AddCommand(configCmd)
+}
+
+// loadConfig 按照 默认值 < 配置文件 < 命令行参数 的优先级生成配置并校验
+// 每次调用都会重新读取配置文件, 用于启动和 SIGHUP 重新加载
+func loadConfig(cmd *cobra.Command) (*config.Config, error) {
+	c := &config.Config{}
+	defaults := pflag.NewFlagSet("defaults", pflag.ContinueOnError)
+	bindFlags(defaults, c)
+
+	if configFile != "" {
+		if err := c.Load(configFile); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	cmd.Flags().Visit(func(f *pflag.Flag) {
+		target := defaults.Lookup(f.Name)
+		if target == nil || err != nil {
+			return
+		}
+		// slice 参数的 String() 为 "[a,b]" 格式, 不能再 Set
+		if values, ok := f.Value.(pflag.SliceValue); ok {
+			err = target.Value.(pflag.SliceValue).Replace(values.GetSlice())
+			return
+		}
+		err = defaults.Set(f.Name, f.Value.String())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c, c.Validate()
+}
+
+var klogFlags = flag.NewFlagSet("klog", flag.ContinueOnError)
+
+func init() {
+	klog.InitFlags(klogFlags)
+}
+
+// setLogLevel 设置 klog 的详细级别
+func setLogLevel(level int) {
+	if err := klogFlags.Set("v", strconv.Itoa(level)); err != nil {
+		klog.Warningf("failed to set log level %d with err:%v", level, err)
+	}
+}
+
+// watchReload 从 ch 收到 SIGHUP 后重新加载配置, 只应用可以在运行时修改的配置项
+// 新的配置不合法时保持原来的配置
+func watchReload(ch <-chan os.Signal, cmd *cobra.Command, current config.Config, rs cri.RuntimeService, srv server.Server) {
+	for range ch {
+		klog.Infof("received SIGHUP, reloading configuration")
+		next, err := reloadConfig(cmd, &current, rs, srv)
+		if err != nil {
+			klog.Errorf("failed to reload configuration, keeping the previous one: %v", err)
+			continue
+		}
+		current = *next
+	}
+}
+
+func reloadConfig(cmd *cobra.Command, current *config.Config, rs cri.RuntimeService, srv server.Server) (*config.Config, error) {
+	next, err := loadConfig(cmd)
+	if err != nil {
+		return nil, err
+	}
+	logPolicy, err := next.ContainerLogPolicy()
+	if err != nil {
+		return nil, err
+	}
+	resources, err := next.ContainerResources()
+	if err != nil {
+		return nil, err
+	}
+	security, err := next.ContainerSecurityDefaults()
+	if err != nil {
+		return nil, err
+	}
+	// 策略文件的内容可能改变, 即使路径没有变化也重新读取
+	var policy *authz.Policy
+	if next.AuthzPolicyFile != "" {
+		if policy, err = authz.LoadPolicy(next.AuthzPolicyFile); err != nil {
+			return nil, err
+		}
+	}
+
+	var restartRequired []string
+	for _, field := range current.Changed(next) {
+		if !liveFields[field] {
+			restartRequired = append(restartRequired, field)
+		}
+	}
+	if len(restartRequired) > 0 {
+		klog.Warningf("configuration changes to %s require a daemon restart and are ignored",
+			strings.Join(restartRequired, ", "))
+		// 返回的配置是正在使用的配置, 之后的重新加载仍然对这些字段发出警告
+		next.CopyFields(current, restartRequired)
+	}
+
+	setLogLevel(next.LogLevel)
+	rs.SetDefaults(logPolicy, resources, security)
+	srv.SetPolicy(policy)
+	klog.Infof("configuration reloaded: logLevel=%d containerLogMaxSize=%s containerLogDriver=%s authzPolicy=%q",
+		next.LogLevel, next.ContainerLogMaxSize, next.ContainerLogDriver, next.AuthzPolicyFile)
+	return next, nil
+}
@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+	"github.com/tluo-github/cri-impl/pkg/authz"
+	"github.com/tluo-github/cri-impl/pkg/container"
+	"github.com/tluo-github/cri-impl/pkg/cri"
+	"github.com/tluo-github/cri-impl/server"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// stubRuntime 记录重新加载后的默认日志策略
+type stubRuntime struct {
+	cri.RuntimeService
+	logPolicy container.LogPolicy
+}
+
+func (r *stubRuntime) SetDefaults(logPolicy container.LogPolicy, resources container.Resources, security container.SecurityOptions) {
+	r.logPolicy = logPolicy
+}
+
+type stubServer struct {
+	server.Server
+}
+
+func (s *stubServer) SetPolicy(policy *authz.Policy) {}
+
+func TestReloadConfigKeepsRestartRequiredFields(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(prev string) { configFile = prev }(configFile)
+	configFile = filepath.Join(dir, "config.yaml")
+	write := func(content string) {
+		if err := ioutil.WriteFile(configFile, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cmd := &cobra.Command{}
+	write("listen: /run/a.sock\ncontainerLogMaxSize: 1Ki\n")
+	current, err := loadConfig(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	running := *current
+	rs := &stubRuntime{}
+	write("listen: /run/b.sock\ncontainerLogMaxSize: 2Ki\n")
+	for i := 0; i < 2; i++ {
+		next, err := reloadConfig(cmd, current, rs, &stubServer{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// listen 需要重启, 返回的配置保持正在使用的值, 每次重新加载都会再次警告
+		if next.Listen != "/run/a.sock" {
+			t.Errorf("reload %d: listen = %s, want the running /run/a.sock", i, next.Listen)
+		}
+		if next.ContainerLogMaxSize != "2Ki" || rs.logPolicy.MaxSize != 2048 {
+			t.Errorf("reload %d: containerLogMaxSize = %s, applied %d", i, next.ContainerLogMaxSize, rs.logPolicy.MaxSize)
+		}
+		if changed := running.Changed(next); len(changed) != 1 || changed[0] != "containerLogMaxSize" {
+			t.Errorf("reload %d: changed fields = %v, want only containerLogMaxSize", i, changed)
+		}
+		current = next
+	}
+}
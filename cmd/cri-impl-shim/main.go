@@ -0,0 +1,126 @@
+/*
+Copyright © 2022 tluo
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// cri-impl-shim 是容器的 shim 进程, 命令行参数和 sync pipe 协议与 shimmy 相同, 只是 --runtime-arg 的值不带引号.
+// 守护进程执行 cri-impl-shim 后, 它检查参数, 以新的 session 重新执行自己并写入 --shimmy-pidfile, 然后立即退出;
+// 脱离守护进程的 shim 执行 runc create, 将容器 stdio 转发到日志文件和 attach socket, 回收容器并写入 exit file
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/spf13/pflag"
+	"github.com/tluo-github/cri-impl/pkg/shim"
+	"io/ioutil"
+	"k8s.io/klog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// daemonEnv 标记已经脱离守护进程的 shim 进程
+const daemonEnv = "_CRI_IMPL_SHIM_DAEMON"
+
+// childSyncPipeFd sync pipe 作为 ExtraFiles[0] 传给脱离后的 shim
+const childSyncPipeFd = 3
+
+func main() {
+	opts := shim.Options{}
+	flags := pflag.NewFlagSet("cri-impl-shim", pflag.ContinueOnError)
+	flags.StringVar(&opts.PidFile, "shimmy-pidfile", "", "shim 进程的 pid 文件")
+	flags.StringVar(&opts.LogLevel, "shimmy-log-level", "INFO", "shim 日志级别 (INFO, DEBUG), 日志写入 bundle 目录下的 shim.log")
+	flags.StringVar(&opts.Runtime, "runtime", "", "OCI 运行时可执行文件(runc)")
+	flags.StringArrayVar(&opts.RuntimeArgs, "runtime-arg", nil, "runc 的全局参数, 可以指定多次")
+	flags.StringVar(&opts.Bundle, "bundle", "", "容器 bundle 目录")
+	flags.StringVar(&opts.ContainerID, "container-id", "", "容器 ID")
+	flags.StringVar(&opts.ContainerPidFile, "container-pidfile", "", "runc 写入容器主进程 pid 的文件")
+	flags.StringVar(&opts.LogFile, "container-logfile", "", "CRI 格式的容器日志文件")
+	flags.StringVar(&opts.ExitFile, "container-exitfile", "", "容器退出后写入退出状态的文件")
+	flags.StringVar(&opts.AttachFile, "container-attachfile", "", "attach UNIX socket")
+	flags.BoolVar(&opts.Stdin, "stdin", false, "为容器保持 stdin")
+	flags.BoolVar(&opts.StdinOnce, "stdin-once", false, "第一个 attach 连接关闭 stdin 后关闭容器 stdin")
+	flags.IntVar(&opts.SyncPipeFd, "syncpipe-fd", 0, "报告 runc create 结果的 pipe")
+	if err := flags.Parse(os.Args[1:]); err != nil {
+		fail(err)
+	}
+
+	if os.Getenv(daemonEnv) == "" {
+		if err := opts.Validate(); err != nil {
+			fail(err)
+		}
+		if err := daemonize(opts); err != nil {
+			fail(err)
+		}
+		return
+	}
+
+	os.Unsetenv(daemonEnv)
+	setupLogging(opts)
+	defer klog.Flush()
+	if err := shim.Run(opts); err != nil {
+		klog.Flush()
+		os.Exit(1)
+	}
+}
+
+// daemonize 在新的 session 中重新执行 shim, 写入它的 pid 后返回, 守护进程的 exec 随之结束
+func daemonize(opts shim.Options) error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	syncpipe := os.NewFile(uintptr(opts.SyncPipeFd), "syncpipe")
+	defer syncpipe.Close()
+
+	cmd := exec.Command(self, append(os.Args[1:], "--syncpipe-fd="+strconv.Itoa(childSyncPipeFd))...)
+	cmd.Env = append(os.Environ(), daemonEnv+"=1")
+	cmd.ExtraFiles = []*os.File{syncpipe}
+	cmd.Dir = "/"
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(opts.PidFile, []byte(strconv.Itoa(cmd.Process.Pid)), 0644); err != nil {
+		cmd.Process.Kill()
+		return err
+	}
+	return cmd.Process.Release()
+}
+
+// setupLogging 脱离后的 shim 没有 stderr, 日志写入 bundle 目录下的 shim.log
+func setupLogging(opts shim.Options) {
+	klogFlags := flag.NewFlagSet("klog", flag.ContinueOnError)
+	klog.InitFlags(klogFlags)
+	klogFlags.Set("logtostderr", "false")
+	klogFlags.Set("log_file", filepath.Join(opts.Bundle, "shim.log"))
+	if strings.EqualFold(opts.LogLevel, "DEBUG") {
+		klogFlags.Set("v", "4")
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "cri-impl-shim: %v\n", err)
+	os.Exit(1)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/tluo-github/cri-impl/pkg/oci"
+	"github.com/tluo-github/cri-impl/pkg/shimutil"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeRunc 代替 runc: 记录全局参数, 像 runc create 一样启动 bundle 中的 entrypoint 并写入 pid file, 然后退出
+// bundle 中存在 fail 文件时 create 失败
+const fakeRunc = `#!/bin/sh
+args=""
+while [ "$1" != create ]; do
+	args="$args$1
+"
+	shift
+done
+bundle=$3
+pidfile=$5
+printf %s "$args" > "$bundle/runtime-args"
+if [ -e "$bundle/fail" ]; then
+	echo "cannot create container" >&2
+	exit 1
+fi
+sh "$bundle/entrypoint" &
+echo $! > "$pidfile"
+`
+
+// entrypoint 容器进程: 输出一行, 等待测试创建 continue 文件后再输出一行并以 3 退出
+const entrypoint = `echo first
+while [ ! -e %[1]s/continue ]; do sleep 0.05; done
+echo second >&2
+exit 3
+`
+
+type shimEnv struct {
+	dir     string
+	runtime oci.Runtime
+}
+
+func newShimEnv(t *testing.T) *shimEnv {
+	dir, err := ioutil.TempDir("", "cri-impl-shim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	// 从本模块构建 shim, 文件名决定守护进程是否向它发送 SIGUSR1
+	shimPath := filepath.Join(dir, "cri-impl-shim")
+	if out, err := exec.Command("go", "build", "-o", shimPath, ".").CombinedOutput(); err != nil {
+		t.Fatalf("build cri-impl-shim: %v\n%s", err, out)
+	}
+	runcPath := filepath.Join(dir, "runc")
+	if err := ioutil.WriteFile(runcPath, []byte(fakeRunc), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return &shimEnv{
+		dir:     dir,
+		runtime: oci.NewRuntime(shimPath, runcPath, filepath.Join(dir, "root"), []string{"--debug"}),
+	}
+}
+
+func (e *shimEnv) bundle(t *testing.T, name string) string {
+	bundle := filepath.Join(e.dir, name)
+	if err := os.Mkdir(bundle, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(bundle, "entrypoint"), []byte(fmt.Sprintf(entrypoint, bundle)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return bundle
+}
+
+func (e *shimEnv) create(bundle string) (int, error) {
+	return e.runtime.CreateContainer(
+		context.Background(),
+		"c1",
+		bundle,
+		filepath.Join(bundle, "container.log"),
+		filepath.Join(bundle, "exit"),
+		filepath.Join(bundle, "attach"),
+		false,
+		false,
+		5*time.Second,
+	)
+}
+
+// waitFile 等待文件存在并且包含 substr
+func waitFile(t *testing.T, path string, substr string) []byte {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		data, err := ioutil.ReadFile(path)
+		if err == nil && bytes.Contains(data, []byte(substr)) {
+			return data
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s does not contain %q: %q (%v)", path, substr, data, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestShimEndToEnd(t *testing.T) {
+	e := newShimEnv(t)
+	bundle := e.bundle(t, "bundle")
+
+	start := time.Now()
+	pid, err := e.create(bundle)
+	if err != nil {
+		t.Fatalf("create container: %v", err)
+	}
+	if pid <= 0 {
+		t.Fatalf("container pid = %d", pid)
+	}
+	// 容器还在运行: sync pipe 没有泄漏给 runc 和容器进程时, 守护进程不需要等到容器退出
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("create took %v, sync pipe leaked to the container", elapsed)
+	}
+
+	args, err := ioutil.ReadFile(filepath.Join(bundle, "runtime-args"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "--root=" + filepath.Join(e.dir, "root") + "\n--debug\n"; string(args) != want {
+		t.Errorf("runc global args = %q, want %q", args, want)
+	}
+
+	logFile := filepath.Join(bundle, "container.log")
+	waitFile(t, logFile, " stdout F first\n")
+
+	// 轮转日志后通知 shim 重新打开
+	if err := os.Rename(logFile, logFile+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.runtime.ReopenContainerLog(context.Background(), "c1", bundle); err != nil {
+		t.Fatalf("reopen container log: %v", err)
+	}
+	// shim 在 wait 循环中处理 SIGUSR1, 等待它重新创建日志文件
+	waitFile(t, logFile, "")
+	if err := ioutil.WriteFile(filepath.Join(bundle, "continue"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	data := waitFile(t, filepath.Join(bundle, "exit"), "exitCode")
+	status, err := shimutil.ParseExitFile(data)
+	if err != nil {
+		t.Fatalf("parse exit file %q: %v", data, err)
+	}
+	if status.IsSignaled() || status.ExitCode() != 3 {
+		t.Errorf("exit status = %q, want exit code 3", data)
+	}
+	waitFile(t, logFile, " stderr F second\n")
+	if rotated, _ := ioutil.ReadFile(logFile + ".1"); strings.Contains(string(rotated), "second") {
+		t.Errorf("shim kept writing the rotated log: %q", rotated)
+	}
+}
+
+func TestShimReportsCreateFailure(t *testing.T) {
+	e := newShimEnv(t)
+	bundle := e.bundle(t, "bundle")
+	if err := ioutil.WriteFile(filepath.Join(bundle, "fail"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := e.create(bundle)
+	if err == nil || !strings.Contains(err.Error(), "cannot create container") {
+		t.Fatalf("create error = %v, want runc stderr in the report", err)
+	}
+}
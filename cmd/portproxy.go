@@ -0,0 +1,44 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+	"github.com/tluo-github/cri-impl/pkg/container"
+	"github.com/tluo-github/cri-impl/pkg/portproxy"
+)
+
+var portProxyOpts struct {
+	containerID string
+	target      string
+	publish     []string
+}
+
+// portProxyCmd 守护进程为发布的端口启动的用户态代理进程, 不需要手动运行
+var portProxyCmd = &cobra.Command{
+	Use:    portproxy.Command,
+	Short:  "转发主机端口到容器的用户态代理",
+	Hidden: true,
+	Args:   cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		opts := portproxy.ServeOptions{
+			ContainerID: portProxyOpts.containerID,
+			Target:      portProxyOpts.target,
+		}
+		for _, s := range portProxyOpts.publish {
+			p, err := container.ParsePortMapping(s)
+			if err != nil {
+				return err
+			}
+			opts.Ports = append(opts.Ports, p)
+		}
+		return portproxy.Serve(opts)
+	},
+}
+
+func init() {
+	flags := portProxyCmd.Flags()
+	flags.StringVar(&portProxyOpts.containerID, "container-id", "", "容器 id")
+	flags.StringVar(&portProxyOpts.target, "target", "", "转发到的容器地址, 为空时创建新的网络命名空间并转发到其中的 127.0.0.1")
+	flags.StringArrayVar(&portProxyOpts.publish, "publish", nil, "发布的端口 [hostIP:]hostPort:containerPort/protocol")
+	portProxyCmd.MarkFlagRequired("container-id")
+	rootCmd.AddCommand(portProxyCmd)
+}
@@ -1,19 +1,41 @@
 package cmd
 
 import (
+	"context"
+	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"github.com/tluo-github/cri-impl/config"
+	"github.com/tluo-github/cri-impl/pkg/audit"
+	"github.com/tluo-github/cri-impl/pkg/authz"
 	"github.com/tluo-github/cri-impl/pkg/cri"
 	"github.com/tluo-github/cri-impl/pkg/fsutil"
+	"github.com/tluo-github/cri-impl/pkg/metrics"
+	"github.com/tluo-github/cri-impl/pkg/network"
 	"github.com/tluo-github/cri-impl/pkg/oci"
+	"github.com/tluo-github/cri-impl/pkg/plugin"
+	"github.com/tluo-github/cri-impl/pkg/portproxy"
+	"github.com/tluo-github/cri-impl/pkg/rootless"
 	"github.com/tluo-github/cri-impl/pkg/storage"
+	"github.com/tluo-github/cri-impl/pkg/systemd"
+	"github.com/tluo-github/cri-impl/pkg/tracing"
 	"github.com/tluo-github/cri-impl/server"
 	"k8s.io/klog"
 	"k8s.io/kubernetes/pkg/kubelet/cri/streaming"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 )
 
 var cfg config.Config
 
+// configFile --config 指定的配置文件
+var configFile string
+
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
 	Use:   "cri-impl",
@@ -22,19 +44,85 @@ var rootCmd = &cobra.Command{
 	// Uncomment the following line if your bare application
 	// has an action associated with it:
 	Run: func(cmd *cobra.Command, args []string) {
+		// 启动期间收到的 SIGHUP 不能按照默认行为结束进程, 在服务启动后再重新加载
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+
+		loaded, err := loadConfig(cmd)
+		if err != nil {
+			klog.Fatalf("%v", err)
+		}
+		cfg = *loaded
+		setLogLevel(cfg.LogLevel)
 		klog.Infof("cri-impl here!")
 
-		runtime := oci.NewRuntime(
-			fsutil.AssertExists(cfg.ShimmyPath),
-			fsutil.AssertExists(cfg.RuntimePath),
-			fsutil.AssertExists(cfg.RuntimeRoot),
-		)
+		shutdownTracing, err := tracing.Init(context.Background(), tracing.Config{
+			Exporter:    cfg.TracingExporter,
+			Endpoint:    cfg.TracingEndpoint,
+			SampleRatio: cfg.TracingSampleRatio,
+		})
+		if err != nil {
+			klog.Fatalf("failed to init tracing: %v", err)
+		}
+		defer shutdownTracing(context.Background())
+
+		runtimes := make(map[string]oci.Runtime)
+		for name, h := range cfg.Runtimes() {
+			runtimes[name] = oci.NewRuntime(
+				fsutil.AssertExists(cfg.ShimmyPath),
+				fsutil.AssertExists(h.Path),
+				fsutil.AssertExists(h.Root),
+				h.Args,
+			)
+		}
 		cstore := storage.NewContainerStore(fsutil.EnsureExists(cfg.LibRoot))
 		logDir := fsutil.EnsureExists(cfg.ContainerLogRoot)
 		exitDir := fsutil.EnsureExists(cfg.RunRoot, "exits")
 		attachDir := fsutil.EnsureExists(cfg.RunRoot, "attach")
 
-		rs, err := cri.NewRuntimeService(runtime, cstore, logDir, exitDir, attachDir)
+		logPolicy, err := cfg.ContainerLogPolicy()
+		if err != nil {
+			klog.Fatalf("invalid container log options: %v", err)
+		}
+		resources, err := cfg.ContainerResources()
+		if err != nil {
+			klog.Fatalf("invalid container resource limits: %v", err)
+		}
+		security, err := cfg.ContainerSecurityDefaults()
+		if err != nil {
+			klog.Fatalf("invalid container security options: %v", err)
+		}
+
+		rootlessInfo := rootless.Detect()
+		if rootlessInfo != nil {
+			if rootlessInfo.Cgroup != nil {
+				klog.Infof("running rootless as uid %d, delegated cgroup %s", rootlessInfo.UID, rootlessInfo.Cgroup.Path)
+			} else {
+				klog.Warningf("running rootless as uid %d without cgroup delegation, container resource limits are ignored: %v",
+					rootlessInfo.UID, rootlessInfo.CgroupError)
+			}
+		}
+
+		// 非 root 用户不能创建网络命名空间和 veth, rootless 时容器只有 loopback 网络
+		var networkManager *network.Manager
+		if rootlessInfo == nil {
+			netOpts, err := cfg.ContainerNetwork()
+			if err != nil {
+				klog.Fatalf("invalid container network options: %v", err)
+			}
+			if networkManager, err = network.NewManager(netOpts); err != nil {
+				klog.Fatalf("failed to init container network: %v", err)
+			}
+		}
+		portProxy, err := portproxy.NewLauncher(fsutil.EnsureExists(cfg.LibRoot, "ports"), rootlessInfo)
+		if err != nil {
+			klog.Fatalf("failed to init port proxy: %v", err)
+		}
+
+		notify(systemd.Status("Restoring containers"))
+		rs, err := cri.NewRuntimeService(runtimes, cfg.DefaultRuntimeHandler, cstore, logDir, exitDir, attachDir, logPolicy, resources,
+			security, cfg.SeccompProfileDir, cfg.Hooks, plugin.NewManager(cfg.LifecyclePlugins()), cfg.ContainerSpecTemplates(),
+			cfg.SubIDUser, cfg.UserNamespaceSize, rootlessInfo, networkManager, cfg.Network, portProxy, cfg.PortBackend)
 		if err != nil {
 			klog.Fatalf("%v", err)
 		}
@@ -46,13 +134,115 @@ var rootCmd = &cobra.Command{
 			klog.Fatalf("%v", err)
 		}
 
-		go ss.Start(true)
+		// 由守护进程创建监听, 保证通知 systemd READY 时流服务已经可以连接
+		ssLis, err := net.Listen("tcp", cfg.StreamingAddr)
+		if err != nil {
+			klog.Fatalf("streaming server listen error %v", err)
+		}
+		ssHTTP := &http.Server{Handler: ss}
+		go func() {
+			if err := ssHTTP.Serve(ssLis); err != http.ErrServerClosed {
+				klog.Errorf("streaming server serve error %v", err)
+			}
+		}()
 
-		criServer := server.New(rs, ss)
-		if err := criServer.Serve("unix", cfg.Listen); err != nil {
-			klog.Fatalf("criserver serve error %v", err)
+		metricsCtx, stopMetrics := context.WithCancel(context.Background())
+		defer stopMetrics()
+		if cfg.MetricsAddr != "" {
+			go func() {
+				if err := metrics.Serve(metricsCtx, cfg.MetricsAddr); err != nil {
+					klog.Errorf("metrics serve error %v", err)
+				}
+			}()
 		}
+
+		srvOpts := server.Options{
+			MaxDeadline: time.Duration(cfg.GrpcMaxDeadline),
+		}
+		if cfg.ListenTCP != "" {
+			srvOpts.TLS = &server.TLSOptions{
+				CertFile:     cfg.TLSCertFile,
+				KeyFile:      cfg.TLSKeyFile,
+				ClientCAFile: cfg.TLSClientCAFile,
+			}
+		}
+		if cfg.AuthzPolicyFile != "" {
+			if srvOpts.Policy, err = authz.LoadPolicy(cfg.AuthzPolicyFile); err != nil {
+				klog.Fatalf("%v", err)
+			}
+		}
+
+		if cfg.ListenMode != "" {
+			mode, err := strconv.ParseUint(cfg.ListenMode, 8, 32)
+			if err != nil {
+				klog.Fatalf("invalid --listen-mode %q: %v", cfg.ListenMode, err)
+			}
+			srvOpts.SocketMode = os.FileMode(mode)
+		}
+		srvOpts.SocketGroup = cfg.ListenGroup
+		if cfg.AuditLog != "" {
+			if srvOpts.Audit, err = audit.Open(cfg.AuditLog); err != nil {
+				klog.Fatalf("failed to open audit log: %v", err)
+			}
+			defer srvOpts.Audit.Close()
+		}
+
+		criServer := server.New(rs, ss, srvOpts)
+		go watchReload(reload, cmd, cfg, rs, criServer)
+		// systemd socket activation 传入的 socket 代替 --listen
+		unixLis, err := activatedListener()
+		if err != nil {
+			klog.Fatalf("%v", err)
+		}
+		if unixLis == nil {
+			if unixLis, err = criServer.Listen("unix", cfg.Listen); err != nil {
+				klog.Fatalf("criserver listen error %v", err)
+			}
+		}
+		var tcpLis net.Listener
+		if cfg.ListenTCP != "" {
+			if tcpLis, err = criServer.Listen("tcp", cfg.ListenTCP); err != nil {
+				klog.Fatalf("criserver tcp listen error %v", err)
+			}
+		}
+
+		serveErr := make(chan error, 2)
+		if tcpLis != nil {
+			go func() {
+				if err := criServer.ServeListener("tcp", tcpLis); err != nil {
+					serveErr <- errors.Wrap(err, "criserver tcp serve error")
+				}
+			}()
+		}
+		go func() {
+			if err := criServer.ServeListener("unix", unixLis); err != nil {
+				serveErr <- errors.Wrap(err, "criserver serve error")
+			}
+		}()
 		klog.Infof("cri-impl start ok! ")
+		notifyReady(rs, unixLis.Addr().String())
+		go runWatchdog(rs)
+
+		signals := make(chan os.Signal, 2)
+		signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+		select {
+		case sig := <-signals:
+			klog.Infof("received %v, shutting down", sig)
+		case err = <-serveErr:
+			klog.Errorf("%v, shutting down", err)
+		}
+		go func() {
+			sig := <-signals
+			klog.Fatalf("received %v again, exiting without graceful shutdown", sig)
+		}()
+
+		notify(systemd.Stopping, systemd.Status("Shutting down"))
+		shutdown(time.Duration(cfg.ShutdownTimeout), cfg.LiveRestore, criServer, ssHTTP, rs)
+		if err != nil {
+			shutdownTracing(context.Background())
+			klog.Fatalf("%v", err)
+		}
+		klog.Infof("cri-impl stopped")
 	},
 }
 
@@ -61,12 +251,55 @@ func Execute() {
 }
 
 func init() {
-	rootCmd.Flags().StringVarP(&cfg.Listen, "listen", "l", config.DefaultListen, "守护进程监听 sock 地址")
-	rootCmd.Flags().StringVarP(&cfg.LibRoot, "lib-root", "b", config.DefaultLibRoot, "持久数据的根目录,如 container bundles 等.")
-	rootCmd.Flags().StringVarP(&cfg.RunRoot, "run-root", "n", config.DefaultRunRoot, "运行时数据的根目录,如 sock 和 pid 文件")
-	rootCmd.Flags().StringVarP(&cfg.ContainerLogRoot, "container-logs", "L", config.DefaultContainerLogRoot, "容器日志根目录")
-	rootCmd.Flags().StringVarP(&cfg.StreamingAddr, "streaming-addr", "S", config.DefaultStreaminAddr, "流服务 host:port( for attach,exec,port-forwarding)")
-	rootCmd.Flags().StringVarP(&cfg.ShimmyPath, "shimmy-path", "s", config.DefaultShimmyPath, "OCI 运行时 shim 可执行文件(shimmy)")
-	rootCmd.Flags().StringVarP(&cfg.RuntimePath, "runtime-path", "r", config.DefaultRuntimePath, "OCI 运行时可执行文件(runc)")
-	rootCmd.Flags().StringVarP(&cfg.RuntimeRoot, "runtime-root", "t", config.DefaultRuntimeRoot, "OCI 运行时根目录")
+	rootCmd.PersistentFlags().StringVarP(&configFile, "config", "c", "", "配置文件 (.yaml/.yml/.json 或 .toml), 命令行参数优先于配置文件")
+	bindFlags(rootCmd.PersistentFlags(), &cfg)
+}
+
+// bindFlags 定义守护进程的命令行参数, 参数名与配置文件中的字段一一对应
+func bindFlags(flags *pflag.FlagSet, cfg *config.Config) {
+	dirs := config.DefaultDirs()
+	flags.StringVarP(&cfg.Listen, "listen", "l", dirs.Listen, "守护进程监听 sock 地址")
+	flags.StringVar(&cfg.ListenMode, "listen-mode", config.DefaultListenMode, "守护进程 sock 文件的权限 (八进制)")
+	flags.StringVar(&cfg.ListenGroup, "listen-group", "", "守护进程 sock 文件的属组 (组名或 gid)")
+	flags.StringVar(&cfg.ListenTCP, "listen-tcp", "", "可选的 TCP 监听地址 host:port, 只接受 mTLS 连接")
+	flags.StringVar(&cfg.TLSCertFile, "tls-cert", "", "TCP 监听使用的服务端证书")
+	flags.StringVar(&cfg.TLSKeyFile, "tls-key", "", "TCP 监听使用的服务端私钥")
+	flags.StringVar(&cfg.TLSClientCAFile, "tls-client-ca", "", "校验客户端证书的 CA")
+	flags.StringVar(&cfg.AuthzPolicyFile, "authz-policy", "", "访问策略文件 (YAML/JSON), 定义客户端证书和 sock 调用方用户/组对应的 read-only 或 full 访问级别")
+	flags.StringVar(&cfg.AuditLog, "audit-log", dirs.AuditLog, "修改状态的调用的审计日志 (JSON Lines), 为空表示不记录")
+	flags.StringVarP(&cfg.LibRoot, "lib-root", "b", dirs.LibRoot, "持久数据的根目录,如 container bundles 等.")
+	flags.StringVarP(&cfg.RunRoot, "run-root", "n", dirs.RunRoot, "运行时数据的根目录,如 sock 和 pid 文件")
+	flags.StringVarP(&cfg.ContainerLogRoot, "container-logs", "L", dirs.ContainerLogRoot, "容器日志根目录")
+	flags.StringVarP(&cfg.StreamingAddr, "streaming-addr", "S", config.DefaultStreaminAddr, "流服务 host:port( for attach,exec,port-forwarding)")
+	flags.StringVarP(&cfg.ShimmyPath, "shimmy-path", "s", config.DefaultShimmyPath, "OCI 运行时 shim 可执行文件 (cri-impl-shim, 也兼容 shimmy)")
+	flags.StringVarP(&cfg.RuntimePath, "runtime-path", "r", config.DefaultRuntimePath, "OCI 运行时可执行文件(runc)")
+	flags.StringVarP(&cfg.RuntimeRoot, "runtime-root", "t", dirs.RuntimeRoot, "OCI 运行时根目录")
+	flags.StringVar(&cfg.DefaultRuntimeHandler, "default-runtime-handler", config.DefaultRuntimeHandler, "未指定 runtime handler 的容器使用的 OCI 运行时, 其他 handler 在配置文件的 runtimeHandlers 中定义")
+	flags.StringVar(&cfg.ContainerLogMaxSize, "container-log-max-size", config.DefaultContainerLogMaxSize, "容器日志文件轮转前的最大大小,如 10Mi, 0 表示不轮转")
+	flags.Int32Var(&cfg.ContainerLogMaxFiles, "container-log-max-files", config.DefaultContainerLogMaxFiles, "每个容器最多保留的日志文件数(包含当前文件)")
+	flags.StringVar(&cfg.ContainerLogDriver, "container-log-driver", config.DefaultContainerLogDriver, "默认的容器日志驱动 (file, syslog, fluentd)")
+	flags.StringVar(&cfg.ContainerLogDriverAddress, "container-log-driver-address", "", "默认日志驱动的地址,如 unixgram:///dev/log, tcp://127.0.0.1:24224")
+	flags.DurationVar((*time.Duration)(&cfg.GrpcMaxDeadline), "grpc-max-deadline", config.DefaultGrpcMaxDeadline, "gRPC unary 调用的最大超时时间, 0 表示不限制")
+	flags.StringVar(&cfg.MetricsAddr, "metrics-addr", config.DefaultMetricsAddr, "Prometheus /metrics 监听的 host:port, 为空表示不开启")
+	flags.StringVar(&cfg.TracingExporter, "tracing-exporter", config.DefaultTracingExporter, "OpenTelemetry trace 导出方式 (none, otlp, stdout)")
+	flags.StringVar(&cfg.TracingEndpoint, "tracing-endpoint", config.DefaultTracingEndpoint, "OTLP/gRPC collector 的 host:port")
+	flags.Float64Var(&cfg.TracingSampleRatio, "tracing-sample-ratio", config.DefaultTracingSampleRatio, "trace 采样比例, 1 表示全部采样")
+	flags.BoolVar(&cfg.LiveRestore, "live-restore", true, "关闭守护进程时保持容器运行,由下次启动接管; false 表示关闭时停止所有容器")
+	flags.DurationVar((*time.Duration)(&cfg.ShutdownTimeout), "shutdown-timeout", config.DefaultShutdownTimeout, "关闭时等待进行中的调用和 attach 结束的最长时间")
+	flags.IntVar(&cfg.LogLevel, "log-level", 0, "日志详细级别 (klog -v), 可以通过 SIGHUP 重新加载")
+	flags.StringVar(&cfg.ContainerMemoryLimit, "container-memory-limit", config.DefaultContainerMemoryLimit, "新建容器默认的内存上限,如 512Mi, 0 表示不限制")
+	flags.StringVar(&cfg.ContainerCPULimit, "container-cpu-limit", config.DefaultContainerCPULimit, "新建容器默认的 CPU 上限,如 1.5 或 500m, 0 表示不限制")
+	flags.Int64Var(&cfg.ContainerPidsLimit, "container-pids-limit", 0, "新建容器默认的最大进程数, 0 表示不限制")
+	flags.StringVar(&cfg.SeccompProfileDir, "seccomp-profile-dir", config.DefaultSeccompProfileDir, "localhost/<路径> seccomp profile 所在的目录")
+	flags.StringVar(&cfg.SubIDUser, "subid-user", config.DefaultSubIDUser, "自动分配用户命名空间时使用 /etc/subuid 和 /etc/subgid 中该用户的范围")
+	flags.Uint32Var(&cfg.UserNamespaceSize, "userns-size", config.DefaultUserNamespaceSize, "自动分配的用户命名空间默认大小")
+	flags.StringVar(&cfg.Network, "network", config.DefaultNetwork, "没有指定网络模式的容器使用的网络 (none, bridge, cni)")
+	flags.StringVar(&cfg.BridgeName, "bridge-name", config.DefaultBridgeName, "bridge 网络使用的 Linux bridge, 不存在时自动创建")
+	flags.StringVar(&cfg.BridgeSubnet, "bridge-subnet", config.DefaultBridgeSubnet, "bridge 网络的 IPv4 子网, 第一个地址作为网关")
+	flags.BoolVar(&cfg.BridgeNAT, "bridge-nat", true, "对 bridge 网络离开主机的流量做 MASQUERADE (需要 iptables)")
+	flags.StringVar(&cfg.CNIConfDir, "cni-conf-dir", config.DefaultCNIConfDir, "CNI 网络配置文件 (.conflist, .conf, .json) 所在的目录")
+	flags.StringSliceVar(&cfg.CNIPluginDirs, "cni-plugin-dir", []string{config.DefaultCNIPluginDir}, "查找 CNI 插件可执行文件的目录, 可以指定多个")
+	flags.StringVar(&cfg.CNINetwork, "cni-network", "", "cni 网络使用的网络名称, 为空时使用 --cni-conf-dir 中按文件名排序的第一个网络")
+	flags.DurationVar((*time.Duration)(&cfg.CNIPluginTimeout), "cni-plugin-timeout", config.DefaultCNIPluginTimeout, "每次执行 CNI 插件的超时时间, 超时的插件被 kill")
+	flags.StringVar(&cfg.PortBackend, "port-backend", config.DefaultPortBackend, "发布容器端口的方式 (iptables, proxy), 容器没有 bridge 或 cni 网络以及 rootless 时总是使用 proxy")
 }
@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"context"
+	"github.com/tluo-github/cri-impl/pkg/cri"
+	"github.com/tluo-github/cri-impl/server"
+	"k8s.io/klog"
+	"net/http"
+	"time"
+)
+
+// shutdown 依次停止 gRPC 服务, RuntimeService 和流服务
+// 进行中的 unary 调用和 attach 最多等待 timeout, 之后强制断开
+func shutdown(
+	timeout time.Duration,
+	liveRestore bool,
+	srv server.Server,
+	ss *http.Server,
+	rs cri.RuntimeService,
+) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	srv.Shutdown(ctx)
+	klog.Infof("grpc server stopped")
+
+	if liveRestore {
+		klog.Infof("live-restore enabled, leaving containers running")
+	} else {
+		klog.Infof("stopping all containers")
+	}
+	if err := rs.Shutdown(ctx, !liveRestore); err != nil {
+		klog.Errorf("failed to shut down runtime service with err:%v", err)
+	}
+
+	if err := ss.Close(); err != nil {
+		klog.Warningf("failed to stop streaming server with err:%v", err)
+	}
+}
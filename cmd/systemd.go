@@ -0,0 +1,171 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/tluo-github/cri-impl/pkg/cri"
+	"github.com/tluo-github/cri-impl/pkg/rootless"
+	"github.com/tluo-github/cri-impl/pkg/systemd"
+	"io/ioutil"
+	"k8s.io/klog"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// defaultWatchdog 生成的 unit 文件中的 WatchdogSec
+const defaultWatchdog = 30 * time.Second
+
+var (
+	unitsOutputDir string
+	unitsName      string
+	unitsWatchdog  time.Duration
+)
+
+var systemdUnitsCmd = &cobra.Command{
+	Use:   "systemd-units",
+	Short: "生成 systemd service 和 socket unit 文件",
+	Long: `按照当前的命令行参数和配置文件生成 systemd service 和 socket unit 文件.
+service 使用 Type=notify 和 watchdog, gRPC socket 由 socket unit 创建并通过 socket activation 传入`,
+	Run: func(cmd *cobra.Command, args []string) {
+		c, err := loadConfig(cmd)
+		if err != nil {
+			klog.Fatalf("%v", err)
+		}
+		exe, err := os.Executable()
+		if err != nil {
+			klog.Fatalf("%v", err)
+		}
+		execStart := []string{exe}
+		if configFile != "" {
+			abs, err := filepath.Abs(configFile)
+			if err != nil {
+				klog.Fatalf("%v", err)
+			}
+			execStart = append(execStart, "--config", abs)
+		}
+		// 命令行指定的守护进程参数原样传给 ExecStart
+		cmd.Flags().Visit(func(f *pflag.Flag) {
+			if f.Name != "config" && rootCmd.PersistentFlags().Lookup(f.Name) != nil {
+				execStart = append(execStart, "--"+f.Name+"="+f.Value.String())
+			}
+		})
+
+		service, socket, err := systemd.Units(systemd.UnitOptions{
+			Name:        unitsName,
+			ExecStart:   execStart,
+			Socket:      c.Listen,
+			SocketMode:  c.ListenMode,
+			SocketGroup: c.ListenGroup,
+			Watchdog:    unitsWatchdog,
+			// 留出停止容器和保存状态的时间
+			StopTimeout: time.Duration(c.ShutdownTimeout) + 30*time.Second,
+			User:        rootless.Enabled(),
+		})
+		if err != nil {
+			klog.Fatalf("%v", err)
+		}
+
+		if unitsOutputDir == "" {
+			fmt.Printf("# %s.service\n%s\n# %s.socket\n%s", unitsName, service, unitsName, socket)
+			return
+		}
+		for name, content := range map[string][]byte{
+			unitsName + ".service": service,
+			unitsName + ".socket":  socket,
+		} {
+			path := filepath.Join(unitsOutputDir, name)
+			if err := ioutil.WriteFile(path, content, 0644); err != nil {
+				klog.Fatalf("%v", err)
+			}
+			fmt.Println(path)
+		}
+	},
+}
+
+func init() {
+	systemdUnitsCmd.Flags().StringVarP(&unitsOutputDir, "output-dir", "o", "", "写入 unit 文件的目录,如 /etc/systemd/system (rootless 时为 ~/.config/systemd/user), 为空时输出到标准输出")
+	systemdUnitsCmd.Flags().StringVar(&unitsName, "name", "cri-impl", "unit 名称")
+	systemdUnitsCmd.Flags().DurationVar(&unitsWatchdog, "watchdog", defaultWatchdog, "WatchdogSec, 0 表示不开启")
+	rootCmd.AddCommand(systemdUnitsCmd)
+}
+
+// notify 向 systemd 发送状态, 不是由 systemd 启动时什么也不做
+func notify(states ...string) {
+	if _, err := systemd.Notify(states...); err != nil {
+		klog.Warningf("failed to notify systemd with err:%v", err)
+	}
+}
+
+// activatedListener 返回 socket activation 传入的 UNIX socket, 没有传入时返回 nil
+func activatedListener() (net.Listener, error) {
+	listeners, err := systemd.Listeners()
+	if err != nil {
+		return nil, err
+	}
+	var unixLis net.Listener
+	for _, lis := range listeners {
+		if _, ok := lis.(*net.UnixListener); ok && unixLis == nil {
+			unixLis = lis
+			continue
+		}
+		klog.Warningf("ignoring unexpected socket %s passed by systemd", lis.Addr())
+		lis.Close()
+	}
+	if len(listeners) > 0 && unixLis == nil {
+		return nil, errors.New("No unix socket found in the sockets passed by systemd")
+	}
+	if unixLis != nil {
+		klog.Infof("using socket %s passed by systemd", unixLis.Addr())
+	}
+	return unixLis, nil
+}
+
+// notifyReady 在 restore() 完成并且 gRPC 和流服务都已经监听之后通知 systemd
+func notifyReady(rs cri.RuntimeService, addr string) {
+	conts, err := rs.ListContainers(context.Background())
+	if err != nil {
+		klog.Warningf("failed to list containers with err:%v", err)
+	}
+	notify(systemd.Ready, systemd.Status("Serving on %s, %d containers", addr, len(conts)))
+}
+
+// runWatchdog 以 watchdog 超时一半的间隔检查 RuntimeService, 检查通过才发送 WATCHDOG=1
+// 检查失败时不发送心跳, 由 systemd 在超时后重启守护进程
+func runWatchdog(rs cri.RuntimeService) {
+	timeout, err := systemd.WatchdogInterval()
+	if err != nil {
+		klog.Warningf("%v", err)
+		return
+	}
+	if timeout == 0 {
+		return
+	}
+	interval := timeout / 2
+	klog.Infof("systemd watchdog enabled, timeout %v", timeout)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	healthy := true
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), interval/2)
+		err := rs.Healthy(ctx)
+		cancel()
+		if err != nil {
+			klog.Errorf("liveness check failed, skipping watchdog heartbeat: %v", err)
+			notify(systemd.Status("Unhealthy: %v", err))
+			healthy = false
+			continue
+		}
+		if !healthy {
+			klog.Infof("liveness check recovered")
+			notify(systemd.Status("Serving"))
+			healthy = true
+		}
+		notify(systemd.Watchdog)
+	}
+}
@@ -2,8 +2,8 @@ package cmd
 
 import (
 	"fmt"
-
 	"github.com/spf13/cobra"
+	"github.com/tluo-github/cri-impl/pkg/version"
 )
 
 // versionCmd represents the version command
@@ -12,7 +12,7 @@ var versionCmd = &cobra.Command{
 	Short: "打印 cri-impl 版本",
 	Long:  `打印 cri-impl 版本`,
 	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Println("cri-impl version 0.0.1")
+		fmt.Println("cri-impl version " + version.Get().String())
 	},
 }
 
@@ -1,28 +1,204 @@
 package config
 
+import (
+	"encoding/json"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/tluo-github/cri-impl/pkg/container"
+	"github.com/tluo-github/cri-impl/pkg/network"
+	"github.com/tluo-github/cri-impl/pkg/rootless"
+	"path/filepath"
+	"time"
+)
+
 const (
-	DefaultListen           = "/var/run/cri-impl.sock"
-	DefaultLibRoot          = "/var/lib/cri-impl"
-	DefaultRunRoot          = "/var/run/cri-impl"
-	DefaultContainerLogRoot = "/var/log/cri-impl/containers"
-	DefaultStreaminAddr     = "127.0.0.1:8881"
-	DefaultShimmyPath       = "/usr/local/bin/shimmy"
-	DefaultRuntimePath      = "/usr/bin/runc"
-	DefaultRuntimeRoot      = "/var/run/cri-impl-runc"
+	DefaultListen               = "/var/run/cri-impl.sock"
+	DefaultListenMode           = "0660"
+	DefaultAuditLog             = "/var/log/cri-impl/audit.jsonl"
+	DefaultLibRoot              = "/var/lib/cri-impl"
+	DefaultRunRoot              = "/var/run/cri-impl"
+	DefaultContainerLogRoot     = "/var/log/cri-impl/containers"
+	DefaultStreaminAddr         = "127.0.0.1:8881"
+	DefaultShimmyPath           = "/usr/local/bin/cri-impl-shim"
+	DefaultRuntimePath          = "/usr/bin/runc"
+	DefaultRuntimeRoot          = "/var/run/cri-impl-runc"
+	DefaultRuntimeHandler       = container.DefaultRuntimeHandler
+	DefaultContainerLogMaxSize  = "10Mi"
+	DefaultContainerLogMaxFiles = 5
+	DefaultContainerLogDriver   = "file"
+	DefaultGrpcMaxDeadline      = 2 * time.Minute
+	DefaultShutdownTimeout      = 30 * time.Second
+	DefaultMetricsAddr          = "127.0.0.1:8882"
+	DefaultTracingExporter      = "none"
+	DefaultTracingEndpoint      = "127.0.0.1:4317"
+	DefaultTracingSampleRatio   = 1.0
+	DefaultContainerMemoryLimit = "0"
+	DefaultContainerCPULimit    = "0"
+	DefaultSeccompProfileDir    = "/etc/cri-impl/seccomp"
+	DefaultSubIDUser            = "containers"
+	DefaultUserNamespaceSize    = 65536
+	DefaultNetwork              = container.NetworkNone
+	DefaultBridgeName           = "cri-impl0"
+	DefaultBridgeSubnet         = "10.88.0.0/16"
+	DefaultCNIConfDir           = "/etc/cni/net.d"
+	DefaultCNIPluginDir         = "/opt/cni/bin"
+	DefaultCNIPluginTimeout     = network.DefaultCNIPluginTimeout
+	DefaultPortBackend          = container.PortBackendIPTables
 )
 
+// Dirs 守护进程默认的 sock, 目录和文件
+type Dirs struct {
+	Listen           string
+	AuditLog         string
+	LibRoot          string
+	RunRoot          string
+	ContainerLogRoot string
+	RuntimeRoot      string
+}
+
+// DefaultDirs 以 root 运行时使用 /var 下的默认路径;
+// rootless 时使用 $XDG_RUNTIME_DIR (sock, 运行时数据), $XDG_DATA_HOME (容器) 和 $XDG_STATE_HOME (日志)
+func DefaultDirs() Dirs {
+	if !rootless.Enabled() {
+		return Dirs{
+			Listen:           DefaultListen,
+			AuditLog:         DefaultAuditLog,
+			LibRoot:          DefaultLibRoot,
+			RunRoot:          DefaultRunRoot,
+			ContainerLogRoot: DefaultContainerLogRoot,
+			RuntimeRoot:      DefaultRuntimeRoot,
+		}
+	}
+	run, data, state := rootless.RuntimeDir(), rootless.DataHome(), rootless.StateHome()
+	return Dirs{
+		Listen:           filepath.Join(run, "cri-impl.sock"),
+		AuditLog:         filepath.Join(state, "cri-impl", "audit.jsonl"),
+		LibRoot:          filepath.Join(data, "cri-impl"),
+		RunRoot:          filepath.Join(run, "cri-impl"),
+		ContainerLogRoot: filepath.Join(state, "cri-impl", "containers"),
+		RuntimeRoot:      filepath.Join(run, "cri-impl-runc"),
+	}
+}
+
 type Config struct {
-	Listen string
+	Listen string `json:"listen"`
+	// ListenMode UNIX socket 文件的权限 (八进制), 如 0660
+	ListenMode string `json:"listenMode"`
+	// ListenGroup UNIX socket 文件的属组 (组名或 gid), 为空表示不修改
+	ListenGroup string `json:"listenGroup"`
+	// ListenTCP 可选的 TCP 监听地址 host:port, 只接受 mTLS 连接, 为空表示不开启
+	ListenTCP string `json:"listenTCP"`
+	// TLSCertFile TLSKeyFile TCP 监听使用的服务端证书和私钥
+	TLSCertFile string `json:"tlsCert"`
+	TLSKeyFile  string `json:"tlsKey"`
+	// TLSClientCAFile 校验客户端证书的 CA
+	TLSClientCAFile string `json:"tlsClientCA"`
+	// AuthzPolicyFile 访问策略文件,定义客户端证书 subject 和 UNIX socket 用户/组对应的访问级别
+	AuthzPolicyFile string `json:"authzPolicy"`
+	// AuditLog 修改状态的调用的审计日志 (JSON Lines), 为空表示不记录
+	AuditLog string `json:"auditLog"`
 	// LibRoot 用于存储长期存在的数据
-	LibRoot string
+	LibRoot string `json:"libRoot"`
 	// RunRoot 用于存储 cri-impl 守护程序的 root path
-	RunRoot string
+	RunRoot string `json:"runRoot"`
 	// ContainerLogRoot 存放容器日志目录
-	ContainerLogRoot string
+	ContainerLogRoot string `json:"containerLogs"`
 	// StreamingAddr 流服务 host:port( for attach,exec,port-forwarding)
-	StreamingAddr string
-	// ShimmyPath OCI 运行时 shim 可执行文件(shimmy)
-	ShimmyPath  string
-	RuntimePath string
-	RuntimeRoot string
+	StreamingAddr string `json:"streamingAddr"`
+	// ShimmyPath OCI 运行时 shim 可执行文件 (cri-impl-shim, 也兼容 shimmy)
+	ShimmyPath string `json:"shimmyPath"`
+	// RuntimePath RuntimeRoot 名为 runc 的运行时 handler
+	RuntimePath string `json:"runtimePath"`
+	RuntimeRoot string `json:"runtimeRoot"`
+	// RuntimeHandlers 其他 OCI 运行时 (如 crun, runsc), 创建容器时按名称选择, 类似 CRI 的 RuntimeClass
+	RuntimeHandlers map[string]RuntimeHandler `json:"runtimeHandlers,omitempty"`
+	// DefaultRuntimeHandler 创建容器时没有指定运行时 handler 时使用的 handler
+	DefaultRuntimeHandler string `json:"defaultRuntimeHandler"`
+	// ContainerLogMaxSize 容器日志文件轮转前的最大大小,如 10Mi, 0 表示不轮转
+	ContainerLogMaxSize string `json:"containerLogMaxSize"`
+	// ContainerLogMaxFiles 每个容器最多保留的日志文件数
+	ContainerLogMaxFiles int32 `json:"containerLogMaxFiles"`
+	// ContainerLogDriver 默认的容器日志驱动: file, syslog 或 fluentd
+	ContainerLogDriver string `json:"containerLogDriver"`
+	// ContainerLogDriverAddress 默认日志驱动的地址,如 unixgram:///dev/log, tcp://127.0.0.1:24224
+	ContainerLogDriverAddress string `json:"containerLogDriverAddress"`
+	// GrpcMaxDeadline gRPC unary 调用的最大超时时间, 0 表示不限制
+	GrpcMaxDeadline Duration `json:"grpcMaxDeadline"`
+	// MetricsAddr Prometheus /metrics 的 host:port, 为空表示不开启
+	MetricsAddr string `json:"metricsAddr"`
+	// TracingExporter trace 导出方式: none, otlp 或 stdout
+	TracingExporter string `json:"tracingExporter"`
+	// TracingEndpoint OTLP/gRPC collector 的 host:port
+	TracingEndpoint string `json:"tracingEndpoint"`
+	// TracingSampleRatio trace 采样比例
+	TracingSampleRatio float64 `json:"tracingSampleRatio"`
+	// LiveRestore 关闭守护进程时保持容器运行,由下次启动的 restore 接管; false 表示关闭时停止所有容器
+	LiveRestore bool `json:"liveRestore"`
+	// ShutdownTimeout 关闭时等待进行中的调用和 attach 结束的最长时间
+	ShutdownTimeout Duration `json:"shutdownTimeout"`
+	// LogLevel 守护进程日志的详细级别 (klog -v)
+	LogLevel int `json:"logLevel"`
+	// ContainerMemoryLimit 新建容器默认的内存上限,如 512Mi, 0 表示不限制
+	ContainerMemoryLimit string `json:"containerMemoryLimit"`
+	// ContainerCPULimit 新建容器默认的 CPU 上限,如 1.5 或 500m, 0 表示不限制
+	ContainerCPULimit string `json:"containerCPULimit"`
+	// ContainerPidsLimit 新建容器默认的最大进程数, 0 表示不限制
+	ContainerPidsLimit int64 `json:"containerPidsLimit"`
+	// ContainerSecurity 新建容器默认的安全选项 (capAdd, capDrop, noNewPrivileges, seccomp, maskedPaths, readonlyPaths),
+	// 创建容器时的选项优先; 不能配置 privileged
+	ContainerSecurity container.SecurityOptions `json:"containerSecurity"`
+	// SeccompProfileDir localhost/<路径> seccomp profile 所在的目录, 不能引用目录之外的文件
+	SeccompProfileDir string `json:"seccompProfileDir"`
+	// SubIDUser 自动分配用户命名空间时使用 /etc/subuid 和 /etc/subgid 中该用户 (用户名或 uid) 的范围
+	SubIDUser string `json:"subIDUser"`
+	// UserNamespaceSize 自动分配的用户命名空间默认大小
+	UserNamespaceSize uint32 `json:"userNamespaceSize"`
+	// Network 没有指定网络模式的容器使用的网络: none (只有 loopback), bridge 或 cni
+	Network string `json:"network"`
+	// BridgeName bridge 网络使用的 Linux bridge, 不存在时自动创建
+	BridgeName string `json:"bridgeName"`
+	// BridgeSubnet bridge 网络的 IPv4 子网, 第一个地址作为网关配置在 bridge 上
+	BridgeSubnet string `json:"bridgeSubnet"`
+	// BridgeNAT 对 bridge 网络离开主机的流量做 MASQUERADE 并开启 IP 转发
+	BridgeNAT bool `json:"bridgeNAT"`
+	// CNIConfDir CNI 网络配置文件 (.conflist, .conf, .json) 所在的目录
+	CNIConfDir string `json:"cniConfDir"`
+	// CNIPluginDirs 按顺序查找 CNI 插件可执行文件的目录
+	CNIPluginDirs []string `json:"cniPluginDirs"`
+	// CNINetwork cni 网络使用的网络名称, 为空时使用 cniConfDir 中按文件名排序的第一个网络
+	CNINetwork string `json:"cniNetwork"`
+	// CNIPluginTimeout 每次执行 CNI 插件的超时时间, 超时的插件被 kill
+	CNIPluginTimeout Duration `json:"cniPluginTimeout"`
+	// PortBackend 发布容器端口的方式: iptables (DNAT 到容器的地址) 或 proxy (用户态代理进程);
+	// 容器没有 bridge 或 cni 网络以及 rootless 时总是使用 proxy
+	PortBackend string `json:"portBackend"`
+	// Hooks 注入到每个新建容器 spec 中的 OCI hooks (prestart, createRuntime, poststart, poststop), 由 OCI 运行时执行
+	Hooks specs.Hooks `json:"hooks"`
+	// Plugins 容器每次 create/start/stop/remove 前后按顺序调用的插件
+	Plugins []Plugin `json:"plugins,omitempty"`
+	// SpecTemplates 命名的 spec 模板, 每个模板是一个应用到生成的 config.json 上的 RFC 7396 merge patch,
+	// 创建容器时按名称选择
+	SpecTemplates map[string]json.RawMessage `json:"specTemplates,omitempty"`
+}
+
+// RuntimeHandler 一个 OCI 运行时, 命令行与 runc 兼容
+type RuntimeHandler struct {
+	// Path 运行时可执行文件
+	Path string `json:"path"`
+	// Root 运行时的状态目录 (--root), 不同 handler 不能相同
+	Root string `json:"root"`
+	// Args 每次执行运行时都加上的全局参数, 如 runsc 的 --platform=ptrace
+	Args []string `json:"args,omitempty"`
+}
+
+// Plugin 一个可执行文件插件, 协议见 pkg/plugin
+type Plugin struct {
+	Name string   `json:"name"`
+	Path string   `json:"path"`
+	Args []string `json:"args,omitempty"`
+	// Events 插件关注的事件 (create, start, stop, remove), 为空表示所有事件
+	Events []string `json:"events,omitempty"`
+	// Timeout 每次调用的超时时间, 默认 10s
+	Timeout Duration `json:"timeout,omitempty"`
+	// IgnoreFailure 插件执行失败时继续状态转换, 插件的否决仍然生效
+	IgnoreFailure bool `json:"ignoreFailure,omitempty"`
 }
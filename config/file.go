@@ -0,0 +1,488 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pelletier/go-toml"
+	"github.com/tluo-github/cri-impl/pkg/container"
+	"github.com/tluo-github/cri-impl/pkg/logdriver"
+	"github.com/tluo-github/cri-impl/pkg/network"
+	"github.com/tluo-github/cri-impl/pkg/oci"
+	"github.com/tluo-github/cri-impl/pkg/plugin"
+	"github.com/tluo-github/cri-impl/pkg/rootless"
+	"github.com/tluo-github/cri-impl/pkg/tracing"
+	"io/ioutil"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"net"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sigs.k8s.io/yaml"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 配置文件格式
+const (
+	FormatYAML = "yaml"
+	FormatTOML = "toml"
+)
+
+// Duration 在配置文件中以 "2m", "30s" 格式表示的时间长度
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return errors.New(fmt.Sprintf("Invalid duration %s, expected a string like \"2m\"", b))
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Invalid duration %q", s))
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// FormatOf 根据文件扩展名判断配置文件格式, .toml 为 TOML, 其他 (.yaml .yml .json) 为 YAML
+func FormatOf(path string) string {
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		return FormatTOML
+	}
+	return FormatYAML
+}
+
+// Load 读取配置文件并覆盖 c 中的对应字段,文件中没有出现的字段保持不变
+// 字段名与 json tag 相同,未知的字段视为错误
+func (c *Config) Load(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var js []byte
+	if FormatOf(path) == FormatTOML {
+		tree, err := toml.LoadBytes(data)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Failed to parse %s: %v", path, err))
+		}
+		js, err = json.Marshal(tree.ToMap())
+		if err != nil {
+			return err
+		}
+	} else {
+		if js, err = yaml.YAMLToJSON(data); err != nil {
+			return errors.New(fmt.Sprintf("Failed to parse %s: %v", path, err))
+		}
+	}
+	if bytes.Equal(bytes.TrimSpace(js), []byte("null")) {
+		// 空文件
+		return nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		return errors.New(fmt.Sprintf("Invalid config file %s: %v", path, err))
+	}
+	return nil
+}
+
+// Dump 以 format 格式输出完整的配置,输出可以直接作为配置文件使用
+func (c *Config) Dump(format string) ([]byte, error) {
+	js, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case FormatYAML:
+		return yaml.JSONToYAML(js)
+	case FormatTOML:
+		dec := json.NewDecoder(bytes.NewReader(js))
+		dec.UseNumber()
+		var m map[string]interface{}
+		if err := dec.Decode(&m); err != nil {
+			return nil, err
+		}
+		tree, err := toml.TreeFromMap(tomlValues(m))
+		if err != nil {
+			return nil, err
+		}
+		return []byte(tree.String()), nil
+	}
+	return nil, errors.New(fmt.Sprintf("Unknown config format %q", format))
+}
+
+// tomlValues 将 json.Number 转换为整数或浮点数,避免整数被输出为 TOML 浮点数
+func tomlValues(m map[string]interface{}) map[string]interface{} {
+	for k, v := range m {
+		m[k] = tomlValue(v)
+	}
+	return m
+}
+
+func tomlValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		} else if f, err := v.Float64(); err == nil {
+			return f
+		}
+	case map[string]interface{}:
+		return tomlValues(v)
+	case []interface{}:
+		// hooks, plugins 等 table 数组
+		for i := range v {
+			v[i] = tomlValue(v[i])
+		}
+	}
+	return v
+}
+
+// Validate 检查所有字段, 返回的错误列出所有不合法的字段
+func (c *Config) Validate() error {
+	var errs []string
+	fail := func(field string, format string, args ...interface{}) {
+		errs = append(errs, field+": "+fmt.Sprintf(format, args...))
+	}
+
+	if c.Listen == "" {
+		fail("listen", "must not be empty")
+	}
+	if c.ListenMode != "" {
+		if mode, err := strconv.ParseUint(c.ListenMode, 8, 32); err != nil || mode > 0777 {
+			fail("listenMode", "invalid octal file mode %q", c.ListenMode)
+		}
+	}
+	if c.ListenTCP != "" && (c.TLSCertFile == "" || c.TLSKeyFile == "" || c.TLSClientCAFile == "") {
+		fail("listenTCP", "requires tlsCert, tlsKey and tlsClientCA")
+	}
+	if _, err := c.ContainerLogPolicy(); err != nil {
+		fail("containerLog*", "%v", err)
+	}
+	if _, err := c.ContainerResources(); err != nil {
+		fail("container*Limit", "%v", err)
+	}
+	if _, err := c.ContainerSecurityDefaults(); err != nil {
+		fail("containerSecurity", "%v", err)
+	}
+	if c.GrpcMaxDeadline < 0 {
+		fail("grpcMaxDeadline", "must not be negative")
+	}
+	if c.ShutdownTimeout < 0 {
+		fail("shutdownTimeout", "must not be negative")
+	}
+	switch c.TracingExporter {
+	case "", tracing.None, tracing.OTLP, tracing.Stdout:
+	default:
+		fail("tracingExporter", "unknown exporter %q, expected none, otlp or stdout", c.TracingExporter)
+	}
+	if c.TracingSampleRatio < 0 || c.TracingSampleRatio > 1 {
+		fail("tracingSampleRatio", "must be between 0 and 1, got %v", c.TracingSampleRatio)
+	}
+	handlers := c.Runtimes()
+	roots := make(map[string]string)
+	for _, name := range sortedHandlerNames(handlers) {
+		h := handlers[name]
+		field := "runtimeHandlers." + name
+		if name == container.DefaultRuntimeHandler {
+			field = "runtimePath"
+			if _, ok := c.RuntimeHandlers[name]; ok {
+				fail("runtimeHandlers."+name, "the runc handler is configured by runtimePath and runtimeRoot")
+			}
+		}
+		if !resourceName.MatchString(name) {
+			fail(field, "invalid handler name, expected lowercase letters, digits and -")
+		}
+		if h.Path == "" {
+			fail(field, "path must not be empty")
+		}
+		if h.Root == "" {
+			fail(field, "root must not be empty")
+		} else if other, ok := roots[h.Root]; ok {
+			fail(field, "root %s is already used by handler %s", h.Root, other)
+		} else {
+			roots[h.Root] = name
+		}
+	}
+	if _, ok := handlers[c.DefaultRuntimeHandler]; !ok {
+		fail("defaultRuntimeHandler", "unknown runtime handler %q", c.DefaultRuntimeHandler)
+	}
+	for _, hooks := range []struct {
+		event string
+		hooks []specs.Hook
+	}{
+		{"prestart", c.Hooks.Prestart},
+		{"createRuntime", c.Hooks.CreateRuntime},
+		{"createContainer", c.Hooks.CreateContainer},
+		{"startContainer", c.Hooks.StartContainer},
+		{"poststart", c.Hooks.Poststart},
+		{"poststop", c.Hooks.Poststop},
+	} {
+		for i, h := range hooks.hooks {
+			field := fmt.Sprintf("hooks.%s[%d]", hooks.event, i)
+			if !filepath.IsAbs(h.Path) {
+				fail(field, "path must be absolute, got %q", h.Path)
+			}
+			if h.Timeout != nil && *h.Timeout <= 0 {
+				fail(field, "timeout must be positive")
+			}
+		}
+	}
+	names := make(map[string]bool)
+	for i, p := range c.Plugins {
+		field := fmt.Sprintf("plugins[%d]", i)
+		if p.Name == "" {
+			fail(field, "name must not be empty")
+		} else if names[p.Name] {
+			fail(field, "duplicate plugin name %q", p.Name)
+		}
+		names[p.Name] = true
+		if p.Path == "" {
+			fail(field, "path must not be empty")
+		}
+		for _, e := range p.Events {
+			if !knownEvent(e) {
+				fail(field, "unknown event %q, expected create, start, stop or remove", e)
+			}
+		}
+		if p.Timeout < 0 {
+			fail(field, "timeout must not be negative")
+		}
+	}
+	for _, name := range sortedTemplateNames(c.SpecTemplates) {
+		if !resourceName.MatchString(name) {
+			fail("specTemplates."+name, "invalid template name, expected lowercase letters, digits and -")
+		}
+		var patch map[string]interface{}
+		if err := json.Unmarshal(c.SpecTemplates[name], &patch); err != nil || patch == nil {
+			fail("specTemplates."+name, "must be a JSON merge patch object")
+		}
+	}
+	if c.SubIDUser == "" {
+		fail("subIDUser", "must not be empty")
+	}
+	if c.UserNamespaceSize == 0 {
+		fail("userNamespaceSize", "must be positive")
+	}
+	if err := container.ValidateNetworkMode(c.Network); err != nil {
+		fail("network", "%v", err)
+	} else if c.Network != container.NetworkNone && rootless.Enabled() {
+		fail("network", "%s networking requires root", c.Network)
+	}
+	if _, err := c.ContainerNetwork(); err != nil {
+		fail("bridge*", "%v", err)
+	}
+	if c.CNIConfDir == "" {
+		fail("cniConfDir", "must not be empty")
+	}
+	if len(c.CNIPluginDirs) == 0 {
+		fail("cniPluginDirs", "must not be empty")
+	}
+	if c.CNIPluginTimeout <= 0 {
+		fail("cniPluginTimeout", "must be positive")
+	}
+	if c.PortBackend != container.PortBackendIPTables && c.PortBackend != container.PortBackendProxy {
+		fail("portBackend", "unknown backend %q, expected %s or %s", c.PortBackend, container.PortBackendIPTables, container.PortBackendProxy)
+	}
+	if c.LogLevel < 0 {
+		fail("logLevel", "must not be negative")
+	}
+
+	if len(errs) > 0 {
+		return errors.New(fmt.Sprintf("Invalid configuration:\n  %s", strings.Join(errs, "\n  ")))
+	}
+	return nil
+}
+
+// resourceName 运行时 handler 和 spec 模板的名称
+var resourceName = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// Runtimes 所有运行时 handler, 包括由 runtimePath 和 runtimeRoot 定义的 runc
+func (c *Config) Runtimes() map[string]RuntimeHandler {
+	handlers := map[string]RuntimeHandler{}
+	for name, h := range c.RuntimeHandlers {
+		handlers[name] = h
+	}
+	runc := RuntimeHandler{Path: c.RuntimePath, Root: c.RuntimeRoot}
+	if rootless.Enabled() {
+		// 忽略没有委派的 cgroup 的权限错误
+		runc.Args = []string{"--rootless=true"}
+	}
+	handlers[container.DefaultRuntimeHandler] = runc
+	return handlers
+}
+
+// LifecyclePlugins 按配置顺序返回插件
+func (c *Config) LifecyclePlugins() []plugin.Plugin {
+	var plugins []plugin.Plugin
+	for _, p := range c.Plugins {
+		var events []plugin.Event
+		for _, e := range p.Events {
+			events = append(events, plugin.Event(e))
+		}
+		plugins = append(plugins, plugin.Plugin{
+			Name:          p.Name,
+			Path:          p.Path,
+			Args:          p.Args,
+			Events:        events,
+			Timeout:       time.Duration(p.Timeout),
+			IgnoreFailure: p.IgnoreFailure,
+		})
+	}
+	return plugins
+}
+
+func knownEvent(event string) bool {
+	for _, e := range plugin.Events {
+		if string(e) == event {
+			return true
+		}
+	}
+	return false
+}
+
+// ContainerSpecTemplates 所有 spec 模板, key 为模板名称
+func (c *Config) ContainerSpecTemplates() map[string][]byte {
+	templates := make(map[string][]byte)
+	for name, patch := range c.SpecTemplates {
+		templates[name] = patch
+	}
+	return templates
+}
+
+func sortedTemplateNames(templates map[string]json.RawMessage) []string {
+	names := make([]string, 0, len(templates))
+	for name := range templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sortedHandlerNames(handlers map[string]RuntimeHandler) []string {
+	names := make([]string, 0, len(handlers))
+	for name := range handlers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ContainerLogPolicy 新建容器默认的日志策略
+func (c *Config) ContainerLogPolicy() (container.LogPolicy, error) {
+	maxSize, err := resource.ParseQuantity(c.ContainerLogMaxSize)
+	if err != nil {
+		return container.LogPolicy{}, errors.New(fmt.Sprintf("Invalid log max size %q", c.ContainerLogMaxSize))
+	}
+	p := container.LogPolicy{
+		MaxSize:  maxSize.Value(),
+		MaxFiles: c.ContainerLogMaxFiles,
+		Driver: logdriver.Config{
+			Type:    c.ContainerLogDriver,
+			Address: c.ContainerLogDriverAddress,
+		},
+	}
+	return p, p.Validate()
+}
+
+// ContainerResources 新建容器默认的资源限制
+func (c *Config) ContainerResources() (container.Resources, error) {
+	var r container.Resources
+	if c.ContainerMemoryLimit != "" {
+		mem, err := resource.ParseQuantity(c.ContainerMemoryLimit)
+		if err != nil {
+			return r, errors.New(fmt.Sprintf("Invalid memory limit %q", c.ContainerMemoryLimit))
+		}
+		r.MemoryLimit = mem.Value()
+	}
+	if c.ContainerCPULimit != "" {
+		cpu, err := resource.ParseQuantity(c.ContainerCPULimit)
+		if err != nil {
+			return r, errors.New(fmt.Sprintf("Invalid CPU limit %q", c.ContainerCPULimit))
+		}
+		r.CPUMilli = cpu.MilliValue()
+	}
+	r.PidsLimit = c.ContainerPidsLimit
+	return r, r.Validate()
+}
+
+// ContainerSecurityDefaults 新建容器默认的安全选项
+func (c *Config) ContainerSecurityDefaults() (container.SecurityOptions, error) {
+	s := c.ContainerSecurity
+	if s.Privileged {
+		return s, errors.New("Privileged can only be set when creating a container")
+	}
+	p, err := oci.ResolveSecurity(container.SecurityOptions{}, s)
+	if err != nil {
+		return s, err
+	}
+	if strings.HasPrefix(p.Seccomp, container.SeccompLocalhostPrefix) {
+		_, err = oci.LoadSeccompProfile(c.SeccompProfileDir, p.Seccomp)
+	}
+	return s, err
+}
+
+// ContainerNetwork bridge 和 CNI 网络的配置, IPAM 等状态保存在 <libRoot>/network 下
+func (c *Config) ContainerNetwork() (network.Options, error) {
+	o := network.Options{
+		StateDir:         filepath.Join(c.LibRoot, "network"),
+		Bridge:           c.BridgeName,
+		NAT:              c.BridgeNAT,
+		CNIConfDir:       c.CNIConfDir,
+		CNIPluginDirs:    c.CNIPluginDirs,
+		CNINetwork:       c.CNINetwork,
+		CNIPluginTimeout: time.Duration(c.CNIPluginTimeout),
+	}
+	if len(c.BridgeName) == 0 || len(c.BridgeName) > 15 || strings.ContainsAny(c.BridgeName, "/ ") {
+		return o, errors.New(fmt.Sprintf("Invalid bridge name %q, expected at most 15 characters", c.BridgeName))
+	}
+	_, subnet, err := net.ParseCIDR(c.BridgeSubnet)
+	if err != nil || subnet.IP.To4() == nil {
+		return o, errors.New(fmt.Sprintf("Invalid bridge subnet %q, expected an IPv4 CIDR", c.BridgeSubnet))
+	}
+	if ones, _ := subnet.Mask.Size(); ones > 30 {
+		return o, errors.New(fmt.Sprintf("Bridge subnet %s is too small", c.BridgeSubnet))
+	}
+	o.Subnet = subnet
+	return o, nil
+}
+
+// Changed 返回 c 与 other 值不同的字段 (json 名称)
+func (c *Config) Changed(other *Config) []string {
+	var fields []string
+	a, b := reflect.ValueOf(c).Elem(), reflect.ValueOf(other).Elem()
+	for i := 0; i < a.NumField(); i++ {
+		if !reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+			fields = append(fields, fieldName(a.Type().Field(i)))
+		}
+	}
+	return fields
+}
+
+// CopyFields 将 from 中的 fields 字段 (json 名称) 复制到 c
+func (c *Config) CopyFields(from *Config, fields []string) {
+	copied := make(map[string]bool)
+	for _, f := range fields {
+		copied[f] = true
+	}
+	a, b := reflect.ValueOf(c).Elem(), reflect.ValueOf(from).Elem()
+	for i := 0; i < a.NumField(); i++ {
+		if copied[fieldName(a.Type().Field(i))] {
+			a.Field(i).Set(b.Field(i))
+		}
+	}
+}
+
+func fieldName(f reflect.StructField) string {
+	return strings.Split(f.Tag.Get("json"), ",")[0]
+}
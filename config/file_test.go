@@ -0,0 +1,274 @@
+package config
+
+import (
+	"encoding/json"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/tluo-github/cri-impl/pkg/container"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// validConfig 与守护进程默认值相同的合法配置
+func validConfig() *Config {
+	return &Config{
+		Listen:                DefaultListen,
+		ListenMode:            DefaultListenMode,
+		LibRoot:               DefaultLibRoot,
+		RunRoot:               DefaultRunRoot,
+		RuntimePath:           DefaultRuntimePath,
+		RuntimeRoot:           DefaultRuntimeRoot,
+		DefaultRuntimeHandler: DefaultRuntimeHandler,
+		ContainerLogMaxSize:   DefaultContainerLogMaxSize,
+		ContainerLogMaxFiles:  DefaultContainerLogMaxFiles,
+		ContainerLogDriver:    DefaultContainerLogDriver,
+		GrpcMaxDeadline:       Duration(DefaultGrpcMaxDeadline),
+		ShutdownTimeout:       Duration(DefaultShutdownTimeout),
+		TracingExporter:       DefaultTracingExporter,
+		TracingSampleRatio:    DefaultTracingSampleRatio,
+		ContainerMemoryLimit:  DefaultContainerMemoryLimit,
+		ContainerCPULimit:     DefaultContainerCPULimit,
+		SeccompProfileDir:     DefaultSeccompProfileDir,
+		SubIDUser:             DefaultSubIDUser,
+		UserNamespaceSize:     DefaultUserNamespaceSize,
+		Network:               DefaultNetwork,
+		BridgeName:            DefaultBridgeName,
+		BridgeSubnet:          DefaultBridgeSubnet,
+		CNIConfDir:            DefaultCNIConfDir,
+		CNIPluginDirs:         []string{DefaultCNIPluginDir},
+		CNIPluginTimeout:      Duration(DefaultCNIPluginTimeout),
+		PortBackend:           DefaultPortBackend,
+	}
+}
+
+func writeConfig(t *testing.T, name string, content string) string {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		file    string
+		content string
+		want    string
+	}{
+		{"unknown key", "c.yaml", "listen: /tmp/a.sock\nlisen: /tmp/b.sock\n", `unknown field "lisen"`},
+		{"unknown nested key", "c.yaml", "containerSecurity:\n  capAddd: [NET_ADMIN]\n", `unknown field "capAddd"`},
+		{"unknown TOML key", "c.toml", "logLevell = 2\n", `unknown field "logLevell"`},
+		{"string for an integer", "c.yaml", "containerLogMaxFiles: five\n", "containerLogMaxFiles"},
+		{"string for a boolean", "c.toml", "liveRestore = \"yes\"\n", "liveRestore"},
+		{"string for a list", "c.yaml", "cniPluginDirs: /opt/cni/bin\n", "cniPluginDirs"},
+		{"number for a duration", "c.yaml", "grpcMaxDeadline: 30\n", `Invalid duration 30, expected a string like "2m"`},
+		{"invalid duration", "c.toml", "shutdownTimeout = \"soon\"\n", `Invalid duration "soon"`},
+		{"negative unsigned", "c.yaml", "userNamespaceSize: -1\n", "userNamespaceSize"},
+		{"invalid YAML", "c.yaml", "listen: [\n", "Failed to parse"},
+		{"invalid TOML", "c.toml", "listen = \n", "Failed to parse"},
+	} {
+		path := writeConfig(t, tc.file, tc.content)
+		err := validConfig().Load(path)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: Load = %v, want an error containing %q", tc.name, err, tc.want)
+		}
+	}
+}
+
+func TestLoadKeepsUnsetFields(t *testing.T) {
+	c := validConfig()
+	if err := c.Load(writeConfig(t, "c.yaml", "logLevel: 3\n")); err != nil {
+		t.Fatal(err)
+	}
+	want := validConfig()
+	want.LogLevel = 3
+	if !reflect.DeepEqual(c, want) {
+		t.Errorf("Load changed %v, want only logLevel", want.Changed(c))
+	}
+	// 空文件不修改任何字段
+	if err := c.Load(writeConfig(t, "c.yaml", "")); err != nil || !reflect.DeepEqual(c, want) {
+		t.Errorf("Load of an empty file = %v, changed %v", err, want.Changed(c))
+	}
+}
+
+func TestLoadYAMLAndTOML(t *testing.T) {
+	yamlConfig := `
+listen: /run/cri.sock
+logLevel: 2
+liveRestore: true
+tracingSampleRatio: 0.25
+grpcMaxDeadline: 45s
+containerLogMaxFiles: 3
+userNamespaceSize: 1024
+cniPluginDirs: [/opt/cni/bin, /usr/libexec/cni]
+containerSecurity:
+  capDrop: [NET_RAW]
+  noNewPrivileges: true
+runtimeHandlers:
+  crun:
+    path: /usr/bin/crun
+    root: /run/crun
+plugins:
+- name: audit
+  path: /usr/local/bin/audit
+  events: [create, stop]
+  timeout: 3s
+`
+	tomlConfig := `
+listen = "/run/cri.sock"
+logLevel = 2
+liveRestore = true
+tracingSampleRatio = 0.25
+grpcMaxDeadline = "45s"
+containerLogMaxFiles = 3
+userNamespaceSize = 1024
+cniPluginDirs = ["/opt/cni/bin", "/usr/libexec/cni"]
+
+[containerSecurity]
+capDrop = ["NET_RAW"]
+noNewPrivileges = true
+
+[runtimeHandlers.crun]
+path = "/usr/bin/crun"
+root = "/run/crun"
+
+[[plugins]]
+name = "audit"
+path = "/usr/local/bin/audit"
+events = ["create", "stop"]
+timeout = "3s"
+`
+	fromYAML, fromTOML := validConfig(), validConfig()
+	if err := fromYAML.Load(writeConfig(t, "c.yaml", yamlConfig)); err != nil {
+		t.Fatal(err)
+	}
+	if err := fromTOML.Load(writeConfig(t, "c.toml", tomlConfig)); err != nil {
+		t.Fatal(err)
+	}
+	if changed := fromYAML.Changed(fromTOML); len(changed) != 0 {
+		t.Errorf("YAML and TOML configs differ in %v", changed)
+	}
+	if fromYAML.GrpcMaxDeadline != Duration(45*time.Second) || fromYAML.Plugins[0].Timeout != Duration(3*time.Second) ||
+		fromYAML.RuntimeHandlers["crun"].Path != "/usr/bin/crun" || fromYAML.ContainerSecurity.NoNewPrivileges == nil {
+		t.Errorf("loaded config = %+v", fromYAML)
+	}
+	if err := fromYAML.Validate(); err != nil {
+		t.Errorf("Validate: %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := validConfig().Validate(); err != nil {
+		t.Fatalf("Validate of the default config: %v", err)
+	}
+	timeout := 0
+	for _, tc := range []struct {
+		field  string
+		modify func(c *Config)
+	}{
+		{"listen", func(c *Config) { c.Listen = "" }},
+		{"listenMode", func(c *Config) { c.ListenMode = "0999" }},
+		{"listenTCP", func(c *Config) { c.ListenTCP = "0.0.0.0:8443" }},
+		{"containerLog*", func(c *Config) { c.ContainerLogMaxSize = "ten" }},
+		{"containerLog*", func(c *Config) { c.ContainerLogDriver = "journald" }},
+		{"container*Limit", func(c *Config) { c.ContainerCPULimit = "lots" }},
+		{"container*Limit", func(c *Config) { c.ContainerPidsLimit = -1 }},
+		{"containerSecurity", func(c *Config) { c.ContainerSecurity.Privileged = true }},
+		{"grpcMaxDeadline", func(c *Config) { c.GrpcMaxDeadline = Duration(-time.Second) }},
+		{"shutdownTimeout", func(c *Config) { c.ShutdownTimeout = Duration(-time.Second) }},
+		{"tracingExporter", func(c *Config) { c.TracingExporter = "jaeger" }},
+		{"tracingSampleRatio", func(c *Config) { c.TracingSampleRatio = 1.5 }},
+		{"tracingSampleRatio", func(c *Config) { c.TracingSampleRatio = -0.1 }},
+		{"runtimeHandlers.Crun", func(c *Config) {
+			c.RuntimeHandlers = map[string]RuntimeHandler{"Crun": {Path: "/usr/bin/crun", Root: "/run/crun"}}
+		}},
+		// 按名称排序, 先检查的 crun 占用了 root
+		{"runtimePath", func(c *Config) {
+			c.RuntimeHandlers = map[string]RuntimeHandler{"crun": {Path: "/usr/bin/crun", Root: c.RuntimeRoot}}
+		}},
+		{"runtimeHandlers.runc", func(c *Config) {
+			c.RuntimeHandlers = map[string]RuntimeHandler{"runc": {Path: "/usr/bin/runc", Root: "/run/r"}}
+		}},
+		{"defaultRuntimeHandler", func(c *Config) { c.DefaultRuntimeHandler = "crun" }},
+		{"hooks.prestart[0]", func(c *Config) { c.Hooks.Prestart = []specs.Hook{{Path: "hook"}} }},
+		{"hooks.poststop[0]", func(c *Config) { c.Hooks.Poststop = []specs.Hook{{Path: "/hook", Timeout: &timeout}} }},
+		{"plugins[1]", func(c *Config) { c.Plugins = []Plugin{{Name: "a", Path: "/a"}, {Name: "a", Path: "/b"}} }},
+		{"plugins[0]", func(c *Config) { c.Plugins = []Plugin{{Name: "a", Path: "/a", Events: []string{"restart"}}} }},
+		{"specTemplates.web", func(c *Config) { c.SpecTemplates = map[string]json.RawMessage{"web": json.RawMessage(`[1]`)} }},
+		{"subIDUser", func(c *Config) { c.SubIDUser = "" }},
+		{"userNamespaceSize", func(c *Config) { c.UserNamespaceSize = 0 }},
+		{"network", func(c *Config) { c.Network = "host" }},
+		{"bridge*", func(c *Config) { c.BridgeName = "a-very-long-bridge-name" }},
+		{"bridge*", func(c *Config) { c.BridgeSubnet = "10.0.0.0/31" }},
+		{"bridge*", func(c *Config) { c.BridgeSubnet = "fd00::/64" }},
+		{"cniPluginDirs", func(c *Config) { c.CNIPluginDirs = nil }},
+		{"cniPluginTimeout", func(c *Config) { c.CNIPluginTimeout = 0 }},
+		{"portBackend", func(c *Config) { c.PortBackend = "nftables" }},
+		{"logLevel", func(c *Config) { c.LogLevel = -1 }},
+	} {
+		c := validConfig()
+		tc.modify(c)
+		err := c.Validate()
+		if err == nil || !strings.Contains(err.Error(), "\n  "+tc.field+": ") {
+			t.Errorf("Validate with an invalid %s = %v", tc.field, err)
+		}
+	}
+
+	// 所有不合法的字段都被列出
+	c := validConfig()
+	c.Listen, c.LogLevel = "", -1
+	if err := c.Validate(); err == nil || strings.Count(err.Error(), "\n  ") != 2 {
+		t.Errorf("Validate with two invalid fields = %v", err)
+	}
+}
+
+func TestDumpRoundTrip(t *testing.T) {
+	c := validConfig()
+	c.LogLevel = 4
+	c.TracingSampleRatio = 0.5
+	c.LiveRestore = true
+	noNewPrivileges := true
+	c.ContainerSecurity = container.SecurityOptions{CapDrop: []string{"NET_RAW"}, NoNewPrivileges: &noNewPrivileges}
+	c.RuntimeHandlers = map[string]RuntimeHandler{"crun": {Path: "/usr/bin/crun", Root: "/run/crun", Args: []string{"--debug"}}}
+	timeout := 5
+	c.Hooks.Prestart = []specs.Hook{{Path: "/usr/bin/hook", Args: []string{"hook", "prestart"}, Timeout: &timeout}}
+	c.Plugins = []Plugin{{Name: "audit", Path: "/usr/local/bin/audit", Events: []string{"create"}, Timeout: Duration(3 * time.Second)}}
+	c.SpecTemplates = map[string]json.RawMessage{"web": json.RawMessage(`{"hostname":"web"}`)}
+
+	for _, format := range []string{FormatYAML, FormatTOML} {
+		out, err := c.Dump(format)
+		if err != nil {
+			t.Fatalf("Dump(%s): %v", format, err)
+		}
+		// 从零值加载, 输出包含所有字段
+		loaded := &Config{}
+		if err := loaded.Load(writeConfig(t, "c."+format, string(out))); err != nil {
+			t.Fatalf("Load of the %s dump: %v\n%s", format, err, out)
+		}
+		if changed := c.Changed(loaded); len(changed) != 0 {
+			t.Errorf("%s dump round trip changed %v\n%s", format, changed, out)
+		}
+	}
+	if _, err := c.Dump("json"); err == nil {
+		t.Error("Dump with an unknown format succeeded")
+	}
+}
+
+func TestCopyFields(t *testing.T) {
+	current, next := validConfig(), validConfig()
+	next.Listen, next.LogLevel = "/run/other.sock", 5
+	next.CopyFields(current, []string{"listen"})
+	if next.Listen != current.Listen || next.LogLevel != 5 {
+		t.Errorf("CopyFields(listen) = listen %q, logLevel %d", next.Listen, next.LogLevel)
+	}
+}
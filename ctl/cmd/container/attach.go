@@ -32,12 +32,12 @@ var attachCmd = &cobra.Command{
 			},
 		)
 		if err != nil {
-			klog.Fatal("Command failed with err:%v", err)
+			cmdutil.ExitOnError(err)
 		}
 
 		url, err := url.Parse(resp.Url)
 		if err != nil {
-			klog.Fatal("Failed to parse stream URL with err:%v", err)
+			klog.Fatalf("Failed to parse stream URL with err:%v", err)
 		}
 		executor, err := remotecommand.NewSPDYExecutor(
 			&rest.Config{
@@ -47,7 +47,7 @@ var attachCmd = &cobra.Command{
 			url,
 		)
 		if err != nil {
-			klog.Fatal("Failed to create stream executor with err:%v", err)
+			klog.Fatalf("Failed to create stream executor with err:%v", err)
 		}
 
 		streamOptions := remotecommand.StreamOptions{
@@ -58,7 +58,7 @@ var attachCmd = &cobra.Command{
 		}
 
 		if err := executor.Stream(streamOptions); err != nil {
-			klog.Fatal("executor.Stream() failed")
+			klog.Fatalf("executor.Stream() failed")
 		}
 
 	},
@@ -13,6 +13,34 @@ type Options struct {
 	Command        string
 	Stdin          bool
 	LeaveStdinOpen bool
+	RestartPolicy  string
+	Liveness       string
+	Readiness      string
+	LivenessAction string
+	ProbeDelay     int32
+	ProbePeriod    int32
+	ProbeTimeout   int32
+	ProbeFailures  int32
+	LogMaxSize     string
+	LogMaxFiles    int32
+	LogDriver      string
+	LogAddress     string
+	LogTag         string
+	Runtime        string
+	SpecTemplate   string
+	SpecPatch      string
+	Privileged     bool
+	CapAdd         []string
+	CapDrop        []string
+	NoNewPrivs     bool
+	Seccomp        string
+	MaskedPaths    []string
+	ReadonlyPaths  []string
+	UserNS         string
+	UIDMaps        []string
+	GIDMaps        []string
+	Network        string
+	Publish        []string
 }
 
 var opts Options
@@ -2,10 +2,16 @@ package container
 
 import (
 	"context"
+	"fmt"
 	"github.com/spf13/cobra"
 	cmdutil "github.com/tluo-github/cri-impl/ctl/cmd"
+	"github.com/tluo-github/cri-impl/pkg/container"
 	"github.com/tluo-github/cri-impl/server"
+	"io/ioutil"
+	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/klog"
+	"strconv"
+	"strings"
 )
 
 // createCmd represents the create command
@@ -14,28 +20,187 @@ var createCmd = &cobra.Command{
 	Short: "",
 	Long:  ``,
 	Run: func(cmd *cobra.Command, args []string) {
+		liveness, err := parseProbe(opts.Liveness)
+		if err != nil {
+			klog.Fatalf("Invalid --liveness with err:%v", err)
+		}
+		readiness, err := parseProbe(opts.Readiness)
+		if err != nil {
+			klog.Fatalf("Invalid --readiness with err:%v", err)
+		}
+
+		var logMaxSize int64
+		if opts.LogMaxSize != "" {
+			q, err := resource.ParseQuantity(opts.LogMaxSize)
+			if err != nil {
+				klog.Fatalf("Invalid --log-max-size with err:%v", err)
+			}
+			logMaxSize = q.Value()
+		}
+
+		var specPatch []byte
+		if opts.SpecPatch != "" {
+			if specPatch, err = ioutil.ReadFile(opts.SpecPatch); err != nil {
+				klog.Fatalf("Invalid --spec-patch with err:%v", err)
+			}
+		}
+
+		security := &server.SecurityOptions{
+			Privileged:     opts.Privileged,
+			CapAdd:         opts.CapAdd,
+			CapDrop:        opts.CapDrop,
+			SeccompProfile: opts.Seccomp,
+			MaskedPaths:    opts.MaskedPaths,
+			ReadonlyPaths:  opts.ReadonlyPaths,
+		}
+		// 没有指定时使用守护进程的默认值
+		if cmd.Flags().Changed("no-new-privileges") {
+			security.NoNewPrivileges = &opts.NoNewPrivs
+		}
+
+		userns, err := parseUserNamespace(opts.UserNS, opts.UIDMaps, opts.GIDMaps)
+		if err != nil {
+			klog.Fatalf("Invalid user namespace options with err:%v", err)
+		}
+		ports, err := parsePortMappings(opts.Publish)
+		if err != nil {
+			klog.Fatalf("Invalid --publish with err:%v", err)
+		}
+
 		client, conn := cmdutil.Connect()
 		defer conn.Close()
 
 		resp, err := client.CreateContainer(
 			context.Background(),
 			&server.CreateContainerRequest{
-				Name:           args[0],
-				RootfsPath:     opts.Rootfs,
-				RootfsReadonly: opts.RootfsReadonly,
-				Command:        args[1],
-				Args:           args[2:],
-				Stdin:          opts.Stdin,
-				StdinOnce:      !opts.LeaveStdinOpen,
+				Name:             args[0],
+				RootfsPath:       opts.Rootfs,
+				RootfsReadonly:   opts.RootfsReadonly,
+				Command:          args[1],
+				Args:             args[2:],
+				Stdin:            opts.Stdin,
+				StdinOnce:        !opts.LeaveStdinOpen,
+				RestartPolicy:    opts.RestartPolicy,
+				LivenessProbe:    liveness,
+				ReadinessProbe:   readiness,
+				LivenessAction:   opts.LivenessAction,
+				LogMaxSize:       logMaxSize,
+				LogMaxFiles:      opts.LogMaxFiles,
+				LogDriver:        opts.LogDriver,
+				LogDriverAddress: opts.LogAddress,
+				LogTag:           opts.LogTag,
+				RuntimeHandler:   opts.Runtime,
+				SpecTemplate:     opts.SpecTemplate,
+				SpecPatch:        string(specPatch),
+				Security:         security,
+				UserNamespace:    userns,
+				Network:          opts.Network,
+				Ports:            ports,
 			},
 		)
 		if err != nil {
-			klog.Fatal("Command failed with err:%v", err)
+			cmdutil.ExitOnError(err)
 		}
 		cmdutil.Print(resp)
 	},
 }
 
+// parseProbe 解析 exec:<command>, tcp:<port> 或 http:<port>[/path] 格式的探针
+func parseProbe(s string) (*server.Probe, error) {
+	if s == "" {
+		return nil, nil
+	}
+	p := &server.Probe{
+		InitialDelaySeconds: opts.ProbeDelay,
+		PeriodSeconds:       opts.ProbePeriod,
+		TimeoutSeconds:      opts.ProbeTimeout,
+		FailureThreshold:    opts.ProbeFailures,
+	}
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, fmt.Errorf("expected <kind>:<target>, got %q", s)
+	}
+	p.Kind = parts[0]
+	switch p.Kind {
+	case "exec":
+		p.Command = strings.Fields(parts[1])
+	case "tcp", "http":
+		port := parts[1]
+		if i := strings.Index(port, "/"); i >= 0 {
+			port, p.Path = port[:i], port[i:]
+		}
+		n, err := strconv.ParseInt(port, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", port)
+		}
+		p.Port = int32(n)
+	default:
+		return nil, fmt.Errorf("unknown probe kind %q", p.Kind)
+	}
+	return p, nil
+}
+
+// parseUserNamespace 解析 --userns auto[:size] 和 container:host:size 格式的 --uidmap/--gidmap
+func parseUserNamespace(userns string, uidmaps []string, gidmaps []string) (*server.UserNamespace, error) {
+	if userns == "" && len(uidmaps) == 0 && len(gidmaps) == 0 {
+		return nil, nil
+	}
+	ns := &server.UserNamespace{}
+	if userns != "" {
+		parts := strings.SplitN(userns, ":", 2)
+		if parts[0] != "auto" {
+			return nil, fmt.Errorf("expected auto[:size], got %q", userns)
+		}
+		ns.Auto = true
+		if len(parts) == 2 {
+			size, err := strconv.ParseUint(parts[1], 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid size %q", parts[1])
+			}
+			ns.Size = uint32(size)
+		}
+	}
+	for _, list := range []struct {
+		specs []string
+		out   *[]*server.IDMapping
+	}{{uidmaps, &ns.UidMappings}, {gidmaps, &ns.GidMappings}} {
+		for _, spec := range list.specs {
+			var ids [3]uint32
+			parts := strings.Split(spec, ":")
+			if len(parts) != 3 {
+				return nil, fmt.Errorf("expected container:host:size, got %q", spec)
+			}
+			for i, p := range parts {
+				n, err := strconv.ParseUint(p, 10, 32)
+				if err != nil {
+					return nil, fmt.Errorf("invalid mapping %q", spec)
+				}
+				ids[i] = uint32(n)
+			}
+			*list.out = append(*list.out, &server.IDMapping{ContainerId: ids[0], HostId: ids[1], Size: ids[2]})
+		}
+	}
+	return ns, nil
+}
+
+// parsePortMappings 解析 [hostIP:]hostPort:containerPort[/protocol] 格式的 --publish
+func parsePortMappings(specs []string) ([]*server.PortMapping, error) {
+	var ports []*server.PortMapping
+	for _, spec := range specs {
+		p, err := container.ParsePortMapping(spec)
+		if err != nil {
+			return nil, err
+		}
+		ports = append(ports, &server.PortMapping{
+			Protocol:      p.Protocol,
+			ContainerPort: uint32(p.ContainerPort),
+			HostPort:      uint32(p.HostPort),
+			HostIp:        p.HostIP,
+		})
+	}
+	return ports, nil
+}
+
 func init() {
 	createCmd.PersistentFlags().StringVarP(&opts.Rootfs,
 		"image", "I",
@@ -54,6 +219,118 @@ func init() {
 		"leave-stdin-open", "",
 		false,
 		"在第一个attach session 完成后保持容器的 STDIN 打开")
+	createCmd.PersistentFlags().StringVarP(&opts.RestartPolicy,
+		"restart", "",
+		"no",
+		"容器退出后的重启策略 (no, on-failure[:max], always)")
+	createCmd.PersistentFlags().StringVarP(&opts.Liveness,
+		"liveness", "",
+		"",
+		"liveness 探针: exec:<command>, tcp:<port> 或 http:<port>[/path]")
+	createCmd.PersistentFlags().StringVarP(&opts.Readiness,
+		"readiness", "",
+		"",
+		"readiness 探针: exec:<command>, tcp:<port> 或 http:<port>[/path]")
+	createCmd.PersistentFlags().StringVarP(&opts.LivenessAction,
+		"liveness-action", "",
+		"restart",
+		"liveness 失败后的处理 (restart, kill)")
+	createCmd.PersistentFlags().Int32VarP(&opts.ProbeDelay,
+		"probe-initial-delay", "",
+		0,
+		"容器启动后第一次探测前等待的秒数")
+	createCmd.PersistentFlags().Int32VarP(&opts.ProbePeriod,
+		"probe-period", "",
+		10,
+		"探测间隔秒数")
+	createCmd.PersistentFlags().Int32VarP(&opts.ProbeTimeout,
+		"probe-timeout", "",
+		1,
+		"单次探测超时秒数")
+	createCmd.PersistentFlags().Int32VarP(&opts.ProbeFailures,
+		"probe-failures", "",
+		3,
+		"连续失败多少次认为 unhealthy")
+	createCmd.PersistentFlags().StringVarP(&opts.LogMaxSize,
+		"log-max-size", "",
+		"",
+		"日志文件轮转前的最大大小,如 10Mi, 默认使用守护进程配置")
+	createCmd.PersistentFlags().Int32VarP(&opts.LogMaxFiles,
+		"log-max-files", "",
+		0,
+		"最多保留的日志文件数, 默认使用守护进程配置")
+	createCmd.PersistentFlags().StringVarP(&opts.LogDriver,
+		"log-driver", "",
+		"",
+		"日志驱动 (file, syslog, fluentd), 默认使用守护进程配置")
+	createCmd.PersistentFlags().StringVarP(&opts.LogAddress,
+		"log-driver-address", "",
+		"",
+		"日志驱动地址,如 unixgram:///dev/log, tcp://127.0.0.1:24224")
+	createCmd.PersistentFlags().StringVarP(&opts.LogTag,
+		"log-tag", "",
+		"",
+		"syslog APP-NAME 或 fluentd tag, 默认为容器名")
+	createCmd.PersistentFlags().StringVarP(&opts.Runtime,
+		"runtime", "",
+		"",
+		"OCI 运行时 handler (守护进程配置的 runtimeHandlers 之一), 默认使用守护进程配置")
+	createCmd.PersistentFlags().StringVarP(&opts.SpecTemplate,
+		"spec-template", "",
+		"",
+		"守护进程配置的 spec 模板 (specTemplates 之一)")
+	createCmd.PersistentFlags().StringVarP(&opts.SpecPatch,
+		"spec-patch", "",
+		"",
+		"JSON merge patch (RFC 7396) 文件, 应用到生成的 config.json, 如设置 hostname, rlimits, sysctl")
+	createCmd.PersistentFlags().BoolVarP(&opts.Privileged,
+		"privileged", "",
+		false,
+		"特权容器: 所有 capability, 不使用 seccomp, 不屏蔽路径")
+	createCmd.PersistentFlags().StringSliceVarP(&opts.CapAdd,
+		"cap-add", "",
+		nil,
+		"添加的 capability, 如 NET_ADMIN 或 ALL")
+	createCmd.PersistentFlags().StringSliceVarP(&opts.CapDrop,
+		"cap-drop", "",
+		nil,
+		"删除的 capability, 如 NET_RAW 或 ALL")
+	createCmd.PersistentFlags().BoolVarP(&opts.NoNewPrivs,
+		"no-new-privileges", "",
+		false,
+		"设置 no_new_privs, 默认使用守护进程配置")
+	createCmd.PersistentFlags().StringVarP(&opts.Seccomp,
+		"seccomp", "",
+		"",
+		"seccomp profile (runtime/default, unconfined, localhost/<path>), 默认使用守护进程配置")
+	createCmd.PersistentFlags().StringSliceVarP(&opts.MaskedPaths,
+		"masked-path", "",
+		nil,
+		"在默认值之外额外屏蔽的路径")
+	createCmd.PersistentFlags().StringSliceVarP(&opts.ReadonlyPaths,
+		"readonly-path", "",
+		nil,
+		"在默认值之外额外只读的路径")
+	createCmd.PersistentFlags().StringVarP(&opts.UserNS,
+		"userns", "",
+		"",
+		"auto[:size]: 从 /etc/subuid 和 /etc/subgid 自动分配用户命名空间")
+	createCmd.PersistentFlags().StringSliceVarP(&opts.UIDMaps,
+		"uidmap", "",
+		nil,
+		"uid 映射 container:host:size, 可以指定多个")
+	createCmd.PersistentFlags().StringSliceVarP(&opts.GIDMaps,
+		"gidmap", "",
+		nil,
+		"gid 映射 container:host:size, 默认与 --uidmap 相同")
+	createCmd.PersistentFlags().StringVarP(&opts.Network,
+		"network", "",
+		"",
+		"网络模式 (none, bridge, cni), 默认使用守护进程配置")
+	createCmd.PersistentFlags().StringArrayVarP(&opts.Publish,
+		"publish", "p",
+		nil,
+		"发布到主机的端口 [hostIP:]hostPort:containerPort[/tcp|udp], 可以指定多个")
 
 	baseCmd.AddCommand(createCmd)
 }
@@ -4,7 +4,6 @@ import (
 	"context"
 	cmdutil "github.com/tluo-github/cri-impl/ctl/cmd"
 	"github.com/tluo-github/cri-impl/server"
-	"k8s.io/klog"
 
 	"github.com/spf13/cobra"
 )
@@ -23,7 +22,7 @@ var listCmd = &cobra.Command{
 			&server.ListContainersRequest{},
 		)
 		if err != nil {
-			klog.Fatal("Command failed with err:%v", err)
+			cmdutil.ExitOnError(err)
 		}
 		cmdutil.Print(resp)
 	},
@@ -0,0 +1,87 @@
+package container
+
+import (
+	"context"
+	"github.com/spf13/cobra"
+	cmdutil "github.com/tluo-github/cri-impl/ctl/cmd"
+	"github.com/tluo-github/cri-impl/server"
+	"io"
+	"os"
+	"time"
+)
+
+type LogsOptions struct {
+	Follow     bool
+	Tail       int64
+	Since      time.Duration
+	Timestamps bool
+	Stream     string
+}
+
+var logsOpts LogsOptions
+
+// logsCmd represents the logs command
+var logsCmd = &cobra.Command{
+	Use:   "logs <container-id>",
+	Short: "",
+	Long:  "",
+	Run: func(cmd *cobra.Command, args []string) {
+		client, conn := cmdutil.Connect()
+		defer conn.Close()
+
+		stream, err := client.ContainerLogs(
+			context.Background(),
+			&server.ContainerLogsRequest{
+				ContainerId:  args[0],
+				Follow:       logsOpts.Follow,
+				TailLines:    logsOpts.Tail,
+				SinceSeconds: int64((logsOpts.Since + time.Second - 1) / time.Second),
+				Stream:       logsOpts.Stream,
+			},
+		)
+		if err != nil {
+			cmdutil.ExitOnError(err)
+		}
+		for {
+			entry, err := stream.Recv()
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				cmdutil.ExitOnError(err)
+			}
+			dst := os.Stdout
+			if entry.Stream == "stderr" {
+				dst = os.Stderr
+			}
+			if logsOpts.Timestamps {
+				dst.WriteString(time.Unix(0, entry.Timestamp).Format(time.RFC3339Nano) + " ")
+			}
+			dst.Write(append(entry.Log, '\n'))
+		}
+	},
+}
+
+func init() {
+	logsCmd.PersistentFlags().BoolVarP(&logsOpts.Follow,
+		"follow", "f",
+		false,
+		"持续输出新的日志")
+	logsCmd.PersistentFlags().Int64VarP(&logsOpts.Tail,
+		"tail", "",
+		0,
+		"只输出最后 N 条日志, 0 表示全部")
+	logsCmd.PersistentFlags().DurationVarP(&logsOpts.Since,
+		"since", "",
+		0,
+		"只输出最近一段时间内的日志, 如 10s, 5m, 1h")
+	logsCmd.PersistentFlags().BoolVarP(&logsOpts.Timestamps,
+		"timestamps", "t",
+		false,
+		"在每条日志前输出时间戳")
+	logsCmd.PersistentFlags().StringVarP(&logsOpts.Stream,
+		"stream", "",
+		"",
+		"只输出 stdout 或 stderr, 默认全部")
+	baseCmd.AddCommand(logsCmd)
+}
@@ -0,0 +1,34 @@
+package container
+
+import (
+	"context"
+	"github.com/spf13/cobra"
+	cmdutil "github.com/tluo-github/cri-impl/ctl/cmd"
+	"github.com/tluo-github/cri-impl/server"
+)
+
+// reopenLogCmd represents the reopen-log command
+var reopenLogCmd = &cobra.Command{
+	Use:   "reopen-log <container-id>",
+	Short: "",
+	Long:  "",
+	Run: func(cmd *cobra.Command, args []string) {
+		client, conn := cmdutil.Connect()
+		defer conn.Close()
+
+		resp, err := client.ReopenContainerLog(
+			context.Background(),
+			&server.ReopenContainerLogRequest{
+				ContainerId: args[0],
+			},
+		)
+		if err != nil {
+			cmdutil.ExitOnError(err)
+		}
+		cmdutil.Print(resp)
+	},
+}
+
+func init() {
+	baseCmd.AddCommand(reopenLogCmd)
+}
@@ -5,14 +5,14 @@ import (
 	"github.com/spf13/cobra"
 	cmdutil "github.com/tluo-github/cri-impl/ctl/cmd"
 	"github.com/tluo-github/cri-impl/server"
-	"k8s.io/klog"
 )
 
 // statusCmd represents the status command
 var statusCmd = &cobra.Command{
-	Use:   "status <container-id>",
-	Short: "",
-	Long:  "",
+	Use:     "status <container-id>",
+	Aliases: []string{"inspect"},
+	Short:   "",
+	Long:    "",
 	Run: func(cmd *cobra.Command, args []string) {
 		client, conn := cmdutil.Connect()
 		defer conn.Close()
@@ -24,7 +24,7 @@ var statusCmd = &cobra.Command{
 			},
 		)
 		if err != nil {
-			klog.Fatal("Command failed with err:%v", err)
+			cmdutil.ExitOnError(err)
 		}
 		cmdutil.Print(resp)
 	},
@@ -5,7 +5,6 @@ import (
 	"github.com/spf13/cobra"
 	cmdutil "github.com/tluo-github/cri-impl/ctl/cmd"
 	"github.com/tluo-github/cri-impl/server"
-	"k8s.io/klog"
 )
 
 // stopCmd represents the stop command
@@ -24,7 +23,7 @@ var stopCmd = &cobra.Command{
 			},
 		)
 		if err != nil {
-			klog.Fatal("Command failed with err:%v", err)
+			cmdutil.ExitOnError(err)
 		}
 		cmdutil.Print(resp)
 	},
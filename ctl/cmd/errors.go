@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"fmt"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io"
+	"os"
+)
+
+// crictl 的退出码,按 gRPC status code 区分,便于脚本判断失败原因
+const (
+	ExitFailure            = 1
+	ExitInvalidArgument    = 2
+	ExitNotFound           = 3
+	ExitAlreadyExists      = 4
+	ExitFailedPrecondition = 5
+	ExitDeadlineExceeded   = 6
+	ExitUnavailable        = 7
+	ExitInternal           = 8
+	ExitPermissionDenied   = 9
+)
+
+var exitCodes = map[codes.Code]int{
+	codes.InvalidArgument:    ExitInvalidArgument,
+	codes.NotFound:           ExitNotFound,
+	codes.AlreadyExists:      ExitAlreadyExists,
+	codes.FailedPrecondition: ExitFailedPrecondition,
+	codes.DeadlineExceeded:   ExitDeadlineExceeded,
+	codes.Unavailable:        ExitUnavailable,
+	codes.Internal:           ExitInternal,
+	codes.PermissionDenied:   ExitPermissionDenied,
+	codes.Unauthenticated:    ExitPermissionDenied,
+}
+
+var errorHints = map[codes.Code]string{
+	codes.NotFound:           "not found",
+	codes.AlreadyExists:      "already exists",
+	codes.FailedPrecondition: "not allowed in current container state",
+	codes.DeadlineExceeded:   "timed out",
+	codes.Internal:           "runtime failure",
+	codes.PermissionDenied:   "permission denied",
+	codes.Unauthenticated:    "permission denied",
+	codes.Unimplemented:      "not supported",
+}
+
+// ExitOnError 将守护进程返回的错误以可读的形式输出到 stderr,并以对应的退出码退出
+func ExitOnError(err error) {
+	if err == nil {
+		return
+	}
+	os.Exit(printError(os.Stderr, err))
+}
+
+// printError 将 err 以可读的形式写入 w,返回对应的退出码
+func printError(w io.Writer, err error) int {
+	st, ok := status.FromError(err)
+	if !ok {
+		fmt.Fprintf(w, "Error: %v\n", err)
+		return ExitFailure
+	}
+
+	switch st.Code() {
+	case codes.Unavailable:
+		fmt.Fprintf(w, "Error: cannot connect to cri-impl daemon at %s, is it running?\n", OptHost)
+	default:
+		if hint, ok := errorHints[st.Code()]; ok {
+			fmt.Fprintf(w, "Error (%s): %s\n", hint, st.Message())
+		} else {
+			fmt.Fprintf(w, "Error: %s\n", st.Message())
+		}
+	}
+	for _, d := range st.Details() {
+		if info, ok := d.(*errdetails.DebugInfo); ok && info.Detail != "" {
+			fmt.Fprintf(w, "Runtime output:\n%s\n", info.Detail)
+		}
+	}
+
+	code, ok := exitCodes[st.Code()]
+	if !ok {
+		code = ExitFailure
+	}
+	return code
+}
@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+)
+
+func TestPrintError(t *testing.T) {
+	OptHost = "/run/cri-impl.sock"
+	withDetail, err := status.New(codes.Internal, "create container failed").
+		WithDetails(&errdetails.DebugInfo{Detail: "runc: exec format error"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		err    error
+		code   int
+		output string
+	}{
+		{"plain error", errors.New("dial failed"), ExitFailure, "Error: dial failed\n"},
+		{"invalid argument", status.Error(codes.InvalidArgument, "bad name"), ExitInvalidArgument, "Error: bad name\n"},
+		{"not found", status.Error(codes.NotFound, "container c1 not found"), ExitNotFound,
+			"Error (not found): container c1 not found\n"},
+		{"already exists", status.Error(codes.AlreadyExists, "container c1 exists"), ExitAlreadyExists,
+			"Error (already exists): container c1 exists\n"},
+		{"failed precondition", status.Error(codes.FailedPrecondition, "container c1 is running"), ExitFailedPrecondition,
+			"Error (not allowed in current container state): container c1 is running\n"},
+		{"deadline exceeded", status.Error(codes.DeadlineExceeded, "wait shim"), ExitDeadlineExceeded,
+			"Error (timed out): wait shim\n"},
+		{"unavailable", status.Error(codes.Unavailable, "connection refused"), ExitUnavailable,
+			"Error: cannot connect to cri-impl daemon at /run/cri-impl.sock, is it running?\n"},
+		{"internal", withDetail.Err(), ExitInternal,
+			"Error (runtime failure): create container failed\nRuntime output:\nrunc: exec format error\n"},
+		{"permission denied", status.Error(codes.PermissionDenied, "privileged"), ExitPermissionDenied,
+			"Error (permission denied): privileged\n"},
+		{"unauthenticated", status.Error(codes.Unauthenticated, "no token"), ExitPermissionDenied,
+			"Error (permission denied): no token\n"},
+		{"unimplemented", status.Error(codes.Unimplemented, "checkpoint"), ExitFailure,
+			"Error (not supported): checkpoint\n"},
+		{"unknown", status.Error(codes.Unknown, "boom"), ExitFailure, "Error: boom\n"},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		if code := printError(&out, tt.err); code != tt.code {
+			t.Errorf("%s: exit code %d, want %d", tt.name, code, tt.code)
+		}
+		if out.String() != tt.output {
+			t.Errorf("%s: output %q, want %q", tt.name, out.String(), tt.output)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/spf13/cobra"
+	"github.com/tluo-github/cri-impl/pkg/version"
+	"github.com/tluo-github/cri-impl/server"
+)
+
+var infoVerbose bool
+
+// infoCmd 输出守护进程的运行时状态和版本
+var infoCmd = &cobra.Command{
+	Use:   "info",
+	Short: "显示运行时状态 (RuntimeReady, NetworkReady) 和版本信息",
+	Run: func(cmd *cobra.Command, args []string) {
+		client, conn := Connect()
+		defer conn.Close()
+
+		status, err := client.Status(
+			context.Background(),
+			&server.StatusRequest{Verbose: infoVerbose},
+		)
+		if err != nil {
+			ExitOnError(err)
+		}
+		ver, err := client.Version(
+			context.Background(),
+			&server.VersionRequest{},
+		)
+		if err != nil {
+			ExitOnError(err)
+		}
+		Print(map[string]interface{}{
+			"status":        json.RawMessage(toString(status.Status)),
+			"info":          status.Info,
+			"version":       json.RawMessage(toString(ver)),
+			"clientVersion": version.Get(),
+		})
+	},
+}
+
+func init() {
+	infoCmd.Flags().BoolVarP(&infoVerbose, "verbose", "v", false, "显示每一项检查的结果")
+	RootCmd.AddCommand(infoCmd)
+}
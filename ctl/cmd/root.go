@@ -3,9 +3,18 @@ package cmd
 import (
 	"fmt"
 	"github.com/spf13/cobra"
+	"github.com/tluo-github/cri-impl/config"
+	"os"
 )
 
-var OptHost string
+var (
+	OptHost string
+	// TLS 选项,只用于 tcp:// host
+	OptTLSCert       string
+	OptTLSKey        string
+	OptTLSCA         string
+	OptTLSServerName string
+)
 
 // RootCmd represents the base command when called without any subcommands
 var RootCmd = &cobra.Command{
@@ -27,6 +36,28 @@ func Execute() {
 func init() {
 	RootCmd.PersistentFlags().StringVarP(&OptHost,
 		"host", "H",
-		"/var/run/cri-impl.sock",
-		"cri-impl 守护进程 sock")
+		defaultHost(),
+		"cri-impl 守护进程地址: sock 路径, unix:///path 或 tcp://host:port")
+	RootCmd.PersistentFlags().StringVar(&OptTLSCert,
+		"tls-cert", "",
+		"tcp 连接使用的客户端证书")
+	RootCmd.PersistentFlags().StringVar(&OptTLSKey,
+		"tls-key", "",
+		"tcp 连接使用的客户端私钥")
+	RootCmd.PersistentFlags().StringVar(&OptTLSCA,
+		"tls-ca", "",
+		"校验守护进程证书的 CA, 默认使用系统 CA")
+	RootCmd.PersistentFlags().StringVar(&OptTLSServerName,
+		"tls-server-name", "",
+		"校验守护进程证书时使用的名称, 默认为 host")
+}
+
+// defaultHost 非 root 用户的 rootless 守护进程 sock 存在时优先使用, 否则为 root 守护进程的 sock
+func defaultHost() string {
+	if host := config.DefaultDirs().Listen; host != config.DefaultListen {
+		if _, err := os.Stat(host); err == nil {
+			return host
+		}
+	}
+	return config.DefaultListen
 }
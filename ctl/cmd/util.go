@@ -1,23 +1,64 @@
 package cmd
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/golang/protobuf/jsonpb"
 	"github.com/golang/protobuf/proto"
 	"github.com/tluo-github/cri-impl/server"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"io/ioutil"
 	"k8s.io/klog"
+	"strings"
 )
 
 func Connect() (server.CriClient, *grpc.ClientConn) {
-	conn, err := grpc.Dial("unix://"+OptHost, grpc.WithInsecure())
+	target, creds, err := dialTarget()
+	if err != nil {
+		klog.Fatalf("Connect with err:%v", err)
+	}
+	conn, err := grpc.Dial(target, creds)
 	if err != nil {
 		klog.Fatalf("Connect with err:%v", err)
 	}
 	return server.NewCriClient(conn), conn
 }
 
+// dialTarget 根据 --host 返回 gRPC 地址, tcp:// 使用 mTLS, 其他视为 UNIX socket
+func dialTarget() (string, grpc.DialOption, error) {
+	if !strings.HasPrefix(OptHost, "tcp://") {
+		return "unix://" + strings.TrimPrefix(OptHost, "unix://"), grpc.WithInsecure(), nil
+	}
+	addr := strings.TrimPrefix(OptHost, "tcp://")
+	if OptTLSCert == "" || OptTLSKey == "" {
+		return "", nil, errors.New("tcp host requires --tls-cert and --tls-key")
+	}
+	cert, err := tls.LoadX509KeyPair(OptTLSCert, OptTLSKey)
+	if err != nil {
+		return "", nil, err
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ServerName:   OptTLSServerName,
+		MinVersion:   tls.VersionTLS12,
+	}
+	if OptTLSCA != "" {
+		pem, err := ioutil.ReadFile(OptTLSCA)
+		if err != nil {
+			return "", nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return "", nil, errors.New("no certificates found in " + OptTLSCA)
+		}
+	}
+	return addr, grpc.WithTransportCredentials(credentials.NewTLS(cfg)), nil
+}
+
 func Print(v interface{}) {
 	fmt.Println(toString(v))
 }
@@ -4,7 +4,6 @@ import (
 	"context"
 	"github.com/spf13/cobra"
 	"github.com/tluo-github/cri-impl/server"
-	"k8s.io/klog"
 )
 
 // versionCmd represents the version command
@@ -21,7 +20,7 @@ var versionCmd = &cobra.Command{
 			&server.VersionRequest{},
 		)
 		if err != nil {
-			klog.Fatal("Command failed with err:%v", err)
+			ExitOnError(err)
 		}
 		Print(resp)
 	},
@@ -0,0 +1,70 @@
+package audit
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Caller 发起调用的客户端
+type Caller struct {
+	// Uid Gid Pid UNIX socket 调用方的进程凭证 (SO_PEERCRED)
+	Uid *uint32 `json:"uid,omitempty"`
+	Gid *uint32 `json:"gid,omitempty"`
+	Pid *int32  `json:"pid,omitempty"`
+	// Subject TLS 调用方的客户端证书 subject
+	Subject string `json:"subject,omitempty"`
+	// Addr TCP 调用方的地址
+	Addr string `json:"addr,omitempty"`
+}
+
+// Entry 审计日志中的一条记录,对应一次修改状态的调用
+type Entry struct {
+	Time      time.Time       `json:"time"`
+	RequestID string          `json:"request_id,omitempty"`
+	Method    string          `json:"method"`
+	Caller    Caller          `json:"caller"`
+	Args      json.RawMessage `json:"args,omitempty"`
+	Code      string          `json:"code"`
+	Error     string          `json:"error,omitempty"`
+}
+
+// Logger 以 JSON Lines 格式追加写入审计日志,每条记录一行
+type Logger struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// Open 以追加模式打开 path, 文件不存在时创建,只有 owner 可读写
+func Open(path string) (*Logger, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &Logger{f: f}, nil
+}
+
+// Log 写入一条记录, 每条记录通过一次 write 写入,不会与其他记录交错
+func (l *Logger) Log(e *Entry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err = l.f.Write(line)
+	return err
+}
+
+func (l *Logger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
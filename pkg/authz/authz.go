@@ -0,0 +1,260 @@
+package authz
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os/user"
+	"sigs.k8s.io/yaml"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level 调用方的访问级别
+type Level string
+
+const (
+	// None 不允许任何调用
+	None Level = "none"
+	// ReadOnly 只允许查询类的调用
+	ReadOnly Level = "read-only"
+	// Full 允许所有调用
+	Full Level = "full"
+	// Privileged 在 Full 之上还允许创建特权容器, 添加 capability 以及 patch 安全相关的 spec 字段
+	// root 调用方始终为 Privileged
+	Privileged Level = "privileged"
+)
+
+// readOnlyMethods 不修改容器状态的 RPC,只需要 ReadOnly 级别
+var readOnlyMethods = map[string]bool{
+	"Version":         true,
+	"Status":          true,
+	"ListContainers":  true,
+	"ContainerStatus": true,
+	"ContainerLogs":   true,
+}
+
+// Allows 判断 level 是否允许调用 fullMethod (/package.Service/Method)
+func (l Level) Allows(fullMethod string) bool {
+	switch l {
+	case Privileged, Full:
+		return true
+	case ReadOnly:
+		return IsReadOnly(fullMethod)
+	}
+	return false
+}
+
+func (l Level) valid() bool {
+	return l == None || l == ReadOnly || l == Full || l == Privileged
+}
+
+// IsReadOnly 判断 RPC 是否为只读调用
+func IsReadOnly(fullMethod string) bool {
+	return readOnlyMethods[fullMethod[strings.LastIndex(fullMethod, "/")+1:]]
+}
+
+// rank 用于比较访问级别的高低
+func (l Level) rank() int {
+	switch l {
+	case Privileged:
+		return 3
+	case Full:
+		return 2
+	case ReadOnly:
+		return 1
+	}
+	return 0
+}
+
+// levelKey context 中调用方访问级别的 key
+type levelKey struct{}
+
+// NewContext 返回保存了调用方访问级别的 context
+func NewContext(ctx context.Context, l Level) context.Context {
+	return context.WithValue(ctx, levelKey{}, l)
+}
+
+// FromContext 返回 NewContext 保存的访问级别, 没有时为 None
+func FromContext(ctx context.Context) Level {
+	if l, ok := ctx.Value(levelKey{}).(Level); ok {
+		return l
+	}
+	return None
+}
+
+// Policy 访问策略文件, YAML 或 JSON 格式:
+//
+//	certificates:
+//	  "CN=admin,O=example": privileged
+//	  "CN=ops,O=example": full
+//	  monitoring: read-only
+//	users:
+//	  deploy: full
+//	  "1001": read-only
+//	groups:
+//	  cri-viewers: read-only
+//	unixDefault: none
+type Policy struct {
+	// Certificates 客户端证书 subject 到访问级别的映射
+	// key 可以是完整的 subject (如 CN=ops,O=example) 或者只是 CommonName
+	Certificates map[string]Level `json:"certificates,omitempty"`
+	// Users UNIX socket 调用方的用户名或 uid 到访问级别的映射
+	Users map[string]Level `json:"users,omitempty"`
+	// Groups UNIX socket 调用方的组名或 gid 到访问级别的映射, 包含用户的附加组
+	Groups map[string]Level `json:"groups,omitempty"`
+	// UnixDefault 没有匹配任何 user/group 的 UNIX socket 调用方的访问级别
+	// 默认为 none; 策略中没有 users 和 groups 时默认为 full, 与只配置证书的旧策略保持兼容
+	UnixDefault Level `json:"unixDefault,omitempty"`
+
+	// lock 保护 identities
+	lock       sync.Mutex
+	identities map[peerKey]unixIdentity
+}
+
+// LoadPolicy 从文件加载访问策略
+func LoadPolicy(path string) (*Policy, error) {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &Policy{}
+	if err := yaml.UnmarshalStrict(bytes, p); err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid authz policy %s: %v", path, err))
+	}
+	for kind, levels := range map[string]map[string]Level{
+		"certificate": p.Certificates,
+		"user":        p.Users,
+		"group":       p.Groups,
+	} {
+		for name, l := range levels {
+			if !l.valid() {
+				return nil, errors.New(fmt.Sprintf("Invalid access level %q for %s %q", l, kind, name))
+			}
+		}
+	}
+	if p.UnixDefault == "" {
+		p.UnixDefault = None
+		if len(p.Users) == 0 && len(p.Groups) == 0 {
+			p.UnixDefault = Full
+		}
+	}
+	if !p.UnixDefault.valid() {
+		return nil, errors.New(fmt.Sprintf("Invalid unixDefault access level %q", p.UnixDefault))
+	}
+	return p, nil
+}
+
+// ForCertificate 返回客户端证书的访问级别,未配置的证书没有任何权限
+func (p *Policy) ForCertificate(cert *x509.Certificate) Level {
+	if p == nil || cert == nil {
+		return None
+	}
+	if l, ok := p.Certificates[cert.Subject.String()]; ok {
+		return l
+	}
+	if l, ok := p.Certificates[cert.Subject.CommonName]; ok {
+		return l
+	}
+	return None
+}
+
+// ForUnknownPeer 返回无法获得凭证的 UNIX socket 调用方 (不支持 SO_PEERCRED 的平台) 的访问级别
+// 没有策略时所有能打开 socket 的调用方都有全部权限, 否则只有 UnixDefault
+func (p *Policy) ForUnknownPeer() Level {
+	if p == nil {
+		return Full
+	}
+	return p.UnixDefault
+}
+
+// ForUnixPeer 返回 UNIX socket 调用方的访问级别, 取用户和所有所属组中最高的级别
+// root 始终为 Privileged; 没有策略时保持以前的行为,所有能打开 socket 的调用方都有 Full 权限
+func (p *Policy) ForUnixPeer(uid uint32, gid uint32) Level {
+	if uid == 0 {
+		return Privileged
+	}
+	if p == nil {
+		return Full
+	}
+
+	level := p.UnixDefault
+	grant := func(l Level, ok bool) {
+		if ok && l.rank() > level.rank() {
+			level = l
+		}
+	}
+	id := p.identity(uid, gid)
+	for _, name := range id.users {
+		l, ok := p.Users[name]
+		grant(l, ok)
+	}
+	for _, name := range id.groups {
+		l, ok := p.Groups[name]
+		grant(l, ok)
+	}
+	return level
+}
+
+// identityCacheTTL 用户名和所属组的缓存时间, 重新加载策略时清空
+const identityCacheTTL = 1 * time.Minute
+
+type peerKey struct {
+	uid uint32
+	gid uint32
+}
+
+// unixIdentity UNIX socket 调用方在策略中可以匹配的名字
+type unixIdentity struct {
+	// users uid 和用户名
+	users []string
+	// groups 主组和附加组的 gid 和组名
+	groups  []string
+	expires time.Time
+}
+
+// resolveIdentity 查询 uid 的用户名和所属组, 查询失败时只使用数字 id
+var resolveIdentity = func(uid uint32, gid uint32) unixIdentity {
+	uidStr := strconv.FormatUint(uint64(uid), 10)
+	id := unixIdentity{users: []string{uidStr}}
+	gids := []string{strconv.FormatUint(uint64(gid), 10)}
+	if u, err := user.LookupId(uidStr); err == nil {
+		id.users = append(id.users, u.Username)
+		if ids, err := u.GroupIds(); err == nil {
+			gids = append(gids, ids...)
+		}
+	}
+	for _, g := range gids {
+		id.groups = append(id.groups, g)
+		if grp, err := user.LookupGroupId(g); err == nil {
+			id.groups = append(id.groups, grp.Name)
+		}
+	}
+	return id
+}
+
+// identity 返回缓存的调用方身份, 避免每次调用都查询 passwd 和 group
+func (p *Policy) identity(uid uint32, gid uint32) unixIdentity {
+	key := peerKey{uid, gid}
+	now := time.Now()
+	p.lock.Lock()
+	id, ok := p.identities[key]
+	p.lock.Unlock()
+	if ok && now.Before(id.expires) {
+		return id
+	}
+
+	id = resolveIdentity(uid, gid)
+	id.expires = now.Add(identityCacheTTL)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.identities == nil {
+		p.identities = make(map[peerKey]unixIdentity)
+	}
+	p.identities[key] = id
+	return id
+}
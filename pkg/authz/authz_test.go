@@ -0,0 +1,204 @@
+package authz
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeIdentities 替换 resolveIdentity, 返回固定的用户名和所属组并记录查询次数
+func fakeIdentities(t *testing.T, ids map[uint32]unixIdentity) *int {
+	calls := 0
+	orig := resolveIdentity
+	resolveIdentity = func(uid uint32, gid uint32) unixIdentity {
+		calls++
+		return ids[uid]
+	}
+	t.Cleanup(func() { resolveIdentity = orig })
+	return &calls
+}
+
+func loadPolicy(t *testing.T, content string) (*Policy, error) {
+	dir, err := ioutil.TempDir("", "authz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "authz.yaml")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return LoadPolicy(path)
+}
+
+func TestLoadPolicyUnixDefault(t *testing.T) {
+	cases := []struct {
+		content string
+		want    Level
+	}{
+		{"certificates:\n  ops: full\n", Full},
+		{"users:\n  deploy: full\n", None},
+		{"groups:\n  cri-viewers: read-only\n", None},
+		{"users:\n  deploy: full\nunixDefault: read-only\n", ReadOnly},
+		{"users:\n  admin: privileged\nunixDefault: privileged\n", Privileged},
+	}
+	for _, c := range cases {
+		p, err := loadPolicy(t, c.content)
+		if err != nil {
+			t.Fatalf("LoadPolicy(%q): %v", c.content, err)
+		}
+		if p.UnixDefault != c.want {
+			t.Errorf("LoadPolicy(%q).UnixDefault = %q, want %q", c.content, p.UnixDefault, c.want)
+		}
+	}
+}
+
+func TestLoadPolicyRejectsInvalid(t *testing.T) {
+	for _, content := range []string{
+		"users:\n  deploy: admin\n",
+		"groups:\n  ops: write\n",
+		"certificates:\n  ops: root\n",
+		"unixDefault: everything\n",
+		"user:\n  deploy: full\n",
+	} {
+		if _, err := loadPolicy(t, content); err == nil {
+			t.Errorf("LoadPolicy(%q) succeeded", content)
+		}
+	}
+}
+
+func TestLevelAllows(t *testing.T) {
+	cases := []struct {
+		level  Level
+		method string
+		want   bool
+	}{
+		{Privileged, "/cri.Cri/CreateContainer", true},
+		{Full, "/cri.Cri/RemoveContainer", true},
+		{ReadOnly, "/cri.Cri/ListContainers", true},
+		{ReadOnly, "/cri.Cri/ContainerLogs", true},
+		{ReadOnly, "/cri.Cri/CreateContainer", false},
+		{ReadOnly, "/cri.Cri/Exec", false},
+		{None, "/cri.Cri/Version", false},
+	}
+	for _, c := range cases {
+		if got := c.level.Allows(c.method); got != c.want {
+			t.Errorf("%s.Allows(%s) = %v, want %v", c.level, c.method, got, c.want)
+		}
+	}
+}
+
+func TestForCertificate(t *testing.T) {
+	p := &Policy{Certificates: map[string]Level{
+		"CN=ops,O=example": Full,
+		"monitoring":       ReadOnly,
+	}}
+	cases := []struct {
+		subject pkix.Name
+		want    Level
+	}{
+		{pkix.Name{CommonName: "ops", Organization: []string{"example"}}, Full},
+		// 完整 subject 不匹配, 只按照 CommonName 匹配
+		{pkix.Name{CommonName: "ops", Organization: []string{"other"}}, None},
+		{pkix.Name{CommonName: "monitoring", Organization: []string{"example"}}, ReadOnly},
+		{pkix.Name{CommonName: "intruder"}, None},
+	}
+	for _, c := range cases {
+		if got := p.ForCertificate(&x509.Certificate{Subject: c.subject}); got != c.want {
+			t.Errorf("ForCertificate(%s) = %q, want %q", c.subject, got, c.want)
+		}
+	}
+	if got := (*Policy)(nil).ForCertificate(&x509.Certificate{}); got != None {
+		t.Errorf("nil policy ForCertificate = %q, want none", got)
+	}
+}
+
+func TestForUnixPeer(t *testing.T) {
+	fakeIdentities(t, map[uint32]unixIdentity{
+		1000: {users: []string{"1000", "deploy"}, groups: []string{"1000", "deploy"}},
+		1001: {users: []string{"1001", "alice"}, groups: []string{"1001", "alice", "2000", "cri-viewers"}},
+		1002: {users: []string{"1002", "bob"}, groups: []string{"1002", "bob", "2000", "cri-viewers", "3000", "cri-admins"}},
+		1003: {users: []string{"1003"}, groups: []string{"1003"}},
+		1005: {users: []string{"1005", "admin"}, groups: []string{"1005", "admin", "3000", "cri-admins"}},
+	})
+	p := &Policy{
+		Users:       map[string]Level{"deploy": Full, "1003": ReadOnly, "admin": Privileged},
+		Groups:      map[string]Level{"cri-viewers": ReadOnly, "3000": Full},
+		UnixDefault: None,
+	}
+	cases := []struct {
+		name string
+		uid  uint32
+		want Level
+	}{
+		{"root", 0, Privileged},
+		{"user name", 1000, Full},
+		{"supplementary group name", 1001, ReadOnly},
+		{"highest of all groups", 1002, Full},
+		{"numeric uid without passwd entry", 1003, ReadOnly},
+		{"unknown user", 1004, None},
+		{"privileged user above full group", 1005, Privileged},
+	}
+	for _, c := range cases {
+		if got := p.ForUnixPeer(c.uid, c.uid); got != c.want {
+			t.Errorf("%s: ForUnixPeer(%d) = %q, want %q", c.name, c.uid, got, c.want)
+		}
+	}
+
+	p.UnixDefault = ReadOnly
+	if got := p.ForUnixPeer(1004, 1004); got != ReadOnly {
+		t.Errorf("ForUnixPeer with unixDefault read-only = %q", got)
+	}
+	if got := (*Policy)(nil).ForUnixPeer(1004, 1004); got != Full {
+		t.Errorf("nil policy ForUnixPeer = %q, want full", got)
+	}
+	// 没有策略时也只有 root 可以使用特权选项
+	if got := (*Policy)(nil).ForUnixPeer(0, 0); got != Privileged {
+		t.Errorf("nil policy ForUnixPeer(root) = %q, want privileged", got)
+	}
+}
+
+func TestForUnixPeerCachesIdentity(t *testing.T) {
+	calls := fakeIdentities(t, map[uint32]unixIdentity{
+		1000: {users: []string{"1000", "deploy"}},
+	})
+	p := &Policy{Users: map[string]Level{"deploy": Full}, UnixDefault: None}
+	for i := 0; i < 3; i++ {
+		if got := p.ForUnixPeer(1000, 1000); got != Full {
+			t.Fatalf("ForUnixPeer = %q, want full", got)
+		}
+	}
+	if *calls != 1 {
+		t.Errorf("identity resolved %d times, want 1", *calls)
+	}
+	// 重新加载的策略不使用旧的缓存
+	reloaded := &Policy{Users: map[string]Level{"deploy": ReadOnly}, UnixDefault: None}
+	if got := reloaded.ForUnixPeer(1000, 1000); got != ReadOnly {
+		t.Errorf("reloaded ForUnixPeer = %q, want read-only", got)
+	}
+	if *calls != 2 {
+		t.Errorf("identity resolved %d times after reload, want 2", *calls)
+	}
+}
+
+func TestForUnknownPeer(t *testing.T) {
+	if got := (*Policy)(nil).ForUnknownPeer(); got != Full {
+		t.Errorf("nil policy ForUnknownPeer = %q, want full", got)
+	}
+	if got := (&Policy{UnixDefault: None}).ForUnknownPeer(); got != None {
+		t.Errorf("ForUnknownPeer = %q, want none", got)
+	}
+}
+
+func TestLevelContext(t *testing.T) {
+	if got := FromContext(context.Background()); got != None {
+		t.Errorf("FromContext without level = %q, want none", got)
+	}
+	if got := FromContext(NewContext(context.Background(), Privileged)); got != Privileged {
+		t.Errorf("FromContext = %q, want privileged", got)
+	}
+}
@@ -8,6 +8,15 @@ import (
 
 const timeFormat = time.RFC3339
 
+// DefaultRuntimeHandler 默认的 OCI 运行时 handler, 也是没有记录 handler 的旧容器使用的 handler
+const DefaultRuntimeHandler = "runc"
+
+// ReasonShimLost 容器的 shim 进程意外退出: 容器输出不再写入日志, 不能 attach, 退出状态未知
+const ReasonShimLost = "ShimLost"
+
+// ExitCodeUnknown shim 丢失后容器退出时的 exit code
+const ExitCodeUnknown int32 = 255
+
 type Container struct {
 	Impl
 }
@@ -17,6 +26,11 @@ type Impl struct {
 	Name_     string `json:"name"`
 	Status_   Status `json:"status"`
 	ExitCode_ int32  `json:"exitCode"`
+	// Reason_ Message_ 容器处于当前状态的原因, 如 ShimLost
+	Reason_  string `json:"reason,omitempty"`
+	Message_ string `json:"message,omitempty"`
+	// ShimPid_ 当前运行的 shim 进程
+	ShimPid_ int `json:"shimPid,omitempty"`
 
 	CreateAt_   string `json:"createdAt"`
 	StartedAt_  string `json:"startedAt,omitempty"`
@@ -26,8 +40,37 @@ type Impl struct {
 	Args_    []string `json:"args,omitempty"`
 
 	Rootfs_ string `json:"rootfs"`
+	// RuntimeHandler_ 创建容器的 OCI 运行时 handler, restore 时使用同一个 handler
+	RuntimeHandler_ string `json:"runtimeHandler,omitempty"`
+	// Security_ 创建时生效的安全配置, 之前版本创建的容器为 nil
+	Security_ *SecurityProfile `json:"security,omitempty"`
+	// UserNamespace_ 容器的 uid/gid 映射, nil 表示不使用用户命名空间
+	UserNamespace_ *UserNamespace `json:"userNamespace,omitempty"`
+	// Network_ 容器的网络, nil 表示只有 loopback
+	Network_ *NetworkStatus `json:"network,omitempty"`
+	// Ports_ 发布到主机的端口
+	Ports_ []PortMapping `json:"ports,omitempty"`
+	// PublishedPorts_ 端口当前的发布状态, nil 表示没有发布 (没有端口或容器已经停止)
+	PublishedPorts_ *PublishedPorts `json:"publishedPorts,omitempty"`
+
+	LogPath_   string    `json:"logPath,omitempty"`
+	LogPolicy_ LogPolicy `json:"logPolicy,omitempty"`
 
-	LogPath_ string `json:"logPath,omitempty"`
+	Stdin_     bool `json:"stdin,omitempty"`
+	StdinOnce_ bool `json:"stdinOnce,omitempty"`
+
+	RestartPolicy_   RestartPolicy `json:"restartPolicy"`
+	RestartCount_    int32         `json:"restartCount"`
+	ManuallyStopped_ bool          `json:"manuallyStopped,omitempty"`
+	// 上一次运行的退出信息,容器被重启时记录
+	LastExitCode_   int32  `json:"lastExitCode"`
+	LastFinishedAt_ string `json:"lastFinishedAt,omitempty"`
+
+	LivenessProbe_  *Probe     `json:"livenessProbe,omitempty"`
+	ReadinessProbe_ *Probe     `json:"readinessProbe,omitempty"`
+	LivenessAction_ string     `json:"livenessAction,omitempty"`
+	Liveness_       ProbeState `json:"liveness,omitempty"`
+	Readiness_      ProbeState `json:"readiness,omitempty"`
 }
 
 func New(id ID, name string, logPath string) (*Container, error) {
@@ -121,10 +164,228 @@ func (c *Container) SetExitCode(code int32) {
 	c.ExitCode_ = code
 }
 
+// RuntimeHandler 容器使用的 OCI 运行时 handler
+func (c *Container) RuntimeHandler() string {
+	if c.RuntimeHandler_ == "" {
+		return DefaultRuntimeHandler
+	}
+	return c.RuntimeHandler_
+}
+
+func (c *Container) SetRuntimeHandler(name string) {
+	c.RuntimeHandler_ = name
+}
+
+func (c *Container) Security() *SecurityProfile {
+	return c.Security_
+}
+
+func (c *Container) SetSecurity(p SecurityProfile) {
+	c.Security_ = &p
+}
+
+func (c *Container) UserNamespace() *UserNamespace {
+	return c.UserNamespace_
+}
+
+func (c *Container) SetUserNamespace(ns *UserNamespace) {
+	c.UserNamespace_ = ns
+}
+
+func (c *Container) Network() *NetworkStatus {
+	return c.Network_
+}
+
+func (c *Container) SetNetwork(n *NetworkStatus) {
+	c.Network_ = n
+}
+
+func (c *Container) Ports() []PortMapping {
+	return c.Ports_
+}
+
+func (c *Container) SetPorts(ports []PortMapping) error {
+	if err := ValidatePortMappings(ports); err != nil {
+		return err
+	}
+	c.Ports_ = ports
+	return nil
+}
+
+func (c *Container) PublishedPorts() *PublishedPorts {
+	return c.PublishedPorts_
+}
+
+func (c *Container) SetPublishedPorts(p *PublishedPorts) {
+	c.PublishedPorts_ = p
+}
+
+func (c *Container) Reason() string {
+	return c.Reason_
+}
+
+func (c *Container) Message() string {
+	return c.Message_
+}
+
+func (c *Container) SetReason(reason string, message string) {
+	c.Reason_ = reason
+	c.Message_ = message
+}
+
+func (c *Container) ShimPid() int {
+	return c.ShimPid_
+}
+
+func (c *Container) SetShimPid(pid int) {
+	c.ShimPid_ = pid
+}
+
 func (c *Container) LogPath() string {
 	return c.LogPath_
 }
 
+func (c *Container) LogPolicy() LogPolicy {
+	return c.LogPolicy_
+}
+
+func (c *Container) SetLogPolicy(p LogPolicy) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	c.LogPolicy_ = p
+	return nil
+}
+
+func (c *Container) Stdin() bool {
+	return c.Stdin_
+}
+
+func (c *Container) StdinOnce() bool {
+	return c.StdinOnce_
+}
+
+func (c *Container) SetStdin(stdin bool, stdinOnce bool) {
+	c.Stdin_ = stdin
+	c.StdinOnce_ = stdinOnce
+}
+
+func (c *Container) RestartPolicy() RestartPolicy {
+	return c.RestartPolicy_
+}
+
+func (c *Container) SetRestartPolicy(p RestartPolicy) {
+	c.RestartPolicy_ = p
+}
+
+func (c *Container) RestartCount() int32 {
+	return c.RestartCount_
+}
+
+// ManuallyStopped 容器是否由 StopContainer 停止,手动停止的容器不再被重启
+func (c *Container) ManuallyStopped() bool {
+	return c.ManuallyStopped_
+}
+
+func (c *Container) SetManuallyStopped(stopped bool) {
+	c.ManuallyStopped_ = stopped
+}
+
+func (c *Container) LastExitCode() int32 {
+	return c.LastExitCode_
+}
+
+func (c *Container) LastFinishedAt() string {
+	return c.LastFinishedAt_
+}
+
+func (c *Container) LastFinishedAtNano() int64 {
+	if c.LastFinishedAt_ == "" {
+		return 0
+	}
+	return unixNanoTime(c.LastFinishedAt())
+}
+
+// ResetForRestart 记录上一次运行的退出信息,清空运行时间戳并增加重启次数
+func (c *Container) ResetForRestart() {
+	c.LastExitCode_ = c.ExitCode_
+	c.LastFinishedAt_ = c.FinishedAt_
+	c.ExitCode_ = 0
+	c.Reason_ = ""
+	c.Message_ = ""
+	c.ShimPid_ = 0
+	c.StartedAt_ = ""
+	c.FinishedAt_ = ""
+	c.RestartCount_++
+	c.Liveness_ = ProbeState{}
+	c.Readiness_ = ProbeState{}
+}
+
+func (c *Container) LivenessProbe() *Probe {
+	return c.LivenessProbe_
+}
+
+func (c *Container) ReadinessProbe() *Probe {
+	return c.ReadinessProbe_
+}
+
+// LivenessAction liveness 探针失败后的处理方式,默认 restart
+func (c *Container) LivenessAction() string {
+	if c.LivenessAction_ == "" {
+		return LivenessActionRestart
+	}
+	return c.LivenessAction_
+}
+
+func (c *Container) SetProbes(liveness *Probe, readiness *Probe, livenessAction string) error {
+	for _, p := range []*Probe{liveness, readiness} {
+		if p == nil {
+			continue
+		}
+		if err := p.Validate(); err != nil {
+			return err
+		}
+	}
+	switch livenessAction {
+	case "", LivenessActionRestart, LivenessActionKill:
+	default:
+		return errors.New("Unknown liveness action " + livenessAction)
+	}
+	c.LivenessProbe_ = liveness
+	c.ReadinessProbe_ = readiness
+	c.LivenessAction_ = livenessAction
+	return nil
+}
+
+func (c *Container) Liveness() ProbeState {
+	return c.Liveness_
+}
+
+func (c *Container) Readiness() ProbeState {
+	return c.Readiness_
+}
+
+// RecordProbeResult 记录一次探针结果,返回更新后的状态
+// 连续失败次数达到 FailureThreshold 后状态变为 unhealthy,一次成功即恢复 healthy
+func (c *Container) RecordProbeResult(liveness bool, ok bool, message string, at time.Time) ProbeState {
+	state, probe := &c.Readiness_, c.ReadinessProbe_
+	if liveness {
+		state, probe = &c.Liveness_, c.LivenessProbe_
+	}
+	state.LastAt = at.Format(timeFormat)
+	state.Message = message
+	if ok {
+		state.Failures = 0
+		state.Status = HealthHealthy
+		return *state
+	}
+	state.Failures++
+	if probe != nil && state.Failures >= probe.FailureThreshold {
+		state.Status = HealthUnhealthy
+	}
+	return *state
+}
+
 func (c *Container) MarshalJSON() ([]byte, error) {
 	return json.Marshal(c.Impl)
 }
@@ -0,0 +1,40 @@
+package container
+
+import (
+	"errors"
+	"github.com/tluo-github/cri-impl/pkg/logdriver"
+)
+
+// LogPolicy 容器日志的轮转策略
+type LogPolicy struct {
+	// MaxSize 日志文件超过该大小(字节)后轮转, 0 表示不轮转
+	MaxSize int64 `json:"maxSize,omitempty"`
+	// MaxFiles 最多保留的日志文件数(包含当前文件)
+	MaxFiles int32 `json:"maxFiles,omitempty"`
+	// Driver 日志驱动,除 file 以外的驱动由守护进程读取日志文件并转发
+	Driver logdriver.Config `json:"driver,omitempty"`
+}
+
+// WithDefaults 未设置的字段使用 defaults 中的值
+func (p LogPolicy) WithDefaults(defaults LogPolicy) LogPolicy {
+	if p.MaxSize == 0 {
+		p.MaxSize = defaults.MaxSize
+	}
+	if p.MaxFiles == 0 {
+		p.MaxFiles = defaults.MaxFiles
+	}
+	if p.Driver.Type == "" {
+		p.Driver = defaults.Driver
+	}
+	return p
+}
+
+func (p LogPolicy) Validate() error {
+	if p.MaxSize < 0 {
+		return errors.New("Log max size must not be negative")
+	}
+	if p.MaxFiles < 0 {
+		return errors.New("Log max files must not be negative")
+	}
+	return p.Driver.Validate()
+}
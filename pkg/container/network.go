@@ -0,0 +1,47 @@
+package container
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// 容器网络模式
+const (
+	// NetworkNone 容器只有 loopback 网络
+	NetworkNone = "none"
+	// NetworkBridge 容器通过 veth 连接到守护进程管理的 Linux bridge
+	NetworkBridge = "bridge"
+	// NetworkCNI 由 CNI 插件配置容器的网络
+	NetworkCNI = "cni"
+)
+
+// NetworkStatus 容器的网络, 保存在容器状态中, restore 时用于恢复网络命名空间和释放地址
+type NetworkStatus struct {
+	Mode string `json:"mode"`
+	// Namespace 网络命名空间的路径, 写入 spec 的 linux.namespaces
+	Namespace string `json:"namespace"`
+	// Interface 容器内的网卡
+	Interface string `json:"interface"`
+	// HostInterface 主机一侧的 veth
+	HostInterface string `json:"hostInterface,omitempty"`
+	// IP 容器的地址 (CIDR), 如 10.88.0.2/16
+	IP      string `json:"ip"`
+	Gateway string `json:"gateway"`
+	MAC     string `json:"mac,omitempty"`
+	// IPs 容器的所有地址 (CIDR), 第一个与 IP 相同
+	IPs []string `json:"ips,omitempty"`
+	// Name CNI 网络的名称
+	Name string `json:"name,omitempty"`
+	// CNIResult CNI ADD 的结果, DEL 和 CHECK 时作为 prevResult 传给插件
+	CNIResult json.RawMessage `json:"cniResult,omitempty"`
+}
+
+// ValidateNetworkMode 检查网络模式, 空字符串表示守护进程的默认值
+func ValidateNetworkMode(mode string) error {
+	switch mode {
+	case "", NetworkNone, NetworkBridge, NetworkCNI:
+		return nil
+	}
+	return errors.New(fmt.Sprintf("Unknown network mode %q, expected %s, %s or %s", mode, NetworkNone, NetworkBridge, NetworkCNI))
+}
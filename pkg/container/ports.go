@@ -0,0 +1,143 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// 端口映射的协议
+const (
+	ProtocolTCP = "tcp"
+	ProtocolUDP = "udp"
+)
+
+// 发布端口的方式
+const (
+	// PortBackendIPTables iptables DNAT 规则把主机端口转发到容器的地址, 需要 root 和 bridge 或 cni 网络
+	PortBackendIPTables = "iptables"
+	// PortBackendProxy 用户态代理进程在主机端口上接受连接并转发到容器
+	PortBackendProxy = "proxy"
+)
+
+// PortMapping 发布到主机的容器端口
+type PortMapping struct {
+	// HostIP 监听的主机地址, 为空时监听所有地址
+	HostIP        string `json:"hostIP,omitempty"`
+	HostPort      uint16 `json:"hostPort"`
+	ContainerPort uint16 `json:"containerPort"`
+	Protocol      string `json:"protocol"`
+}
+
+// PublishedPorts 已经发布的端口, 容器停止或删除时释放
+type PublishedPorts struct {
+	Backend string `json:"backend"`
+	// IP 转发到的容器地址, 为空时代理进程在自己创建的网络命名空间中转发到 127.0.0.1
+	IP string `json:"ip,omitempty"`
+	// ProxyPid 用户态代理进程的 pid
+	ProxyPid int `json:"proxyPid,omitempty"`
+	// NetworkNamespace UserNamespace 代理进程创建的命名空间, 写入 spec 的 linux.namespaces
+	NetworkNamespace string `json:"networkNamespace,omitempty"`
+	UserNamespace    string `json:"userNamespace,omitempty"`
+}
+
+// ParsePortMapping 解析 [hostIP:]hostPort:containerPort[/protocol], 协议默认为 tcp
+func ParsePortMapping(s string) (PortMapping, error) {
+	p := PortMapping{Protocol: ProtocolTCP}
+	spec := s
+	if i := strings.LastIndex(spec, "/"); i >= 0 {
+		p.Protocol, spec = strings.ToLower(spec[i+1:]), spec[:i]
+	}
+	parts := strings.Split(spec, ":")
+	switch len(parts) {
+	case 2:
+	case 3:
+		p.HostIP, parts = parts[0], parts[1:]
+	default:
+		return p, errors.New(fmt.Sprintf("Invalid port mapping %q, expected [hostIP:]hostPort:containerPort[/protocol]", s))
+	}
+	ports := make([]uint16, 2)
+	for i, v := range parts {
+		n, err := strconv.ParseUint(v, 10, 16)
+		if err != nil {
+			return p, errors.New(fmt.Sprintf("Invalid port %q in port mapping %q", v, s))
+		}
+		ports[i] = uint16(n)
+	}
+	p.HostPort, p.ContainerPort = ports[0], ports[1]
+	return p, p.Validate()
+}
+
+func (p PortMapping) String() string {
+	s := fmt.Sprintf("%d:%d/%s", p.HostPort, p.ContainerPort, p.Protocol)
+	if p.HostIP != "" {
+		s = p.HostIP + ":" + s
+	}
+	return s
+}
+
+// HostAddress 监听的主机地址和端口, 如 0.0.0.0:8080
+func (p PortMapping) HostAddress() string {
+	ip := p.HostIP
+	if ip == "" {
+		ip = "0.0.0.0"
+	}
+	return net.JoinHostPort(ip, strconv.Itoa(int(p.HostPort)))
+}
+
+func (p PortMapping) Validate() error {
+	if p.Protocol != ProtocolTCP && p.Protocol != ProtocolUDP {
+		return errors.New(fmt.Sprintf("Unsupported protocol %q in port mapping %s, expected %s or %s", p.Protocol, p, ProtocolTCP, ProtocolUDP))
+	}
+	if p.HostPort == 0 || p.ContainerPort == 0 {
+		return errors.New(fmt.Sprintf("Invalid port mapping %s, ports must be between 1 and 65535", p))
+	}
+	if p.HostIP != "" {
+		if ip := net.ParseIP(p.HostIP); ip == nil || ip.To4() == nil {
+			return errors.New(fmt.Sprintf("Invalid host IP %q in port mapping %s, expected an IPv4 address", p.HostIP, p))
+		}
+	}
+	return nil
+}
+
+// Conflicts 两个映射是否占用同一个主机端口, 监听所有地址时与该端口的任何映射冲突
+func (p PortMapping) Conflicts(o PortMapping) bool {
+	if p.Protocol != o.Protocol || p.HostPort != o.HostPort {
+		return false
+	}
+	return p.HostIP == "" || o.HostIP == "" || net.ParseIP(p.HostIP).Equal(net.ParseIP(o.HostIP))
+}
+
+// ValidatePortMappings 检查每个映射以及映射之间是否占用同一个主机端口
+func ValidatePortMappings(ports []PortMapping) error {
+	for i, p := range ports {
+		if err := p.Validate(); err != nil {
+			return err
+		}
+		for _, o := range ports[:i] {
+			if p.Conflicts(o) {
+				return errors.New(fmt.Sprintf("Port mappings %s and %s use the same host port", o, p))
+			}
+		}
+	}
+	return nil
+}
+
+// IPv4 容器的第一个 IPv4 地址, 没有时返回 nil
+func (n *NetworkStatus) IPv4() net.IP {
+	if n == nil {
+		return nil
+	}
+	for _, addr := range append([]string{n.IP}, n.IPs...) {
+		ip, _, err := net.ParseCIDR(addr)
+		if err != nil {
+			ip = net.ParseIP(addr)
+		}
+		if ip != nil && ip.To4() != nil {
+			return ip.To4()
+		}
+	}
+	return nil
+}
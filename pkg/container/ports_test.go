@@ -0,0 +1,116 @@
+package container
+
+import (
+	"testing"
+)
+
+func TestParsePortMapping(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		want PortMapping
+		err  bool
+	}{
+		{s: "8080:80", want: PortMapping{HostPort: 8080, ContainerPort: 80, Protocol: ProtocolTCP}},
+		{s: "53:5353/udp", want: PortMapping{HostPort: 53, ContainerPort: 5353, Protocol: ProtocolUDP}},
+		{s: "127.0.0.1:8080:80/TCP", want: PortMapping{HostIP: "127.0.0.1", HostPort: 8080, ContainerPort: 80, Protocol: ProtocolTCP}},
+		{s: "80", err: true},
+		{s: "1:2:3:4", err: true},
+		{s: "8080:80/sctp", err: true},
+		{s: "0:80", err: true},
+		{s: "8080:0", err: true},
+		{s: "65536:80", err: true},
+		{s: "-1:80", err: true},
+		{s: "http:80", err: true},
+		{s: "localhost:8080:80", err: true},
+		{s: "::1:8080:80", err: true},
+	} {
+		p, err := ParsePortMapping(tc.s)
+		if tc.err {
+			if err == nil {
+				t.Errorf("ParsePortMapping(%q) = %+v, want error", tc.s, p)
+			}
+			continue
+		}
+		if err != nil || p != tc.want {
+			t.Errorf("ParsePortMapping(%q) = %+v, %v, want %+v", tc.s, p, err, tc.want)
+		}
+		// String 的结果可以再次解析
+		if again, err := ParsePortMapping(p.String()); err != nil || again != p {
+			t.Errorf("ParsePortMapping(%q) = %+v, %v, want %+v", p.String(), again, err, p)
+		}
+	}
+}
+
+func TestPortMappingValidate(t *testing.T) {
+	for _, tc := range []struct {
+		p   PortMapping
+		err bool
+	}{
+		{p: PortMapping{HostPort: 1, ContainerPort: 65535, Protocol: ProtocolTCP}},
+		{p: PortMapping{HostIP: "10.0.0.1", HostPort: 80, ContainerPort: 80, Protocol: ProtocolUDP}},
+		{p: PortMapping{HostPort: 80, ContainerPort: 80}, err: true},
+		{p: PortMapping{HostPort: 0, ContainerPort: 80, Protocol: ProtocolTCP}, err: true},
+		{p: PortMapping{HostPort: 80, ContainerPort: 0, Protocol: ProtocolTCP}, err: true},
+		{p: PortMapping{HostIP: "fd00::1", HostPort: 80, ContainerPort: 80, Protocol: ProtocolTCP}, err: true},
+		{p: PortMapping{HostIP: "host", HostPort: 80, ContainerPort: 80, Protocol: ProtocolTCP}, err: true},
+	} {
+		if err := tc.p.Validate(); (err != nil) != tc.err {
+			t.Errorf("Validate(%+v) = %v, want error %v", tc.p, err, tc.err)
+		}
+	}
+}
+
+func TestPortMappingConflicts(t *testing.T) {
+	tcp := func(ip string, port uint16) PortMapping {
+		return PortMapping{HostIP: ip, HostPort: port, ContainerPort: 80, Protocol: ProtocolTCP}
+	}
+	udp := tcp("", 8080)
+	udp.Protocol = ProtocolUDP
+	for _, tc := range []struct {
+		a, b PortMapping
+		want bool
+	}{
+		{tcp("", 8080), tcp("", 8080), true},
+		// 监听所有地址时与任何地址冲突
+		{tcp("", 8080), tcp("127.0.0.1", 8080), true},
+		{tcp("127.0.0.1", 8080), tcp("", 8080), true},
+		{tcp("127.0.0.1", 8080), tcp("127.0.0.1", 8080), true},
+		{tcp("127.0.0.1", 8080), tcp("10.0.0.1", 8080), false},
+		{tcp("", 8080), tcp("", 8081), false},
+		// 不同的协议不冲突
+		{tcp("", 8080), udp, false},
+	} {
+		if got := tc.a.Conflicts(tc.b); got != tc.want {
+			t.Errorf("%s.Conflicts(%s) = %v, want %v", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
+
+func TestValidatePortMappings(t *testing.T) {
+	parse := func(specs ...string) []PortMapping {
+		var ports []PortMapping
+		for _, s := range specs {
+			p, err := ParsePortMapping(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ports = append(ports, p)
+		}
+		return ports
+	}
+	for _, tc := range []struct {
+		ports []PortMapping
+		err   bool
+	}{
+		{ports: nil},
+		{ports: parse("8080:80", "8443:443", "8080:80/udp")},
+		{ports: parse("127.0.0.1:8080:80", "10.0.0.1:8080:81")},
+		{ports: parse("8080:80", "8080:81"), err: true},
+		{ports: parse("127.0.0.1:8080:80", "8080:81"), err: true},
+		{ports: []PortMapping{{HostPort: 8080, ContainerPort: 80, Protocol: "icmp"}}, err: true},
+	} {
+		if err := ValidatePortMappings(tc.ports); (err != nil) != tc.err {
+			t.Errorf("ValidatePortMappings(%v) = %v, want error %v", tc.ports, err, tc.err)
+		}
+	}
+}
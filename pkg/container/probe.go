@@ -0,0 +1,103 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	ProbeExec = "exec"
+	ProbeTCP  = "tcp"
+	ProbeHTTP = "http"
+)
+
+const (
+	// LivenessActionRestart liveness 失败后强杀并重启容器
+	LivenessActionRestart = "restart"
+	// LivenessActionKill liveness 失败后仅强杀容器,是否重启由重启策略决定
+	LivenessActionKill = "kill"
+)
+
+const (
+	defaultProbePeriodSeconds    = 10
+	defaultProbeTimeoutSeconds   = 1
+	defaultProbeFailureThreshold = 3
+)
+
+// Probe 由守护进程执行的容器健康检查
+type Probe struct {
+	Kind string `json:"kind"`
+	// Command exec 探针在容器内执行的命令
+	Command []string `json:"command,omitempty"`
+	// Port tcp/http 探针在容器网络命名空间内连接的端口
+	Port int32 `json:"port,omitempty"`
+	// Path http 探针请求的路径
+	Path string `json:"path,omitempty"`
+
+	InitialDelaySeconds int32 `json:"initialDelaySeconds,omitempty"`
+	PeriodSeconds       int32 `json:"periodSeconds"`
+	TimeoutSeconds      int32 `json:"timeoutSeconds"`
+	FailureThreshold    int32 `json:"failureThreshold"`
+}
+
+// Validate 检查探针参数并填充默认值
+func (p *Probe) Validate() error {
+	switch p.Kind {
+	case ProbeExec:
+		if len(p.Command) == 0 {
+			return errors.New("exec probe requires a command")
+		}
+	case ProbeTCP, ProbeHTTP:
+		if p.Port <= 0 || p.Port > 65535 {
+			return errors.New(fmt.Sprintf("Invalid %s probe port %d", p.Kind, p.Port))
+		}
+		if p.Kind == ProbeHTTP && p.Path == "" {
+			p.Path = "/"
+		}
+	default:
+		return errors.New(fmt.Sprintf("Unknown probe kind %q", p.Kind))
+	}
+	if p.InitialDelaySeconds < 0 || p.PeriodSeconds < 0 || p.TimeoutSeconds < 0 || p.FailureThreshold < 0 {
+		return errors.New("probe durations and thresholds must not be negative")
+	}
+	if p.PeriodSeconds == 0 {
+		p.PeriodSeconds = defaultProbePeriodSeconds
+	}
+	if p.TimeoutSeconds == 0 {
+		p.TimeoutSeconds = defaultProbeTimeoutSeconds
+	}
+	if p.FailureThreshold == 0 {
+		p.FailureThreshold = defaultProbeFailureThreshold
+	}
+	return nil
+}
+
+type HealthStatus string
+
+const (
+	HealthUnknown   HealthStatus = "unknown"
+	HealthHealthy   HealthStatus = "healthy"
+	HealthUnhealthy HealthStatus = "unhealthy"
+)
+
+// ProbeState 探针最近一次的执行结果
+type ProbeState struct {
+	Status   HealthStatus `json:"status,omitempty"`
+	Failures int32        `json:"failures,omitempty"`
+	LastAt   string       `json:"lastAt,omitempty"`
+	Message  string       `json:"message,omitempty"`
+}
+
+func (s ProbeState) LastAtNano() int64 {
+	if s.LastAt == "" {
+		return 0
+	}
+	return unixNanoTime(s.LastAt)
+}
+
+func (s ProbeState) StatusOrUnknown() HealthStatus {
+	if s.Status == "" {
+		return HealthUnknown
+	}
+	return s.Status
+}
@@ -0,0 +1,37 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+)
+
+// DefaultCPUPeriod CFS 调度周期 (微秒), CPU 限制按该周期换算为 quota
+const DefaultCPUPeriod = 100000
+
+// Resources 容器的 cgroup 资源限制, 0 表示不限制
+type Resources struct {
+	// MemoryLimit 内存上限 (字节)
+	MemoryLimit int64 `json:"memoryLimit,omitempty"`
+	// CPUMilli CPU 上限, 以千分之一核为单位, 如 1500 表示 1.5 核
+	CPUMilli int64 `json:"cpuMilli,omitempty"`
+	// PidsLimit 最大进程数
+	PidsLimit int64 `json:"pidsLimit,omitempty"`
+}
+
+func (r Resources) Validate() error {
+	if r.MemoryLimit < 0 {
+		return errors.New(fmt.Sprintf("Memory limit must not be negative, got %d", r.MemoryLimit))
+	}
+	if r.CPUMilli < 0 {
+		return errors.New(fmt.Sprintf("CPU limit must not be negative, got %dm", r.CPUMilli))
+	}
+	if r.PidsLimit < 0 {
+		return errors.New(fmt.Sprintf("Pids limit must not be negative, got %d", r.PidsLimit))
+	}
+	return nil
+}
+
+// CPUQuota 返回 DefaultCPUPeriod 周期内可使用的 CPU 时间 (微秒)
+func (r Resources) CPUQuota() int64 {
+	return r.CPUMilli * DefaultCPUPeriod / 1000
+}
@@ -0,0 +1,68 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	RestartNo        = "no"
+	RestartOnFailure = "on-failure"
+	RestartAlways    = "always"
+)
+
+// RestartPolicy 容器退出后守护进程的重启策略
+// 格式: no | on-failure[:max] | always
+type RestartPolicy struct {
+	Name string `json:"name"`
+	// MaxRetries 仅对 on-failure 生效,0 表示不限制
+	MaxRetries int32 `json:"maxRetries,omitempty"`
+}
+
+func ParseRestartPolicy(s string) (RestartPolicy, error) {
+	if s == "" {
+		return RestartPolicy{Name: RestartNo}, nil
+	}
+	parts := strings.SplitN(s, ":", 2)
+	switch parts[0] {
+	case RestartNo, RestartAlways:
+		if len(parts) > 1 {
+			return RestartPolicy{}, errors.New(fmt.Sprintf("Restart policy %q does not accept max retries", parts[0]))
+		}
+		return RestartPolicy{Name: parts[0]}, nil
+	case RestartOnFailure:
+		p := RestartPolicy{Name: RestartOnFailure}
+		if len(parts) > 1 {
+			max, err := strconv.ParseInt(parts[1], 10, 32)
+			if err != nil || max < 0 {
+				return RestartPolicy{}, errors.New(fmt.Sprintf("Invalid restart max retries %q", parts[1]))
+			}
+			p.MaxRetries = int32(max)
+		}
+		return p, nil
+	}
+	return RestartPolicy{}, errors.New(fmt.Sprintf("Unknown restart policy %q", s))
+}
+
+// ShouldRestart 根据退出码和已重启次数判断是否需要重启
+func (p RestartPolicy) ShouldRestart(exitCode int32, restartCount int32) bool {
+	switch p.Name {
+	case RestartAlways:
+		return true
+	case RestartOnFailure:
+		return exitCode != 0 && (p.MaxRetries == 0 || restartCount < p.MaxRetries)
+	}
+	return false
+}
+
+func (p RestartPolicy) String() string {
+	if p.Name == "" {
+		return RestartNo
+	}
+	if p.Name == RestartOnFailure && p.MaxRetries > 0 {
+		return fmt.Sprintf("%s:%d", p.Name, p.MaxRetries)
+	}
+	return p.Name
+}
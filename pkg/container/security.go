@@ -0,0 +1,137 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// seccomp profile 名称, 与 CRI 的 SecurityProfile 相同
+const (
+	// SeccompRuntimeDefault 内置的默认 profile, 与 Docker 的默认 profile 相同
+	SeccompRuntimeDefault = "runtime/default"
+	// SeccompUnconfined 不使用 seccomp
+	SeccompUnconfined = "unconfined"
+	// SeccompLocalhostPrefix localhost/<路径>, seccomp profile 目录中 OCI 格式 (linux.seccomp) 的 profile 文件
+	// 路径相对于 profile 目录, 绝对路径必须在 profile 目录中
+	SeccompLocalhostPrefix = "localhost/"
+	// SeccompCustom 只出现在 SecurityProfile 中: spec 模板, patch 或插件直接修改了 linux.seccomp
+	SeccompCustom = "custom"
+)
+
+// CapabilityAll 在 CapAdd/CapDrop 中表示所有 capability
+const CapabilityAll = "ALL"
+
+// DefaultCapabilities 容器默认的 capability, 与 Docker 相同
+var DefaultCapabilities = []string{
+	"CAP_CHOWN",
+	"CAP_DAC_OVERRIDE",
+	"CAP_FSETID",
+	"CAP_FOWNER",
+	"CAP_MKNOD",
+	"CAP_NET_RAW",
+	"CAP_SETGID",
+	"CAP_SETUID",
+	"CAP_SETFCAP",
+	"CAP_SETPCAP",
+	"CAP_NET_BIND_SERVICE",
+	"CAP_SYS_CHROOT",
+	"CAP_KILL",
+	"CAP_AUDIT_WRITE",
+}
+
+// DefaultMaskedPaths 容器中默认被屏蔽的路径, 与 Docker 相同
+var DefaultMaskedPaths = []string{
+	"/proc/acpi",
+	"/proc/asound",
+	"/proc/kcore",
+	"/proc/keys",
+	"/proc/latency_stats",
+	"/proc/timer_list",
+	"/proc/timer_stats",
+	"/proc/sched_debug",
+	"/proc/scsi",
+	"/sys/firmware",
+}
+
+// DefaultReadonlyPaths 容器中默认只读的路径, 与 Docker 相同
+var DefaultReadonlyPaths = []string{
+	"/proc/bus",
+	"/proc/fs",
+	"/proc/irq",
+	"/proc/sys",
+	"/proc/sysrq-trigger",
+}
+
+// SecurityOptions 创建容器时或守护进程配置的安全选项, 空值表示使用默认值
+type SecurityOptions struct {
+	// Privileged 所有 capability, 不使用 seccomp, 不屏蔽路径, /sys 可写
+	Privileged bool `json:"privileged,omitempty"`
+	// CapAdd CapDrop 在默认 capability 上添加和删除, 可以使用 ALL, 名称可以省略 CAP_ 前缀
+	CapAdd  []string `json:"capAdd,omitempty"`
+	CapDrop []string `json:"capDrop,omitempty"`
+	// NoNewPrivileges 为 nil 时使用守护进程的默认值
+	NoNewPrivileges *bool `json:"noNewPrivileges,omitempty"`
+	// Seccomp runtime/default, unconfined 或 localhost/<path>, 为空时使用守护进程的默认值
+	Seccomp string `json:"seccomp,omitempty"`
+	// MaskedPaths ReadonlyPaths 在默认值之外额外屏蔽和只读的路径
+	MaskedPaths   []string `json:"maskedPaths,omitempty"`
+	ReadonlyPaths []string `json:"readonlyPaths,omitempty"`
+}
+
+// SecurityProfile 容器实际生效的安全配置, 保存在容器状态中
+// 从应用 spec 模板, patch 和插件之后的最终 spec 中读取
+type SecurityProfile struct {
+	// Privileged 拥有所有 capability, 不使用 seccomp 并且没有屏蔽和只读的路径
+	Privileged bool `json:"privileged"`
+	// Capabilities 容器进程的 bounding capability
+	Capabilities    []string `json:"capabilities"`
+	NoNewPrivileges bool     `json:"noNewPrivileges"`
+	Seccomp         string   `json:"seccomp"`
+	MaskedPaths     []string `json:"maskedPaths"`
+	ReadonlyPaths   []string `json:"readonlyPaths"`
+}
+
+// Validate 检查 seccomp profile 名称和路径, capability 名称在 oci.ResolveSecurity 中检查
+func (o SecurityOptions) Validate() error {
+	if err := ValidateSeccomp(o.Seccomp); err != nil {
+		return err
+	}
+	for _, p := range append(append([]string{}, o.MaskedPaths...), o.ReadonlyPaths...) {
+		if !filepath.IsAbs(p) {
+			return errors.New(fmt.Sprintf("Masked and readonly paths must be absolute, got %q", p))
+		}
+	}
+	return nil
+}
+
+// ValidateSeccomp 检查 seccomp profile 名称, 空字符串表示默认值
+func ValidateSeccomp(name string) error {
+	switch {
+	case name == "", name == SeccompRuntimeDefault, name == SeccompUnconfined:
+		return nil
+	case strings.HasPrefix(name, SeccompLocalhostPrefix):
+		path := strings.TrimPrefix(name, SeccompLocalhostPrefix)
+		if path == "" || path == "/" {
+			return errors.New(fmt.Sprintf("Seccomp profile %q must be localhost/<path>", name))
+		}
+		for _, elem := range strings.Split(filepath.ToSlash(path), "/") {
+			if elem == ".." {
+				return errors.New(fmt.Sprintf("Seccomp profile %q must not contain ..", name))
+			}
+		}
+		return nil
+	}
+	return errors.New(fmt.Sprintf("Unknown seccomp profile %q, expected %s, %s or %s<path>",
+		name, SeccompRuntimeDefault, SeccompUnconfined, SeccompLocalhostPrefix))
+}
+
+// NormalizeCapability 转换为大写并补全 CAP_ 前缀, ALL 保持不变
+func NormalizeCapability(c string) string {
+	c = strings.ToUpper(strings.TrimSpace(c))
+	if c == CapabilityAll || strings.HasPrefix(c, "CAP_") {
+		return c
+	}
+	return "CAP_" + c
+}
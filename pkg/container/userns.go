@@ -0,0 +1,96 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// IDMapping 容器内 [ContainerID, ContainerID+Size) 映射到主机的 [HostID, HostID+Size)
+type IDMapping struct {
+	ContainerID uint32 `json:"containerID"`
+	HostID      uint32 `json:"hostID"`
+	Size        uint32 `json:"size"`
+}
+
+// UserNamespace 容器的 uid/gid 映射
+type UserNamespace struct {
+	UIDMappings []IDMapping `json:"uidMappings"`
+	GIDMappings []IDMapping `json:"gidMappings"`
+}
+
+// UserNamespaceOptions 创建容器时的用户命名空间选项
+type UserNamespaceOptions struct {
+	// Auto 从 /etc/subuid 和 /etc/subgid 分配与其他容器不重叠的范围, 容器的 0 映射到范围的起点
+	Auto bool
+	// Size 自动分配的大小, 0 使用守护进程的默认值
+	Size uint32
+	// UIDMappings GIDMappings 指定的映射, GIDMappings 为空时与 UIDMappings 相同
+	UIDMappings []IDMapping
+	GIDMappings []IDMapping
+}
+
+// Enabled 是否使用用户命名空间
+func (o UserNamespaceOptions) Enabled() bool {
+	return o.Auto || len(o.UIDMappings) > 0 || len(o.GIDMappings) > 0
+}
+
+func (o UserNamespaceOptions) Validate() error {
+	if o.Auto && (len(o.UIDMappings) > 0 || len(o.GIDMappings) > 0) {
+		return errors.New("Automatic user namespace allocation can't be combined with explicit mappings")
+	}
+	if !o.Auto && o.Size > 0 {
+		return errors.New("User namespace size only applies to automatic allocation")
+	}
+	if !o.Auto && len(o.UIDMappings) == 0 && len(o.GIDMappings) > 0 {
+		return errors.New("GID mappings require UID mappings")
+	}
+	return nil
+}
+
+// Validate 检查映射的大小, 溢出以及同一个列表中容器和主机范围的重叠, 容器的 root 必须被映射
+func (ns UserNamespace) Validate() error {
+	for _, list := range []struct {
+		kind     string
+		mappings []IDMapping
+	}{{"uid", ns.UIDMappings}, {"gid", ns.GIDMappings}} {
+		if len(list.mappings) == 0 {
+			return errors.New(fmt.Sprintf("No %s mappings", list.kind))
+		}
+		for i, m := range list.mappings {
+			if m.Size == 0 {
+				return errors.New(fmt.Sprintf("Invalid %s mapping %s: size must be positive", list.kind, m))
+			}
+			if uint64(m.ContainerID)+uint64(m.Size) > math.MaxUint32 || uint64(m.HostID)+uint64(m.Size) > math.MaxUint32 {
+				return errors.New(fmt.Sprintf("Invalid %s mapping %s: range overflows", list.kind, m))
+			}
+			for _, other := range list.mappings[:i] {
+				if overlaps(m.ContainerID, m.Size, other.ContainerID, other.Size) || overlaps(m.HostID, m.Size, other.HostID, other.Size) {
+					return errors.New(fmt.Sprintf("Invalid %s mapping %s: overlaps with %s", list.kind, m, other))
+				}
+			}
+		}
+		if _, ok := HostID(list.mappings, 0); !ok {
+			return errors.New(fmt.Sprintf("The %s mappings must map container root (0)", list.kind))
+		}
+	}
+	return nil
+}
+
+func (m IDMapping) String() string {
+	return fmt.Sprintf("%d:%d:%d", m.ContainerID, m.HostID, m.Size)
+}
+
+// HostID 容器内的 id 对应的主机 id
+func HostID(mappings []IDMapping, id uint32) (uint32, bool) {
+	for _, m := range mappings {
+		if id >= m.ContainerID && uint64(id) < uint64(m.ContainerID)+uint64(m.Size) {
+			return m.HostID + (id - m.ContainerID), true
+		}
+	}
+	return 0, false
+}
+
+func overlaps(a, asize, b, bsize uint32) bool {
+	return uint64(a) < uint64(b)+uint64(bsize) && uint64(b) < uint64(a)+uint64(asize)
+}
@@ -0,0 +1,88 @@
+package cri
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/tluo-github/cri-impl/pkg/container"
+	"github.com/tluo-github/cri-impl/pkg/oci"
+)
+
+// ErrorCode RuntimeService 错误的分类,由 gRPC 层转换为对应的 status code
+type ErrorCode int
+
+const (
+	ErrUnknown ErrorCode = iota
+	ErrInvalidArgument
+	ErrNotFound
+	ErrAlreadyExists
+	// ErrFailedPrecondition 容器当前的状态不允许该操作
+	ErrFailedPrecondition
+	// ErrDeadlineExceeded 等待 shim 或容器超时
+	ErrDeadlineExceeded
+	// ErrInternal runc 或 shim 执行失败
+	ErrInternal
+	ErrUnimplemented
+	// ErrPermissionDenied 调用方的访问级别不允许该选项
+	ErrPermissionDenied
+)
+
+// Error 带有分类的错误
+type Error struct {
+	Code    ErrorCode
+	Message string
+	// Details 附加的诊断信息,如 runc 的 stderr
+	Details string
+	// Err 原始错误,可以为 nil
+	Err error
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Errorf 创建一个分类错误
+func Errorf(code ErrorCode, format string, args ...interface{}) error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// WrapError 为 err 添加分类和说明, err 为 nil 时返回 nil
+func WrapError(code ErrorCode, err error, format string, args ...interface{}) error {
+	if err == nil {
+		return nil
+	}
+	e := &Error{Code: code, Message: fmt.Sprintf(format, args...), Err: err}
+	var rerr *oci.RuntimeError
+	if errors.As(err, &rerr) {
+		e.Details = rerr.Stderr
+	}
+	return e
+}
+
+// Classify 返回 err 的分类和附加信息
+// 未分类的 runc 执行错误视为 ErrInternal, 超时视为 ErrDeadlineExceeded
+func Classify(err error) (ErrorCode, string) {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code, e.Details
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrDeadlineExceeded, ""
+	}
+	var rerr *oci.RuntimeError
+	if errors.As(err, &rerr) {
+		return ErrInternal, rerr.Stderr
+	}
+	return ErrUnknown, ""
+}
+
+func errContainerNotFound(id container.ID) error {
+	return Errorf(ErrNotFound, "container %s not found", id)
+}
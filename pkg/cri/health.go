@@ -0,0 +1,163 @@
+package cri
+
+import (
+	"context"
+	"fmt"
+	"github.com/tluo-github/cri-impl/pkg/container"
+	"github.com/tluo-github/cri-impl/pkg/oci"
+	"github.com/tluo-github/cri-impl/pkg/probe"
+	"k8s.io/klog"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const probeSuperviseInterval = 1 * time.Second
+
+type probeKey struct {
+	id       container.ID
+	liveness bool
+}
+
+// probeGeneration 标识容器的一次运行
+// StartedAt 只精确到秒,同一秒内的重启由重启次数区分
+type probeGeneration struct {
+	startedAt int64
+	restarts  int32
+}
+
+func generationOf(c *container.Container) probeGeneration {
+	return probeGeneration{startedAt: c.StartedAtNano(), restarts: c.RestartCount()}
+}
+
+// probeSchedule 探针的调度状态,仅在内存中
+type probeSchedule struct {
+	generation probeGeneration
+	nextAt     time.Time
+	inflight   bool
+}
+
+// superviseProbes 周期性的执行到期的 liveness/readiness 探针
+// 探针本身在锁外并发执行,执行结果在锁内写回容器状态
+func (rs *runtimeService) superviseProbes(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-rs.done:
+			return
+		case <-ticker.C:
+		}
+		rs.lock.Lock()
+		rs.scheduleProbesNoLock(context.Background(), time.Now())
+		rs.lock.Unlock()
+	}
+}
+
+func (rs *runtimeService) scheduleProbesNoLock(ctx context.Context, now time.Time) {
+	for _, c := range rs.cmap.All() {
+		for _, key := range []probeKey{{c.ID(), true}, {c.ID(), false}} {
+			p := c.ReadinessProbe()
+			if key.liveness {
+				p = c.LivenessProbe()
+			}
+			if p == nil || c.Status() != container.Running || c.StartedAt() == "" {
+				delete(rs.probes, key)
+				continue
+			}
+
+			// 容器在两次调度之间重启时, 按新的一次运行重新计算初始延迟
+			sched := rs.probes[key]
+			if sched == nil || sched.generation != generationOf(c) {
+				sched = &probeSchedule{
+					generation: generationOf(c),
+					nextAt:     time.Unix(0, c.StartedAtNano()).Add(time.Duration(p.InitialDelaySeconds) * time.Second),
+				}
+				rs.probes[key] = sched
+			}
+			if sched.inflight || now.Before(sched.nextAt) {
+				continue
+			}
+
+			state, err := rs.runtimeOf(c).ContainerState(ctx, c.ID())
+			if err != nil || state.Status != "running" || state.Pid <= 0 {
+				continue
+			}
+			sched.inflight = true
+			sched.nextAt = now.Add(time.Duration(p.PeriodSeconds) * time.Second)
+			go rs.runProbe(ctx, rs.runtimeOf(c), key, sched.generation, *p, state.Pid)
+		}
+	}
+}
+
+// runProbe 执行一次探针, 结果只写回发起探针时的那一次运行
+// 容器在探针执行期间重启时, 丢弃结果, 避免旧实例的慢探针影响新实例的健康状态
+func (rs *runtimeService) runProbe(ctx context.Context, runtime oci.Runtime, key probeKey, gen probeGeneration, p container.Probe, pid int) {
+	ok, msg, err := execProbe(ctx, runtime, key.id, p, pid)
+	if err != nil {
+		ok, msg = false, err.Error()
+	}
+
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+
+	if sched := rs.probes[key]; sched != nil && sched.generation == gen {
+		sched.inflight = false
+	}
+	cont := rs.cmap.Get(key.id)
+	if cont == nil || cont.Status() != container.Running || generationOf(cont) != gen {
+		return
+	}
+	state := cont.RecordProbeResult(key.liveness, ok, msg, time.Now())
+	if err := rs.writeContainerStateNoLock(cont); err != nil {
+		klog.Warningf("failed to save probe result of container %s with err:%v", cont.ID(), err)
+	}
+	if key.liveness && state.Status == container.HealthUnhealthy {
+		rs.handleLivenessFailureNoLock(ctx, cont, state)
+	}
+}
+
+func execProbe(ctx context.Context, runtime oci.Runtime, id container.ID, p container.Probe, pid int) (bool, string, error) {
+	timeout := time.Duration(p.TimeoutSeconds) * time.Second
+	switch p.Kind {
+	case container.ProbeExec:
+		code, output, err := runtime.ExecSync(ctx, id, p.Command, timeout)
+		if err != nil {
+			return false, "", err
+		}
+		msg := strings.TrimSpace(string(output))
+		if code != 0 {
+			return false, fmt.Sprintf("exit code %d: %s", code, msg), nil
+		}
+		return true, msg, nil
+	case container.ProbeTCP:
+		return probe.TCP(pid, p.Port, timeout)
+	case container.ProbeHTTP:
+		return probe.HTTP(pid, p.Port, p.Path, timeout)
+	}
+	return false, "", fmt.Errorf("unknown probe kind %q", p.Kind)
+}
+
+// handleLivenessFailureNoLock 强杀 liveness 失败的容器, 不等待容器退出
+// 重启交给重启监控, 由它在容器退出后按照重启策略的最大重启次数和退避执行
+func (rs *runtimeService) handleLivenessFailureNoLock(ctx context.Context, cont *container.Container, state container.ProbeState) {
+	klog.Warningf("container %s liveness probe failed %d times: %s", cont.ID(), state.Failures, state.Message)
+	delete(rs.probes, probeKey{cont.ID(), true})
+	delete(rs.probes, probeKey{cont.ID(), false})
+
+	if err := rs.runtimeOf(cont).KillContainer(ctx, cont.ID(), syscall.SIGKILL); err != nil {
+		klog.Errorf("failed to kill unhealthy container %s with err:%v", cont.ID(), err)
+		return
+	}
+	if cont.LivenessAction() != container.LivenessActionRestart {
+		// kill: 由重启策略决定后续处理
+		return
+	}
+	st := rs.restarts[cont.ID()]
+	if st == nil {
+		st = &restartState{}
+		rs.restarts[cont.ID()] = st
+	}
+	st.liveness = true
+}
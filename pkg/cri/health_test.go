@@ -0,0 +1,149 @@
+package cri
+
+import (
+	"context"
+	"errors"
+	"github.com/tluo-github/cri-impl/pkg/container"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// execProbeRuntime 的 ExecSync 返回预设的结果
+type execProbeRuntime struct {
+	*stubOCIRuntime
+	code   int
+	output string
+	err    error
+}
+
+func (r *execProbeRuntime) ExecSync(ctx context.Context, id container.ID, cmd []string, timeout time.Duration) (int, []byte, error) {
+	return r.code, []byte(r.output), r.err
+}
+
+func TestExecProbe(t *testing.T) {
+	p := container.Probe{Kind: container.ProbeExec, Command: []string{"check"}, TimeoutSeconds: 1}
+	tests := []struct {
+		name    string
+		runtime *execProbeRuntime
+		ok      bool
+		msg     string
+		err     bool
+	}{
+		{"success", &execProbeRuntime{output: "ready\n"}, true, "ready", false},
+		{"failure", &execProbeRuntime{code: 2, output: "not ready\n"}, false, "exit code 2: not ready", false},
+		{"exec error", &execProbeRuntime{err: errors.New("runc exec failed")}, false, "", true},
+	}
+	for _, tt := range tests {
+		ok, msg, err := execProbe(context.Background(), tt.runtime, "c1", p, 1)
+		if ok != tt.ok || msg != tt.msg || (err != nil) != tt.err {
+			t.Errorf("%s: execProbe() = %v, %q, %v", tt.name, ok, msg, err)
+		}
+	}
+}
+
+// newProbeTestService 创建带有 liveness 探针的运行中容器 c1
+func newProbeTestService(t *testing.T, p *container.Probe) (*runtimeService, *execProbeRuntime, *container.Container) {
+	rs, stub, _ := newPluginTestService(t)
+	runtime := &execProbeRuntime{stubOCIRuntime: stub}
+	rs.runtimes["runc"] = runtime
+	rs.probes = make(map[probeKey]*probeSchedule)
+
+	cont := rs.cmap.Get("c1")
+	if err := cont.SetProbes(p, nil, container.LivenessActionRestart); err != nil {
+		t.Fatal(err)
+	}
+	if err := cont.SetStartedAt(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	return rs, runtime, cont
+}
+
+func TestRunProbeTCP(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("entering a network namespace requires root")
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := int32(l.Addr().(*net.TCPAddr).Port)
+
+	p := &container.Probe{Kind: container.ProbeTCP, Port: port, PeriodSeconds: 1, TimeoutSeconds: 1, FailureThreshold: 1}
+	rs, runtime, cont := newProbeTestService(t, p)
+	key := probeKey{"c1", true}
+
+	// 测试进程的 pid 作为容器, 探针连接测试进程网络命名空间内的监听
+	rs.runProbe(context.Background(), runtime, key, generationOf(cont), *p, os.Getpid())
+	if state := cont.Liveness(); state.Status != container.HealthHealthy {
+		t.Fatalf("liveness = %+v, want healthy", state)
+	}
+
+	l.Close()
+	rs.runProbe(context.Background(), runtime, key, generationOf(cont), *p, os.Getpid())
+	state := cont.Liveness()
+	if state.Status != container.HealthUnhealthy || !strings.Contains(state.Message, "connection refused") {
+		t.Fatalf("liveness = %+v, want unhealthy with connection refused", state)
+	}
+	if runtime.status != "stopped" || rs.restarts["c1"] == nil || !rs.restarts["c1"].liveness {
+		t.Errorf("unhealthy container was not killed for a liveness restart")
+	}
+}
+
+func TestRunProbeDropsStaleResult(t *testing.T) {
+	p := &container.Probe{Kind: container.ProbeExec, Command: []string{"check"}, PeriodSeconds: 1, TimeoutSeconds: 1, FailureThreshold: 1}
+	rs, runtime, cont := newProbeTestService(t, p)
+	runtime.code = 1
+	key := probeKey{"c1", true}
+	stale := generationOf(cont)
+
+	// 探针执行期间容器在同一秒内重启, 新的一次运行已经调度了自己的探针
+	cont.ResetForRestart()
+	if err := cont.SetStartedAt(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	current := &probeSchedule{generation: generationOf(cont), inflight: true}
+	rs.probes[key] = current
+
+	rs.runProbe(context.Background(), runtime, key, stale, *p, 1)
+	if state := cont.Liveness(); state.Status != "" || state.Failures != 0 {
+		t.Errorf("stale result recorded: %+v", state)
+	}
+	if !current.inflight {
+		t.Error("stale result finished the probe of the new instance")
+	}
+	if runtime.status != "running" || rs.restarts["c1"] != nil {
+		t.Error("stale result killed the new instance")
+	}
+
+	rs.runProbe(context.Background(), runtime, key, current.generation, *p, 1)
+	if state := cont.Liveness(); state.Status != container.HealthUnhealthy {
+		t.Errorf("liveness = %+v, want unhealthy", state)
+	}
+	if runtime.status != "stopped" {
+		t.Error("unhealthy container was not killed")
+	}
+}
+
+func TestScheduleProbesAfterRestart(t *testing.T) {
+	p := &container.Probe{Kind: container.ProbeExec, Command: []string{"check"}, InitialDelaySeconds: 30, PeriodSeconds: 1, TimeoutSeconds: 1, FailureThreshold: 1}
+	rs, _, cont := newProbeTestService(t, p)
+	key := probeKey{"c1", true}
+	rs.probes[key] = &probeSchedule{generation: generationOf(cont), inflight: true}
+
+	// 重启发生在两次调度之间, 旧的调度状态不能阻塞新实例的探针, 初始延迟重新计算
+	cont.ResetForRestart()
+	if err := cont.SetStartedAt(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	rs.scheduleProbesNoLock(context.Background(), time.Now())
+	sched := rs.probes[key]
+	if sched.generation != generationOf(cont) || sched.inflight {
+		t.Fatalf("schedule = %+v, want a fresh schedule for the new instance", sched)
+	}
+	if wait := time.Until(sched.nextAt); wait < 29*time.Second {
+		t.Errorf("next probe in %v, want the initial delay", wait)
+	}
+}
@@ -0,0 +1,104 @@
+package cri
+
+import (
+	"context"
+	"github.com/tluo-github/cri-impl/pkg/container"
+	"github.com/tluo-github/cri-impl/pkg/logdriver"
+	"github.com/tluo-github/cri-impl/pkg/logs"
+	"k8s.io/klog"
+	"time"
+)
+
+// startLogForwarderNoLock 对使用非 file 日志驱动的容器,持续读取日志文件并发送到日志驱动
+// 转发在容器的整个生命周期内进行(包括重启),直到容器被删除
+// 驱动的缓冲区满时读取暂停,未发送的日志仍然保存在日志文件中
+func (rs *runtimeService) startLogForwarderNoLock(c *container.Container, since time.Time) {
+	policy := c.LogPolicy().WithDefaults(rs.defaultLogPolicy)
+	if policy.Driver.IsFile() {
+		return
+	}
+	if _, ok := rs.forwarders[c.ID()]; ok {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	rs.forwarders[c.ID()] = cancel
+
+	id, name, path := c.ID(), c.Name(), c.LogPath()
+	rs.forwarding.Add(1)
+	go func() {
+		defer rs.forwarding.Done()
+		driver, err := logdriver.New(ctx, policy.Driver, logdriver.ContainerInfo{ID: string(id), Name: name})
+		if err != nil {
+			klog.Errorf("failed to create %s log driver for container %s with err:%v", policy.Driver.Type, id, err)
+			return
+		}
+		defer driver.Close()
+		forwardLogs(ctx, path, since, driver)
+	}()
+}
+
+// forwardLogs 持续读取 path 中的日志发送到 driver, 读取失败后重试, 直到 ctx 结束
+// 日志文件在容器第一次启动时才由 shim 创建
+func forwardLogs(ctx context.Context, path string, since time.Time, driver logdriver.Driver) {
+	cursor := &logCursor{since: since}
+	for {
+		err := logs.ReadLogs(ctx, path, logs.Options{Follow: true, Since: cursor.resume()}, cursor.wrap(driver.Log))
+		if err == nil || ctx.Err() != nil {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(logForwardRetryInterval):
+		}
+	}
+}
+
+const logForwardRetryInterval = 1 * time.Second
+
+// logCursor 记录已经转发的位置, 重试时从最后转发的日志继续, 不重复发送
+type logCursor struct {
+	since time.Time
+	// last 最后转发的日志的时间戳, count 已经转发的时间戳等于 last 的日志条数
+	last  time.Time
+	count int
+	// skip 本次读取还需要跳过的时间戳等于 last 的日志条数
+	skip int
+}
+
+// resume 返回本次读取使用的 Since
+func (c *logCursor) resume() time.Time {
+	if c.last.IsZero() {
+		return c.since
+	}
+	// Since 包含等于 last 的日志, 其中已经转发的由 skip 跳过
+	c.skip = c.count
+	return c.last
+}
+
+func (c *logCursor) wrap(fn func(*logs.Message) error) func(*logs.Message) error {
+	return func(m *logs.Message) error {
+		if c.skip > 0 && m.Timestamp.Equal(c.last) {
+			c.skip--
+			return nil
+		}
+		c.skip = 0
+		if err := fn(m); err != nil {
+			return err
+		}
+		if m.Timestamp.Equal(c.last) {
+			c.count++
+		} else {
+			c.last, c.count = m.Timestamp, 1
+		}
+		return nil
+	}
+}
+
+func (rs *runtimeService) stopLogForwarderNoLock(id container.ID) {
+	if cancel, ok := rs.forwarders[id]; ok {
+		cancel()
+		delete(rs.forwarders, id)
+	}
+}
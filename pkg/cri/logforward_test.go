@@ -0,0 +1,140 @@
+package cri
+
+import (
+	"bytes"
+	"context"
+	"github.com/tluo-github/cri-impl/pkg/logdriver"
+	"github.com/tluo-github/cri-impl/pkg/logs"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubListener 模拟 fluentd, 记录收到的所有数据
+type stubListener struct {
+	ln   net.Listener
+	lock sync.Mutex
+	data []byte
+}
+
+func newStubListener(t *testing.T) *stubListener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	s := &stubListener{ln: ln}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 4096)
+				for {
+					n, err := conn.Read(buf)
+					s.lock.Lock()
+					s.data = append(s.data, buf[:n]...)
+					s.lock.Unlock()
+					if err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return s
+}
+
+func (s *stubListener) count(log string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return bytes.Count(s.data, []byte(log))
+}
+
+func (s *stubListener) waitFor(t *testing.T, log string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for s.count(log) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("stub listener did not receive %q", log)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func appendLogLines(t *testing.T, path string, ts time.Time, contents ...string) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, c := range contents {
+		if _, err := f.Write(logs.FormatLine(ts, logs.Stdout, false, []byte(c))); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestForwardLogsRetryDoesNotResend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logforward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "container.log")
+
+	stub := newStubListener(t)
+	defer stub.ln.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	driver, err := logdriver.New(ctx, logdriver.Config{
+		Type:    logdriver.Fluentd,
+		Address: "tcp://" + stub.ln.Addr().String(),
+	}, logdriver.ContainerInfo{ID: "c1", Name: "c1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		forwardLogs(ctx, path, time.Time{}, driver)
+	}()
+
+	// 日志文件还不存在时转发会重试
+	time.Sleep(300 * time.Millisecond)
+	ts := time.Now()
+	appendLogLines(t, path, ts, "msg-1")
+	appendLogLines(t, path, ts.Add(time.Millisecond), "msg-2", "msg-3")
+	stub.waitFor(t, "msg-3")
+
+	// 用目录替换日志文件使读取失败, 重试会重新读取轮转后的 container.log.1
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(path, 0750); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(logForwardRetryInterval + 500*time.Millisecond)
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	// 与已经转发的日志时间戳相同的新日志仍然需要转发
+	appendLogLines(t, path, ts.Add(time.Millisecond), "msg-4")
+	stub.waitFor(t, "msg-4")
+
+	cancel()
+	<-done
+	driver.Close()
+
+	for _, log := range []string{"msg-1", "msg-2", "msg-3", "msg-4"} {
+		if n := stub.count(log); n != 1 {
+			t.Errorf("%s forwarded %d times, want 1", log, n)
+		}
+	}
+}
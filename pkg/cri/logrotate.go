@@ -0,0 +1,127 @@
+package cri
+
+import (
+	"context"
+	"github.com/tluo-github/cri-impl/pkg/container"
+	"github.com/tluo-github/cri-impl/pkg/logs"
+	"github.com/tluo-github/cri-impl/pkg/oci"
+	"k8s.io/klog"
+	"os"
+	"time"
+)
+
+const logRotateInterval = 10 * time.Second
+
+// superviseLogRotation 周期性的检查容器日志大小,超过 LogPolicy.MaxSize 后轮转并通知 shim 重新打开
+func (rs *runtimeService) superviseLogRotation(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-rs.done:
+			return
+		case <-ticker.C:
+		}
+		rs.lock.Lock()
+		for _, c := range rs.cmap.All() {
+			if err := rs.rotateContainerLogNoLock(context.Background(), c); err != nil {
+				klog.Warningf("failed to rotate log of container %s with err:%v", c.ID(), err)
+			}
+		}
+		rs.lock.Unlock()
+	}
+}
+
+func (rs *runtimeService) rotateContainerLogNoLock(ctx context.Context, c *container.Container) error {
+	// 旧版本创建的容器没有保存策略,使用守护进程的默认值
+	policy := c.LogPolicy().WithDefaults(rs.defaultLogPolicy)
+	if policy.MaxSize <= 0 {
+		return nil
+	}
+	fi, err := os.Stat(c.LogPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if fi.Size() < policy.MaxSize {
+		return nil
+	}
+
+	// 没有 shim 在写日志时可以直接轮转
+	running := c.Status() == container.Running || c.Status() == container.Created
+	if running {
+		if _, err := rs.logReopenBundleNoLock(c); err != nil {
+			// 无法通知 shim 重新打开日志文件, 轮转后 shim 会继续写已经轮转的文件, 不轮转
+			// 日志会超过 MaxSize 继续增长, 第一次跳过时返回错误, 由调用方记录警告
+			if rs.rotateSkipped[c.ID()] {
+				return nil
+			}
+			if rs.rotateSkipped == nil {
+				rs.rotateSkipped = make(map[container.ID]bool)
+			}
+			rs.rotateSkipped[c.ID()] = true
+			return WrapError(ErrFailedPrecondition, err,
+				"log of container %s exceeds %d bytes but cannot be rotated, it will keep growing", c.ID(), policy.MaxSize)
+		}
+	}
+	delete(rs.rotateSkipped, c.ID())
+	if err := logs.Rotate(c.LogPath(), int(policy.MaxFiles)); err != nil {
+		return err
+	}
+	klog.Infof("rotated log of container %s (%d bytes)", c.ID(), fi.Size())
+	if !running {
+		return nil
+	}
+	return rs.reopenContainerLogNoLock(ctx, c)
+}
+
+func (rs *runtimeService) ReopenContainerLog(ctx context.Context, id container.ID) error {
+	if err := rs.lockContext(ctx); err != nil {
+		return err
+	}
+	defer rs.lock.Unlock()
+
+	cont, err := rs.getContainerNoLock(ctx, id)
+	if err != nil {
+		return err
+	}
+	if cont.Status() != container.Running {
+		return Errorf(ErrFailedPrecondition, "cannot reopen log of %v container", cont.Status())
+	}
+	return rs.reopenContainerLogNoLock(ctx, cont)
+}
+
+func (rs *runtimeService) reopenContainerLogNoLock(ctx context.Context, c *container.Container) error {
+	bundleDir, err := rs.logReopenBundleNoLock(c)
+	if err != nil {
+		return err
+	}
+	return rs.runtimeOf(c).ReopenContainerLog(ctx, c.ID(), bundleDir)
+}
+
+// logReopenBundleNoLock 检查容器的 shim 是否能够重新打开日志文件, 返回容器的 bundle 目录
+// 只有 cri-impl-shim 处理 SIGUSR1, 向 shimmy 发送 SIGUSR1 会结束 shim
+func (rs *runtimeService) logReopenBundleNoLock(c *container.Container) (string, error) {
+	// shim 丢失后 pid 可能已经被其他进程复用
+	if c.Reason() == container.ReasonShimLost {
+		return "", errShimLost(c)
+	}
+	hcont, err := rs.cstore.GetContainer(c.ID())
+	if err != nil {
+		return "", err
+	}
+	if hcont == nil {
+		return "", Errorf(ErrNotFound, "container %s directory not found", c.ID())
+	}
+	pid, err := rs.runtimeOf(c).ShimPid(hcont.BundleDir())
+	if err != nil {
+		return "", WrapError(ErrInternal, err, "failed to read shim pid of container %s", c.ID())
+	}
+	if !oci.ShimReopensLog(pid) {
+		return "", Errorf(ErrFailedPrecondition, "shim of container %s does not support reopening its log", c.ID())
+	}
+	return hcont.BundleDir(), nil
+}
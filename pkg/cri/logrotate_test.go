@@ -0,0 +1,47 @@
+package cri
+
+import (
+	"context"
+	"github.com/tluo-github/cri-impl/pkg/container"
+	"github.com/tluo-github/cri-impl/pkg/fsutil"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestRotateContainerLogWithoutReopen(t *testing.T) {
+	rs, _, _ := newPluginTestService(t)
+	cont := rs.cmap.Get("c1")
+	if err := cont.SetLogPolicy(container.LogPolicy{MaxSize: 16, MaxFiles: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(cont.LogPath(), make([]byte, 32), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// shim 不能重新打开日志文件
+	cont.SetReason(container.ReasonShimLost, "shim exited")
+
+	ctx := context.Background()
+	if err := rs.rotateContainerLogNoLock(ctx, cont); err == nil {
+		t.Error("rotating a log that cannot be reopened returned no error")
+	}
+	// 之后不再重复报错
+	if err := rs.rotateContainerLogNoLock(ctx, cont); err != nil {
+		t.Errorf("second rotation returned %v", err)
+	}
+	if ok, _ := fsutil.Exists(cont.LogPath() + ".1"); ok {
+		t.Error("log was rotated while the shim keeps writing it")
+	}
+
+	// 容器停止后没有 shim 在写日志, 可以直接轮转
+	cont.SetStatus(container.Stopped)
+	if err := rs.rotateContainerLogNoLock(ctx, cont); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(cont.LogPath() + ".1"); err != nil {
+		t.Errorf("log of a stopped container was not rotated: %v", err)
+	}
+	if rs.rotateSkipped["c1"] {
+		t.Error("rotated container is still recorded as skipped")
+	}
+}
@@ -0,0 +1,84 @@
+package cri
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tluo-github/cri-impl/pkg/container"
+	"github.com/tluo-github/cri-impl/pkg/metrics"
+	"github.com/tluo-github/cri-impl/pkg/oci"
+	"k8s.io/klog"
+)
+
+var (
+	containersDesc = prometheus.NewDesc(
+		"cri_impl_containers",
+		"Number of containers by status.",
+		[]string{"status"}, nil,
+	)
+	containerCPUDesc = prometheus.NewDesc(
+		"cri_impl_container_cpu_usage_seconds_total",
+		"Cumulative CPU time consumed by the container cgroup.",
+		[]string{"id", "name"}, nil,
+	)
+	containerMemoryDesc = prometheus.NewDesc(
+		"cri_impl_container_memory_usage_bytes",
+		"Current memory usage of the container cgroup.",
+		[]string{"id", "name"}, nil,
+	)
+)
+
+// containerCollector 在每次抓取时统计容器数量,并从 cgroup 读取运行中容器的资源使用
+type containerCollector struct {
+	rs *runtimeService
+}
+
+func (c *containerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- containersDesc
+	ch <- containerCPUDesc
+	ch <- containerMemoryDesc
+}
+
+func (c *containerCollector) Collect(ch chan<- prometheus.Metric) {
+	type running struct {
+		id        container.ID
+		name      string
+		bundleDir string
+	}
+	var rcs []running
+	counts := map[container.Status]int{
+		container.Created: 0,
+		container.Running: 0,
+		container.Stopped: 0,
+	}
+
+	// 只在锁内读取内存中的状态, 读取 cgroup 不需要持有锁
+	c.rs.lock.Lock()
+	for _, cont := range c.rs.cmap.All() {
+		counts[cont.Status()]++
+		if cont.Status() != container.Running {
+			continue
+		}
+		hcont, err := c.rs.cstore.GetContainer(cont.ID())
+		if err != nil || hcont == nil {
+			continue
+		}
+		rcs = append(rcs, running{cont.ID(), cont.Name(), hcont.BundleDir()})
+	}
+	c.rs.lock.Unlock()
+
+	for s, n := range counts {
+		ch <- prometheus.MustNewConstMetric(containersDesc, prometheus.GaugeValue, float64(n), s.String())
+	}
+	for _, rc := range rcs {
+		pid, err := oci.ReadContainerPid(rc.bundleDir)
+		if err != nil {
+			continue
+		}
+		stats, err := metrics.ReadCgroupStats(pid)
+		if err != nil {
+			klog.V(4).Infof("failed to read cgroup stats of container %s with err:%v", rc.id, err)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(containerCPUDesc, prometheus.CounterValue, stats.CPUSeconds, string(rc.id), rc.name)
+		ch <- prometheus.MustNewConstMetric(containerMemoryDesc, prometheus.GaugeValue, float64(stats.MemoryBytes), string(rc.id), rc.name)
+	}
+}
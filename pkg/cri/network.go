@@ -0,0 +1,103 @@
+package cri
+
+import (
+	"context"
+	"github.com/tluo-github/cri-impl/pkg/container"
+	"github.com/tluo-github/cri-impl/pkg/rollback"
+	"github.com/tluo-github/cri-impl/pkg/tracing"
+	"k8s.io/klog"
+	"reflect"
+)
+
+// NetworkReady 为 false 时的原因
+const (
+	ReasonBridgeNotReady = "BridgeNotReady"
+	ReasonCNINotReady    = "NetworkPluginNotReady"
+)
+
+// setupNetworkNoLock 按网络模式为新建容器创建网络, 返回 nil 表示容器只有 loopback
+func (rs *runtimeService) setupNetworkNoLock(ctx context.Context, id container.ID, mode string, rb *rollback.Rollback) (*container.NetworkStatus, error) {
+	if err := container.ValidateNetworkMode(mode); err != nil {
+		return nil, WrapError(ErrInvalidArgument, err, "invalid container network")
+	}
+	if mode == "" {
+		mode = rs.defaultNetwork
+	}
+	if mode == container.NetworkNone {
+		return nil, nil
+	}
+	if rs.network == nil {
+		return nil, Errorf(ErrFailedPrecondition, "%s networking is not available when the daemon runs rootless", mode)
+	}
+	status, err := rs.network.Setup(ctx, string(id), mode)
+	if err != nil {
+		return nil, WrapError(ErrFailedPrecondition, err, "can't set up container %s network", mode)
+	}
+	// 回滚在请求超时或被取消之后也要执行完成, 否则网络命名空间和地址会泄漏
+	cleanupCtx := tracing.Detach(ctx)
+	rb.Add(func() {
+		if err := rs.network.Teardown(cleanupCtx, string(id), status); err != nil {
+			klog.Errorf("failed to tear down network of container %s with err:%v", id, err)
+		}
+	})
+	return status, nil
+}
+
+// teardownNetworkNoLock 删除容器的网络并释放地址, 失败时由下次 restore 重试和回收
+// 容器的状态已经删除, 清理不受请求超时和取消的影响
+func (rs *runtimeService) teardownNetworkNoLock(ctx context.Context, cont *container.Container) {
+	if cont.Network() == nil || rs.network == nil {
+		return
+	}
+	if err := rs.network.Teardown(tracing.Detach(ctx), string(cont.ID()), cont.Network()); err != nil {
+		klog.Errorf("failed to tear down network of container %s with err:%v", cont.ID(), err)
+	}
+}
+
+// restoreNetworkNoLock 恢复已有容器的网络命名空间和地址
+func (rs *runtimeService) restoreNetworkNoLock(ctx context.Context, cont *container.Container) {
+	if cont.Network() == nil {
+		return
+	}
+	if rs.network == nil {
+		klog.Errorf("can't restore %s network of container %s when the daemon runs rootless", cont.Network().Mode, cont.ID())
+		return
+	}
+	status, err := rs.network.Restore(ctx, string(cont.ID()), cont.Network())
+	if err != nil {
+		klog.Errorf("failed to restore network of container %s with err:%v", cont.ID(), err)
+		return
+	}
+	if !reflect.DeepEqual(status, cont.Network()) {
+		cont.SetNetwork(status)
+		if err := rs.writeContainerStateNoLock(cont); err != nil {
+			klog.Errorf("failed to write state of container %s with err:%v", cont.ID(), err)
+		}
+	}
+}
+
+// networkCondition NetworkReady 条件, 默认网络为 none 时容器只有 loopback, 总是就绪
+func (rs *runtimeService) networkCondition(ctx context.Context, info map[string]string) Condition {
+	info["network"] = rs.defaultNetwork
+	if rs.defaultNetwork == container.NetworkNone {
+		return Condition{Type: NetworkReady, Status: true, Reason: "LoopbackOnly", Message: "containers only have a loopback interface by default"}
+	}
+	if rs.network == nil {
+		return Condition{Type: NetworkReady, Status: false, Reason: networkNotReady(rs.defaultNetwork), Message: rs.defaultNetwork + " networking requires root"}
+	}
+	if rs.defaultNetwork == container.NetworkBridge {
+		bridge, gateway := rs.network.Bridge()
+		info["bridge"] = bridge + " " + gateway.String()
+	}
+	if err := rs.network.Check(ctx, rs.defaultNetwork); err != nil {
+		return Condition{Type: NetworkReady, Status: false, Reason: networkNotReady(rs.defaultNetwork), Message: err.Error()}
+	}
+	return Condition{Type: NetworkReady, Status: true}
+}
+
+func networkNotReady(mode string) string {
+	if mode == container.NetworkCNI {
+		return ReasonCNINotReady
+	}
+	return ReasonBridgeNotReady
+}
@@ -0,0 +1,31 @@
+package cri
+
+import (
+	"errors"
+	"github.com/tluo-github/cri-impl/pkg/container"
+	"github.com/tluo-github/cri-impl/pkg/plugin"
+)
+
+// pluginContainerNoLock 插件请求中的容器信息
+func (rs *runtimeService) pluginContainerNoLock(c *container.Container) plugin.Container {
+	info := plugin.Container{
+		ID:             string(c.ID()),
+		Name:           string(c.Name()),
+		RuntimeHandler: c.RuntimeHandler(),
+		Status:         c.Status().String(),
+		ExitCode:       c.ExitCode(),
+	}
+	if hcont, err := rs.cstore.GetContainer(c.ID()); err == nil && hcont != nil {
+		info.Bundle = hcont.BundleDir()
+	}
+	return info
+}
+
+// pluginError 插件否决视为 ErrFailedPrecondition, 插件执行失败视为 ErrInternal
+func pluginError(err error) error {
+	var veto *plugin.VetoError
+	if errors.As(err, &veto) {
+		return WrapError(ErrFailedPrecondition, err, "rejected by lifecycle plugin")
+	}
+	return WrapError(ErrInternal, err, "lifecycle plugin failed")
+}
@@ -0,0 +1,126 @@
+package cri
+
+import (
+	"context"
+	"fmt"
+	"github.com/tluo-github/cri-impl/pkg/container"
+	"github.com/tluo-github/cri-impl/pkg/oci"
+	"github.com/tluo-github/cri-impl/pkg/plugin"
+	"github.com/tluo-github/cri-impl/pkg/shimutil"
+	"github.com/tluo-github/cri-impl/pkg/storage"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// stubOCIRuntime 只实现停止和删除容器需要的方法, 收到信号后容器退出
+type stubOCIRuntime struct {
+	oci.Runtime
+	exitFile string
+	status   string
+	// stateCalls ContainerState 被调用的次数
+	stateCalls int
+}
+
+func (r *stubOCIRuntime) ContainerState(ctx context.Context, id container.ID) (oci.StateResp, error) {
+	r.stateCalls++
+	return oci.StateResp{Id: string(id), Status: r.status}, nil
+}
+
+func (r *stubOCIRuntime) KillContainer(ctx context.Context, id container.ID, sig os.Signal) error {
+	r.exit(shimutil.Signaled(time.Now(), int32(sig.(syscall.Signal))))
+	return nil
+}
+
+func (r *stubOCIRuntime) DeleteContainer(ctx context.Context, id container.ID) error {
+	return nil
+}
+
+func (r *stubOCIRuntime) exit(status *shimutil.TerminationStatus) {
+	shimutil.WriteExitFile(r.exitFile, status)
+	r.status = "stopped"
+}
+
+// newPluginTestService 创建一个运行中的容器 c1, 插件把收到的事件写入 dir/calls
+func newPluginTestService(t *testing.T) (*runtimeService, *stubOCIRuntime, string) {
+	dir, err := ioutil.TempDir("", "cri-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	script := filepath.Join(dir, "plugin")
+	if err := ioutil.WriteFile(script, []byte(fmt.Sprintf("#!/bin/sh\necho \"$1 $2\" >> %s/calls\n", dir)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	cstore := storage.NewContainerStore(filepath.Join(dir, "containers"))
+	if _, err := cstore.CreateContainer("c1", nil); err != nil {
+		t.Fatal(err)
+	}
+	runtime := &stubOCIRuntime{exitFile: filepath.Join(dir, "c1"), status: "running"}
+	rs := &runtimeService{
+		runtimes:       map[string]oci.Runtime{"runc": runtime},
+		defaultRuntime: "runc",
+		cstore:         cstore,
+		exitDir:        dir,
+		plugins:        plugin.NewManager([]plugin.Plugin{{Name: "recorder", Path: script, Events: []plugin.Event{plugin.Stop}}}),
+		cmap:           container.NewMap(),
+		restarts:       make(map[container.ID]*restartState),
+	}
+	cont, err := container.New("c1", "c1", filepath.Join(dir, "c1.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cont.SetStatus(container.Running)
+	if err := rs.cmap.Add(cont, nil); err != nil {
+		t.Fatal(err)
+	}
+	return rs, runtime, dir
+}
+
+// stopNotifications 等待插件通知完成, 返回收到的事件
+func stopNotifications(t *testing.T, rs *runtimeService, dir string) []string {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	rs.plugins.Close(ctx)
+	data, err := ioutil.ReadFile(filepath.Join(dir, "calls"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSpace(string(data)), "\n")
+}
+
+func TestStopPluginOnContainerExit(t *testing.T) {
+	rs, runtime, dir := newPluginTestService(t)
+	runtime.exit(shimutil.Exited(time.Now(), 0))
+	// 之后的查询不再重复通知
+	for i := 0; i < 2; i++ {
+		if _, err := rs.getContainerNoLock(context.Background(), "c1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls := stopNotifications(t, rs, dir); len(calls) != 1 || calls[0] != "stop post" {
+		t.Errorf("plugin calls = %q, want one stop post", calls)
+	}
+}
+
+func TestStopPluginOnStopContainer(t *testing.T) {
+	rs, _, dir := newPluginTestService(t)
+	if err := rs.StopContainer(context.Background(), "c1", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rs.getContainerNoLock(context.Background(), "c1"); err != nil {
+		t.Fatal(err)
+	}
+	want := "stop pre,stop post"
+	if calls := stopNotifications(t, rs, dir); strings.Join(calls, ",") != want {
+		t.Errorf("plugin calls = %q, want %q", calls, want)
+	}
+}
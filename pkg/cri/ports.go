@@ -0,0 +1,159 @@
+package cri
+
+import (
+	"context"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/tluo-github/cri-impl/pkg/container"
+	"github.com/tluo-github/cri-impl/pkg/portproxy"
+	"github.com/tluo-github/cri-impl/pkg/rollback"
+	"k8s.io/klog"
+	"net"
+)
+
+// publishPortsNoLock 发布容器的端口, 端口已经被其他容器或主机上的进程占用时返回错误
+// 容器没有自己的网络时由代理进程创建网络命名空间, 容器加入 PublishedPorts 中的命名空间
+func (rs *runtimeService) publishPortsNoLock(ctx context.Context, cont *container.Container, rb *rollback.Rollback) error {
+	if len(cont.Ports()) == 0 || cont.PublishedPorts() != nil {
+		return nil
+	}
+	if err := rs.checkPortConflictsNoLock(cont); err != nil {
+		return err
+	}
+	published := &container.PublishedPorts{Backend: rs.portBackendNoLock(cont)}
+	if ip := cont.Network().IPv4(); ip != nil {
+		published.IP = ip.String()
+	}
+	switch published.Backend {
+	case container.PortBackendIPTables:
+		if err := rs.network.PublishPorts(ctx, string(cont.ID()), net.ParseIP(published.IP), cont.Ports()); err != nil {
+			return WrapError(ErrFailedPrecondition, err, "can't publish ports of container %s", cont.ID())
+		}
+	case container.PortBackendProxy:
+		proxy, err := rs.portProxy.Start(ctx, string(cont.ID()), published.IP, cont.Ports())
+		if err != nil {
+			return WrapError(ErrFailedPrecondition, err, "can't publish ports of container %s", cont.ID())
+		}
+		published.ProxyPid = proxy.Pid
+		published.NetworkNamespace = proxy.NetworkNamespace
+		published.UserNamespace = proxy.UserNamespace
+	}
+	cont.SetPublishedPorts(published)
+	if rb != nil {
+		rb.Add(func() { rs.releasePortsNoLock(ctx, cont) })
+	}
+	return nil
+}
+
+// releasePortsNoLock 释放容器发布的端口, 容器停止或删除时调用, 可以重复调用
+func (rs *runtimeService) releasePortsNoLock(ctx context.Context, cont *container.Container) {
+	published := cont.PublishedPorts()
+	if published == nil {
+		return
+	}
+	var err error
+	switch published.Backend {
+	case container.PortBackendIPTables:
+		if rs.network != nil {
+			err = rs.network.UnpublishPorts(ctx, string(cont.ID()), net.ParseIP(published.IP), cont.Ports())
+		}
+	case container.PortBackendProxy:
+		err = rs.portProxy.Stop(published.ProxyPid, string(cont.ID()))
+	}
+	if err != nil {
+		klog.Errorf("failed to release ports of container %s with err:%v", cont.ID(), err)
+		return
+	}
+	cont.SetPublishedPorts(nil)
+}
+
+// restorePortsNoLock 守护进程重启后恢复容器发布的端口, 已经停止的容器释放端口
+// 代理进程在守护进程重启期间一直运行; DNAT 规则仍然在内核中, 但需要重新占用主机端口, 容器地址改变时 (如重新 CNI ADD 后) 更新规则
+func (rs *runtimeService) restorePortsNoLock(ctx context.Context, cont *container.Container) {
+	published := cont.PublishedPorts()
+	if published == nil {
+		return
+	}
+	defer func() {
+		if err := rs.writeContainerStateNoLock(cont); err != nil {
+			klog.Errorf("failed to write state of container %s with err:%v", cont.ID(), err)
+		}
+	}()
+	if cont.Status() == container.Stopped {
+		rs.releasePortsNoLock(ctx, cont)
+		return
+	}
+	ip := ""
+	if addr := cont.Network().IPv4(); addr != nil {
+		ip = addr.String()
+	}
+	if published.Backend == container.PortBackendProxy {
+		if portproxy.Alive(published.ProxyPid, string(cont.ID())) && published.IP == ip {
+			return
+		}
+		if published.NetworkNamespace != "" {
+			// 容器所在的网络命名空间由退出的代理进程创建, 无法重新进入, 容器重启时再发布
+			klog.Errorf("port proxy %d of container %s exited, ports are not published until the container restarts", published.ProxyPid, cont.ID())
+			cont.SetPublishedPorts(nil)
+			return
+		}
+	}
+	rs.releasePortsNoLock(ctx, cont)
+	if err := rs.publishPortsNoLock(ctx, cont, nil); err != nil {
+		klog.Errorf("failed to restore ports of container %s with err:%v", cont.ID(), err)
+	}
+}
+
+// checkPortConflictsNoLock 检查容器的端口是否与其他容器占用的端口冲突
+func (rs *runtimeService) checkPortConflictsNoLock(cont *container.Container) error {
+	for _, other := range rs.cmap.All() {
+		if other.ID() == cont.ID() || !rs.holdsPortsNoLock(other) {
+			continue
+		}
+		for _, p := range cont.Ports() {
+			for _, o := range other.Ports() {
+				if p.Conflicts(o) {
+					return Errorf(ErrFailedPrecondition, "port mapping %s conflicts with %s of container %s", p, o, other.ID())
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// holdsPortsNoLock 容器是否占用声明的端口
+// 停止时释放了端口但仍会被重启的容器也占用, 否则其他容器占用端口后, 冲突在重启时才会发现
+func (rs *runtimeService) holdsPortsNoLock(c *container.Container) bool {
+	if c.PublishedPorts() != nil {
+		return true
+	}
+	switch c.Status() {
+	case container.Created, container.Running:
+		return true
+	case container.Stopped:
+		return rs.restartableNoLock(c)
+	}
+	return false
+}
+
+// portNamespaces 代理进程为容器创建的命名空间
+func portNamespaces(published *container.PublishedPorts) map[specs.LinuxNamespaceType]string {
+	paths := map[specs.LinuxNamespaceType]string{specs.NetworkNamespace: published.NetworkNamespace}
+	if published.UserNamespace != "" {
+		paths[specs.UserNamespace] = published.UserNamespace
+	}
+	return paths
+}
+
+// portBackendNoLock iptables 需要 root 和容器的地址, 否则使用代理进程
+// 本机访问 127.0.0.0/8 的连接不经过 DNAT, 发布到回环地址时也使用代理进程
+func (rs *runtimeService) portBackendNoLock(cont *container.Container) string {
+	if rs.portBackend != container.PortBackendIPTables || rs.network == nil || cont.Network().IPv4() == nil {
+		return container.PortBackendProxy
+	}
+	for _, p := range cont.Ports() {
+		if ip := net.ParseIP(p.HostIP); ip != nil && ip.IsLoopback() {
+			return container.PortBackendProxy
+		}
+	}
+	return container.PortBackendIPTables
+}
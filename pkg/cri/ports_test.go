@@ -0,0 +1,202 @@
+package cri
+
+import (
+	"context"
+	"github.com/tluo-github/cri-impl/pkg/container"
+	"github.com/tluo-github/cri-impl/pkg/oci"
+	"github.com/tluo-github/cri-impl/pkg/portproxy"
+	"github.com/tluo-github/cri-impl/pkg/storage"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMain 测试二进制以 port-proxy 子命令启动时作为代理进程运行
+func TestMain(m *testing.M) {
+	if len(os.Args) > 1 && os.Args[1] == portproxy.Command {
+		opts := portproxy.ServeOptions{}
+		for _, arg := range os.Args[2:] {
+			switch {
+			case strings.HasPrefix(arg, "--container-id="):
+				opts.ContainerID = strings.TrimPrefix(arg, "--container-id=")
+			case strings.HasPrefix(arg, "--target="):
+				opts.Target = strings.TrimPrefix(arg, "--target=")
+			case strings.HasPrefix(arg, "--publish="):
+				p, err := container.ParsePortMapping(strings.TrimPrefix(arg, "--publish="))
+				if err != nil {
+					os.Exit(2)
+				}
+				opts.Ports = append(opts.Ports, p)
+			}
+		}
+		if err := portproxy.Serve(opts); err != nil {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func testPort(hostPort uint16) container.PortMapping {
+	return container.PortMapping{HostIP: "127.0.0.1", HostPort: hostPort, ContainerPort: 80, Protocol: container.ProtocolTCP}
+}
+
+func TestCheckPortConflicts(t *testing.T) {
+	always := container.RestartPolicy{Name: container.RestartAlways}
+	no := container.RestartPolicy{Name: container.RestartNo}
+	for _, tc := range []struct {
+		name      string
+		status    container.Status
+		published bool
+		policy    container.RestartPolicy
+		manual    bool
+		port      uint16
+		conflict  bool
+	}{
+		{name: "running", status: container.Running, published: true, port: 8080, conflict: true},
+		{name: "created", status: container.Created, port: 8080, conflict: true},
+		{name: "running with another port", status: container.Running, published: true, port: 8081},
+		{name: "stopped waiting to restart", status: container.Stopped, policy: always, port: 8080, conflict: true},
+		{name: "stopped without restart policy", status: container.Stopped, policy: no, port: 8080},
+		{name: "stopped manually", status: container.Stopped, policy: always, manual: true, port: 8080},
+	} {
+		rs := &runtimeService{cmap: container.NewMap(), restarts: make(map[container.ID]*restartState)}
+		other, _ := container.New("other", "other", "")
+		other.SetStatus(tc.status)
+		other.SetRestartPolicy(tc.policy)
+		other.SetManuallyStopped(tc.manual)
+		if err := other.SetPorts([]container.PortMapping{testPort(tc.port)}); err != nil {
+			t.Fatal(err)
+		}
+		if tc.published {
+			other.SetPublishedPorts(&container.PublishedPorts{Backend: container.PortBackendProxy})
+		}
+		cont, _ := container.New("new", "new", "")
+		if err := cont.SetPorts([]container.PortMapping{{HostPort: 8080, ContainerPort: 80, Protocol: container.ProtocolTCP}}); err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range []*container.Container{other, cont} {
+			if err := rs.cmap.Add(c, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		err := rs.checkPortConflictsNoLock(cont)
+		if code, _ := Classify(err); (err != nil) != tc.conflict || (err != nil && code != ErrFailedPrecondition) {
+			t.Errorf("%s: checkPortConflicts = %v, want conflict %v", tc.name, err, tc.conflict)
+		}
+	}
+}
+
+func TestCreateContainerRejectsPortConflict(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cri-ports")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rs := &runtimeService{
+		runtimes:       map[string]oci.Runtime{"runc": &stubOCIRuntime{}},
+		defaultRuntime: "runc",
+		defaultNetwork: container.NetworkNone,
+		cstore:         storage.NewContainerStore(filepath.Join(dir, "containers")),
+		logDir:         dir,
+		cmap:           container.NewMap(),
+		restarts:       make(map[container.ID]*restartState),
+	}
+	// 已经退出, 等待重启的容器释放了端口
+	other, _ := container.New("other", "other", "")
+	other.SetStatus(container.Stopped)
+	other.SetRestartPolicy(container.RestartPolicy{Name: container.RestartAlways})
+	if err := other.SetPorts([]container.PortMapping{testPort(8080)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := rs.cmap.Add(other, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = rs.CreateContainer(context.Background(), ContainerOptions{
+		Name:  "web",
+		Ports: []container.PortMapping{{HostPort: 8080, ContainerPort: 8000, Protocol: container.ProtocolTCP}},
+	})
+	if code, _ := Classify(err); code != ErrFailedPrecondition || !strings.Contains(err.Error(), "container other") {
+		t.Fatalf("CreateContainer with a conflicting host port returned %v, want failed precondition", err)
+	}
+	if n := len(rs.cmap.All()); n != 1 {
+		t.Errorf("%d containers after a rejected create, want 1", n)
+	}
+	if hconts, err := rs.cstore.FindContainers(); err != nil || len(hconts) != 0 {
+		t.Errorf("container directories after a rejected create = %v, %v", hconts, err)
+	}
+}
+
+// freeHostPort 返回一个当前没有被占用的本地 TCP 端口
+func freeHostPort(t *testing.T) uint16 {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return uint16(l.Addr().(*net.TCPAddr).Port)
+}
+
+func hostPortInUse(port uint16) bool {
+	l, err := net.Listen("tcp4", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port))))
+	if err != nil {
+		return true
+	}
+	l.Close()
+	return false
+}
+
+func TestPublishedPortsReleased(t *testing.T) {
+	rs, _, dir := newPluginTestService(t)
+	launcher, err := portproxy.NewLauncher(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs.portProxy = launcher
+	rs.portBackend = container.PortBackendProxy
+	ctx := context.Background()
+
+	// publish 使用代理进程, 转发到容器的地址
+	publish := func(cont *container.Container) uint16 {
+		port := freeHostPort(t)
+		cont.SetNetwork(&container.NetworkStatus{IP: "127.0.0.1/8"})
+		if err := cont.SetPorts([]container.PortMapping{testPort(port)}); err != nil {
+			t.Fatal(err)
+		}
+		if err := rs.publishPortsNoLock(ctx, cont, nil); err != nil {
+			t.Fatalf("publish ports: %v", err)
+		}
+		if published := cont.PublishedPorts(); published == nil || !portproxy.Alive(published.ProxyPid, string(cont.ID())) {
+			t.Fatalf("port proxy is not running: %+v", published)
+		}
+		if !hostPortInUse(port) {
+			t.Fatalf("host port %d is not published", port)
+		}
+		return port
+	}
+
+	cont := rs.cmap.Get("c1")
+	port := publish(cont)
+	if err := rs.StopContainer(ctx, "c1", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if cont.PublishedPorts() != nil || hostPortInUse(port) {
+		t.Errorf("host port %d is still published after stop: %+v", port, cont.PublishedPorts())
+	}
+
+	// 删除没有停止的容器时同样释放端口
+	cont.SetStatus(container.Running)
+	port = publish(cont)
+	if err := rs.RemoveContainer(ctx, "c1"); err != nil {
+		t.Fatal(err)
+	}
+	if hostPortInUse(port) {
+		t.Errorf("host port %d is still published after remove", port)
+	}
+}
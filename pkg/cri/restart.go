@@ -0,0 +1,371 @@
+package cri
+
+import (
+	"context"
+	"github.com/tluo-github/cri-impl/pkg/container"
+	"github.com/tluo-github/cri-impl/pkg/fsutil"
+	"github.com/tluo-github/cri-impl/pkg/oci"
+	"github.com/tluo-github/cri-impl/pkg/plugin"
+	"github.com/tluo-github/cri-impl/pkg/tracing"
+	"k8s.io/klog"
+	"os"
+	"syscall"
+	"time"
+)
+
+const (
+	restartSuperviseInterval = 1 * time.Second
+	// 重启退避: 1s, 2s, 4s ... 最大 2min
+	restartBaseDelay = 1 * time.Second
+	restartMaxDelay  = 2 * time.Minute
+	// 容器运行超过该时间后再退出,退避重新从 restartBaseDelay 开始
+	restartResetWindow = 10 * time.Second
+)
+
+// restartState 容器的重启退避状态
+type restartState struct {
+	// consecutive 连续快速退出(或重启失败)的次数,决定下一次退避时长
+	consecutive int
+	// restartAt 计划重启的时间,为零值表示当前没有待执行的重启
+	restartAt time.Time
+	// inflight 正在锁外执行 runc create 和 start
+	inflight bool
+	// liveness 容器因 liveness 失败被强杀且 LivenessAction 为 restart,
+	// 即使重启策略为 no 也需要重启, 重启成功后清除
+	liveness bool
+}
+
+func (s *restartState) schedule(now time.Time) time.Duration {
+	delay := restartBaseDelay
+	for i := 0; i < s.consecutive && delay < restartMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > restartMaxDelay {
+		delay = restartMaxDelay
+	}
+	s.consecutive++
+	s.restartAt = now.Add(delay)
+	return delay
+}
+
+// superviseRestarts 周期性的检查已退出的容器,并按照重启策略重启它们
+func (rs *runtimeService) superviseRestarts(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-rs.done:
+			return
+		case <-ticker.C:
+		}
+		rs.checkRestarts(context.Background(), time.Now())
+	}
+}
+
+// restartCheck 锁外检查 exit file 的容器
+type restartCheck struct {
+	id       container.ID
+	exitFile string
+}
+
+// checkRestarts 锁外检查 created/running 容器的 exit file, shim 在容器退出后写入 exit file,
+// 只有 exit file 出现的容器在锁内记录为已退出, 不对每个容器执行 runc state
+func (rs *runtimeService) checkRestarts(ctx context.Context, now time.Time) {
+	rs.lock.Lock()
+	var checks []restartCheck
+	for _, c := range rs.cmap.All() {
+		if rs.exitCheckedNoLock(c) {
+			checks = append(checks, restartCheck{c.ID(), rs.containerExitFile(c.ID())})
+		}
+	}
+	rs.lock.Unlock()
+
+	var exited []restartCheck
+	for _, check := range checks {
+		if ok, _ := fsutil.Exists(check.exitFile); ok {
+			exited = append(exited, check)
+		}
+	}
+
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	for _, check := range exited {
+		c := rs.cmap.Get(check.id)
+		// 锁外检查期间容器可能已经被删除, 停止或重启
+		if c == nil || !rs.exitCheckedNoLock(c) {
+			continue
+		}
+		if ok, _ := fsutil.Exists(check.exitFile); !ok {
+			continue
+		}
+		if err := rs.updateStatusNoLock(ctx, c, container.Stopped); err != nil {
+			klog.Warningf("restart supervisor: failed to update container %s with err:%v", c.ID(), err)
+		}
+	}
+	rs.checkRestartsNoLock(ctx, now)
+}
+
+// restartableNoLock 容器退出后是否可能被重启
+func (rs *runtimeService) restartableNoLock(c *container.Container) bool {
+	if c.ManuallyStopped() {
+		return false
+	}
+	st := rs.restarts[c.ID()]
+	return (st != nil && st.liveness) || (c.RestartPolicy().Name != container.RestartNo && c.RestartPolicy().Name != "")
+}
+
+// exitCheckedNoLock 容器是否需要检查 exit file
+func (rs *runtimeService) exitCheckedNoLock(c *container.Container) bool {
+	if c.Status() != container.Created && c.Status() != container.Running {
+		return false
+	}
+	return rs.restartableNoLock(c) && !rs.restartingNoLock(c.ID())
+}
+
+// checkRestartsNoLock 根据内存中的状态计划和执行重启, 不查询 runc
+func (rs *runtimeService) checkRestartsNoLock(ctx context.Context, now time.Time) {
+	for _, c := range rs.cmap.All() {
+		if !rs.restartableNoLock(c) {
+			continue
+		}
+		st := rs.restarts[c.ID()]
+		liveness := st != nil && st.liveness
+
+		if st == nil || st.restartAt.IsZero() {
+			// 只重启运行过并已经退出的容器
+			if c.Status() != container.Stopped || c.StartedAt() == "" || (st != nil && st.inflight) {
+				continue
+			}
+			if !shouldRestart(c, liveness) {
+				if liveness {
+					st.liveness = false
+				}
+				continue
+			}
+			if st == nil {
+				st = &restartState{}
+				rs.restarts[c.ID()] = st
+			}
+			// liveness 失败的容器总是运行了一段时间, 不重置退避, 避免反复失败的容器被立即重启
+			if !liveness && c.FinishedAtNano()-c.StartedAtNano() >= int64(restartResetWindow) {
+				st.consecutive = 0
+			}
+			delay := st.schedule(now)
+			klog.Infof("container %s exited with code %d, restarting in %v", c.ID(), c.ExitCode(), delay)
+			continue
+		}
+
+		if st.inflight || now.Before(st.restartAt) {
+			continue
+		}
+		st.restartAt = time.Time{}
+		rs.startRestartNoLock(ctx, c, st, now)
+	}
+}
+
+// shouldRestart 判断已退出的容器是否需要重启
+// liveness 触发的重启在重启策略为 no 时也执行, 其它策略仍然受 on-failure 的最大重启次数限制
+func shouldRestart(cont *container.Container, liveness bool) bool {
+	policy := cont.RestartPolicy()
+	if liveness && (policy.Name == container.RestartNo || policy.Name == "") {
+		return true
+	}
+	return policy.ShouldRestart(cont.ExitCode(), cont.RestartCount())
+}
+
+// startRestartNoLock 准备重启并在锁外执行 runc create 和 start, 准备失败时按照退避重新计划
+func (rs *runtimeService) startRestartNoLock(ctx context.Context, cont *container.Container, st *restartState, now time.Time) {
+	select {
+	case <-rs.done:
+		// 守护进程正在关闭
+		return
+	default:
+	}
+	job, err := rs.prepareRestartNoLock(ctx, cont)
+	if err != nil {
+		delay := st.schedule(now)
+		klog.Errorf("failed to restart container %s with err:%v, retrying in %v", cont.ID(), err, delay)
+		return
+	}
+	st.inflight = true
+	rs.restarting.Add(1)
+	go rs.restartContainer(ctx, cont, job)
+}
+
+// restartJob 重启需要在锁外使用的参数, 在锁内准备好, 锁外不访问 Container
+type restartJob struct {
+	id         container.ID
+	runtime    oci.Runtime
+	bundleDir  string
+	logFile    string
+	exitFile   string
+	attachFile string
+	stdin      bool
+	stdinOnce  bool
+	// prev 重启之前的容器状态, 重启失败时恢复
+	prev container.Impl
+}
+
+// restartingNoLock 容器是否正在锁外执行重启
+func (rs *runtimeService) restartingNoLock(id container.ID) bool {
+	st := rs.restarts[id]
+	return st != nil && st.inflight
+}
+
+// assertNotRestartingNoLock 重启期间不允许 start/stop/remove
+func (rs *runtimeService) assertNotRestartingNoLock(id container.ID) error {
+	if rs.restartingNoLock(id) {
+		return Errorf(ErrFailedPrecondition, "container %s is being restarted", id)
+	}
+	return nil
+}
+
+// prepareRestartNoLock 删除 runc 中已经停止的容器并重新发布端口, 容器状态改为 created
+// runc 无法原地重启已经停止的容器,所以需要先 delete 再 create; 耗时的 create 和 start 在锁外执行
+func (rs *runtimeService) prepareRestartNoLock(ctx context.Context, cont *container.Container) (job *restartJob, err error) {
+	hcont, err := rs.cstore.GetContainer(cont.ID())
+	if err != nil {
+		return nil, err
+	}
+	if hcont == nil {
+		return nil, Errorf(ErrNotFound, "container %s directory not found", cont.ID())
+	}
+	// 自动重启也是一次 start, 插件否决时按重启失败处理
+	if _, err := rs.plugins.Pre(ctx, plugin.Start, rs.pluginContainerNoLock(cont), nil); err != nil {
+		return nil, pluginError(err)
+	}
+
+	// 上一次重启失败时 runc 中可能已经没有这个容器了
+	if _, err := rs.runtimeOf(cont).ContainerState(ctx, cont.ID()); err == nil {
+		if err := rs.runtimeOf(cont).DeleteContainer(ctx, cont.ID()); err != nil {
+			return nil, err
+		}
+	}
+	// 清理上一次运行留下的 exit file 和 attach socket
+	for _, f := range []string{rs.containerExitFile(cont.ID()), rs.containerAttachFile(cont.ID())} {
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	job = &restartJob{
+		id:         cont.ID(),
+		runtime:    rs.runtimeOf(cont),
+		bundleDir:  hcont.BundleDir(),
+		logFile:    cont.LogPath(),
+		exitFile:   rs.containerExitFile(cont.ID()),
+		attachFile: rs.containerAttachFile(cont.ID()),
+		stdin:      cont.Stdin(),
+		stdinOnce:  cont.StdinOnce(),
+		prev:       cont.Impl,
+	}
+	defer func() {
+		if err != nil {
+			rs.rollbackRestartNoLock(ctx, cont, job)
+		}
+	}()
+	// 停止时释放的端口重新发布, 代理进程创建了新的网络命名空间时修改 spec 中的路径
+	if err := rs.publishPortsNoLock(ctx, cont, nil); err != nil {
+		return nil, err
+	}
+	if published := cont.PublishedPorts(); published != nil && published.NetworkNamespace != "" {
+		if err := oci.SetNamespacePaths(hcont.RuntimeSpecFile(), portNamespaces(published)); err != nil {
+			return nil, err
+		}
+	}
+
+	if cont.Status() == container.Stopped {
+		cont.ResetForRestart()
+	}
+	if err := rs.optimisticChangeContainerStatus(cont, container.Created); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// restartContainer 在锁外执行 runc create 和 start, 然后在锁内记录结果
+func (rs *runtimeService) restartContainer(ctx context.Context, cont *container.Container, job *restartJob) {
+	defer rs.restarting.Done()
+
+	ctx, span := tracing.Start(ctx, "cri.RestartContainer", tracing.ContainerID(string(job.id)))
+	startedAt, err := runRestart(ctx, job)
+
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+
+	if err == nil {
+		rs.recordShimNoLock(cont, job.bundleDir)
+		if err = rs.optimisticChangeContainerStatus(cont, container.Running); err == nil {
+			err = cont.SetStartedAt(startedAt)
+		}
+	}
+	if err != nil {
+		rs.rollbackRestartNoLock(ctx, cont, job)
+	}
+	tracing.End(span, err)
+	if st := rs.restarts[job.id]; st != nil {
+		st.inflight = false
+		if err == nil {
+			st.liveness = false
+		} else {
+			delay := st.schedule(time.Now())
+			klog.Errorf("failed to restart container %s with err:%v, retrying in %v", job.id, err, delay)
+		}
+	}
+	if err == nil {
+		rs.plugins.Post(ctx, plugin.Start, rs.pluginContainerNoLock(cont))
+	}
+}
+
+// runRestart 不持有锁, 创建 shim 和容器并启动, 返回启动的时间
+func runRestart(ctx context.Context, job *restartJob) (time.Time, error) {
+	if _, err := job.runtime.CreateContainer(
+		ctx,
+		job.id,
+		job.bundleDir,
+		job.logFile,
+		job.exitFile,
+		job.attachFile,
+		job.stdin,
+		job.stdinOnce,
+		10*time.Second,
+	); err != nil {
+		return time.Time{}, err
+	}
+	startedAt := time.Now()
+	if err := job.runtime.StartContainer(ctx, job.id); err != nil {
+		return time.Time{}, err
+	}
+	// 容器启动后立即退出也算启动成功, 交给下一轮检查按照重启策略处理
+	for _, d := range []time.Duration{250 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond, 500 * time.Millisecond, 500 * time.Millisecond} {
+		time.Sleep(d)
+		state, err := job.runtime.ContainerState(ctx, job.id)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if state.Status == "running" || state.Status == "stopped" {
+			return startedAt, nil
+		}
+	}
+	return time.Time{}, Errorf(ErrInternal, "Failed to restart container %s", job.id)
+}
+
+// rollbackRestartNoLock 重启失败时删除 runc 中创建了一半的容器, 释放重新发布的端口, 恢复重启之前的状态
+// runc 中已经没有这个容器, getContainerNoLock 对停止的容器保持保存的状态
+func (rs *runtimeService) rollbackRestartNoLock(ctx context.Context, cont *container.Container, job *restartJob) {
+	if _, err := job.runtime.ContainerState(ctx, job.id); err == nil {
+		job.runtime.KillContainer(ctx, job.id, syscall.SIGKILL)
+		if err := job.runtime.DeleteContainer(ctx, job.id); err != nil {
+			klog.Errorf("failed to delete container %s after a failed restart with err:%v", job.id, err)
+		}
+	}
+	rs.releasePortsNoLock(ctx, cont)
+	published := cont.PublishedPorts()
+	cont.Impl = job.prev
+	cont.SetPublishedPorts(published)
+	cont.SetStatus(container.Stopped)
+	if err := rs.writeContainerStateNoLock(cont); err != nil {
+		klog.Errorf("failed to write state of container %s with err:%v", job.id, err)
+	}
+}
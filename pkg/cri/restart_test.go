@@ -0,0 +1,75 @@
+package cri
+
+import (
+	"context"
+	"github.com/tluo-github/cri-impl/pkg/container"
+	"github.com/tluo-github/cri-impl/pkg/shimutil"
+	"testing"
+	"time"
+)
+
+// newRestartTestService 创建一个重启策略为 always 的运行中的容器 c1
+func newRestartTestService(t *testing.T) (*runtimeService, *stubOCIRuntime, *container.Container) {
+	rs, runtime, _ := newPluginTestService(t)
+	cont := rs.cmap.Get("c1")
+	cont.SetRestartPolicy(container.RestartPolicy{Name: container.RestartAlways})
+	if err := cont.SetStartedAt(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	return rs, runtime, cont
+}
+
+func TestCheckRestartsWithoutExitFile(t *testing.T) {
+	rs, runtime, cont := newRestartTestService(t)
+	for i := 0; i < 3; i++ {
+		rs.checkRestarts(context.Background(), time.Now())
+	}
+	// 没有 exit file 的容器不执行 runc state
+	if runtime.stateCalls != 0 {
+		t.Errorf("runc state was called %d times for a running container", runtime.stateCalls)
+	}
+	if cont.Status() != container.Running || rs.restarts["c1"] != nil {
+		t.Errorf("running container status = %v, restart = %+v", cont.Status(), rs.restarts["c1"])
+	}
+}
+
+func TestCheckRestartsSchedulesExitedContainer(t *testing.T) {
+	rs, runtime, cont := newRestartTestService(t)
+	runtime.exit(shimutil.Exited(time.Now(), 3))
+	rs.checkRestarts(context.Background(), time.Now())
+	if runtime.stateCalls != 0 {
+		t.Errorf("runc state was called %d times, want the exit file to be used", runtime.stateCalls)
+	}
+	if cont.Status() != container.Stopped || cont.ExitCode() != 3 {
+		t.Errorf("exited container status = %v, exit code = %d", cont.Status(), cont.ExitCode())
+	}
+	if st := rs.restarts["c1"]; st == nil || st.restartAt.IsZero() {
+		t.Errorf("restart of an exited container was not scheduled: %+v", st)
+	}
+}
+
+func TestStopContainerCancelsPendingRestart(t *testing.T) {
+	rs, runtime, cont := newRestartTestService(t)
+	runtime.exit(shimutil.Exited(time.Now(), 1))
+	now := time.Now()
+	rs.checkRestarts(context.Background(), now)
+	if st := rs.restarts["c1"]; st == nil || st.restartAt.IsZero() {
+		t.Fatalf("restart was not scheduled: %+v", st)
+	}
+
+	if err := rs.StopContainer(context.Background(), "c1", time.Second); err != nil {
+		t.Fatalf("StopContainer of a container waiting to restart: %v", err)
+	}
+	if !cont.ManuallyStopped() || rs.restarts["c1"] != nil {
+		t.Errorf("pending restart was not cancelled: manually stopped = %v, restart = %+v", cont.ManuallyStopped(), rs.restarts["c1"])
+	}
+	// 退避到期后也不再重启
+	rs.checkRestarts(context.Background(), now.Add(time.Hour))
+	if cont.Status() != container.Stopped || rs.restarts["c1"] != nil {
+		t.Errorf("cancelled container status = %v, restart = %+v", cont.Status(), rs.restarts["c1"])
+	}
+	// 再次停止时容器已经停止
+	if code, _ := Classify(rs.StopContainer(context.Background(), "c1", time.Second)); code != ErrFailedPrecondition {
+		t.Errorf("second StopContainer returned %v, want FailedPrecondition", code)
+	}
+}
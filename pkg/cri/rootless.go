@@ -0,0 +1,52 @@
+package cri
+
+import (
+	"github.com/tluo-github/cri-impl/pkg/container"
+	"github.com/tluo-github/cri-impl/pkg/rootless"
+	"k8s.io/klog"
+	"strconv"
+	"strings"
+)
+
+// cgroupNoLock 返回新建容器的 cgroupsPath 和资源限制
+// 以 root 运行时由 OCI 运行时决定 cgroup; rootless 时容器放在委派的 cgroup 下, 只保留委派了 controller 的限制
+func (rs *runtimeService) cgroupNoLock(id container.ID) (string, container.Resources) {
+	r := rs.defaultResources
+	if rs.rootless == nil {
+		return "", r
+	}
+	cg := rs.rootless.Cgroup
+	if cg == nil {
+		if r != (container.Resources{}) {
+			klog.Warningf("cgroup is not delegated, resource limits of container %s are ignored", id)
+		}
+		return "", container.Resources{}
+	}
+	for _, limit := range []struct {
+		controller string
+		value      *int64
+	}{
+		{"memory", &r.MemoryLimit},
+		{"cpu", &r.CPUMilli},
+		{"pids", &r.PidsLimit},
+	} {
+		if *limit.value != 0 && !cg.Supports(limit.controller) {
+			klog.Warningf("cgroup controller %s is not delegated, the limit of container %s is ignored", limit.controller, id)
+			*limit.value = 0
+		}
+	}
+	return cg.ContainerPath(string(id)), r
+}
+
+// rootlessStatus rootless 模式的状态信息
+func rootlessStatus(info *rootless.Info, status map[string]string) {
+	status["rootless"] = strconv.FormatBool(info != nil)
+	if info == nil {
+		return
+	}
+	if info.Cgroup != nil {
+		status["cgroupDelegation"] = info.Cgroup.Path + " (" + strings.Join(info.Cgroup.Controllers, " ") + ")"
+	} else if info.CgroupError != nil {
+		status["cgroupDelegation"] = "none: " + info.CgroupError.Error()
+	}
+}
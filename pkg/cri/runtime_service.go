@@ -1,18 +1,30 @@
 package cri
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"github.com/pkg/errors"
+	"github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/tluo-github/cri-impl/pkg/container"
+	"github.com/tluo-github/cri-impl/pkg/fsutil"
+	"github.com/tluo-github/cri-impl/pkg/metrics"
+	"github.com/tluo-github/cri-impl/pkg/network"
 	"github.com/tluo-github/cri-impl/pkg/oci"
+	"github.com/tluo-github/cri-impl/pkg/plugin"
+	"github.com/tluo-github/cri-impl/pkg/portproxy"
 	"github.com/tluo-github/cri-impl/pkg/rollback"
+	"github.com/tluo-github/cri-impl/pkg/rootless"
 	"github.com/tluo-github/cri-impl/pkg/shimutil"
 	"github.com/tluo-github/cri-impl/pkg/storage"
+	"github.com/tluo-github/cri-impl/pkg/tracing"
 	"io/ioutil"
 	"k8s.io/klog"
 	"k8s.io/kubernetes/pkg/kubelet/cri/streaming"
+	"net"
+	"os"
 	"path"
 	"sort"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -22,22 +34,46 @@ import (
 // 类似于CRI runtime interface,但不严格遵循它
 type RuntimeService interface {
 	// CreateContainer 在disk 上准备一个新的 container bundle,并启动runc init，但不启动指定进程
-	CreateContainer(options ContainerOptions) (*container.Container, error)
+	CreateContainer(ctx context.Context, options ContainerOptions) (*container.Container, error)
 
 	// StartContainer 实际上通过CreateContainer()创建的容器中启动一个预定义的进程
-	StartContainer(id container.ID) error
+	StartContainer(ctx context.Context, id container.ID) error
 
 	// StopContainer 向container发出信号优雅停机
-	StopContainer(id container.ID, timeout time.Duration) error
+	StopContainer(ctx context.Context, id container.ID, timeout time.Duration) error
 
 	// RemoveContainer 从 cri-impl 和 runc storages 中删除 container，
 	// 如果container 没有停止,必须设置强制标志.
 	// 如果container 已经被移出,则不返回错误,保持 幂等行为
-	RemoveContainer(id container.ID) error
+	RemoveContainer(ctx context.Context, id container.ID) error
 
-	ListContainers() ([]*container.Container, error)
+	ListContainers(ctx context.Context) ([]*container.Container, error)
 	// GetContainer 从 OCI 获得 container
-	GetContainer(id container.ID) (*container.Container, error)
+	GetContainer(ctx context.Context, id container.ID) (*container.Container, error)
+	// ContainerExited 不查询 OCI 运行时, 根据保存的状态和 exit file 判断容器是否已经退出, 容器不存在时返回 true
+	// 用于 logs -f 等需要频繁检查的场景
+	ContainerExited(id container.ID) bool
+
+	// ReopenContainerLog 通知 shim 重新打开容器日志文件,容器必须处于 running 状态.
+	// 用于外部的日志轮转工具在重命名日志文件之后调用
+	ReopenContainerLog(ctx context.Context, id container.ID) error
+
+	// SetDefaults 更新新建容器使用的默认日志策略, 资源限制和安全选项, 已存在的容器不受影响
+	SetDefaults(logPolicy container.LogPolicy, resources container.Resources, security container.SecurityOptions)
+
+	// Shutdown 停止后台任务, 等待进行中的 attach 结束并保存所有容器状态
+	// stopContainers 为 false 时 (live-restore) 容器保持运行, 由下次启动的 restore() 接管
+	Shutdown(ctx context.Context, stopContainers bool) error
+
+	// Healthy 检查服务是否还能处理请求: 没有开始关闭, 并且公共 lock 能在 ctx 结束前获得 (没有死锁或长时间阻塞)
+	Healthy(ctx context.Context) error
+
+	// Status 检查 runc, shim, 状态目录和 cgroup, 返回 RuntimeReady 和 NetworkReady 条件
+	// verbose 为 true 时在 Info 中返回每一项检查的结果
+	Status(ctx context.Context, verbose bool) (*RuntimeStatus, error)
+
+	// Version 返回 OCI 运行时的版本
+	Version(ctx context.Context) (*oci.VersionInfo, error)
 
 	streaming.Runtime
 }
@@ -50,6 +86,29 @@ type ContainerOptions struct {
 	RootsfsReadOnly bool
 	Stdin           bool
 	StdinOnce       bool
+	RestartPolicy   container.RestartPolicy
+	LivenessProbe   *container.Probe
+	ReadinessProbe  *container.Probe
+	// LivenessAction liveness 失败后的处理: restart(默认) 或 kill
+	LivenessAction string
+	// LogPolicy 未设置的字段使用守护进程的默认值
+	LogPolicy container.LogPolicy
+	// RuntimeHandler 创建容器使用的 OCI runtime, 为空时使用守护进程的默认 runtime
+	RuntimeHandler string
+	// SpecTemplate 守护进程配置的 spec 模板名称, 在 SpecPatch 之前应用
+	SpecTemplate string
+	// SpecPatch 应用到生成的 config.json 上的 RFC 7396 merge patch
+	SpecPatch []byte
+	// Security 未设置的字段使用守护进程的默认安全选项
+	Security container.SecurityOptions
+	// UserNamespace 为空表示不使用用户命名空间 (rootless 时总是使用)
+	UserNamespace container.UserNamespaceOptions
+	// Network 网络模式 (none, bridge, cni), 为空时使用守护进程的默认网络
+	Network string
+	// Ports 发布到主机的端口, 从创建到容器停止期间占用主机端口
+	Ports []container.PortMapping
+	// Trusted 调用方拥有 privileged 访问级别 (包括 root), 可以在 SpecPatch 中修改安全相关的字段
+	Trusted bool
 }
 
 // runtimeService 实现 RuntimeService
@@ -65,38 +124,177 @@ type ContainerOptions struct {
 // 第二次 in disk store
 // 第三层 runc
 type runtimeService struct {
-	lock      sync.Mutex
-	runtime   oci.Runtime
+	lock sync.Mutex
+	// runtimes 配置的 OCI runtime handler, key 为 handler 名称
+	runtimes map[string]oci.Runtime
+	// defaultRuntime 未指定 handler 的容器使用的 runtime
+	defaultRuntime string
+
 	cstore    storage.ContainerStore
 	logDir    string
 	exitDir   string
 	attachDir string
+	// defaultLogPolicy 守护进程默认的容器日志轮转策略
+	defaultLogPolicy container.LogPolicy
+	// defaultResources 新建容器的默认资源限制
+	defaultResources container.Resources
+	// defaultSecurity 新建容器的默认安全选项
+	defaultSecurity container.SecurityOptions
+	// seccompDir localhost/ seccomp profile 所在的目录
+	seccompDir string
+	// hooks 注入到新建容器 spec 中的 OCI hooks
+	hooks specs.Hooks
+	// plugins 容器生命周期插件, nil 表示没有插件
+	plugins *plugin.Manager
+	// specTemplates 命名的 spec 模板 (merge patch)
+	specTemplates map[string][]byte
+	// subIDUser 自动分配用户命名空间时使用 /etc/subuid 和 /etc/subgid 中该用户的范围
+	subIDUser string
+	// usernsSize 自动分配的默认大小
+	usernsSize uint32
+	// rootless 守护进程以非 root 用户运行, 以 root 运行时为 nil
+	rootless *rootless.Info
+	// network 容器的 bridge 和 CNI 网络, rootless 时为 nil
+	network *network.Manager
+	// defaultNetwork 没有指定网络模式的容器使用的网络
+	defaultNetwork string
+	// portProxy 启动发布端口的用户态代理进程
+	portProxy *portproxy.Launcher
+	// portBackend 首选的发布端口的方式, 不能使用 iptables 时使用代理进程
+	portBackend string
 
 	cmap *container.Map
+
+	// restarts 记录需要重启的容器的退避状态,仅在内存中
+	restarts map[container.ID]*restartState
+	// restarting 在锁外执行的重启, 关闭时等待它们结束
+	restarting sync.WaitGroup
+	// probes 记录健康检查探针的调度状态,仅在内存中
+	probes map[probeKey]*probeSchedule
+	// forwarders 日志转发 goroutine 的取消函数
+	forwarders map[container.ID]context.CancelFunc
+	// forwarding 运行中的日志转发 goroutine, 关闭时等待它们发送完缓冲区
+	forwarding sync.WaitGroup
+	// rotateSkipped 无法轮转日志的容器, 每个容器只警告一次, 仅在内存中
+	rotateSkipped map[container.ID]bool
+
+	// done 关闭后后台的 supervise goroutine 退出
+	done chan struct{}
+	// attaches 进行中的 attach 连接, 关闭时等待它们结束, 超时后强制断开
+	attachLock sync.Mutex
+	attaches   map[*net.UnixConn]struct{}
+	attachWg   sync.WaitGroup
+	// shuttingDown 关闭开始后不再接受新的 attach
+	shuttingDown bool
 }
 
 func NewRuntimeService(
-	runtime oci.Runtime,
+	runtimes map[string]oci.Runtime,
+	defaultRuntime string,
 	cstore storage.ContainerStore,
 	logDir string,
 	exitDir string,
-	attachDir string) (RuntimeService, error) {
+	attachDir string,
+	defaultLogPolicy container.LogPolicy,
+	defaultResources container.Resources,
+	defaultSecurity container.SecurityOptions,
+	seccompProfileDir string,
+	hooks specs.Hooks,
+	plugins *plugin.Manager,
+	specTemplates map[string][]byte,
+	subIDUser string,
+	usernsSize uint32,
+	rootlessInfo *rootless.Info,
+	networkManager *network.Manager,
+	defaultNetwork string,
+	portProxy *portproxy.Launcher,
+	portBackend string) (RuntimeService, error) {
+	if _, ok := runtimes[defaultRuntime]; !ok {
+		return nil, errors.New(fmt.Sprintf("default runtime handler %s is not configured", defaultRuntime))
+	}
 	rs := &runtimeService{
-		runtime:   runtime,
-		cstore:    cstore,
-		logDir:    logDir,
-		exitDir:   exitDir,
-		attachDir: attachDir,
-		cmap:      container.NewMap(),
+		runtimes:         runtimes,
+		defaultRuntime:   defaultRuntime,
+		cstore:           cstore,
+		logDir:           logDir,
+		exitDir:          exitDir,
+		attachDir:        attachDir,
+		defaultLogPolicy: defaultLogPolicy,
+		defaultResources: defaultResources,
+		defaultSecurity:  defaultSecurity,
+		seccompDir:       seccompProfileDir,
+		hooks:            hooks,
+		plugins:          plugins,
+		specTemplates:    specTemplates,
+		subIDUser:        subIDUser,
+		usernsSize:       usernsSize,
+		rootless:         rootlessInfo,
+		network:          networkManager,
+		defaultNetwork:   defaultNetwork,
+		portProxy:        portProxy,
+		portBackend:      portBackend,
+		cmap:             container.NewMap(),
+		restarts:         make(map[container.ID]*restartState),
+		probes:           make(map[probeKey]*probeSchedule),
+		forwarders:       make(map[container.ID]context.CancelFunc),
+		done:             make(chan struct{}),
+		attaches:         make(map[*net.UnixConn]struct{}),
 	}
 	if err := rs.restore(); err != nil {
 		return nil, err
 	}
+	metrics.Registry.MustRegister(&containerCollector{rs})
+	go rs.superviseRestarts(restartSuperviseInterval)
+	go rs.superviseProbes(probeSuperviseInterval)
+	go rs.superviseLogRotation(logRotateInterval)
+	go rs.superviseShims(shimSuperviseInterval)
 	return rs, nil
 }
 
-func (rs *runtimeService) CreateContainer(options ContainerOptions) (cont *container.Container, err error) {
-	rs.lock.Lock()
+// runtimeOf 返回容器创建时使用的 runtime handler
+// restore 会跳过 handler 没有配置的容器, 因此 cmap 中的容器总能找到它的 runtime
+func (rs *runtimeService) runtimeOf(c *container.Container) oci.Runtime {
+	if runtime, ok := rs.runtimes[c.RuntimeHandler()]; ok {
+		return runtime
+	}
+	return rs.runtimes[rs.defaultRuntime]
+}
+
+// lockContext 在 ctx 结束前获得公共 lock, 否则返回 ErrDeadlineExceeded
+// ctx 只限制等待 lock 的时间: 获得 lock 后操作会执行完成并返回真实结果, 不会在修改到一半时向调用方返回超时
+func (rs *runtimeService) lockContext(ctx context.Context) error {
+	if ctx.Done() == nil {
+		rs.lock.Lock()
+		return nil
+	}
+	locked := make(chan struct{})
+	go func() {
+		rs.lock.Lock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		return nil
+	case <-ctx.Done():
+		// 等待中的 goroutine 获得 lock 后立即释放
+		go func() {
+			<-locked
+			rs.lock.Unlock()
+		}()
+		return WrapError(ErrDeadlineExceeded, ctx.Err(), "runtime service lock is held for too long")
+	}
+}
+
+func (rs *runtimeService) CreateContainer(ctx context.Context, options ContainerOptions) (cont *container.Container, err error) {
+	ctx, span := tracing.Start(ctx, "cri.CreateContainer")
+	defer func() { tracing.End(span, err) }()
+
+	_, lockSpan := tracing.Start(ctx, "cri.lock wait")
+	err = rs.lockContext(ctx)
+	lockSpan.End()
+	if err != nil {
+		return nil, err
+	}
 	defer rs.lock.Unlock()
 
 	rb := rollback.New()
@@ -104,6 +302,7 @@ func (rs *runtimeService) CreateContainer(options ContainerOptions) (cont *conta
 
 	// UUID 生产容器ID
 	contID := container.RandID()
+	span.SetAttributes(tracing.ContainerID(string(contID)))
 	// 创建容器
 	cont, err = container.New(
 		contID,
@@ -111,40 +310,178 @@ func (rs *runtimeService) CreateContainer(options ContainerOptions) (cont *conta
 		rs.containerLogFile(contID),
 	)
 	if err != nil {
+		err = WrapError(ErrInvalidArgument, err, "invalid container options")
+		return
+	}
+	cont.SetStdin(options.Stdin, options.StdinOnce)
+	cont.SetRestartPolicy(options.RestartPolicy)
+	if err = cont.SetProbes(options.LivenessProbe, options.ReadinessProbe, options.LivenessAction); err != nil {
+		err = WrapError(ErrInvalidArgument, err, "invalid container probes")
+		return
+	}
+	if err = cont.SetLogPolicy(options.LogPolicy.WithDefaults(rs.defaultLogPolicy)); err != nil {
+		err = WrapError(ErrInvalidArgument, err, "invalid container log policy")
+		return
+	}
+	handler := options.RuntimeHandler
+	if handler == "" {
+		handler = rs.defaultRuntime
+	}
+	if _, ok := rs.runtimes[handler]; !ok {
+		err = Errorf(ErrInvalidArgument, "unknown runtime handler %q", handler)
+		return
+	}
+	cont.SetRuntimeHandler(handler)
+	security, err := oci.ResolveSecurity(options.Security, rs.defaultSecurity)
+	if err != nil {
+		err = WrapError(ErrInvalidArgument, err, "invalid container security options")
+		return
+	}
+	if err = rs.checkSecurityNoLock(options, security); err != nil {
+		return
+	}
+	// 调用方有权使用该 profile 之后才读取文件
+	if strings.HasPrefix(security.Seccomp, container.SeccompLocalhostPrefix) {
+		if _, err = oci.LoadSeccompProfile(rs.seccompDir, security.Seccomp); err != nil {
+			err = WrapError(ErrInvalidArgument, err, "invalid container security options")
+			return
+		}
+	}
+	userns, err := rs.userNamespaceNoLock(options.UserNamespace)
+	if err != nil {
+		return
+	}
+	cont.SetUserNamespace(userns)
+	if err = cont.SetPorts(options.Ports); err != nil {
+		err = WrapError(ErrInvalidArgument, err, "invalid port mappings")
 		return
 	}
+	cgroupsPath, resources := rs.cgroupNoLock(contID)
+	var templatePatch []byte
+	if options.SpecTemplate != "" {
+		var ok bool
+		if templatePatch, ok = rs.specTemplates[options.SpecTemplate]; !ok {
+			err = Errorf(ErrInvalidArgument, "unknown spec template %q", options.SpecTemplate)
+			return
+		}
+	}
 	// 添加进缓存
 	if err = rs.cmap.Add(cont, rb); err != nil {
+		err = WrapError(ErrAlreadyExists, err, "container %s", contID)
 		return
 	}
 	// 在磁盘上创建容器目录
+	_, stepSpan := tracing.Start(ctx, "storage.CreateContainer")
 	hcont, err := rs.cstore.CreateContainer(cont.ID(), rb)
+	tracing.End(stepSpan, err)
 	if err != nil {
 		return
 	}
 
+	// 创建网络命名空间, 容器加入该命名空间
+	netStatus, err := rs.setupNetworkNoLock(ctx, contID, options.Network, rb)
+	if err != nil {
+		return
+	}
+	cont.SetNetwork(netStatus)
+	netns := ""
+	if netStatus != nil {
+		netns = netStatus.Namespace
+	}
+	// 发布端口, 容器没有自己的网络时加入代理进程创建的网络命名空间
+	if err = rs.publishPortsNoLock(ctx, cont, rb); err != nil {
+		return
+	}
+	usernsPath := ""
+	if published := cont.PublishedPorts(); published != nil && published.NetworkNamespace != "" {
+		netns, usernsPath = published.NetworkNamespace, published.UserNamespace
+	}
+
 	// 生产容器 spec
+	_, stepSpan = tracing.Start(ctx, "oci.NewSpec")
 	spec, err := oci.NewSpec(oci.SpecOptions{
-		Command:      options.Command,
-		Args:         options.Args,
-		RootPath:     hcont.RootfsDir(),
-		RootReadonly: options.RootsfsReadOnly,
+		Command:           options.Command,
+		Args:              options.Args,
+		RootPath:          hcont.RootfsDir(),
+		RootReadonly:      options.RootsfsReadOnly,
+		Resources:         resources,
+		Security:          security,
+		SeccompProfileDir: rs.seccompDir,
+		UserNamespace:     userns,
+		Rootless:          rs.rootless != nil,
+		CgroupsPath:       cgroupsPath,
+		NetworkNamespace:  netns,
+		UserNamespacePath: usernsPath,
+		Hooks:             rs.hooks,
 	})
+	tracing.End(stepSpan, err)
 
 	if err != nil {
 		return
 	}
+	generated := spec
+	// 先应用模板, 再应用调用方的 patch
+	if templatePatch != nil {
+		if spec, err = oci.MergePatch(spec, templatePatch); err != nil {
+			err = WrapError(ErrInvalidArgument, err, "spec template %s", options.SpecTemplate)
+			return
+		}
+	}
+	if len(options.SpecPatch) > 0 {
+		if err = checkSpecPatch(options); err != nil {
+			return
+		}
+		if spec, err = oci.MergePatch(spec, options.SpecPatch); err != nil {
+			err = WrapError(ErrInvalidArgument, err, "spec patch")
+			return
+		}
+	}
+	// 插件可以否决创建或修改 spec
+	if spec, err = rs.plugins.Pre(ctx, plugin.Create, rs.pluginContainerNoLock(cont), spec); err != nil {
+		err = pluginError(err)
+		return
+	}
+	_, stepSpan = tracing.Start(ctx, "oci.ValidateSpec")
+	err = oci.ValidateSpec(spec, hcont.RootfsDir())
+	tracing.End(stepSpan, err)
+	if err != nil {
+		err = WrapError(ErrInvalidArgument, err, "container spec")
+		return
+	}
+	// 模板, patch 和插件都可能修改安全相关的字段, 保存最终 spec 中实际生效的配置
+	if security, err = oci.EffectiveSecurity(spec, generated, security); err != nil {
+		err = WrapError(ErrInvalidArgument, err, "container spec")
+		return
+	}
+	cont.SetSecurity(security)
 
-	// 在磁盘创建容器 bundle
-	if err = rs.cstore.CreateContainerBundle(cont.ID(), spec, options.RootfsPath); err != nil {
+	// 在磁盘创建容器 bundle, 包含复制 rootfs
+	_, stepSpan = tracing.Start(ctx, "storage.CreateContainerBundle")
+	err = rs.cstore.CreateContainerBundle(cont.ID(), spec, options.RootfsPath)
+	tracing.End(stepSpan, err)
+	if err != nil {
 		return
 	}
+	// rootless 时复制的文件属于当前用户, 已经映射为容器的 root
+	if userns != nil && rs.rootless == nil {
+		_, stepSpan = tracing.Start(ctx, "storage.ChownContainerRootfs")
+		err = rs.cstore.ChownContainerRootfs(cont.ID(), *userns)
+		tracing.End(stepSpan, err)
+		if err != nil {
+			err = WrapError(ErrInvalidArgument, err, "user namespace")
+			return
+		}
+	}
 	// 乐观的修改容器状态
-	if err = rs.optimisticChangeContainerStatus(cont, container.Created); err != nil {
+	_, stepSpan = tracing.Start(ctx, "storage.WriteContainerState")
+	err = rs.optimisticChangeContainerStatus(cont, container.Created)
+	tracing.End(stepSpan, err)
+	if err != nil {
 		return
 	}
 
-	_, err = rs.runtime.CreateContainer(
+	_, err = rs.runtimeOf(cont).CreateContainer(
+		ctx,
 		cont.ID(),
 		hcont.BundleDir(),
 		cont.LogPath(),
@@ -158,53 +495,148 @@ func (rs *runtimeService) CreateContainer(options ContainerOptions) (cont *conta
 	if err != nil {
 		return
 	}
-	err = cont.SetCreatedAt(time.Now())
+	rs.recordShimNoLock(cont, hcont.BundleDir())
+	createdAt := time.Now()
+	if err = cont.SetCreatedAt(createdAt); err != nil {
+		return
+	}
+	rs.startLogForwarderNoLock(cont, createdAt)
+	rs.plugins.Post(ctx, plugin.Create, rs.pluginContainerNoLock(cont))
 	return
 }
 
-func (rs *runtimeService) StartContainer(id container.ID) error {
+// checkSecurityNoLock 非特权调用方只能在守护进程默认的安全配置上收紧: 不能创建特权容器,
+// 不能添加默认之外的 capability, 不能关闭默认的 no_new_privs, 只能使用默认或者 runtime/default 的 seccomp profile
+func (rs *runtimeService) checkSecurityNoLock(options ContainerOptions, profile container.SecurityProfile) error {
+	if options.Trusted {
+		return nil
+	}
+	if profile.Privileged {
+		return Errorf(ErrPermissionDenied, "privileged containers require privileged access")
+	}
+	base, err := oci.ResolveSecurity(container.SecurityOptions{}, rs.defaultSecurity)
+	if err != nil {
+		return WrapError(ErrInvalidArgument, err, "invalid default security options")
+	}
+	for _, c := range profile.Capabilities {
+		found := false
+		for _, b := range base.Capabilities {
+			if b == c {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return Errorf(ErrPermissionDenied, "adding capability %s requires privileged access", c)
+		}
+	}
+	if base.NoNewPrivileges && !profile.NoNewPrivileges {
+		return Errorf(ErrPermissionDenied, "disabling no_new_privs requires privileged access")
+	}
+	if profile.Seccomp != base.Seccomp && profile.Seccomp != container.SeccompRuntimeDefault {
+		return Errorf(ErrPermissionDenied, "seccomp profile %s requires privileged access", profile.Seccomp)
+	}
+	return nil
+}
+
+// checkSpecPatch 只有特权调用方可以修改 hooks, mounts, namespaces, capabilities, seccomp 等安全相关的字段
+func checkSpecPatch(options ContainerOptions) error {
+	field, err := oci.RestrictedPatchField(options.SpecPatch)
+	if err != nil {
+		return WrapError(ErrInvalidArgument, err, "spec patch")
+	}
+	if field != "" && !options.Trusted {
+		return Errorf(ErrPermissionDenied, "spec patch may not modify %s without privileged access", field)
+	}
+	return nil
+}
+
+func (rs *runtimeService) SetDefaults(logPolicy container.LogPolicy, resources container.Resources, security container.SecurityOptions) {
 	rs.lock.Lock()
 	defer rs.lock.Unlock()
 
+	rs.defaultLogPolicy = logPolicy
+	rs.defaultResources = resources
+	rs.defaultSecurity = security
+}
+
+func (rs *runtimeService) StartContainer(ctx context.Context, id container.ID) error {
+	if err := rs.lockContext(ctx); err != nil {
+		return err
+	}
+	defer rs.lock.Unlock()
+
 	cont := rs.cmap.Get(id)
 	if cont == nil {
-		return errors.New("container not found")
+		return errContainerNotFound(id)
+	}
+	if err := rs.assertNotRestartingNoLock(id); err != nil {
+		return err
 	}
 	// 检查容器状态是否为 created
 	if err := assertStatus(cont.Status(), container.Created); err != nil {
 		return err
 	}
+	if _, err := rs.plugins.Pre(ctx, plugin.Start, rs.pluginContainerNoLock(cont), nil); err != nil {
+		return pluginError(err)
+	}
 
 	// 乐观的修改容器状态为 Running
 	if err := rs.optimisticChangeContainerStatus(cont, container.Running); err != nil {
 		return err
 	}
 	// 调用 runc start container
-	if err := rs.runtime.StartContainer(cont.ID()); err != nil {
+	if err := rs.runtimeOf(cont).StartContainer(ctx, cont.ID()); err != nil {
 		return err
 	}
 	// 等待容器运行成功
-	if err := rs.waitContainerStartedNoLock(id); err != nil {
+	if err := rs.waitContainerStartedNoLock(ctx, id); err != nil {
 		return nil
 	}
-	return cont.SetStartedAt(time.Now())
+	if err := cont.SetStartedAt(time.Now()); err != nil {
+		return err
+	}
+	rs.plugins.Post(ctx, plugin.Start, rs.pluginContainerNoLock(cont))
+	return nil
 
 }
 
-func (rs *runtimeService) StopContainer(id container.ID, timeout time.Duration) error {
-	rs.lock.Lock()
+func (rs *runtimeService) StopContainer(ctx context.Context, id container.ID, timeout time.Duration) error {
+	if err := rs.lockContext(ctx); err != nil {
+		return err
+	}
 	defer rs.lock.Unlock()
 
 	cont := rs.cmap.Get(id)
 	if cont == nil {
-		return errors.New("container not found")
+		return errContainerNotFound(id)
+	}
+	if err := rs.assertNotRestartingNoLock(id); err != nil {
+		return err
+	}
+	// 已经退出, 等待按重启策略重启的容器, 停止只取消计划的重启
+	if cont.Status() == container.Stopped && rs.restartableNoLock(cont) {
+		cont.SetManuallyStopped(true)
+		delete(rs.restarts, id)
+		return rs.writeContainerStateNoLock(cont)
 	}
 	// 检查容器状态
 	if err := assertStatus(cont.Status(), container.Created, container.Running); err != nil {
 		return err
 	}
+	if _, err := rs.plugins.Pre(ctx, plugin.Stop, rs.pluginContainerNoLock(cont), nil); err != nil {
+		return pluginError(err)
+	}
+	// 手动停止的容器不再被重启
+	cont.SetManuallyStopped(true)
+	delete(rs.restarts, id)
+	return rs.stopContainerNoLock(ctx, cont)
+}
+
+// stopContainerNoLock 先发送 SIGTERM, 超时后发送 SIGKILL, 停止后通知 stop 插件
+func (rs *runtimeService) stopContainerNoLock(ctx context.Context, cont *container.Container) error {
 	// todo 实现一个合适的算法,等待超时
-	// 如果容器 proc 存在, rs.runtime.KillContainer(cont.ID(),syscall.SIGKILL) 等待一些默认超时时间
+	// 如果容器 proc 存在, rs.runtimeOf(cont).KillContainer(cont.ID(),syscall.SIGKILL) 等待一些默认超时时间
 	// 如果容器 proc 任然存在,os.kill(PID)
 
 	// todo 测试这个逻辑
@@ -214,52 +646,79 @@ func (rs *runtimeService) StopContainer(id container.ID, timeout time.Duration)
 		return err
 	}
 	// 先发送 -15 信号
-	if err := rs.runtime.KillContainer(cont.ID(), syscall.SIGTERM); err != nil {
+	if err := rs.runtimeOf(cont).KillContainer(ctx, cont.ID(), syscall.SIGTERM); err != nil {
 		return err
 	}
 	// 等待 -15 信号删除情况
-	if err := rs.waitContainerStopedNoLock(cont.ID()); err != nil {
+	if err := rs.waitContainerStopedNoLock(ctx, cont.ID()); err != nil {
 		// 15 失败,在用 -9 强杀
-		if err := rs.runtime.KillContainer(cont.ID(), syscall.SIGKILL); err != nil {
+		if err := rs.runtimeOf(cont).KillContainer(ctx, cont.ID(), syscall.SIGKILL); err != nil {
 			return err
 		}
 		// 再次等待
-		if err := rs.waitContainerStopedNoLock(cont.ID()); err != nil {
+		if err := rs.waitContainerStopedNoLock(ctx, cont.ID()); err != nil {
 			return err
 		}
 	}
+	rs.plugins.Post(ctx, plugin.Stop, rs.pluginContainerNoLock(cont))
 	return nil
 
 }
 
-func (rs *runtimeService) RemoveContainer(id container.ID) error {
-	rs.lock.Lock()
+func (rs *runtimeService) RemoveContainer(ctx context.Context, id container.ID) error {
+	if err := rs.lockContext(ctx); err != nil {
+		return err
+	}
 	defer rs.lock.Unlock()
 
 	cont := rs.cmap.Get(id)
 	if cont == nil {
-		return errors.New("container not found")
+		return errContainerNotFound(id)
 	}
+	if err := rs.assertNotRestartingNoLock(id); err != nil {
+		return err
+	}
+	if _, err := rs.plugins.Pre(ctx, plugin.Remove, rs.pluginContainerNoLock(cont), nil); err != nil {
+		return pluginError(err)
+	}
+	// 删除之后 bundle 目录已经不存在, 先记录容器信息
+	info := rs.pluginContainerNoLock(cont)
 	// 在磁盘上删除容器状态文件state.json
 	if err := rs.cstore.ContainerStateDeleteAtomic(id); err != nil {
 		return err
 	}
 	// runc 开始 remove
-	if err := rs.runtime.DeleteContainer(cont.ID()); err != nil {
+	if err := rs.runtimeOf(cont).DeleteContainer(ctx, cont.ID()); err != nil {
 		return err
 	}
 	// cleanup
+	rs.releasePortsNoLock(ctx, cont)
+	if err := rs.portProxy.Remove(string(id)); err != nil {
+		klog.Errorf("failed to remove port proxy log of container %s with err:%v", id, err)
+	}
+	rs.teardownNetworkNoLock(ctx, cont)
+	rs.stopLogForwarderNoLock(id)
 	rs.cmap.Del(id)
-	return rs.cstore.DeleteContainer(id)
+	delete(rs.restarts, id)
+	delete(rs.rotateSkipped, id)
+	delete(rs.probes, probeKey{id, true})
+	delete(rs.probes, probeKey{id, false})
+	if err := rs.cstore.DeleteContainer(id); err != nil {
+		return err
+	}
+	rs.plugins.Post(ctx, plugin.Remove, info)
+	return nil
 }
 
-func (rs *runtimeService) ListContainers() ([]*container.Container, error) {
-	rs.lock.Lock()
+func (rs *runtimeService) ListContainers(ctx context.Context) ([]*container.Container, error) {
+	if err := rs.lockContext(ctx); err != nil {
+		return nil, err
+	}
 	defer rs.lock.Unlock()
 
 	var cs []*container.Container
 	for _, c := range rs.cmap.All() {
-		cont, err := rs.getContainerNoLock(c.ID())
+		cont, err := rs.getContainerNoLock(ctx, c.ID())
 		if err != nil {
 			return nil, err
 		}
@@ -278,21 +737,42 @@ func (rs *runtimeService) ListContainers() ([]*container.Container, error) {
 	return cs, nil
 }
 
-func (rs *runtimeService) GetContainer(id container.ID) (*container.Container, error) {
-	rs.lock.Lock()
+func (rs *runtimeService) GetContainer(ctx context.Context, id container.ID) (*container.Container, error) {
+	if err := rs.lockContext(ctx); err != nil {
+		return nil, err
+	}
 	defer rs.lock.Unlock()
-	return rs.getContainerNoLock(id)
+	return rs.getContainerNoLock(ctx, id)
+}
+
+func (rs *runtimeService) ContainerExited(id container.ID) bool {
+	rs.lock.Lock()
+	cont := rs.cmap.Get(id)
+	if cont == nil || cont.Status() == container.Stopped {
+		rs.lock.Unlock()
+		return true
+	}
+	// 重启期间 exit file 已经被删除, 新的 shim 退出后才会重新写入
+	exitFile := rs.containerExitFile(id)
+	rs.lock.Unlock()
+
+	ok, _ := fsutil.Exists(exitFile)
+	return ok
 }
 
 // getContainerNoLock 无锁获取容器
-func (rs *runtimeService) getContainerNoLock(id container.ID) (*container.Container, error) {
+func (rs *runtimeService) getContainerNoLock(ctx context.Context, id container.ID) (*container.Container, error) {
 	cont := rs.cmap.Get(id)
 	if cont == nil {
-		return nil, errors.New("container not found")
+		return nil, errContainerNotFound(id)
 	}
 	// 获取容器state
-	state, err := rs.runtime.ContainerState(cont.ID())
+	state, err := rs.runtimeOf(cont).ContainerState(ctx, cont.ID())
 	if err != nil {
+		// 重启期间 runc create 完成之前, 以及重启失败之后, runc 中没有这个容器, 使用保存的状态
+		if rs.restartingNoLock(id) || cont.Status() == container.Stopped {
+			return cont, nil
+		}
 		return nil, err
 	}
 	// 设置容器 status
@@ -300,30 +780,51 @@ func (rs *runtimeService) getContainerNoLock(id container.ID) (*container.Contai
 	if err != nil {
 		return nil, err
 	}
+	if err := rs.updateStatusNoLock(ctx, cont, status); err != nil {
+		return nil, err
+	}
+	return cont, nil
+}
+
+// updateStatusNoLock 记录 runc (或 exit file) 报告的容器状态, 容器停止时读取退出码并释放端口
+func (rs *runtimeService) updateStatusNoLock(ctx context.Context, cont *container.Container, status container.Status) error {
+	id := cont.ID()
+	prev := cont.Status()
 	cont.SetStatus(status)
 	// 设置容器 exit code
 	if cont.Status() == container.Stopped {
 		ts, err := rs.parseContainerExitFile(id)
-		if err != nil {
-			return nil, err
-		}
-		cont.SetFinishedAt(ts.At())
-
-		if ts.IsSignaled() {
-			cont.SetExitCode(127 + ts.Signal())
-		} else {
-			cont.SetExitCode(ts.ExitCode())
+		switch {
+		case err == nil:
+			cont.SetFinishedAt(ts.At())
+			if ts.IsSignaled() {
+				cont.SetExitCode(127 + ts.Signal())
+			} else {
+				cont.SetExitCode(ts.ExitCode())
+			}
+		case errors.Is(err, os.ErrNotExist) && !rs.shimAliveNoLock(cont):
+			// shim 已经不存在, 不会再写入 exit file
+			if cont.Reason() != container.ReasonShimLost {
+				rs.markShimLostNoLock(cont)
+			}
+			if cont.FinishedAt() == "" {
+				cont.SetFinishedAt(time.Now())
+			}
+			cont.SetExitCode(container.ExitCodeUnknown)
+		default:
+			return err
 		}
+		// 停止的容器 (包括自己退出的) 释放发布的端口
+		rs.releasePortsNoLock(ctx, cont)
 	}
-	blob, err := cont.MarshalJSON()
-	if err != nil {
-		return nil, err
+	if err := rs.writeContainerStateNoLock(cont); err != nil {
+		return err
 	}
-	if err := rs.cstore.ContainerStateWriteAtomic(id, blob); err != nil {
-		return nil, err
+	// 容器自己退出或者被 liveness 强杀, stopContainerNoLock 已经乐观的修改了状态, 不会重复通知
+	if (prev == container.Created || prev == container.Running) && status == container.Stopped {
+		rs.plugins.Post(ctx, plugin.Stop, rs.pluginContainerNoLock(cont))
 	}
-	return cont, nil
-
+	return nil
 }
 
 // restore 同步一下 store 容器
@@ -331,13 +832,28 @@ func (rs *runtimeService) restore() error {
 	rs.lock.Lock()
 	defer rs.lock.Unlock()
 
+	ctx := context.Background()
+
 	hconts, err := rs.cstore.FindContainers()
 	if err != nil {
 		return err
 	}
 
+	// keep 磁盘上保留的容器, 其他容器的网络命名空间和地址在恢复之后被回收
+	keep := make(map[string]bool)
+	for _, h := range hconts {
+		keep[string(h.ContainerID())] = true
+	}
+	if rs.network != nil {
+		if err := rs.network.Init(ctx, rs.defaultNetwork); err != nil {
+			klog.Errorf("failed to set up %s network with err:%v", rs.defaultNetwork, err)
+		}
+	}
+
 	// purgeBrokenContainer 清理容器函数
 	purgeBrokenContainer := func(id container.ID) {
+		metrics.OrphanedContainers.Inc()
+		delete(keep, string(id))
 		// 第一步清理缓存
 		rs.cmap.Del(id)
 		// 第二步情况磁盘
@@ -359,24 +875,46 @@ func (rs *runtimeService) restore() error {
 			klog.Warningf("failed to unmarshal container state with err:%v", err)
 			continue
 		}
+		// handler 从配置中移除后无法管理该容器, 保留磁盘上的状态, 恢复配置后重启守护进程即可
+		if _, ok := rs.runtimes[cont.RuntimeHandler()]; !ok {
+			klog.Errorf("skip container %s with unknown runtime handler %s", cont.ID(), cont.RuntimeHandler())
+			continue
+		}
 		if err := rs.cmap.Add(cont, nil); err != nil {
 			klog.Warningf("failed to in-memory store container with err:%v", err)
 			continue
 		}
-		cont, err = rs.getContainerNoLock(h.ContainerID())
+		cont, err = rs.getContainerNoLock(ctx, h.ContainerID())
 		if err != nil {
 			klog.Warningf("failed to update container state")
 			purgeBrokenContainer(h.ContainerID())
 			continue
 		}
+		// 守护进程停止期间 shim 可能已经退出
+		if (cont.Status() == container.Created || cont.Status() == container.Running) && !rs.shimAliveNoLock(cont) {
+			rs.markShimLostNoLock(cont)
+			if err := rs.writeContainerStateNoLock(cont); err != nil {
+				klog.Errorf("failed to write state of container %s with err:%v", cont.ID(), err)
+			}
+		}
+		rs.restoreNetworkNoLock(ctx, cont)
+		rs.restorePortsNoLock(ctx, cont)
+		// 守护进程停止期间写入的日志不会被转发
+		rs.startLogForwarderNoLock(cont, time.Now())
+		metrics.RestoredContainers.Inc()
 
 	}
+	if rs.network != nil {
+		if err := rs.network.GarbageCollect(ctx, keep); err != nil {
+			klog.Errorf("failed to collect orphaned container networks with err:%v", err)
+		}
+	}
 	return nil
 
 }
 
 // waitContainerStartedNoLock 等待容器启动情况
-func (rs *runtimeService) waitContainerStartedNoLock(id container.ID) error {
+func (rs *runtimeService) waitContainerStartedNoLock(ctx context.Context, id container.ID) error {
 	// 简单的退避算法
 	delays := []time.Duration{
 		250 * time.Millisecond,
@@ -388,7 +926,7 @@ func (rs *runtimeService) waitContainerStartedNoLock(id container.ID) error {
 	status := container.Unknown
 	for _, d := range delays {
 		time.Sleep(d)
-		cont, err := rs.getContainerNoLock(id)
+		cont, err := rs.getContainerNoLock(ctx, id)
 		if err != nil {
 			return err
 		}
@@ -401,11 +939,11 @@ func (rs *runtimeService) waitContainerStartedNoLock(id container.ID) error {
 		}
 	}
 	//todo 处理容器快速退出的情况
-	return errors.New(fmt.Sprintf("Failed to start container; status=%v.", status))
+	return Errorf(ErrInternal, "Failed to start container; status=%v.", status)
 }
 
 // waitContainerStopedNoLock 等待容器删除情况
-func (rs *runtimeService) waitContainerStopedNoLock(id container.ID) error {
+func (rs *runtimeService) waitContainerStopedNoLock(ctx context.Context, id container.ID) error {
 	// 简单的退避算法
 	delays := []time.Duration{
 		250 * time.Millisecond,
@@ -414,7 +952,7 @@ func (rs *runtimeService) waitContainerStopedNoLock(id container.ID) error {
 	status := container.Unknown
 	for _, d := range delays {
 		time.Sleep(d)
-		cont, err := rs.getContainerNoLock(id)
+		cont, err := rs.getContainerNoLock(ctx, id)
 		if err != nil {
 			return err
 		}
@@ -423,12 +961,17 @@ func (rs *runtimeService) waitContainerStopedNoLock(id container.ID) error {
 			return nil
 		}
 	}
-	return errors.New(fmt.Sprintf("Cannot kill container status=%v.", status))
+	return Errorf(ErrDeadlineExceeded, "Cannot kill container status=%v.", status)
 }
 
 // optimisticChangeContainerStatus 乐观的修改容器 status
 func (rs *runtimeService) optimisticChangeContainerStatus(c *container.Container, s container.Status) error {
 	c.SetStatus(s)
+	return rs.writeContainerStateNoLock(c)
+}
+
+// writeContainerStateNoLock 将容器状态写入磁盘 state.json
+func (rs *runtimeService) writeContainerStateNoLock(c *container.Container) error {
 	blob, err := c.MarshalJSON()
 	if err != nil {
 		return err
@@ -451,7 +994,7 @@ func (rs *runtimeService) containerExitFile(id container.ID) string {
 func (rs *runtimeService) parseContainerExitFile(id container.ID) (*shimutil.TerminationStatus, error) {
 	bytes, err := ioutil.ReadFile(rs.containerExitFile(id))
 	if err != nil {
-		return nil, errors.New("container exit file parsing failed")
+		return nil, WrapError(ErrInternal, err, "container exit file parsing failed")
 	}
 	return shimutil.ParseExitFile(bytes)
 }
@@ -463,5 +1006,5 @@ func assertStatus(actual container.Status, expected ...container.Status) error {
 			return nil
 		}
 	}
-	return errors.New(fmt.Sprintf("Wrong container status \"%v\". Expected one of=%v", actual, expected))
+	return Errorf(ErrFailedPrecondition, "Wrong container status \"%v\". Expected one of=%v", actual, expected)
 }
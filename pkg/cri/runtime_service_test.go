@@ -0,0 +1,143 @@
+package cri
+
+import (
+	"context"
+	"github.com/tluo-github/cri-impl/pkg/container"
+	"github.com/tluo-github/cri-impl/pkg/oci"
+	"github.com/tluo-github/cri-impl/pkg/shimutil"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckSpecPatch(t *testing.T) {
+	hooks := []byte(`{"hooks":{"prestart":[{"path":"/bin/sh","args":["sh","-c","id > /tmp/pwned"]}]}}`)
+	cases := []struct {
+		name    string
+		options ContainerOptions
+		want    ErrorCode
+	}{
+		{"hooks from a full caller", ContainerOptions{SpecPatch: hooks}, ErrPermissionDenied},
+		{"hooks from a privileged caller", ContainerOptions{SpecPatch: hooks, Trusted: true}, ErrUnknown},
+		{"hostname from a full caller", ContainerOptions{SpecPatch: []byte(`{"hostname":"web1"}`)}, ErrUnknown},
+		{"cgroup from a full caller", ContainerOptions{SpecPatch: []byte(`{"linux":{"cgroupsPath":"/system.slice"}}`)}, ErrPermissionDenied},
+		{"limits from a full caller", ContainerOptions{SpecPatch: []byte(`{"linux":{"resources":{"memory":{"limit":null}}}}`)}, ErrPermissionDenied},
+		{"root user from a full caller", ContainerOptions{SpecPatch: []byte(`{"process":{"user":{"uid":0}}}`)}, ErrPermissionDenied},
+		{"sysctl from a full caller", ContainerOptions{SpecPatch: []byte(`{"linux":{"sysctl":{"net.ipv4.ip_forward":"1"}}}`)}, ErrPermissionDenied},
+		{"sysctl from a privileged caller", ContainerOptions{SpecPatch: []byte(`{"linux":{"sysctl":{"net.ipv4.ip_forward":"1"}}}`), Trusted: true}, ErrUnknown},
+		{"invalid patch", ContainerOptions{SpecPatch: []byte(`{"hooks":`)}, ErrInvalidArgument},
+	}
+	for _, c := range cases {
+		err := checkSpecPatch(c.options)
+		if c.want == ErrUnknown {
+			if err != nil {
+				t.Errorf("%s: checkSpecPatch returned %v", c.name, err)
+			}
+			continue
+		}
+		if code, _ := Classify(err); err == nil || code != c.want {
+			t.Errorf("%s: checkSpecPatch returned %v, want code %v", c.name, err, c.want)
+		}
+	}
+}
+
+func TestCheckSecurity(t *testing.T) {
+	yes := true
+	no := false
+	rs := &runtimeService{defaultSecurity: container.SecurityOptions{NoNewPrivileges: &yes}}
+	cases := []struct {
+		name     string
+		security container.SecurityOptions
+		trusted  bool
+		allowed  bool
+	}{
+		{"defaults", container.SecurityOptions{}, false, true},
+		{"drop capabilities", container.SecurityOptions{CapDrop: []string{"ALL"}, CapAdd: []string{"NET_BIND_SERVICE"}}, false, true},
+		{"extra masked path", container.SecurityOptions{MaskedPaths: []string{"/proc/cpuinfo"}}, false, true},
+		{"privileged", container.SecurityOptions{Privileged: true}, false, false},
+		{"privileged from a privileged caller", container.SecurityOptions{Privileged: true}, true, true},
+		{"add capability", container.SecurityOptions{CapAdd: []string{"SYS_ADMIN"}}, false, false},
+		{"add all capabilities", container.SecurityOptions{CapAdd: []string{"ALL"}}, false, false},
+		{"disable no_new_privs", container.SecurityOptions{NoNewPrivileges: &no}, false, false},
+		{"unconfined seccomp", container.SecurityOptions{Seccomp: container.SeccompUnconfined}, false, false},
+		{"unconfined seccomp from a privileged caller", container.SecurityOptions{Seccomp: container.SeccompUnconfined}, true, true},
+	}
+	for _, c := range cases {
+		profile, err := oci.ResolveSecurity(c.security, rs.defaultSecurity)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = rs.checkSecurityNoLock(ContainerOptions{Security: c.security, Trusted: c.trusted}, profile)
+		if c.allowed && err != nil {
+			t.Errorf("%s: checkSecurityNoLock returned %v", c.name, err)
+		}
+		if code, _ := Classify(err); !c.allowed && (err == nil || code != ErrPermissionDenied) {
+			t.Errorf("%s: checkSecurityNoLock returned %v, want permission denied", c.name, err)
+		}
+	}
+}
+
+func TestCreateContainerChecksSeccompBeforeReading(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seccomp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "invalid.json"), []byte("not a profile"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rs := &runtimeService{
+		runtimes:       map[string]oci.Runtime{"runc": &stubOCIRuntime{}},
+		defaultRuntime: "runc",
+		logDir:         dir,
+		seccompDir:     dir,
+		cmap:           container.NewMap(),
+	}
+	create := func(profile string, trusted bool) error {
+		_, err := rs.CreateContainer(context.Background(), ContainerOptions{
+			Name:     "c1",
+			Security: container.SecurityOptions{Seccomp: profile},
+			Trusted:  trusted,
+		})
+		return err
+	}
+	// 存在, 不存在和不合法的文件返回相同的错误, 调用方无法借此探测主机上的文件
+	for _, profile := range []string{"localhost//etc/shadow", "localhost/missing.json", "localhost/invalid.json"} {
+		err := create(profile, false)
+		if code, _ := Classify(err); err == nil || code != ErrPermissionDenied {
+			t.Errorf("unprivileged create with %s returned %v, want permission denied", profile, err)
+			continue
+		}
+		if want := "seccomp profile " + profile + " requires privileged access"; !strings.Contains(err.Error(), want) {
+			t.Errorf("unprivileged create with %s returned %q, want %q", profile, err, want)
+		}
+	}
+	// privileged 调用方通过检查之后才读取文件
+	if code, _ := Classify(create("localhost/invalid.json", true)); code != ErrInvalidArgument {
+		t.Errorf("privileged create with an invalid profile returned code %v, want invalid argument", code)
+	}
+	if code, _ := Classify(create("localhost//etc/shadow", true)); code != ErrInvalidArgument {
+		t.Errorf("privileged create with a profile outside the directory returned code %v, want invalid argument", code)
+	}
+}
+
+func TestContainerExited(t *testing.T) {
+	rs, runtime, _ := newPluginTestService(t)
+	if rs.ContainerExited("c1") {
+		t.Error("running container without an exit file reported as exited")
+	}
+	runtime.exit(shimutil.Exited(time.Now(), 0))
+	if !rs.ContainerExited("c1") {
+		t.Error("container with an exit file reported as running")
+	}
+	if !rs.ContainerExited("missing") {
+		t.Error("missing container reported as running")
+	}
+	// 不查询 runc
+	if runtime.stateCalls != 0 {
+		t.Errorf("runc state was called %d times", runtime.stateCalls)
+	}
+}
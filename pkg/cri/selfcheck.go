@@ -0,0 +1,19 @@
+package cri
+
+import (
+	"context"
+)
+
+func (rs *runtimeService) Healthy(ctx context.Context) error {
+	select {
+	case <-rs.done:
+		return Errorf(ErrFailedPrecondition, "runtime service is shutting down")
+	default:
+	}
+
+	if err := rs.lockContext(ctx); err != nil {
+		return err
+	}
+	rs.lock.Unlock()
+	return nil
+}
@@ -0,0 +1,134 @@
+package cri
+
+import (
+	"context"
+	"fmt"
+	"github.com/tluo-github/cri-impl/pkg/container"
+	"github.com/tluo-github/cri-impl/pkg/metrics"
+	"github.com/tluo-github/cri-impl/pkg/oci"
+	"k8s.io/klog"
+	"time"
+)
+
+const shimSuperviseInterval = 2 * time.Second
+
+// superviseShims 周期性的检查 created/running 容器的 shim 进程是否存在
+// shim 持有容器 stdio 的另一端, 它退出后容器的输出无处可去, 也无法重新连接, 因此不会重新启动 shim;
+// 容器被标记为 ShimLost, 退出后按重启策略重启时会启动新的 shim
+func (rs *runtimeService) superviseShims(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-rs.done:
+			return
+		case <-ticker.C:
+		}
+		rs.checkShims()
+	}
+}
+
+// shimCheck 锁外检查的 shim 进程
+type shimCheck struct {
+	id  container.ID
+	pid int
+}
+
+// checkShims 只在锁内读取 shim pid, 锁外检查 /proc, 只对 shim 不存在的容器在锁内执行 runc state
+func (rs *runtimeService) checkShims() {
+	rs.lock.Lock()
+	var checks []shimCheck
+	for _, c := range rs.cmap.All() {
+		if rs.shimCheckedNoLock(c) {
+			checks = append(checks, shimCheck{c.ID(), rs.shimPidNoLock(c)})
+		}
+	}
+	rs.lock.Unlock()
+
+	var suspects []shimCheck
+	for _, check := range checks {
+		if check.pid == 0 || !oci.ShimAlive(check.pid, check.id) {
+			suspects = append(suspects, check)
+		}
+	}
+	if len(suspects) == 0 {
+		return
+	}
+
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	for _, check := range suspects {
+		c := rs.cmap.Get(check.id)
+		// 锁外检查期间容器可能已经被删除, 停止或重启
+		if c == nil || !rs.shimCheckedNoLock(c) || c.ShimPid() != check.pid {
+			continue
+		}
+		// 容器正常退出后 shim 写入 exit file 再退出, 内存中的状态可能还没有更新
+		cont, err := rs.getContainerNoLock(context.Background(), c.ID())
+		if err != nil {
+			klog.Warningf("shim supervisor: failed to get container %s with err:%v", c.ID(), err)
+			continue
+		}
+		if cont.Status() == container.Stopped || cont.Reason() == container.ReasonShimLost {
+			continue
+		}
+		rs.markShimLostNoLock(cont)
+		if err := rs.writeContainerStateNoLock(cont); err != nil {
+			klog.Errorf("failed to write state of container %s with err:%v", cont.ID(), err)
+		}
+	}
+}
+
+// shimCheckedNoLock 容器的 shim 是否需要检查
+func (rs *runtimeService) shimCheckedNoLock(c *container.Container) bool {
+	if c.Status() != container.Created && c.Status() != container.Running {
+		return false
+	}
+	// 重启期间 shim 还没有创建, 保存的是上一个 shim 的 pid
+	return !rs.restartingNoLock(c.ID()) && c.Reason() != container.ReasonShimLost
+}
+
+// recordShimNoLock 在 runtime.CreateContainer 之后记录 shim 的 pid
+func (rs *runtimeService) recordShimNoLock(c *container.Container, bundleDir string) {
+	pid, err := rs.runtimeOf(c).ShimPid(bundleDir)
+	if err != nil {
+		klog.Warningf("failed to read shim pid of container %s with err:%v", c.ID(), err)
+		return
+	}
+	c.SetShimPid(pid)
+}
+
+// shimAliveNoLock 检查容器的 shim 进程是否存在
+func (rs *runtimeService) shimAliveNoLock(c *container.Container) bool {
+	if c.Reason() == container.ReasonShimLost {
+		return false
+	}
+	pid := rs.shimPidNoLock(c)
+	return pid != 0 && oci.ShimAlive(pid, c.ID())
+}
+
+// shimPidNoLock 返回容器的 shim pid, 之前版本保存的状态中没有 shim pid 时从 bundle 目录读取
+func (rs *runtimeService) shimPidNoLock(c *container.Container) int {
+	if c.ShimPid() == 0 {
+		hcont, err := rs.cstore.GetContainer(c.ID())
+		if err != nil || hcont == nil {
+			return 0
+		}
+		rs.recordShimNoLock(c, hcont.BundleDir())
+	}
+	return c.ShimPid()
+}
+
+func (rs *runtimeService) markShimLostNoLock(c *container.Container) {
+	klog.Errorf("shim process %d of container %s exited unexpectedly", c.ShimPid(), c.ID())
+	metrics.ShimsLost.Inc()
+	c.SetReason(container.ReasonShimLost, fmt.Sprintf(
+		"shim process %d exited unexpectedly, container output is no longer logged and attach is unavailable",
+		c.ShimPid()))
+}
+
+// errShimLost 需要 shim 的操作 (attach, 重新打开日志) 在 shim 丢失后返回的错误
+func errShimLost(c *container.Container) error {
+	return Errorf(ErrFailedPrecondition, "shim of container %s is lost: %s", c.ID(), c.Message())
+}
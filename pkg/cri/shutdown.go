@@ -0,0 +1,109 @@
+package cri
+
+import (
+	"context"
+	"github.com/tluo-github/cri-impl/pkg/container"
+	"k8s.io/klog"
+	"net"
+	"time"
+)
+
+// shutdownStopTimeout 关闭时停止单个容器的超时时间
+const shutdownStopTimeout = 10 * time.Second
+
+// trackAttach 记录一个 attach 连接, 关闭开始后返回错误
+func (rs *runtimeService) trackAttach(conn *net.UnixConn) error {
+	rs.attachLock.Lock()
+	defer rs.attachLock.Unlock()
+
+	if rs.shuttingDown {
+		return Errorf(ErrFailedPrecondition, "daemon is shutting down")
+	}
+	rs.attaches[conn] = struct{}{}
+	rs.attachWg.Add(1)
+	return nil
+}
+
+func (rs *runtimeService) untrackAttach(conn *net.UnixConn) {
+	rs.attachLock.Lock()
+	defer rs.attachLock.Unlock()
+
+	if _, ok := rs.attaches[conn]; ok {
+		delete(rs.attaches, conn)
+		rs.attachWg.Done()
+	}
+}
+
+// drainAttaches 等待进行中的 attach 结束, ctx 结束后断开剩余的连接
+func (rs *runtimeService) drainAttaches(ctx context.Context) {
+	rs.attachLock.Lock()
+	rs.shuttingDown = true
+	rs.attachLock.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		rs.attachWg.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		return
+	case <-ctx.Done():
+	}
+
+	rs.attachLock.Lock()
+	klog.Warningf("closing %d attach connections still open at shutdown", len(rs.attaches))
+	for conn := range rs.attaches {
+		conn.Close()
+	}
+	rs.attachLock.Unlock()
+}
+
+func (rs *runtimeService) Shutdown(ctx context.Context, stopContainers bool) error {
+	// 先停止重启和健康检查,避免它们重新启动正在被停止的容器
+	close(rs.done)
+	rs.drainAttaches(ctx)
+	// 获得一次锁之后不会再开始新的重启, 等待锁外执行的重启记录结果, 之后它们的容器和其他容器一样被停止
+	rs.lock.Lock()
+	rs.lock.Unlock()
+	rs.restarting.Wait()
+
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+
+	if stopContainers {
+		for _, c := range rs.cmap.All() {
+			if c.Status() != container.Created && c.Status() != container.Running {
+				continue
+			}
+			// 不标记为手动停止, 下次启动时按照重启策略处理
+			// 等待 attach 可能已经用完了 ctx 的时间, 停止容器使用单独的超时
+			stopCtx, cancel := context.WithTimeout(context.Background(), shutdownStopTimeout)
+			err := rs.stopContainerNoLock(stopCtx, c)
+			cancel()
+			if err != nil {
+				klog.Errorf("failed to stop container %s on shutdown with err:%v", c.ID(), err)
+			}
+		}
+	}
+
+	// 等待停止容器等状态转换的插件通知 (有时间上限)
+	pluginCtx, cancel := context.WithTimeout(context.Background(), shutdownStopTimeout)
+	rs.plugins.Close(pluginCtx)
+	cancel()
+
+	// 停止日志转发, 驱动在退出前发送缓冲区中的日志 (有时间上限)
+	for id := range rs.forwarders {
+		rs.stopLogForwarderNoLock(id)
+	}
+	rs.forwarding.Wait()
+
+	var lastErr error
+	for _, c := range rs.cmap.All() {
+		if err := rs.writeContainerStateNoLock(c); err != nil {
+			klog.Errorf("failed to write state of container %s on shutdown with err:%v", c.ID(), err)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
@@ -0,0 +1,138 @@
+package cri
+
+import (
+	"context"
+	"errors"
+	"github.com/tluo-github/cri-impl/pkg/metrics"
+	"github.com/tluo-github/cri-impl/pkg/oci"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 运行时状态条件, 与 CRI 的 RuntimeCondition 相同
+const (
+	// RuntimeReady 运行时可以创建和启动容器
+	RuntimeReady = "RuntimeReady"
+	// NetworkReady 容器网络已经就绪
+	NetworkReady = "NetworkReady"
+)
+
+// RuntimeReady 为 false 时的原因
+const (
+	ReasonRuntimeBinaryNotReady = "RuntimeBinaryNotReady"
+	ReasonShimBinaryNotReady    = "ShimBinaryNotReady"
+	ReasonRootNotWritable       = "RootNotWritable"
+	ReasonCgroupUnavailable     = "CgroupUnavailable"
+	ReasonShuttingDown          = "ShuttingDown"
+)
+
+// Condition 运行时的一个状态条件
+type Condition struct {
+	Type    string
+	Status  bool
+	Reason  string
+	Message string
+}
+
+// RuntimeStatus Status() 的结果
+type RuntimeStatus struct {
+	Conditions []Condition
+	// Info verbose 时每一项检查的详细结果
+	Info map[string]string
+}
+
+// statusCheck 一项检查的结果
+type statusCheck struct {
+	name   string
+	reason string
+	err    error
+}
+
+func (rs *runtimeService) Status(ctx context.Context, verbose bool) (*RuntimeStatus, error) {
+	var checks []statusCheck
+	info := make(map[string]string)
+
+	select {
+	case <-rs.done:
+		checks = append(checks, statusCheck{"shutdown", ReasonShuttingDown, errors.New("runtime service is shutting down")})
+	default:
+	}
+
+	handlers := make([]string, 0, len(rs.runtimes))
+	for name := range rs.runtimes {
+		handlers = append(handlers, name)
+	}
+	sort.Strings(handlers)
+	dirs := []string{rs.cstore.RootDir(), rs.logDir, rs.exitDir, rs.attachDir}
+	for _, name := range handlers {
+		runtimeVersion, err := rs.runtimes[name].Version(ctx)
+		checks = append(checks, statusCheck{"runtime " + name, ReasonRuntimeBinaryNotReady, err})
+		if err == nil {
+			info["runtimeVersion."+name] = runtimeVersion.Output
+		}
+		dirs = append(dirs, rs.runtimes[name].RootDir())
+	}
+	// 所有 handler 使用同一个 shim
+	checks = append(checks, statusCheck{"shim", ReasonShimBinaryNotReady, rs.runtimes[rs.defaultRuntime].CheckShim()})
+
+	for _, dir := range dirs {
+		checks = append(checks, statusCheck{"root " + dir, ReasonRootNotWritable, checkWritable(dir)})
+	}
+
+	cgroupVersion, err := metrics.CgroupVersion()
+	checks = append(checks, statusCheck{"cgroup", ReasonCgroupUnavailable, err})
+	info["cgroupVersion"] = strconv.Itoa(cgroupVersion)
+	rootlessStatus(rs.rootless, info)
+
+	runtimeReady := Condition{Type: RuntimeReady, Status: true}
+	var messages []string
+	for _, c := range checks {
+		result := "ok"
+		if c.err != nil {
+			result = c.err.Error()
+			if runtimeReady.Status {
+				runtimeReady.Status = false
+				runtimeReady.Reason = c.reason
+			}
+			messages = append(messages, c.name+": "+result)
+		}
+		info["check."+c.name] = result
+	}
+	runtimeReady.Message = strings.Join(messages, "; ")
+
+	status := &RuntimeStatus{
+		Conditions: []Condition{
+			runtimeReady,
+			rs.networkCondition(ctx, info),
+		},
+	}
+	if verbose {
+		status.Info = info
+	}
+	return status, nil
+}
+
+func (rs *runtimeService) Version(ctx context.Context) (*oci.VersionInfo, error) {
+	return rs.runtimes[rs.defaultRuntime].Version(ctx)
+}
+
+// checkWritable 在 dir 中创建并删除一个临时文件
+// dir 还不存在时 (如 runc 在第一次创建容器时才创建它的根目录) 检查最近的已存在的上级目录
+func checkWritable(dir string) error {
+	for {
+		if _, err := os.Stat(dir); !os.IsNotExist(err) || filepath.Dir(dir) == dir {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+	f, err := ioutil.TempFile(dir, ".status-")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
@@ -2,18 +2,18 @@ package cri
 
 import (
 	"bytes"
-	"fmt"
-	"github.com/pkg/errors"
+	"context"
 	"github.com/tluo-github/cri-impl/pkg/container"
+	"github.com/tluo-github/cri-impl/pkg/shimutil"
 	"io"
 	"k8s.io/client-go/tools/remotecommand"
 	"k8s.io/klog"
 	"net"
 )
 
-const BufSize = 32 * 1024
-const PipeTypeStdout = 1
-const PipeTypeStderr = 2
+const BufSize = shimutil.AttachBufSize
+const PipeTypeStdout = shimutil.AttachPipeStdout
+const PipeTypeStderr = shimutil.AttachPipeStderr
 
 func (rs *runtimeService) Attach(
 	containerID string,
@@ -24,15 +24,18 @@ func (rs *runtimeService) Attach(
 	_resize <-chan remotecommand.TerminalSize,
 ) error {
 	if stdin == nil && stdout == nil && stderr == nil {
-		return errors.New("at least one of the std streams must be open")
+		return Errorf(ErrInvalidArgument, "at least one of the std streams must be open")
 	}
 
-	cont, err := rs.GetContainer(container.ID(containerID))
+	cont, err := rs.GetContainer(context.Background(), container.ID(containerID))
 	if err != nil {
 		return err
 	}
 	if cont.Status() != container.Running {
-		return errors.New(fmt.Sprintf("cannot connect to %v container", cont.Status()))
+		return Errorf(ErrFailedPrecondition, "cannot connect to %v container", cont.Status())
+	}
+	if cont.Reason() == container.ReasonShimLost {
+		return errShimLost(cont)
 	}
 	// unix sock 通信
 	conn, err := net.DialUnix(
@@ -46,6 +49,10 @@ func (rs *runtimeService) Attach(
 		return err
 	}
 	defer conn.Close()
+	if err := rs.trackAttach(conn); err != nil {
+		return err
+	}
+	defer rs.untrackAttach(conn)
 
 	// 转发输出 stream
 	doneOut := make(chan error)
@@ -75,7 +82,6 @@ func (rs *runtimeService) Attach(
 	case err := <-doneOut:
 		return err
 	}
-	return nil
 }
 
 func (rs *runtimeService) Exec(
@@ -86,11 +92,11 @@ func (rs *runtimeService) Exec(
 	tty bool,
 	resize <-chan remotecommand.TerminalSize,
 ) error {
-	return errors.New("Not implemented")
+	return Errorf(ErrUnimplemented, "Not implemented")
 }
 
 func (rs *runtimeService) PortForward(podSandboxID string, port int32, stream io.ReadWriteCloser) error {
-	return errors.New("Not implemented")
+	return Errorf(ErrUnimplemented, "Not implemented")
 }
 
 // forwardOutStreams 复制转发 stream
@@ -123,6 +129,4 @@ func forwardOutStreams(conn io.Reader, stdout, stderr io.Writer) error {
 			return err
 		}
 	}
-	// 无法到达
-	return nil
 }
@@ -0,0 +1,121 @@
+package cri
+
+import (
+	"github.com/tluo-github/cri-impl/pkg/container"
+	"github.com/tluo-github/cri-impl/pkg/idmap"
+)
+
+// userNamespaceNoLock 返回新建容器的 uid/gid 映射, nil 表示不使用用户命名空间
+// 自动分配的范围与 cmap 中所有容器 (包括 restore 恢复的) 的映射不重叠, 因此不需要单独保存分配状态
+func (rs *runtimeService) userNamespaceNoLock(opts container.UserNamespaceOptions) (*container.UserNamespace, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, WrapError(ErrInvalidArgument, err, "invalid user namespace options")
+	}
+	if rs.rootless != nil {
+		// 非 root 用户只能把自己映射为容器的 root, 不能修改 rootfs 的属主
+		if opts.Enabled() {
+			return nil, Errorf(ErrInvalidArgument, "user namespace mappings are not supported when the daemon runs rootless")
+		}
+		return &container.UserNamespace{
+			UIDMappings: []container.IDMapping{{ContainerID: 0, HostID: uint32(rs.rootless.UID), Size: 1}},
+			GIDMappings: []container.IDMapping{{ContainerID: 0, HostID: uint32(rs.rootless.GID), Size: 1}},
+		}, nil
+	}
+	if !opts.Enabled() {
+		return nil, nil
+	}
+
+	if !opts.Auto {
+		ns := &container.UserNamespace{UIDMappings: opts.UIDMappings, GIDMappings: opts.GIDMappings}
+		if len(ns.GIDMappings) == 0 {
+			ns.GIDMappings = ns.UIDMappings
+		}
+		if err := ns.Validate(); err != nil {
+			return nil, WrapError(ErrInvalidArgument, err, "invalid user namespace mappings")
+		}
+		if err := rs.checkSubIDsNoLock(idmap.SubUIDFile, ns.UIDMappings, func(ns *container.UserNamespace) []container.IDMapping {
+			return ns.UIDMappings
+		}); err != nil {
+			return nil, err
+		}
+		if err := rs.checkSubIDsNoLock(idmap.SubGIDFile, ns.GIDMappings, func(ns *container.UserNamespace) []container.IDMapping {
+			return ns.GIDMappings
+		}); err != nil {
+			return nil, err
+		}
+		return ns, nil
+	}
+
+	size := opts.Size
+	if size == 0 {
+		size = rs.usernsSize
+	}
+	uid, err := rs.allocateSubIDsNoLock(idmap.SubUIDFile, size, func(ns *container.UserNamespace) []container.IDMapping {
+		return ns.UIDMappings
+	})
+	if err != nil {
+		return nil, err
+	}
+	gid, err := rs.allocateSubIDsNoLock(idmap.SubGIDFile, size, func(ns *container.UserNamespace) []container.IDMapping {
+		return ns.GIDMappings
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &container.UserNamespace{
+		UIDMappings: []container.IDMapping{{ContainerID: 0, HostID: uid, Size: size}},
+		GIDMappings: []container.IDMapping{{ContainerID: 0, HostID: gid, Size: size}},
+	}, nil
+}
+
+// allocateSubIDsNoLock 从 file 中属于 subIDUser 的范围分配 size 个 id, 返回起点
+func (rs *runtimeService) allocateSubIDsNoLock(
+	file string,
+	size uint32,
+	mappings func(ns *container.UserNamespace) []container.IDMapping,
+) (uint32, error) {
+	available, err := idmap.ReadSubIDs(file, rs.subIDUser)
+	if err != nil {
+		return 0, WrapError(ErrFailedPrecondition, err, "can't allocate user namespace")
+	}
+	start, err := idmap.Allocate(available, rs.usedSubIDsNoLock(mappings), size)
+	if err != nil {
+		return 0, WrapError(ErrFailedPrecondition, err, "can't allocate user namespace from %s", file)
+	}
+	return start, nil
+}
+
+// checkSubIDsNoLock 指定的映射必须在 file 中属于 subIDUser 的范围内, 并且不与其他容器的映射重叠
+func (rs *runtimeService) checkSubIDsNoLock(
+	file string,
+	requested []container.IDMapping,
+	mappings func(ns *container.UserNamespace) []container.IDMapping,
+) error {
+	available, err := idmap.ReadSubIDs(file, rs.subIDUser)
+	if err != nil {
+		return WrapError(ErrFailedPrecondition, err, "can't check user namespace mappings")
+	}
+	used := rs.usedSubIDsNoLock(mappings)
+	for _, r := range idmap.HostRanges(requested) {
+		if !idmap.Covers(available, r) {
+			return Errorf(ErrInvalidArgument, "host ids %d-%d are not delegated to %s in %s",
+				r.Start, uint64(r.Start)+uint64(r.Size)-1, rs.subIDUser, file)
+		}
+		if idmap.Overlaps(used, r) {
+			return Errorf(ErrAlreadyExists, "host ids %d-%d are already mapped by another container",
+				r.Start, uint64(r.Start)+uint64(r.Size)-1)
+		}
+	}
+	return nil
+}
+
+// usedSubIDsNoLock 所有容器的映射占用的主机 id
+func (rs *runtimeService) usedSubIDsNoLock(mappings func(ns *container.UserNamespace) []container.IDMapping) []idmap.Range {
+	var used []idmap.Range
+	for _, c := range rs.cmap.All() {
+		if ns := c.UserNamespace(); ns != nil {
+			used = append(used, idmap.HostRanges(mappings(ns))...)
+		}
+	}
+	return used
+}
@@ -0,0 +1,61 @@
+package idmap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/tluo-github/cri-impl/pkg/container"
+	"golang.org/x/sys/unix"
+)
+
+// security.capability 的格式 (linux/capability.h 中的 vfs_cap_data/vfs_ns_cap_data)
+// magic_etc, permitted/inheritable (低 32 位, 高 32 位), v3 额外带有 rootid
+const (
+	capabilityXattr = "security.capability"
+
+	vfsCapRevisionMask = 0xFF000000
+	vfsCapRevision2    = 0x02000000
+	vfsCapRevision3    = 0x03000000
+	vfsCapSize2        = 20
+	vfsCapSize3        = 24
+)
+
+// readFileCaps 读取文件的 security.capability, 文件没有 capability 时返回 nil
+func readFileCaps(path string) ([]byte, error) {
+	buf := make([]byte, vfsCapSize3)
+	n, err := unix.Lgetxattr(path, capabilityXattr, buf)
+	if err == unix.ENODATA || err == unix.ENOTSUP {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// shiftFileCaps 把文件 capability 转换为 v3 格式, rootid 为容器内 root (或原来的 rootid) 映射后的主机 uid
+// v2 的 capability 只对初始用户命名空间的 root 生效, 容器内的 root 需要 v3 的 rootid 与自己对应
+func shiftFileCaps(caps []byte, ns container.UserNamespace) ([]byte, error) {
+	if len(caps) < 4 {
+		return nil, errors.New(fmt.Sprintf("Invalid %s of %d bytes", capabilityXattr, len(caps)))
+	}
+	magic := binary.LittleEndian.Uint32(caps)
+	var rootid uint32
+	switch {
+	case magic&vfsCapRevisionMask == vfsCapRevision2 && len(caps) == vfsCapSize2:
+	case magic&vfsCapRevisionMask == vfsCapRevision3 && len(caps) == vfsCapSize3:
+		rootid = binary.LittleEndian.Uint32(caps[vfsCapSize2:])
+	default:
+		return nil, errors.New(fmt.Sprintf("Unsupported %s revision %#x with %d bytes", capabilityXattr, magic&vfsCapRevisionMask, len(caps)))
+	}
+	hostID, ok := container.HostID(ns.UIDMappings, rootid)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Capability rootid %d is not mapped into the user namespace", rootid))
+	}
+
+	shifted := make([]byte, vfsCapSize3)
+	copy(shifted, caps[:vfsCapSize2])
+	binary.LittleEndian.PutUint32(shifted, magic&^vfsCapRevisionMask|vfsCapRevision3)
+	binary.LittleEndian.PutUint32(shifted[vfsCapSize2:], hostID)
+	return shifted, nil
+}
@@ -0,0 +1,196 @@
+package idmap
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/tluo-github/cri-impl/pkg/container"
+	"golang.org/x/sys/unix"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// subordinate id 文件, 格式为每行 <用户名或 uid>:<起点>:<数量>
+const (
+	SubUIDFile = "/etc/subuid"
+	SubGIDFile = "/etc/subgid"
+)
+
+// Range 主机上的一段 id [Start, Start+Size)
+type Range struct {
+	Start uint32
+	Size  uint32
+}
+
+// ReadSubIDs 读取 path 中属于 name (用户名, 也匹配该用户的 uid) 的范围
+func ReadSubIDs(path string, name string) ([]Range, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	names := map[string]bool{name: true}
+	if u, err := user.Lookup(name); err == nil {
+		names[u.Uid] = true
+	}
+	var ranges []Range
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.Split(line, ":")
+		if len(parts) != 3 || !names[parts[0]] {
+			continue
+		}
+		start, err := strconv.ParseUint(parts[1], 10, 32)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid line %q in %s", line, path))
+		}
+		size, err := strconv.ParseUint(parts[2], 10, 32)
+		if err != nil || start+size > 1<<32-1 {
+			return nil, errors.New(fmt.Sprintf("Invalid line %q in %s", line, path))
+		}
+		if size > 0 {
+			ranges = append(ranges, Range{Start: uint32(start), Size: uint32(size)})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(ranges) == 0 {
+		return nil, errors.New(fmt.Sprintf("No subordinate ids for %s in %s", name, path))
+	}
+	return ranges, nil
+}
+
+// HostRanges 映射占用的主机 id
+func HostRanges(mappings []container.IDMapping) []Range {
+	var ranges []Range
+	for _, m := range mappings {
+		ranges = append(ranges, Range{Start: m.HostID, Size: m.Size})
+	}
+	return ranges
+}
+
+// Allocate 在 available 中找到第一段长度为 size 且不与 used 重叠的 id, 返回起点
+func Allocate(available []Range, used []Range, size uint32) (uint32, error) {
+	used = append([]Range{}, used...)
+	sort.Slice(used, func(i, j int) bool { return used[i].Start < used[j].Start })
+	for _, r := range available {
+		start := uint64(r.Start)
+		end := uint64(r.Start) + uint64(r.Size)
+		for _, u := range used {
+			ustart, uend := uint64(u.Start), uint64(u.Start)+uint64(u.Size)
+			if uend <= start || ustart >= end {
+				continue
+			}
+			if ustart >= start+uint64(size) {
+				break
+			}
+			start = uend
+		}
+		if start+uint64(size) <= end {
+			return uint32(start), nil
+		}
+	}
+	return 0, errors.New(fmt.Sprintf("No free range of %d subordinate ids", size))
+}
+
+// Covers 判断 r 是否完全在 available 中, r 可以跨越相邻的多段
+func Covers(available []Range, r Range) bool {
+	available = append([]Range{}, available...)
+	sort.Slice(available, func(i, j int) bool { return available[i].Start < available[j].Start })
+	pos := uint64(r.Start)
+	end := uint64(r.Start) + uint64(r.Size)
+	for _, a := range available {
+		astart, aend := uint64(a.Start), uint64(a.Start)+uint64(a.Size)
+		if astart <= pos && aend > pos {
+			pos = aend
+		}
+	}
+	return pos >= end
+}
+
+// Overlaps 判断 r 是否与 used 中的任何一段重叠
+func Overlaps(used []Range, r Range) bool {
+	start, end := uint64(r.Start), uint64(r.Start)+uint64(r.Size)
+	for _, u := range used {
+		ustart, uend := uint64(u.Start), uint64(u.Start)+uint64(u.Size)
+		if ustart < end && uend > start {
+			return true
+		}
+	}
+	return false
+}
+
+// inode 文件在主机上的唯一标识
+type inode struct {
+	dev uint64
+	ino uint64
+}
+
+// ChownTree 按映射修改 dir 下所有文件 (包括 dir 本身) 的属主, 文件原来的属主视为容器内的 id
+// 用于复制 rootfs 之后, 容器内的 root 才能访问和修改自己的文件
+// 复制时保留了硬链接, 同一个 inode 的多个路径只修改一次, 否则第二次看到的已经是映射后的主机 id
+// chown 会清除文件的 capability (如 ping 的 cap_net_raw), 修改属主后按映射重新写入
+func ChownTree(dir string, ns container.UserNamespace) error {
+	shifted := map[inode]bool{}
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		st, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return errors.New(fmt.Sprintf("Can't get the owner of %s", path))
+		}
+		if st.Nlink > 1 && info.Mode().IsRegular() {
+			key := inode{dev: uint64(st.Dev), ino: st.Ino}
+			if shifted[key] {
+				return nil
+			}
+			shifted[key] = true
+		}
+		uid, ok := container.HostID(ns.UIDMappings, st.Uid)
+		if !ok {
+			return errors.New(fmt.Sprintf("Owner uid %d of %s is not mapped into the user namespace", st.Uid, path))
+		}
+		gid, ok := container.HostID(ns.GIDMappings, st.Gid)
+		if !ok {
+			return errors.New(fmt.Sprintf("Owner gid %d of %s is not mapped into the user namespace", st.Gid, path))
+		}
+		var caps []byte
+		if info.Mode().IsRegular() {
+			if caps, err = readFileCaps(path); err != nil {
+				return errors.New(fmt.Sprintf("Can't read capabilities of %s: %v", path, err))
+			}
+			if caps != nil {
+				if caps, err = shiftFileCaps(caps, ns); err != nil {
+					return errors.New(fmt.Sprintf("Can't shift capabilities of %s: %v", path, err))
+				}
+			}
+		}
+		if err := os.Lchown(path, int(uid), int(gid)); err != nil {
+			return err
+		}
+		// chown 会清除 setuid/setgid 位, 需要恢复
+		if info.Mode()&(os.ModeSetuid|os.ModeSetgid) != 0 && info.Mode()&os.ModeSymlink == 0 {
+			if err := os.Chmod(path, info.Mode()); err != nil {
+				return err
+			}
+		}
+		if caps != nil {
+			if err := unix.Lsetxattr(path, capabilityXattr, caps, 0); err != nil {
+				return errors.New(fmt.Sprintf("Can't restore capabilities of %s: %v", path, err))
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,248 @@
+package idmap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/tluo-github/cri-impl/pkg/container"
+	"golang.org/x/sys/unix"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestAllocate(t *testing.T) {
+	available := []Range{{Start: 100000, Size: 65536 * 3}}
+	cases := []struct {
+		name      string
+		available []Range
+		used      []Range
+		size      uint32
+		want      uint32
+		fail      bool
+	}{
+		{"empty", available, nil, 65536, 100000, false},
+		{"after used", available, []Range{{100000, 65536}}, 65536, 165536, false},
+		{"gap between used", available, []Range{{100000, 65536}, {231072, 65536}}, 65536, 165536, false},
+		{"gap too small", available, []Range{{100000, 65536}, {200000, 65536}}, 65536, 0, true},
+		{"unsorted used", available, []Range{{165536, 65536}, {100000, 65536}}, 65536, 231072, false},
+		{"used outside available", available, []Range{{0, 100000}, {296608, 1000}}, 65536, 100000, false},
+		{"second available range", []Range{{1000, 10}, {5000, 100}}, []Range{{1000, 5}}, 10, 5000, false},
+		{"exhausted", available, []Range{{100000, 65536 * 3}}, 1, 0, true},
+		{"too large", available, nil, 65536 * 4, 0, true},
+		{"end of id space", []Range{{1<<32 - 11, 10}}, nil, 10, 1<<32 - 11, false},
+	}
+	for _, c := range cases {
+		got, err := Allocate(c.available, c.used, c.size)
+		if c.fail {
+			if err == nil {
+				t.Errorf("%s: Allocate = %d, want error", c.name, got)
+			}
+			continue
+		}
+		if err != nil || got != c.want {
+			t.Errorf("%s: Allocate = %d, %v, want %d", c.name, got, err, c.want)
+		}
+	}
+}
+
+func TestCoversAndOverlaps(t *testing.T) {
+	available := []Range{{Start: 200000, Size: 1000}, {Start: 100000, Size: 100000}}
+	for _, c := range []struct {
+		r    Range
+		want bool
+	}{
+		{Range{100000, 65536}, true},
+		{Range{190000, 11000}, true},
+		{Range{190000, 11001}, false},
+		{Range{99999, 10}, false},
+		{Range{0, 1}, false},
+	} {
+		if got := Covers(available, c.r); got != c.want {
+			t.Errorf("Covers(%+v) = %v, want %v", c.r, got, c.want)
+		}
+	}
+
+	used := []Range{{Start: 100000, Size: 65536}}
+	for _, c := range []struct {
+		r    Range
+		want bool
+	}{
+		{Range{165536, 10}, false},
+		{Range{165535, 10}, true},
+		{Range{99990, 10}, false},
+		{Range{99990, 11}, true},
+	} {
+		if got := Overlaps(used, c.r); got != c.want {
+			t.Errorf("Overlaps(%+v) = %v, want %v", c.r, got, c.want)
+		}
+	}
+}
+
+func TestReadSubIDs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "idmap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "subuid")
+	content := "# comment\ncontainers:100000:65536\nother:200000:65536\ncontainers:300000:1000\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ranges, err := ReadSubIDs(path, "containers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ranges) != 2 || ranges[0] != (Range{100000, 65536}) || ranges[1] != (Range{300000, 1000}) {
+		t.Errorf("ReadSubIDs = %+v", ranges)
+	}
+	if _, err := ReadSubIDs(path, "nobody-here"); err == nil {
+		t.Error("ReadSubIDs for a user without ranges succeeded")
+	}
+}
+
+func owner(t *testing.T, path string) (uint32, uint32) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := info.Sys().(*syscall.Stat_t)
+	return st.Uid, st.Gid
+}
+
+func TestChownTree(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing file owners requires root")
+	}
+	dir, err := ioutil.TempDir("", "idmap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// rootfs 中的硬链接 (如 busybox 的 applet) 和属于非 root 用户的文件
+	bin := filepath.Join(dir, "bin")
+	if err := os.Mkdir(bin, 0755); err != nil {
+		t.Fatal(err)
+	}
+	busybox := filepath.Join(bin, "busybox")
+	if err := ioutil.WriteFile(busybox, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"sh", "ls"} {
+		if err := os.Link(busybox, filepath.Join(bin, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("busybox", filepath.Join(bin, "cat")); err != nil {
+		t.Fatal(err)
+	}
+	home := filepath.Join(dir, "home")
+	if err := os.Mkdir(home, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chown(home, 1000, 1000); err != nil {
+		t.Fatal(err)
+	}
+	su := filepath.Join(bin, "su")
+	if err := ioutil.WriteFile(su, nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(su, 0755|os.ModeSetuid); err != nil {
+		t.Fatal(err)
+	}
+	// ping 的 cap_net_raw (v2, 生效), 文件系统不支持 security xattr 时跳过
+	ping := filepath.Join(bin, "ping")
+	if err := ioutil.WriteFile(ping, nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Lsetxattr(ping, capabilityXattr, capData(vfsCapRevision2|1, 1<<13, 0)[:vfsCapSize2], 0); err != nil {
+		if err != unix.ENOTSUP {
+			t.Fatal(err)
+		}
+		ping = ""
+	}
+
+	ns := container.UserNamespace{
+		UIDMappings: []container.IDMapping{{ContainerID: 0, HostID: 100000, Size: 65536}},
+		GIDMappings: []container.IDMapping{{ContainerID: 0, HostID: 200000, Size: 65536}},
+	}
+	if err := ChownTree(dir, ns); err != nil {
+		t.Fatalf("ChownTree: %v", err)
+	}
+	for _, path := range []string{dir, bin, busybox, filepath.Join(bin, "sh"), filepath.Join(bin, "ls"), filepath.Join(bin, "cat"), su} {
+		if uid, gid := owner(t, path); uid != 100000 || gid != 200000 {
+			t.Errorf("%s owned by %d:%d, want 100000:200000", path, uid, gid)
+		}
+	}
+	if uid, gid := owner(t, home); uid != 101000 || gid != 201000 {
+		t.Errorf("%s owned by %d:%d, want 101000:201000", home, uid, gid)
+	}
+	if info, err := os.Stat(su); err != nil || info.Mode()&os.ModeSetuid == 0 {
+		t.Errorf("setuid bit of %s was not restored: %v", su, info.Mode())
+	}
+	if ping != "" {
+		caps, err := readFileCaps(ping)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := capData(vfsCapRevision3|1, 1<<13, 100000); !bytes.Equal(caps, want) {
+			t.Errorf("capabilities of %s = %x, want %x", ping, caps, want)
+		}
+	}
+
+	// 属主不在映射中时失败
+	unmapped := filepath.Join(dir, "unmapped")
+	if err := os.Mkdir(unmapped, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chown(unmapped, 70000, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := ChownTree(unmapped, ns); err == nil {
+		t.Error("ChownTree succeeded with an unmapped owner")
+	}
+}
+
+// capData 返回 v3 格式的 security.capability, v2 取前 20 字节
+func capData(magic uint32, permitted uint32, rootid uint32) []byte {
+	data := make([]byte, vfsCapSize3)
+	binary.LittleEndian.PutUint32(data, magic)
+	binary.LittleEndian.PutUint32(data[4:], permitted)
+	binary.LittleEndian.PutUint32(data[vfsCapSize2:], rootid)
+	return data
+}
+
+func TestShiftFileCaps(t *testing.T) {
+	ns := container.UserNamespace{
+		UIDMappings: []container.IDMapping{{ContainerID: 0, HostID: 100000, Size: 1000}},
+	}
+	cases := []struct {
+		name string
+		caps []byte
+		want []byte
+		fail bool
+	}{
+		{"v2", capData(vfsCapRevision2, 1<<13, 0)[:vfsCapSize2], capData(vfsCapRevision3, 1<<13, 100000), false},
+		{"v2 effective", capData(vfsCapRevision2|1, 1<<13, 0)[:vfsCapSize2], capData(vfsCapRevision3|1, 1<<13, 100000), false},
+		{"v3 rootid", capData(vfsCapRevision3|1, 1<<10, 10), capData(vfsCapRevision3|1, 1<<10, 100010), false},
+		{"v3 unmapped rootid", capData(vfsCapRevision3, 1<<10, 5000), nil, true},
+		{"v2 with v3 size", capData(vfsCapRevision2, 1<<13, 0), nil, true},
+		{"v1", capData(0x01000000, 1<<13, 0)[:12], nil, true},
+		{"truncated", []byte{0, 0}, nil, true},
+	}
+	for _, c := range cases {
+		got, err := shiftFileCaps(c.caps, ns)
+		if c.fail {
+			if err == nil {
+				t.Errorf("%s: shiftFileCaps = %x, want error", c.name, got)
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(got, c.want) {
+			t.Errorf("%s: shiftFileCaps = %x, %v, want %x", c.name, got, err, c.want)
+		}
+	}
+}
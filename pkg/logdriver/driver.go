@@ -0,0 +1,211 @@
+package logdriver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/tluo-github/cri-impl/pkg/logs"
+	"k8s.io/klog"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	// File shim 直接写入 CRI 格式的日志文件,不需要转发
+	File = "file"
+	// Syslog 以 RFC5424 格式发送到本地 syslog unix socket
+	Syslog = "syslog"
+	// Fluentd 以 Fluentd forward 协议发送到 TCP 端点
+	Fluentd = "fluentd"
+)
+
+const (
+	defaultSyslogAddress  = "unixgram:///dev/log"
+	defaultFluentdAddress = "tcp://127.0.0.1:24224"
+
+	// bufferSize 等待发送的日志条数,缓冲区满时 Log 阻塞
+	bufferSize      = 1024
+	dialTimeout     = 5 * time.Second
+	writeTimeout    = 10 * time.Second
+	retryBaseDelay  = 500 * time.Millisecond
+	retryMaxDelay   = 30 * time.Second
+	closeFlushLimit = 5 * time.Second
+)
+
+// Config 容器的日志驱动配置
+type Config struct {
+	Type string `json:"type,omitempty"`
+	// Address syslog: unix:///path 或 unixgram:///path, fluentd: tcp://host:port
+	Address string `json:"address,omitempty"`
+	// Tag syslog APP-NAME 或 fluentd tag, 默认为容器名
+	Tag string `json:"tag,omitempty"`
+}
+
+// IsFile 是否只使用日志文件,不需要守护进程转发
+func (c Config) IsFile() bool {
+	return c.Type == "" || c.Type == File
+}
+
+func (c Config) Validate() error {
+	switch c.Type {
+	case "", File:
+		return nil
+	case Syslog, Fluentd:
+		_, _, err := c.endpoint()
+		return err
+	}
+	return errors.New(fmt.Sprintf("Unknown log driver %q", c.Type))
+}
+
+// endpoint 解析 Address,返回 net.Dial 使用的 network 和 address
+func (c Config) endpoint() (string, string, error) {
+	addr := c.Address
+	if addr == "" {
+		addr = defaultSyslogAddress
+		if c.Type == Fluentd {
+			addr = defaultFluentdAddress
+		}
+	}
+	parts := strings.SplitN(addr, "://", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", "", errors.New(fmt.Sprintf("Invalid log driver address %q", addr))
+	}
+	network := parts[0]
+	switch {
+	case c.Type == Syslog && (network == "unix" || network == "unixgram"):
+	case c.Type == Fluentd && network == "tcp":
+	default:
+		return "", "", errors.New(fmt.Sprintf("Unsupported %s address %q", c.Type, addr))
+	}
+	return network, parts[1], nil
+}
+
+// ContainerInfo 日志记录中附带的容器信息
+type ContainerInfo struct {
+	ID   string
+	Name string
+}
+
+// Driver 将容器的日志消息发送到外部收集端
+type Driver interface {
+	// Log 发送一条日志.消息先进入缓冲区,缓冲区满时阻塞,直到有空间或 ctx 结束
+	Log(m *logs.Message) error
+	// Close 尽量发送缓冲区中剩余的日志并关闭连接
+	Close() error
+}
+
+type encoder func(m *logs.Message) ([]byte, error)
+
+// New 创建一个日志驱动,ctx 结束后 Log 不再阻塞.cfg 不能是 File
+func New(ctx context.Context, cfg Config, info ContainerInfo) (Driver, error) {
+	network, address, err := cfg.endpoint()
+	if err != nil {
+		return nil, err
+	}
+	tag := cfg.Tag
+	if tag == "" {
+		tag = info.Name
+	}
+
+	var enc encoder
+	switch cfg.Type {
+	case Syslog:
+		enc = syslogEncoder(tag, info, network == "unix")
+	case Fluentd:
+		enc = fluentEncoder(tag, info)
+	default:
+		return nil, errors.New(fmt.Sprintf("Log driver %q does not forward", cfg.Type))
+	}
+
+	d := &bufferedDriver{
+		ctx:     ctx,
+		network: network,
+		address: address,
+		encode:  enc,
+		frames:  make(chan []byte, bufferSize),
+		done:    make(chan struct{}),
+	}
+	go d.run()
+	return d, nil
+}
+
+// bufferedDriver 通过有界缓冲区异步发送,连接失败时按指数退避重连,失败的日志会被重发
+type bufferedDriver struct {
+	ctx     context.Context
+	network string
+	address string
+	encode  encoder
+
+	frames chan []byte
+	done   chan struct{}
+	conn   net.Conn
+}
+
+func (d *bufferedDriver) Log(m *logs.Message) error {
+	frame, err := d.encode(m)
+	if err != nil {
+		return err
+	}
+	select {
+	case d.frames <- frame:
+		return nil
+	case <-d.ctx.Done():
+		return d.ctx.Err()
+	}
+}
+
+func (d *bufferedDriver) Close() error {
+	close(d.frames)
+	select {
+	case <-d.done:
+	case <-time.After(closeFlushLimit):
+		klog.Warningf("log driver %s://%s: dropped %d buffered lines on close", d.network, d.address, len(d.frames))
+	}
+	return nil
+}
+
+func (d *bufferedDriver) run() {
+	defer close(d.done)
+	defer func() {
+		if d.conn != nil {
+			d.conn.Close()
+		}
+	}()
+
+	for frame := range d.frames {
+		delay := retryBaseDelay
+		for {
+			err := d.write(frame)
+			if err == nil {
+				break
+			}
+			klog.Warningf("log driver %s://%s: write failed with err:%v, retrying in %v", d.network, d.address, err, delay)
+			select {
+			case <-time.After(delay):
+			case <-d.ctx.Done():
+				return
+			}
+			if delay *= 2; delay > retryMaxDelay {
+				delay = retryMaxDelay
+			}
+		}
+	}
+}
+
+func (d *bufferedDriver) write(frame []byte) error {
+	if d.conn == nil {
+		conn, err := net.DialTimeout(d.network, d.address, dialTimeout)
+		if err != nil {
+			return err
+		}
+		d.conn = conn
+	}
+	d.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if _, err := d.conn.Write(frame); err != nil {
+		d.conn.Close()
+		d.conn = nil
+		return err
+	}
+	return nil
+}
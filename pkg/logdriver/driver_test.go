@@ -0,0 +1,274 @@
+package logdriver
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/tluo-github/cri-impl/pkg/logs"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testInfo = ContainerInfo{ID: "0123abcd", Name: `web"1]`}
+
+func testMessages() []*logs.Message {
+	ts := time.Date(2021, 7, 1, 10, 0, 0, 123, time.FixedZone("CST", 8*3600))
+	return []*logs.Message{
+		{Timestamp: ts, Stream: logs.Stdout, Log: []byte("hello world")},
+		{Timestamp: ts.Add(time.Second), Stream: logs.Stderr, Log: []byte(strings.Repeat("e", 40))},
+	}
+}
+
+func socketPath(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "logdriver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, "log.sock")
+}
+
+func newTestDriver(t *testing.T, cfg Config) Driver {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	d, err := New(ctx, cfg, testInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range testMessages() {
+		if err := d.Log(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+func syslogWant(t *testing.T) []string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sd := `[container@32473 id="0123abcd" name="web\"1\]"`
+	return []string{
+		"<30>1 2021-07-01T02:00:00.000000123Z " + hostname + " app - - " + sd + ` stream="stdout"] hello world`,
+		"<27>1 2021-07-01T02:00:01.000000123Z " + hostname + " app - - " + sd + ` stream="stderr"] ` + strings.Repeat("e", 40),
+	}
+}
+
+func TestSyslogUnixgram(t *testing.T) {
+	path := socketPath(t)
+	pc, err := net.ListenPacket("unixgram", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	newTestDriver(t, Config{Type: Syslog, Address: "unixgram://" + path, Tag: "app"})
+
+	// 每条消息一个数据报, 没有换行
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4096)
+	for _, want := range syslogWant(t) {
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(buf[:n]); got != want {
+			t.Errorf("syslog datagram = %q, want %q", got, want)
+		}
+	}
+}
+
+func TestSyslogUnixStream(t *testing.T) {
+	path := socketPath(t)
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	newTestDriver(t, Config{Type: Syslog, Address: "unix://" + path, Tag: "app"})
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// stream socket 以换行分隔消息
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	rd := bufio.NewReader(conn)
+	for _, want := range syslogWant(t) {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.TrimSuffix(line, "\n"); got != want {
+			t.Errorf("syslog frame = %q, want %q", got, want)
+		}
+	}
+}
+
+func TestFluentForward(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	// 没有设置 tag 时使用容器名
+	newTestDriver(t, Config{Type: Fluentd, Address: "tcp://" + ln.Addr().String()})
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	rd := bufio.NewReader(conn)
+	for _, m := range testMessages() {
+		got, err := decodeMsgpack(rd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := fmt.Sprint([]interface{}{
+			testInfo.Name,
+			eventTime{uint32(m.Timestamp.Unix()), uint32(m.Timestamp.Nanosecond())},
+			map[string]interface{}{
+				"container_id":   testInfo.ID,
+				"container_name": testInfo.Name,
+				"source":         m.Stream,
+				"log":            string(m.Log),
+			},
+		})
+		if fmt.Sprint(got) != want {
+			t.Errorf("fluent forward message = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestLogAfterContextDone(t *testing.T) {
+	path := socketPath(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	// 没有收集端时缓冲区填满后 Log 阻塞, ctx 结束后返回错误
+	d, err := New(ctx, Config{Type: Syslog, Address: "unixgram://" + path}, testInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	m := testMessages()[0]
+	// 发送 goroutine 取出一条后不断重试
+	for i := 0; i < bufferSize+1; i++ {
+		if err := d.Log(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- d.Log(m) }()
+	select {
+	case err := <-errc:
+		t.Fatalf("Log with a full buffer returned %v before ctx was done", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	cancel()
+	select {
+	case err := <-errc:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Log after ctx was done returned %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Log is still blocked after ctx was done")
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	for _, tc := range []struct {
+		cfg Config
+		err bool
+	}{
+		{cfg: Config{}},
+		{cfg: Config{Type: File}},
+		{cfg: Config{Type: Syslog}},
+		{cfg: Config{Type: Syslog, Address: "unix:///run/syslog.sock"}},
+		{cfg: Config{Type: Fluentd}},
+		{cfg: Config{Type: Fluentd, Address: "tcp://10.0.0.1:24224"}},
+		{cfg: Config{Type: "journald"}, err: true},
+		{cfg: Config{Type: Syslog, Address: "tcp://127.0.0.1:514"}, err: true},
+		{cfg: Config{Type: Syslog, Address: "/dev/log"}, err: true},
+		{cfg: Config{Type: Fluentd, Address: "unix:///run/fluentd.sock"}, err: true},
+		{cfg: Config{Type: Fluentd, Address: "tcp://"}, err: true},
+	} {
+		if err := tc.cfg.Validate(); (err != nil) != tc.err {
+			t.Errorf("Validate(%+v) = %v, want error %v", tc.cfg, err, tc.err)
+		}
+	}
+}
+
+// eventTime 解码后的 Fluentd EventTime
+type eventTime struct {
+	sec, nsec uint32
+}
+
+// decodeMsgpack 只解码 fluentEncoder 使用的类型
+func decodeMsgpack(rd *bufio.Reader) (interface{}, error) {
+	b, err := rd.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	readN := func(n int) ([]byte, error) {
+		buf := make([]byte, n)
+		_, err := io.ReadFull(rd, buf)
+		return buf, err
+	}
+	switch {
+	case b&0xf0 == 0x90:
+		var a []interface{}
+		for i := 0; i < int(b&0x0f); i++ {
+			v, err := decodeMsgpack(rd)
+			if err != nil {
+				return nil, err
+			}
+			a = append(a, v)
+		}
+		return a, nil
+	case b&0xf0 == 0x80:
+		m := make(map[string]interface{})
+		for i := 0; i < int(b&0x0f); i++ {
+			k, err := decodeMsgpack(rd)
+			if err != nil {
+				return nil, err
+			}
+			v, err := decodeMsgpack(rd)
+			if err != nil {
+				return nil, err
+			}
+			m[fmt.Sprint(k)] = v
+		}
+		return m, nil
+	case b&0xe0 == 0xa0:
+		s, err := readN(int(b & 0x1f))
+		return string(s), err
+	case b == 0xd9:
+		n, err := rd.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		s, err := readN(int(n))
+		return string(s), err
+	case b == 0xd7:
+		buf, err := readN(9)
+		if err != nil {
+			return nil, err
+		}
+		if buf[0] != 0 {
+			return nil, errors.New(fmt.Sprintf("unexpected ext type %d", buf[0]))
+		}
+		return eventTime{binary.BigEndian.Uint32(buf[1:5]), binary.BigEndian.Uint32(buf[5:9])}, nil
+	}
+	return nil, errors.New(fmt.Sprintf("unexpected msgpack type 0x%x", b))
+}
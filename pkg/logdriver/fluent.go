@@ -0,0 +1,78 @@
+package logdriver
+
+import (
+	"encoding/binary"
+	"github.com/tluo-github/cri-impl/pkg/logs"
+	"math"
+)
+
+// fluentEncoder 将日志编码为 Fluentd forward 协议的 Message 模式: [tag, EventTime, record]
+// https://github.com/fluent/fluentd/wiki/Forward-Protocol-Specification-v1
+func fluentEncoder(tag string, info ContainerInfo) encoder {
+	return func(m *logs.Message) ([]byte, error) {
+		var b msgpackBuffer
+		b.arrayHeader(3)
+		b.str(tag)
+		b.eventTime(m.Timestamp.Unix(), m.Timestamp.Nanosecond())
+		b.mapHeader(4)
+		b.str("container_id")
+		b.str(info.ID)
+		b.str("container_name")
+		b.str(info.Name)
+		b.str("source")
+		b.str(m.Stream)
+		b.str("log")
+		b.str(string(m.Log))
+		return b.buf, nil
+	}
+}
+
+// msgpackBuffer 只实现 forward 协议需要的 msgpack 类型
+type msgpackBuffer struct {
+	buf []byte
+}
+
+func (b *msgpackBuffer) arrayHeader(n int) {
+	if n < 16 {
+		b.buf = append(b.buf, 0x90|byte(n))
+		return
+	}
+	b.buf = append(b.buf, 0xdc, byte(n>>8), byte(n))
+}
+
+func (b *msgpackBuffer) mapHeader(n int) {
+	if n < 16 {
+		b.buf = append(b.buf, 0x80|byte(n))
+		return
+	}
+	b.buf = append(b.buf, 0xde, byte(n>>8), byte(n))
+}
+
+func (b *msgpackBuffer) str(s string) {
+	n := len(s)
+	switch {
+	case n < 32:
+		b.buf = append(b.buf, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		b.buf = append(b.buf, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		b.buf = append(b.buf, 0xda, byte(n>>8), byte(n))
+	default:
+		b.buf = append(b.buf, 0xdb)
+		b.uint32(uint32(n))
+	}
+	b.buf = append(b.buf, s...)
+}
+
+// eventTime Fluentd EventTime 扩展类型: fixext8, type 0, 秒和纳秒各 32 位大端
+func (b *msgpackBuffer) eventTime(sec int64, nsec int) {
+	b.buf = append(b.buf, 0xd7, 0x00)
+	b.uint32(uint32(sec))
+	b.uint32(uint32(nsec))
+}
+
+func (b *msgpackBuffer) uint32(v uint32) {
+	var tmp [4]byte
+	binary.BigEndian.PutUint32(tmp[:], v)
+	b.buf = append(b.buf, tmp[:]...)
+}
@@ -0,0 +1,71 @@
+package logdriver
+
+import (
+	"fmt"
+	"github.com/tluo-github/cri-impl/pkg/logs"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	syslogFacilityDaemon = 3
+	syslogSeverityErr    = 3
+	syslogSeverityInfo   = 6
+	// syslogEnterpriseID RFC5424 示例用的私有企业号,用于 structured data ID
+	syslogEnterpriseID = 32473
+)
+
+// syslogEncoder 将日志编码为 RFC5424 消息:
+// <PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID [SD-ELEMENT] MSG
+// stream 类型的 unix socket 以换行分隔消息(RFC6587 non-transparent framing)
+func syslogEncoder(tag string, info ContainerInfo, stream bool) encoder {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+	appName := syslogHeaderField(tag, 48)
+	return func(m *logs.Message) ([]byte, error) {
+		severity := syslogSeverityInfo
+		if m.Stream == logs.Stderr {
+			severity = syslogSeverityErr
+		}
+		msg := fmt.Sprintf("<%d>1 %s %s %s - - [container@%d id=\"%s\" name=\"%s\" stream=\"%s\"] %s",
+			syslogFacilityDaemon*8+severity,
+			m.Timestamp.UTC().Format(time.RFC3339Nano),
+			syslogHeaderField(hostname, 255),
+			appName,
+			syslogEnterpriseID,
+			syslogParamValue(info.ID),
+			syslogParamValue(info.Name),
+			m.Stream,
+			m.Log,
+		)
+		if stream {
+			msg += "\n"
+		}
+		return []byte(msg), nil
+	}
+}
+
+// syslogHeaderField header 字段只能包含可打印的 ASCII 字符且不能为空
+func syslogHeaderField(s string, max int) string {
+	var b strings.Builder
+	for _, c := range s {
+		if c > 32 && c < 127 {
+			b.WriteRune(c)
+		}
+		if b.Len() == max {
+			break
+		}
+	}
+	if b.Len() == 0 {
+		return "-"
+	}
+	return b.String()
+}
+
+// syslogParamValue PARAM-VALUE 中的 '"', '\' 和 ']' 需要转义
+func syslogParamValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(s)
+}
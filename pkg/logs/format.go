@@ -0,0 +1,73 @@
+package logs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// CRI 日志行格式: <RFC3339Nano 时间戳> <stream> <tag> <content>
+// tag 为 P(partial) 表示该行是一条消息的一部分,F(full) 表示消息结束
+const (
+	Stdout = "stdout"
+	Stderr = "stderr"
+
+	tagPartial = "P"
+	tagFull    = "F"
+)
+
+const timestampFormat = time.RFC3339Nano
+
+// Line 日志文件中的一行
+type Line struct {
+	Timestamp time.Time
+	Stream    string
+	Partial   bool
+	Content   []byte
+}
+
+// ParseLine 解析一行 CRI 格式的日志,line 不包含结尾的换行符
+func ParseLine(line []byte) (*Line, error) {
+	fields := bytes.SplitN(line, []byte{' '}, 4)
+	if len(fields) < 3 {
+		return nil, errors.New(fmt.Sprintf("Unexpected log line format %q", line))
+	}
+	ts, err := time.Parse(timestampFormat, string(fields[0]))
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Unexpected log timestamp %q", fields[0]))
+	}
+	stream := string(fields[1])
+	if stream != Stdout && stream != Stderr {
+		return nil, errors.New(fmt.Sprintf("Unexpected log stream %q", stream))
+	}
+	l := &Line{Timestamp: ts, Stream: stream}
+	switch string(fields[2]) {
+	case tagPartial:
+		l.Partial = true
+	case tagFull:
+	default:
+		return nil, errors.New(fmt.Sprintf("Unexpected log tag %q", fields[2]))
+	}
+	if len(fields) == 4 {
+		l.Content = fields[3]
+	}
+	return l, nil
+}
+
+// FormatLine 将一段内容格式化为 CRI 日志行(包含结尾的换行符)
+func FormatLine(ts time.Time, stream string, partial bool, content []byte) []byte {
+	tag := tagFull
+	if partial {
+		tag = tagPartial
+	}
+	buf := make([]byte, 0, len(content)+64)
+	buf = append(buf, ts.Format(timestampFormat)...)
+	buf = append(buf, ' ')
+	buf = append(buf, stream...)
+	buf = append(buf, ' ')
+	buf = append(buf, tag...)
+	buf = append(buf, ' ')
+	buf = append(buf, content...)
+	return append(buf, '\n')
+}
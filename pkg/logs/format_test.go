@@ -0,0 +1,63 @@
+package logs
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestParseLine(t *testing.T) {
+	ts := "2021-07-01T10:00:00.123456789Z"
+	for _, tc := range []struct {
+		line    string
+		stream  string
+		partial bool
+		content string
+		err     bool
+	}{
+		{line: ts + " stdout F hello", stream: Stdout, content: "hello"},
+		{line: ts + " stderr P part", stream: Stderr, partial: true, content: "part"},
+		// 内容中的空格保留
+		{line: ts + " stdout F a  b c ", stream: Stdout, content: "a  b c "},
+		// 空行只有三个字段
+		{line: ts + " stdout F", stream: Stdout},
+		{line: ts + " stdout F ", stream: Stdout},
+		{line: "", err: true},
+		{line: "garbage", err: true},
+		{line: ts + " stdout", err: true},
+		{line: "2021-07-01 stdout F hello", err: true},
+		{line: ts + " stdin F hello", err: true},
+		{line: ts + " stdout X hello", err: true},
+		{line: ts + " stdout p hello", err: true},
+	} {
+		l, err := ParseLine([]byte(tc.line))
+		if tc.err {
+			if err == nil {
+				t.Errorf("ParseLine(%q) = %+v, want error", tc.line, l)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseLine(%q): %v", tc.line, err)
+			continue
+		}
+		if l.Stream != tc.stream || l.Partial != tc.partial || string(l.Content) != tc.content {
+			t.Errorf("ParseLine(%q) = %+v", tc.line, l)
+		}
+		if want, _ := time.Parse(time.RFC3339Nano, ts); !l.Timestamp.Equal(want) {
+			t.Errorf("ParseLine(%q) timestamp = %v, want %v", tc.line, l.Timestamp, want)
+		}
+	}
+}
+
+func TestFormatLine(t *testing.T) {
+	ts := time.Date(2021, 7, 1, 10, 0, 0, 5, time.UTC)
+	line := FormatLine(ts, Stderr, true, []byte("a b"))
+	if want := "2021-07-01T10:00:00.000000005Z stderr P a b\n"; string(line) != want {
+		t.Errorf("FormatLine = %q, want %q", line, want)
+	}
+	l, err := ParseLine(bytes.TrimSuffix(line, []byte("\n")))
+	if err != nil || !l.Timestamp.Equal(ts) || l.Stream != Stderr || !l.Partial || string(l.Content) != "a b" {
+		t.Errorf("ParseLine(FormatLine) = %+v, %v", l, err)
+	}
+}
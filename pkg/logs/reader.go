@@ -0,0 +1,249 @@
+package logs
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"k8s.io/klog"
+	"os"
+	"time"
+)
+
+const followPollInterval = 250 * time.Millisecond
+
+// Options 读取容器日志的选项
+type Options struct {
+	// Follow 读到文件末尾后继续等待新的日志
+	Follow bool
+	// Tail > 0 时只输出最后 Tail 条消息
+	Tail int64
+	// Since 只输出该时间之后的消息,零值表示不限制
+	Since time.Time
+	// Stream 只输出 stdout 或 stderr,空字符串表示全部
+	Stream string
+	// Stopped follow 模式下读到文件末尾时调用,返回 true 表示容器已经停止,不会再有新的日志
+	Stopped func() bool
+}
+
+// Message 一条完整的日志消息,partial 行已经被合并
+type Message struct {
+	Timestamp time.Time
+	Stream    string
+	Log       []byte
+}
+
+// ReadLogs 读取 path 中 CRI 格式的日志,对每条符合条件的消息调用 fn
+// 已轮转的旧文件会先于 path 被读取;follow 模式下 path 被轮转后会自动切换到新文件
+func ReadLogs(ctx context.Context, path string, opts Options, fn func(*Message) error) error {
+	r := &reader{
+		opts:     opts,
+		partials: make(map[string]*Message),
+	}
+
+	emit := fn
+	var tail []*Message
+	if opts.Tail > 0 {
+		// 第一次读到文件末尾之前,只保留最后 Tail 条消息
+		emit = func(m *Message) error {
+			if int64(len(tail)) == opts.Tail {
+				tail = tail[1:]
+			}
+			tail = append(tail, m)
+			return nil
+		}
+	}
+	// 先打开当前文件再打开已轮转的文件, 两者之间发生的轮转不会丢失或重复读取文件
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { f.Close() }()
+
+	olds, err := openRotated(path, f)
+	if err != nil {
+		return err
+	}
+	defer closeFiles(olds)
+	for _, old := range olds {
+		r.reset(old)
+		if err := r.readToEOF(emit); err != nil {
+			return err
+		}
+	}
+
+	r.reset(f)
+	if err := r.readToEOF(emit); err != nil {
+		return err
+	}
+	for _, m := range tail {
+		if err := fn(m); err != nil {
+			return err
+		}
+	}
+
+	for opts.Follow {
+		stopped := opts.Stopped != nil && opts.Stopped()
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(followPollInterval):
+		}
+		if err := r.readToEOF(fn); err != nil {
+			return err
+		}
+		if rotated(f, path) {
+			// 旧文件已经读完,切换到轮转后新建的文件
+			nf, err := os.Open(path)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if err != nil {
+				// 写入方还没有重新打开日志文件
+				if stopped {
+					return nil
+				}
+				continue
+			}
+			// 新文件出现时写入方已经不再写旧文件,读完旧文件剩余的内容
+			if err := r.readToEOF(fn); err != nil {
+				nf.Close()
+				return err
+			}
+			f.Close()
+			f = nf
+			r.reset(f)
+			if err := r.readToEOF(fn); err != nil {
+				return err
+			}
+		}
+		if stopped {
+			return nil
+		}
+	}
+	return nil
+}
+
+// rotated 判断已打开的文件 f 是否已经不再是 path
+func rotated(f *os.File, path string) bool {
+	cur, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return os.IsNotExist(err)
+	}
+	return !os.SameFile(cur, fi)
+}
+
+// openRotated 打开 path 已轮转的文件, 从旧到新排序
+// 打开 cur 之后 path 可能又被轮转, 按 inode 跳过 cur 和重复的文件
+func openRotated(path string, cur *os.File) ([]*os.File, error) {
+	var seen []os.FileInfo
+	if fi, err := cur.Stat(); err == nil {
+		seen = append(seen, fi)
+	}
+	var files []*os.File
+	for _, name := range RotatedFiles(path) {
+		f, err := os.Open(name)
+		if os.IsNotExist(err) {
+			// 已经被轮转删除
+			continue
+		}
+		if err != nil {
+			closeFiles(files)
+			return nil, err
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			closeFiles(files)
+			return nil, err
+		}
+		if sameFile(seen, fi) {
+			f.Close()
+			continue
+		}
+		seen = append(seen, fi)
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+func sameFile(seen []os.FileInfo, fi os.FileInfo) bool {
+	for _, s := range seen {
+		if os.SameFile(s, fi) {
+			return true
+		}
+	}
+	return false
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+type reader struct {
+	opts Options
+	rd   *bufio.Reader
+	// pending 文件末尾尚未写完的半行
+	pending []byte
+	// partials 每个 stream 尚未结束的 partial 消息
+	partials map[string]*Message
+}
+
+func (r *reader) reset(f *os.File) {
+	r.rd = bufio.NewReader(f)
+	r.pending = nil
+}
+
+// readToEOF 读取当前能读到的所有完整行
+func (r *reader) readToEOF(fn func(*Message) error) error {
+	for {
+		chunk, err := r.rd.ReadBytes('\n')
+		if err == io.EOF {
+			r.pending = append(r.pending, chunk...)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line := chunk[:len(chunk)-1]
+		if len(r.pending) > 0 {
+			line = append(r.pending, line...)
+			r.pending = nil
+		}
+		if err := r.handleLine(line, fn); err != nil {
+			return err
+		}
+	}
+}
+
+func (r *reader) handleLine(raw []byte, fn func(*Message) error) error {
+	l, err := ParseLine(raw)
+	if err != nil {
+		klog.Warningf("skip malformed log line with err:%v", err)
+		return nil
+	}
+
+	m := r.partials[l.Stream]
+	if m == nil {
+		m = &Message{Timestamp: l.Timestamp, Stream: l.Stream}
+	}
+	m.Log = append(m.Log, l.Content...)
+	if l.Partial {
+		r.partials[l.Stream] = m
+		return nil
+	}
+	delete(r.partials, l.Stream)
+
+	if r.opts.Stream != "" && r.opts.Stream != m.Stream {
+		return nil
+	}
+	if !r.opts.Since.IsZero() && m.Timestamp.Before(r.opts.Since) {
+		return nil
+	}
+	return fn(m)
+}
@@ -0,0 +1,162 @@
+package logs
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var logBase = time.Date(2021, 7, 1, 10, 0, 0, 0, time.UTC)
+
+// testLine 第 n 秒写入的一行日志
+type testLine struct {
+	n       int
+	stream  string
+	partial bool
+	content string
+}
+
+func newLogPath(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, "c1.log")
+}
+
+func writeLog(t *testing.T, path string, lines ...testLine) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, l := range lines {
+		ts := logBase.Add(time.Duration(l.n) * time.Second)
+		if _, err := f.Write(FormatLine(ts, l.stream, l.partial, []byte(l.content))); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readLogs 读取日志, 返回 "<秒> <stream> <内容>" 形式的消息
+func readLogs(t *testing.T, path string, opts Options) []string {
+	var got []string
+	err := ReadLogs(context.Background(), path, opts, func(m *Message) error {
+		got = append(got, strings.Join([]string{
+			m.Timestamp.Sub(logBase).String(), m.Stream, string(m.Log),
+		}, " "))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ReadLogs: %v", err)
+	}
+	return got
+}
+
+func TestReadLogs(t *testing.T) {
+	path := newLogPath(t)
+	writeLog(t, path+".2", testLine{1, Stdout, false, "one"})
+	writeLog(t, path+".1",
+		testLine{2, Stderr, false, "two"},
+		// partial 消息跨越轮转的文件
+		testLine{3, Stdout, true, "thr"},
+	)
+	writeLog(t, path,
+		testLine{4, Stderr, false, "four"},
+		testLine{5, Stdout, false, "ee"},
+		testLine{6, Stdout, true, "fi"},
+		testLine{7, Stdout, true, "v"},
+		testLine{8, Stdout, false, "e"},
+	)
+	// 格式错误的行被跳过
+	if f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644); err == nil {
+		f.WriteString("garbage\n")
+		f.Close()
+	}
+	writeLog(t, path, testLine{9, Stderr, false, "six"})
+
+	all := []string{"1s stdout one", "2s stderr two", "4s stderr four", "3s stdout three", "6s stdout five", "9s stderr six"}
+	for _, tc := range []struct {
+		name string
+		opts Options
+		want []string
+	}{
+		{"all", Options{}, all},
+		{"tail", Options{Tail: 2}, all[4:]},
+		{"tail larger than log", Options{Tail: 10}, all},
+		{"since", Options{Since: logBase.Add(4 * time.Second)}, []string{"4s stderr four", "6s stdout five", "9s stderr six"}},
+		{"stdout", Options{Stream: Stdout}, []string{"1s stdout one", "3s stdout three", "6s stdout five"}},
+		{"stderr tail", Options{Stream: Stderr, Tail: 1}, []string{"9s stderr six"}},
+	} {
+		if got := readLogs(t, path, tc.opts); strings.Join(got, ",") != strings.Join(tc.want, ",") {
+			t.Errorf("%s: ReadLogs = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestReadLogsMissingFile(t *testing.T) {
+	err := ReadLogs(context.Background(), newLogPath(t), Options{}, func(*Message) error { return nil })
+	if !os.IsNotExist(err) {
+		t.Errorf("ReadLogs of a missing file returned %v", err)
+	}
+}
+
+func TestReadLogsFollowStopped(t *testing.T) {
+	path := newLogPath(t)
+	writeLog(t, path, testLine{1, Stdout, false, "one"})
+	stopped := make(chan struct{})
+	opts := Options{
+		Follow: true,
+		Stopped: func() bool {
+			select {
+			case <-stopped:
+				return true
+			default:
+				return false
+			}
+		},
+	}
+	go func() {
+		time.Sleep(2 * followPollInterval)
+		writeLog(t, path, testLine{2, Stdout, false, "two"})
+		close(stopped)
+	}()
+	// 容器停止后读完剩余的日志再返回
+	if got, want := readLogs(t, path, opts), "1s stdout one,2s stdout two"; strings.Join(got, ",") != want {
+		t.Errorf("ReadLogs = %q, want %q", got, want)
+	}
+}
+
+func TestOpenRotated(t *testing.T) {
+	path := newLogPath(t)
+	writeLog(t, path+".1", testLine{1, Stdout, false, "one"})
+	writeLog(t, path, testLine{2, Stdout, false, "two"})
+	cur, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cur.Close()
+
+	// 打开当前文件之后发生轮转, 当前文件变为 path.1
+	if err := Rotate(path, 3); err != nil {
+		t.Fatal(err)
+	}
+	writeLog(t, path, testLine{3, Stdout, false, "three"})
+	files, err := openRotated(path, cur)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFiles(files)
+	var names []string
+	for _, f := range files {
+		names = append(names, filepath.Base(f.Name()))
+	}
+	if got, want := strings.Join(names, ","), "c1.log.2"; got != want {
+		t.Errorf("openRotated = %s, want %s", got, want)
+	}
+}
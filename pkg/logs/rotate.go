@@ -0,0 +1,65 @@
+package logs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 轮转后的日志文件命名为 <path>.1, <path>.2 ... 数字越大越旧
+
+// Rotate 将 path 重命名为 path.1,已有的轮转文件依次后移,最多保留 maxFiles 个文件(包含 path 本身)
+// 调用方需要在 Rotate 之后通知日志写入方(shim)重新打开 path
+func Rotate(path string, maxFiles int) error {
+	if maxFiles < 2 {
+		// 没有可以保留的旧文件,直接删除. 不能原地清空: 正在 follow 的读取方会停在新的文件末尾之后
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	for _, old := range RotatedFiles(path) {
+		if n := rotatedIndex(path, old); n >= maxFiles-1 {
+			if err := os.Remove(old); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	for n := maxFiles - 2; n >= 1; n-- {
+		src := rotatedName(path, n)
+		if err := os.Rename(src, rotatedName(path, n+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(path, rotatedName(path, 1))
+}
+
+// RotatedFiles 返回 path 已轮转的文件,从旧到新排序
+func RotatedFiles(path string) []string {
+	matches, _ := filepath.Glob(path + ".*")
+	var files []string
+	for _, m := range matches {
+		if rotatedIndex(path, m) > 0 {
+			files = append(files, m)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return rotatedIndex(path, files[i]) > rotatedIndex(path, files[j])
+	})
+	return files
+}
+
+func rotatedName(path string, n int) string {
+	return fmt.Sprintf("%s.%d", path, n)
+}
+
+func rotatedIndex(path string, name string) int {
+	n, err := strconv.Atoi(strings.TrimPrefix(name, path+"."))
+	if err != nil || n <= 0 {
+		return 0
+	}
+	return n
+}
@@ -0,0 +1,122 @@
+package logs
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRotate(t *testing.T) {
+	path := newLogPath(t)
+	for i := 1; i <= 4; i++ {
+		writeLog(t, path, testLine{i, Stdout, false, fmt.Sprint(i)})
+		if err := Rotate(path, 3); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 最多保留 3 个文件, 当前文件已经被轮转
+	files := RotatedFiles(path)
+	var names []string
+	for _, f := range files {
+		names = append(names, filepath.Base(f))
+	}
+	if got, want := strings.Join(names, ","), "c1.log.2,c1.log.1"; got != want {
+		t.Errorf("RotatedFiles = %s, want %s", got, want)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("log file exists after Rotate: %v", err)
+	}
+	if got, want := readRotated(t, path), "3s stdout 3,4s stdout 4"; got != want {
+		t.Errorf("rotated logs = %q, want %q", got, want)
+	}
+
+	// maxFiles < 2 时直接删除
+	writeLog(t, path, testLine{5, Stdout, false, "5"})
+	if err := Rotate(path, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("log file exists after Rotate without old files: %v", err)
+	}
+}
+
+// readRotated 创建空的当前文件后读取已轮转的文件
+func readRotated(t *testing.T, path string) string {
+	writeLog(t, path)
+	return strings.Join(readLogs(t, path, Options{}), ",")
+}
+
+// TestReadLogsFollowRotation follow 期间日志被多次轮转, 读取方不丢失也不重复读取消息
+func TestReadLogsFollowRotation(t *testing.T) {
+	path := newLogPath(t)
+	writeLog(t, path)
+	const rounds, perRound = 5, 20
+
+	stopped := make(chan struct{})
+	errs := make(chan error, 1)
+	go func() {
+		defer close(stopped)
+		n := 0
+		for r := 0; r < rounds; r++ {
+			f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				errs <- err
+				return
+			}
+			for i := 0; i < perRound; i++ {
+				f.Write(FormatLine(logBase, Stdout, false, []byte(fmt.Sprint(n))))
+				n++
+			}
+			f.Close()
+			// 等待读取方读到当前文件, 然后轮转, 写入方 (shim) 重新打开新文件
+			time.Sleep(2 * followPollInterval)
+			if err := Rotate(path, 3); err != nil {
+				errs <- err
+				return
+			}
+			if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+
+	opts := Options{
+		Follow: true,
+		Stopped: func() bool {
+			select {
+			case <-stopped:
+				return true
+			default:
+				return false
+			}
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	var got []string
+	err := ReadLogs(ctx, path, opts, func(m *Message) error {
+		got = append(got, string(m.Log))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ReadLogs: %v", err)
+	}
+	select {
+	case err := <-errs:
+		t.Fatal(err)
+	default:
+	}
+	var want []string
+	for n := 0; n < rounds*perRound; n++ {
+		want = append(want, fmt.Sprint(n))
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("followed %d messages across rotations = %q, want %d messages in order", len(got), got, len(want))
+	}
+}
@@ -0,0 +1,133 @@
+package metrics
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const cgroupRoot = "/sys/fs/cgroup"
+
+// CgroupStats 容器 cgroup 的资源使用
+type CgroupStats struct {
+	// CPUSeconds 累计使用的 CPU 时间
+	CPUSeconds float64
+	// MemoryBytes 当前内存使用量
+	MemoryBytes uint64
+}
+
+// ReadCgroupStats 读取进程 pid 所在 cgroup 的资源使用, 同时支持 cgroup v1 和 v2
+func ReadCgroupStats(pid int) (*CgroupStats, error) {
+	paths, err := cgroupPaths(pid)
+	if err != nil {
+		return nil, err
+	}
+
+	// cgroup v2: 只有一条 0::/path 记录
+	if p, ok := paths[""]; ok && len(paths) == 1 {
+		dir := filepath.Join(cgroupRoot, p)
+		usec, err := readKeyedUint(filepath.Join(dir, "cpu.stat"), "usage_usec")
+		if err != nil {
+			return nil, err
+		}
+		mem, err := readUint(filepath.Join(dir, "memory.current"))
+		if err != nil {
+			return nil, err
+		}
+		return &CgroupStats{CPUSeconds: float64(usec) / 1e6, MemoryBytes: mem}, nil
+	}
+
+	cpuPath, ok := paths["cpuacct"]
+	if !ok {
+		return nil, errors.New("cpuacct cgroup not found")
+	}
+	memPath, ok := paths["memory"]
+	if !ok {
+		return nil, errors.New("memory cgroup not found")
+	}
+	nsec, err := readUint(filepath.Join(cgroupRoot, "cpuacct", cpuPath, "cpuacct.usage"))
+	if err != nil {
+		return nil, err
+	}
+	mem, err := readUint(filepath.Join(cgroupRoot, "memory", memPath, "memory.usage_in_bytes"))
+	if err != nil {
+		return nil, err
+	}
+	return &CgroupStats{CPUSeconds: float64(nsec) / 1e9, MemoryBytes: mem}, nil
+}
+
+// CgroupVersion 返回主机挂载的 cgroup 版本 (1 或 2), 容器的资源限制和指标都依赖 memory, cpu 和 pids controller
+func CgroupVersion() (int, error) {
+	if data, err := ioutil.ReadFile(filepath.Join(cgroupRoot, "cgroup.controllers")); err == nil {
+		controllers := strings.Fields(string(data))
+		for _, want := range []string{"memory", "cpu", "pids"} {
+			found := false
+			for _, c := range controllers {
+				found = found || c == want
+			}
+			if !found {
+				return 2, errors.New(fmt.Sprintf("cgroup v2 controller %s is not enabled", want))
+			}
+		}
+		return 2, nil
+	}
+	for _, c := range []string{"memory", "cpu", "cpuacct", "pids"} {
+		if _, err := os.Stat(filepath.Join(cgroupRoot, c)); err != nil {
+			return 1, errors.New(fmt.Sprintf("cgroup v1 controller %s is not mounted under %s", c, cgroupRoot))
+		}
+	}
+	return 1, nil
+}
+
+// cgroupPaths 解析 /proc/<pid>/cgroup, 返回 controller -> path, cgroup v2 的 controller 为空字符串
+func cgroupPaths(pid int) (map[string]string, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	paths := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if parts[1] == "" {
+			paths[""] = parts[2]
+			continue
+		}
+		for _, c := range strings.Split(parts[1], ",") {
+			paths[c] = parts[2]
+		}
+	}
+	return paths, scanner.Err()
+}
+
+func readUint(path string) (uint64, error) {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(bytes)), 10, 64)
+}
+
+func readKeyedUint(path string, key string) (uint64, error) {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(bytes), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == key {
+			return strconv.ParseUint(fields[1], 10, 64)
+		}
+	}
+	return 0, errors.New(fmt.Sprintf("%s not found in %s", key, path))
+}
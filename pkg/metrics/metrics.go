@@ -0,0 +1,131 @@
+package metrics
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/klog"
+	"net/http"
+	"time"
+)
+
+const namespace = "cri_impl"
+
+// Registry 守护进程所有指标注册在这里,不使用 prometheus 的全局 registry
+var Registry = prometheus.NewRegistry()
+
+var (
+	// GrpcRequests 按方法和返回码统计的 gRPC 调用次数
+	GrpcRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "grpc",
+			Name:      "requests_total",
+			Help:      "Number of gRPC requests by method and status code.",
+		},
+		[]string{"method", "code"},
+	)
+	// GrpcLatency gRPC 调用耗时
+	GrpcLatency = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "grpc",
+			Name:      "request_duration_seconds",
+			Help:      "Latency of gRPC requests by method.",
+			Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+		},
+		[]string{"method"},
+	)
+	// RuntimeExecDuration 执行 runc/shimmy 命令的耗时
+	RuntimeExecDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "runtime",
+			Name:      "exec_duration_seconds",
+			Help:      "Duration of runc and shimmy invocations by binary and operation.",
+			Buckets:   []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+		},
+		[]string{"binary", "operation"},
+	)
+	// RuntimeExecFailures 执行 runc/shimmy 命令失败的次数
+	RuntimeExecFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "runtime",
+			Name:      "exec_failures_total",
+			Help:      "Number of failed runc and shimmy invocations by binary and operation.",
+		},
+		[]string{"binary", "operation"},
+	)
+	// RestoredContainers 守护进程启动时从磁盘恢复的容器数
+	RestoredContainers = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "restored_containers_total",
+			Help:      "Number of containers restored from disk on daemon start.",
+		},
+	)
+	// OrphanedContainers 恢复时因状态损坏或 runc 中不存在而被清理的容器数
+	OrphanedContainers = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "orphaned_containers_total",
+			Help:      "Number of broken or orphaned containers purged on daemon start.",
+		},
+	)
+	// ShimsLost shim 进程意外退出的容器数
+	ShimsLost = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "shims_lost_total",
+			Help:      "Number of containers whose shim process exited unexpectedly.",
+		},
+	)
+)
+
+func init() {
+	Registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		GrpcRequests,
+		GrpcLatency,
+		RuntimeExecDuration,
+		RuntimeExecFailures,
+		RestoredContainers,
+		OrphanedContainers,
+		ShimsLost,
+	)
+}
+
+// ObserveExec 记录一次 runc/shimmy 命令的执行结果
+func ObserveExec(binary string, operation string, start time.Time, err error) {
+	RuntimeExecDuration.WithLabelValues(binary, operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		RuntimeExecFailures.WithLabelValues(binary, operation).Inc()
+	}
+}
+
+// Handler 以 Prometheus 文本格式导出 Registry 中的指标
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// Serve 在 addr 上提供 /metrics,直到 ctx 结束
+func Serve(ctx context.Context, addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	srv := &http.Server{Addr: addr, Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	klog.Infof("metrics listening on http://%s/metrics", addr)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
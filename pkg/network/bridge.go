@@ -0,0 +1,156 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/hashicorp/go-multierror"
+	"github.com/tluo-github/cri-impl/pkg/container"
+	"github.com/tluo-github/cri-impl/pkg/fsutil"
+	"io/ioutil"
+	"net"
+	"strings"
+)
+
+// ipForwardFile 开启后主机在 bridge 和外部网卡之间转发容器的流量
+const ipForwardFile = "/proc/sys/net/ipv4/ip_forward"
+
+// iptablesComment 守护进程添加的 iptables 规则的注释
+const iptablesComment = "cri-impl"
+
+// initBridge 配置 bridge 和 NAT 规则
+func (m *Manager) initBridge(ctx context.Context) error {
+	if m.ready {
+		return nil
+	}
+	if err := m.ensureBridge(ctx); err != nil {
+		return err
+	}
+	if m.nat {
+		if err := m.ensureNAT(ctx); err != nil {
+			return err
+		}
+	}
+	m.ready = true
+	return nil
+}
+
+// setupBridge 为容器分配地址并创建连接到 bridge 的网络命名空间
+func (m *Manager) setupBridge(ctx context.Context, id string) (status *container.NetworkStatus, err error) {
+	if err := m.initBridge(ctx); err != nil {
+		return nil, err
+	}
+	ip, err := m.ipam.Allocate(id)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			m.teardownBridge(ctx, id)
+		}
+	}()
+	return m.attach(ctx, id, ip)
+}
+
+// teardownBridge 删除网络命名空间和 veth 并释放地址
+func (m *Manager) teardownBridge(ctx context.Context, id string) error {
+	var result *multierror.Error
+	if err := m.deleteNamespace(ctx, id); err != nil {
+		result = multierror.Append(result, err)
+	}
+	// 删除命名空间时 veth 随之删除, 命名空间已经不存在时主机一侧可能还留着
+	if _, err := run(ctx, "link delete", m.ipPath, "link", "delete", HostInterface(id)); err != nil && !notFound(err) {
+		result = multierror.Append(result, err)
+	}
+	if err := m.ipam.Release(id); err != nil {
+		result = multierror.Append(result, err)
+	}
+	return result.ErrorOrNil()
+}
+
+// restoreBridge 重新保留容器的地址, 网络命名空间不存在时以相同的地址重新创建
+func (m *Manager) restoreBridge(ctx context.Context, id string, status *container.NetworkStatus) (*container.NetworkStatus, error) {
+	ip, subnet, err := net.ParseCIDR(status.IP)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid address %q of container %s", status.IP, id))
+	}
+	if err := m.ipam.Reserve(ip, id); err != nil {
+		return nil, err
+	}
+	if err := m.initBridge(ctx); err != nil {
+		return nil, err
+	}
+	if ok, err := fsutil.Exists(NamespacePath(id)); err != nil || ok {
+		return status, err
+	}
+	restored, err := m.attach(ctx, id, &net.IPNet{IP: ip, Mask: subnet.Mask})
+	if err != nil {
+		m.deleteNamespace(ctx, id)
+		return nil, err
+	}
+	return restored, nil
+}
+
+// checkBridge 检查 bridge 是否存在并且已经启用
+func (m *Manager) checkBridge(ctx context.Context) error {
+	out, err := run(ctx, "link show", m.ipPath, "-o", "link", "show", m.bridge)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(linkFlags(out), ",UP,") {
+		return errors.New(fmt.Sprintf("bridge %s is down", m.bridge))
+	}
+	return nil
+}
+
+// ensureBridge 创建 bridge 并配置网关地址, bridge 已经存在时只更新地址, 可以重复调用
+func (m *Manager) ensureBridge(ctx context.Context) error {
+	if _, err := run(ctx, "link show", m.ipPath, "link", "show", m.bridge); err != nil {
+		if !notFound(err) {
+			return err
+		}
+		if _, err := run(ctx, "link add", m.ipPath, "link", "add", m.bridge, "type", "bridge"); err != nil {
+			return err
+		}
+	}
+	if _, err := run(ctx, "addr replace", m.ipPath, "addr", "replace", m.ipam.Gateway().String(), "dev", m.bridge); err != nil {
+		return err
+	}
+	_, err := run(ctx, "link up", m.ipPath, "link", "set", m.bridge, "up")
+	return err
+}
+
+// ensureNAT 开启 IP 转发, 对离开 bridge 的容器流量做 MASQUERADE 并允许 bridge 上的转发
+func (m *Manager) ensureNAT(ctx context.Context) error {
+	if err := ioutil.WriteFile(ipForwardFile, []byte("1"), 0644); err != nil {
+		return err
+	}
+	subnet := m.ipam.subnet.String()
+	rules := []struct {
+		table string
+		chain string
+		rule  []string
+	}{
+		{"nat", "POSTROUTING", []string{"-s", subnet, "!", "-o", m.bridge, "-j", "MASQUERADE"}},
+		{"filter", "FORWARD", []string{"-i", m.bridge, "-j", "ACCEPT"}},
+		{"filter", "FORWARD", []string{"-o", m.bridge, "-j", "ACCEPT"}},
+	}
+	for _, r := range rules {
+		if err := m.ensureRule(ctx, r.table, r.chain, r.rule...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ensureRule 规则不存在时添加到链的末尾
+func (m *Manager) ensureRule(ctx context.Context, table string, chain string, rule ...string) error {
+	rule = append(rule, "-m", "comment", "--comment", iptablesComment)
+	check := append([]string{"-w", "-t", table, "-C", chain}, rule...)
+	if _, err := run(ctx, "check", m.iptablesPath, check...); err == nil {
+		return nil
+	}
+	add := append([]string{"-w", "-t", table, "-A", chain}, rule...)
+	_, err := run(ctx, "append", m.iptablesPath, add...)
+	return err
+}
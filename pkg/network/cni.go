@@ -0,0 +1,522 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hashicorp/go-multierror"
+	"github.com/tluo-github/cri-impl/pkg/container"
+	"github.com/tluo-github/cri-impl/pkg/fsutil"
+	"io/ioutil"
+	"k8s.io/klog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CNI 插件的命令
+const (
+	cniAdd   = "ADD"
+	cniDel   = "DEL"
+	cniCheck = "CHECK"
+)
+
+// DefaultCNIPluginTimeout 每次执行 CNI 插件的默认超时时间
+// 插件在 runtimeService 的全局锁内执行, 挂起的插件会阻塞所有请求
+const DefaultCNIPluginTimeout = 10 * time.Second
+
+// cniDelDelays 删除容器时 DEL 失败后重试的间隔, 全部失败或插件超时后由 GarbageCollect 重试
+var cniDelDelays = []time.Duration{
+	0,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+}
+
+// CNIConfList 一个 CNI 网络, 只有一个插件的 .conf 文件视为只有一个插件的列表
+type CNIConfList struct {
+	CNIVersion   string                       `json:"cniVersion"`
+	Name         string                       `json:"name"`
+	DisableCheck bool                         `json:"disableCheck,omitempty"`
+	Plugins      []map[string]json.RawMessage `json:"plugins"`
+	// File 配置文件的路径
+	File string `json:"-"`
+}
+
+// CNIResult CNI 插件 ADD 的结果 (0.3.0 之后的格式), 只解析守护进程用到的字段
+type CNIResult struct {
+	CNIVersion string         `json:"cniVersion"`
+	Interfaces []CNIInterface `json:"interfaces,omitempty"`
+	IPs        []CNIIPConfig  `json:"ips,omitempty"`
+}
+
+type CNIInterface struct {
+	Name    string `json:"name"`
+	Mac     string `json:"mac,omitempty"`
+	Sandbox string `json:"sandbox,omitempty"`
+}
+
+type CNIIPConfig struct {
+	// Interface 地址所在的网卡在 Interfaces 中的下标
+	Interface *int   `json:"interface,omitempty"`
+	Address   string `json:"address"`
+	Gateway   string `json:"gateway,omitempty"`
+}
+
+// CNIError CNI 插件失败时在 stdout 输出的错误
+type CNIError struct {
+	Code    uint   `json:"code"`
+	Msg     string `json:"msg"`
+	Details string `json:"details,omitempty"`
+}
+
+// CNITimeoutError CNI 插件没有在超时时间内退出
+type CNITimeoutError struct {
+	Plugin  string
+	Command string
+	Timeout time.Duration
+}
+
+func (e *CNITimeoutError) Error() string {
+	return fmt.Sprintf("CNI plugin %s %s timed out after %v", e.Plugin, e.Command, e.Timeout)
+}
+
+// timedOut err 中有 CNI 插件超时, cniDelList 的错误为 multierror
+func timedOut(err error) bool {
+	var errs *multierror.Error
+	if errors.As(err, &errs) {
+		for _, e := range errs.Errors {
+			if timedOut(e) {
+				return true
+			}
+		}
+		return false
+	}
+	var timeout *CNITimeoutError
+	return errors.As(err, &timeout)
+}
+
+func (e *CNIError) Error() string {
+	msg := fmt.Sprintf("%s (code %d)", e.Msg, e.Code)
+	if e.Details != "" {
+		msg += ": " + e.Details
+	}
+	return msg
+}
+
+// LoadCNIConfList 读取 dir 中名称为 name 的网络, name 为空时返回按文件名排序的第一个网络
+func LoadCNIConfList(dir string, name string) (*CNIConfList, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		switch filepath.Ext(f.Name()) {
+		case ".conflist", ".conf", ".json":
+			if !f.IsDir() {
+				names = append(names, f.Name())
+			}
+		}
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		list, err := parseCNIConf(filepath.Join(dir, n))
+		if err != nil {
+			klog.Warningf("skip invalid CNI network config with err:%v", err)
+			continue
+		}
+		if name == "" || list.Name == name {
+			return list, nil
+		}
+	}
+	if name == "" {
+		return nil, errors.New(fmt.Sprintf("No CNI network config found in %s", dir))
+	}
+	return nil, errors.New(fmt.Sprintf("CNI network %q not found in %s", name, dir))
+}
+
+// parseCNIConf 解析 .conflist, 或只有一个插件的 .conf/.json
+func parseCNIConf(path string) (*CNIConfList, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	list := &CNIConfList{File: path}
+	if filepath.Ext(path) == ".conflist" {
+		if err := json.Unmarshal(data, list); err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid CNI network config %s: %v", path, err))
+		}
+	} else {
+		var plugin map[string]json.RawMessage
+		if err := json.Unmarshal(data, &plugin); err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid CNI network config %s: %v", path, err))
+		}
+		json.Unmarshal(plugin["cniVersion"], &list.CNIVersion)
+		json.Unmarshal(plugin["name"], &list.Name)
+		list.Plugins = []map[string]json.RawMessage{plugin}
+	}
+	if list.Name == "" {
+		return nil, errors.New(fmt.Sprintf("CNI network config %s has no name", path))
+	}
+	if len(list.Plugins) == 0 {
+		return nil, errors.New(fmt.Sprintf("CNI network config %s has no plugins", path))
+	}
+	for i, p := range list.Plugins {
+		if pluginType(p) == "" {
+			return nil, errors.New(fmt.Sprintf("CNI network config %s: plugin %d has no type", path, i))
+		}
+	}
+	return list, nil
+}
+
+func pluginType(plugin map[string]json.RawMessage) string {
+	var t string
+	json.Unmarshal(plugin["type"], &t)
+	return t
+}
+
+// supportsCheck CHECK 从 CNI 0.4.0 开始支持
+func (l *CNIConfList) supportsCheck() bool {
+	if l.DisableCheck {
+		return false
+	}
+	switch l.CNIVersion {
+	case "", "0.1.0", "0.2.0", "0.3.0", "0.3.1":
+		return false
+	}
+	return true
+}
+
+// cniConfList 当前配置的 CNI 网络
+func (m *Manager) cniConfList() (*CNIConfList, error) {
+	return LoadCNIConfList(m.cniConfDir, m.cniNetwork)
+}
+
+// findPlugin 在插件目录中查找插件可执行文件
+func (m *Manager) findPlugin(name string) (string, error) {
+	for _, dir := range m.cniPluginDirs {
+		path := filepath.Join(dir, name)
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+			return path, nil
+		}
+	}
+	return "", errors.New(fmt.Sprintf("CNI plugin %s not found in %s", name, strings.Join(m.cniPluginDirs, ":")))
+}
+
+// execPlugin 按照 CNI 协议执行一个插件, stdin 为插件的配置, 加上网络的 name, cniVersion 和 prevResult
+// 插件超过 cniTimeout 没有退出时被 kill
+func (m *Manager) execPlugin(ctx context.Context, command string, list *CNIConfList, plugin map[string]json.RawMessage, id string, prevResult json.RawMessage) ([]byte, error) {
+	t := pluginType(plugin)
+	path, err := m.findPlugin(t)
+	if err != nil {
+		return nil, err
+	}
+	conf := make(map[string]json.RawMessage, len(plugin)+3)
+	for k, v := range plugin {
+		conf[k] = v
+	}
+	conf["name"], _ = json.Marshal(list.Name)
+	conf["cniVersion"], _ = json.Marshal(list.CNIVersion)
+	delete(conf, "prevResult")
+	if len(prevResult) > 0 {
+		conf["prevResult"] = prevResult
+	}
+	stdin, err := json.Marshal(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, m.cniTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, path)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Env = append(os.Environ(),
+		"CNI_COMMAND="+command,
+		"CNI_CONTAINERID="+id,
+		"CNI_NETNS="+NamespacePath(id),
+		"CNI_IFNAME="+ContainerInterface,
+		"CNI_ARGS=IgnoreUnknown=1",
+		"CNI_PATH="+strings.Join(m.cniPluginDirs, string(os.PathListSeparator)),
+	)
+	out, err := runCommand(ctx, strings.ToLower(command), cmd)
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, &CNITimeoutError{Plugin: t, Command: command, Timeout: m.cniTimeout}
+	}
+	if err != nil {
+		cniErr := &CNIError{}
+		if json.Unmarshal(out, cniErr) == nil && cniErr.Msg != "" {
+			return nil, errors.New(fmt.Sprintf("CNI plugin %s %s failed: %v", t, command, cniErr))
+		}
+		return nil, err
+	}
+	return out, nil
+}
+
+// cniAddList 按顺序对每个插件执行 ADD, 前一个插件的结果作为后一个插件的 prevResult
+func (m *Manager) cniAddList(ctx context.Context, list *CNIConfList, id string) (json.RawMessage, error) {
+	var result json.RawMessage
+	for _, p := range list.Plugins {
+		out, err := m.execPlugin(ctx, cniAdd, list, p, id, result)
+		if err != nil {
+			return nil, err
+		}
+		if len(bytes.TrimSpace(out)) > 0 {
+			result = out
+		}
+	}
+	return result, nil
+}
+
+// cniDelList 按相反的顺序对每个插件执行 DEL, prevResult 为 ADD 的结果
+// 一个插件失败时继续执行其他插件, 尽量释放所有资源
+func (m *Manager) cniDelList(ctx context.Context, list *CNIConfList, id string, result json.RawMessage) error {
+	var errs *multierror.Error
+	for i := len(list.Plugins) - 1; i >= 0; i-- {
+		if _, err := m.execPlugin(ctx, cniDel, list, list.Plugins[i], id, result); err != nil {
+			errs = multierror.Append(errs, err)
+		}
+	}
+	return errs.ErrorOrNil()
+}
+
+// cniCheckList 按顺序对每个插件执行 CHECK
+func (m *Manager) cniCheckList(ctx context.Context, list *CNIConfList, id string, result json.RawMessage) error {
+	for _, p := range list.Plugins {
+		if _, err := m.execPlugin(ctx, cniCheck, list, p, id, result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setupCNI 创建网络命名空间并执行 ADD, 失败时执行 DEL 并删除命名空间
+func (m *Manager) setupCNI(ctx context.Context, id string) (*container.NetworkStatus, error) {
+	list, err := m.cniConfList()
+	if err != nil {
+		return nil, err
+	}
+	// 在 ADD 之前记录网络, 守护进程在 ADD 期间退出时 GarbageCollect 也会执行 DEL
+	if err := m.writeCNIState(m.cniStateDir, id, &container.NetworkStatus{Mode: container.NetworkCNI, Name: list.Name}); err != nil {
+		return nil, err
+	}
+	if err := m.createNamespace(ctx, id); err != nil {
+		m.deleteNamespace(ctx, id)
+		m.removeCNIState(m.cniStateDir, id)
+		return nil, err
+	}
+	result, err := m.cniAddList(ctx, list, id)
+	if err == nil {
+		var status *container.NetworkStatus
+		if status, err = cniStatus(id, list.Name, result); err == nil {
+			if err = m.writeCNIState(m.cniStateDir, id, status); err == nil {
+				return status, nil
+			}
+		}
+	}
+	// 插件可能已经分配了地址, DEL 失败时保留记录由 GarbageCollect 重试
+	if derr := m.cniDelList(ctx, list, id, result); derr != nil {
+		klog.Errorf("failed to clean up CNI network of container %s with err:%v", id, derr)
+		m.deleteNamespace(ctx, id)
+		return nil, err
+	}
+	m.deleteNamespace(ctx, id)
+	m.removeCNIState(m.cniStateDir, id)
+	return nil, err
+}
+
+// teardownCNI 执行 DEL 并删除网络命名空间, 多次失败后记录网络状态, 由 GarbageCollect 重试
+// 插件超时时不再重试, 避免在全局锁内长时间等待
+func (m *Manager) teardownCNI(ctx context.Context, id string, status *container.NetworkStatus) error {
+	var err error
+	for _, d := range cniDelDelays {
+		time.Sleep(d)
+		if err = m.cniTeardownOnce(ctx, id, status); err == nil {
+			return m.removeCNIState(m.pendingDir, id)
+		}
+		klog.Warningf("failed to tear down CNI network of container %s with err:%v", id, err)
+		if timedOut(err) {
+			break
+		}
+	}
+	if perr := m.writeCNIState(m.pendingDir, id, status); perr != nil {
+		return multierror.Append(err, perr)
+	}
+	return err
+}
+
+// cniTeardownOnce 网络命名空间只在 DEL 成功后删除, 重试的 DEL 仍然可以进入命名空间
+func (m *Manager) cniTeardownOnce(ctx context.Context, id string, status *container.NetworkStatus) error {
+	list, err := m.cniConfList()
+	if err != nil {
+		return err
+	}
+	if list.Name != status.Name {
+		return errors.New(fmt.Sprintf("CNI network %s of container %s is not configured, current network is %s", status.Name, id, list.Name))
+	}
+	if err := m.cniDelList(ctx, list, id, status.CNIResult); err != nil {
+		return err
+	}
+	if err := m.deleteNamespace(ctx, id); err != nil {
+		return err
+	}
+	return m.removeCNIState(m.cniStateDir, id)
+}
+
+// restoreCNI 网络命名空间存在时执行 CHECK, 不存在时重新执行 ADD
+func (m *Manager) restoreCNI(ctx context.Context, id string, status *container.NetworkStatus) (*container.NetworkStatus, error) {
+	list, err := m.cniConfList()
+	if err != nil {
+		return nil, err
+	}
+	ok, err := fsutil.Exists(NamespacePath(id))
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		if list.Name == status.Name && list.supportsCheck() {
+			if err := m.cniCheckList(ctx, list, id, status.CNIResult); err != nil {
+				return nil, err
+			}
+		}
+		return status, m.writeCNIState(m.cniStateDir, id, status)
+	}
+	// 主机重启后插件可能还保留着之前分配的地址
+	if list.Name == status.Name {
+		if err := m.cniDelList(ctx, list, id, status.CNIResult); err != nil {
+			klog.Warningf("failed to release previous CNI network of container %s with err:%v", id, err)
+		}
+	}
+	return m.setupCNI(ctx, id)
+}
+
+// checkCNI 检查网络配置和其中所有插件是否存在
+func (m *Manager) checkCNI() error {
+	list, err := m.cniConfList()
+	if err != nil {
+		return err
+	}
+	for _, p := range list.Plugins {
+		if _, err := m.findPlugin(pluginType(p)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cniStatus 从 ADD 的结果中取出容器的地址, 网关和 MAC
+func cniStatus(id string, name string, raw json.RawMessage) (*container.NetworkStatus, error) {
+	result := &CNIResult{}
+	if err := json.Unmarshal(raw, result); err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid CNI result: %v", err))
+	}
+	status := &container.NetworkStatus{
+		Mode:      container.NetworkCNI,
+		Name:      name,
+		Namespace: NamespacePath(id),
+		Interface: ContainerInterface,
+		CNIResult: raw,
+	}
+	for _, iface := range result.Interfaces {
+		if iface.Name == ContainerInterface && iface.Sandbox != "" {
+			status.MAC = iface.Mac
+		}
+	}
+	for _, ip := range result.IPs {
+		status.IPs = append(status.IPs, ip.Address)
+		if status.IP == "" {
+			status.IP, status.Gateway = ip.Address, ip.Gateway
+		}
+	}
+	return status, nil
+}
+
+// writeCNIState 在 dir 中记录容器的 CNI 网络状态
+// cniStateDir 记录使用 CNI 网络的容器, GarbageCollect 据此对孤立的命名空间执行 DEL; pendingDir 记录 DEL 失败的容器
+func (m *Manager) writeCNIState(dir string, id string, status *container.NetworkStatus) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, "."+id)
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, id+".json"))
+}
+
+// readCNIState 读取 dir 中容器的 CNI 网络状态, 没有记录时返回 nil
+func (m *Manager) readCNIState(dir string, id string) (*container.NetworkStatus, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, id+".json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	status := &container.NetworkStatus{}
+	if err := json.Unmarshal(data, status); err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid CNI network state of container %s: %v", id, err))
+	}
+	return status, nil
+}
+
+func (m *Manager) removeCNIState(dir string, id string) error {
+	if err := os.Remove(filepath.Join(dir, id+".json")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// cniStateIDs dir 中有记录的容器
+func cniStateIDs(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var ids []string
+	for _, f := range files {
+		if filepath.Ext(f.Name()) == ".json" {
+			ids = append(ids, strings.TrimSuffix(f.Name(), ".json"))
+		}
+	}
+	return ids, nil
+}
+
+// retryPendingCNI 重试之前失败的 DEL, 返回仍然失败的容器, 它们的网络命名空间需要保留
+func (m *Manager) retryPendingCNI(ctx context.Context, keep map[string]bool) (map[string]bool, error) {
+	pending := make(map[string]bool)
+	ids, err := cniStateIDs(m.pendingDir)
+	if err != nil {
+		return pending, err
+	}
+	var result *multierror.Error
+	for _, id := range ids {
+		status, err := m.readCNIState(m.pendingDir, id)
+		if err != nil || status == nil || keep[id] {
+			// 损坏的记录, 或者容器仍然存在 (网络由容器的状态管理)
+			m.removeCNIState(m.pendingDir, id)
+			continue
+		}
+		if err := m.cniTeardownOnce(ctx, id, status); err != nil {
+			pending[id] = true
+			result = multierror.Append(result, errors.New(fmt.Sprintf("retry tearing down CNI network of container %s: %v", id, err)))
+			continue
+		}
+		klog.Infof("tore down CNI network of removed container %s", id)
+		if err := m.removeCNIState(m.pendingDir, id); err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
+	return pending, result.ErrorOrNil()
+}
@@ -0,0 +1,198 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/tluo-github/cri-impl/pkg/container"
+	"github.com/tluo-github/cri-impl/pkg/fsutil"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stubPlugin 代替 CNI 插件的 sh 脚本, 把 "<插件> <命令> <容器>" 追加到 calls 文件
+// stub-a 的 ADD 返回一个地址, stub-b 收到 prevResult 时在记录后加上 prev
+// dir 中存在 hang-<命令> 文件时插件挂起
+const stubPlugin = `#!/bin/sh
+name=$(basename "$0")
+prev=
+if grep -q prevResult; then prev=" prev"; fi
+echo "$name $CNI_COMMAND $CNI_CONTAINERID$prev" >> %[1]s/calls
+if [ -e %[1]s/hang-$CNI_COMMAND ]; then exec sleep 60; fi
+if [ "$name" = stub-a ] && [ "$CNI_COMMAND" = ADD ]; then
+	echo '{"cniVersion":"1.0.0","interfaces":[{"name":"eth0","mac":"aa:bb:cc:dd:ee:ff","sandbox":"'$CNI_NETNS'"}],"ips":[{"interface":0,"address":"10.22.0.5/24","gateway":"10.22.0.1"}]}'
+fi
+`
+
+const stubConfList = `{"cniVersion":"1.0.0","name":"stubnet","plugins":[{"type":"stub-a"},{"type":"stub-b"}]}`
+
+// newCNITestManager 创建使用 stub 插件的 Manager, 返回插件记录调用的目录
+func newCNITestManager(t *testing.T) (*Manager, string) {
+	m := newTestManager(t)
+	dir := tempDir(t)
+	for _, name := range []string{"stub-a", "stub-b"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(fmt.Sprintf(stubPlugin, dir)), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "10-stub.conflist"), []byte(stubConfList), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m.cniConfDir = dir
+	m.cniPluginDirs = []string{dir}
+	return m, dir
+}
+
+func cniCalls(t *testing.T, dir string) string {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "calls"))
+	if os.IsNotExist(err) {
+		return ""
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(filepath.Join(dir, "calls"))
+	return strings.Join(strings.Split(strings.TrimSpace(string(data)), "\n"), ",")
+}
+
+func hang(t *testing.T, dir string, command string, hung bool) {
+	path := filepath.Join(dir, "hang-"+command)
+	if !hung {
+		os.Remove(path)
+		return
+	}
+	if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCNISetupTeardown(t *testing.T) {
+	if !inNetworkNamespace(t) {
+		return
+	}
+	ctx := context.Background()
+	m, dir := newCNITestManager(t)
+	status, err := m.Setup(ctx, "cni1", container.NetworkCNI)
+	if err != nil {
+		t.Fatalf("Setup: %v", err)
+	}
+	if status.Name != "stubnet" || status.IP != "10.22.0.5/24" || status.Gateway != "10.22.0.1" || status.MAC != "aa:bb:cc:dd:ee:ff" {
+		t.Errorf("Setup status = %+v", status)
+	}
+	if calls, want := cniCalls(t, dir), "stub-a ADD cni1,stub-b ADD cni1 prev"; calls != want {
+		t.Errorf("ADD calls = %q, want %q", calls, want)
+	}
+	if recorded, err := m.readCNIState(m.cniStateDir, "cni1"); err != nil || recorded == nil || recorded.IP != status.IP {
+		t.Errorf("recorded CNI network = %+v, %v", recorded, err)
+	}
+
+	if err := m.Teardown(ctx, "cni1", status); err != nil {
+		t.Fatalf("Teardown: %v", err)
+	}
+	// DEL 逆序执行, prevResult 为 ADD 的结果
+	if calls, want := cniCalls(t, dir), "stub-b DEL cni1 prev,stub-a DEL cni1 prev"; calls != want {
+		t.Errorf("DEL calls = %q, want %q", calls, want)
+	}
+	if ok, _ := fsutil.Exists(NamespacePath("cni1")); ok {
+		t.Error("network namespace still exists after Teardown")
+	}
+	if recorded, _ := m.readCNIState(m.cniStateDir, "cni1"); recorded != nil {
+		t.Error("CNI network is still recorded after Teardown")
+	}
+}
+
+func TestCNIPluginTimeout(t *testing.T) {
+	if !inNetworkNamespace(t) {
+		return
+	}
+	ctx := context.Background()
+	m, dir := newCNITestManager(t)
+	m.cniTimeout = 200 * time.Millisecond
+
+	// ADD 超时后执行 DEL 清理
+	hang(t, dir, cniAdd, true)
+	start := time.Now()
+	_, err := m.Setup(ctx, "cni1", container.NetworkCNI)
+	var timeout *CNITimeoutError
+	if !errors.As(err, &timeout) || timeout.Plugin != "stub-a" || timeout.Command != cniAdd {
+		t.Fatalf("Setup returned %v, want ADD timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Setup took %v with a hung plugin", elapsed)
+	}
+	if calls, want := cniCalls(t, dir), "stub-a ADD cni1,stub-b DEL cni1,stub-a DEL cni1"; calls != want {
+		t.Errorf("calls = %q, want %q", calls, want)
+	}
+	hang(t, dir, cniAdd, false)
+
+	// DEL 超时时不重试, 记录后由 GarbageCollect 重试
+	status, err := m.Setup(ctx, "cni2", container.NetworkCNI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cniCalls(t, dir)
+	hang(t, dir, cniDel, true)
+	start = time.Now()
+	if err := m.Teardown(ctx, "cni2", status); !timedOut(err) {
+		t.Fatalf("Teardown returned %v, want DEL timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Teardown took %v with a hung plugin", elapsed)
+	}
+	if calls, want := cniCalls(t, dir), "stub-b DEL cni2 prev,stub-a DEL cni2 prev"; calls != want {
+		t.Errorf("calls = %q, want one DEL of each plugin %q", calls, want)
+	}
+	if ok, _ := fsutil.Exists(NamespacePath("cni2")); !ok {
+		t.Error("network namespace was deleted before DEL succeeded")
+	}
+
+	hang(t, dir, cniDel, false)
+	if err := m.GarbageCollect(ctx, nil); err != nil {
+		t.Fatalf("GarbageCollect: %v", err)
+	}
+	if calls, want := cniCalls(t, dir), "stub-b DEL cni2 prev,stub-a DEL cni2 prev"; calls != want {
+		t.Errorf("calls = %q, want %q", calls, want)
+	}
+	if ok, _ := fsutil.Exists(NamespacePath("cni2")); ok {
+		t.Error("network namespace still exists after GarbageCollect")
+	}
+	if ids, _ := cniStateIDs(m.pendingDir); len(ids) != 0 {
+		t.Errorf("pending CNI networks after GarbageCollect = %v", ids)
+	}
+}
+
+func TestGarbageCollectCNI(t *testing.T) {
+	if !inNetworkNamespace(t) {
+		return
+	}
+	ctx := context.Background()
+	m, dir := newCNITestManager(t)
+	for _, id := range []string{"keep", "orphan"} {
+		if _, err := m.Setup(ctx, id, container.NetworkCNI); err != nil {
+			t.Fatalf("Setup %s: %v", id, err)
+		}
+	}
+	cniCalls(t, dir)
+	defer m.Teardown(ctx, "keep", nil)
+
+	// 守护进程重启后 orphan 已经不存在, 插件分配的地址由 DEL 释放
+	if err := m.GarbageCollect(ctx, map[string]bool{"keep": true}); err != nil {
+		t.Fatalf("GarbageCollect: %v", err)
+	}
+	if calls, want := cniCalls(t, dir), "stub-b DEL orphan prev,stub-a DEL orphan prev"; calls != want {
+		t.Errorf("calls = %q, want %q", calls, want)
+	}
+	if ok, _ := fsutil.Exists(NamespacePath("orphan")); ok {
+		t.Error("orphaned network namespace was not deleted")
+	}
+	if ok, _ := fsutil.Exists(NamespacePath("keep")); !ok {
+		t.Error("network namespace of a kept container was deleted")
+	}
+	if ids, _ := cniStateIDs(m.cniStateDir); len(ids) != 1 || ids[0] != "keep" {
+		t.Errorf("recorded CNI networks after GarbageCollect = %v", ids)
+	}
+}
@@ -0,0 +1,74 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/tluo-github/cri-impl/pkg/metrics"
+	"github.com/tluo-github/cri-impl/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"k8s.io/klog"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// CommandError ip 或 iptables 执行失败
+type CommandError struct {
+	Command string
+	Stderr  string
+	Err     error
+}
+
+func (e *CommandError) Error() string {
+	msg := fmt.Sprintf("%s failed", e.Command)
+	if e.Stderr != "" {
+		msg = fmt.Sprintf("%s,stderr=[%s]", msg, e.Stderr)
+	}
+	return msg + ": " + e.Err.Error()
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// run 执行 ip/iptables 命令, operation 用于指标的标签和 span 名称
+// 与 OCI 运行时相同, ctx 只用于传递 trace, 不中断正在执行的命令, 避免网络只配置了一部分
+func run(ctx context.Context, operation string, name string, args ...string) (string, error) {
+	out, err := runCommand(ctx, operation, exec.Command(name, args...))
+	return string(out), err
+}
+
+// runCommand 执行命令并返回 stdout, 失败时 stdout 仍然返回 (CNI 插件在 stdout 输出错误)
+func runCommand(ctx context.Context, operation string, cmd *exec.Cmd) ([]byte, error) {
+	binary := filepath.Base(cmd.Path)
+	_, span := tracing.Start(ctx, binary+" "+operation,
+		attribute.String("exec.binary", binary),
+		attribute.StringSlice("exec.args", cmd.Args[1:]),
+	)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	start := time.Now()
+	err := cmd.Run()
+	klog.V(4).Infof("stdout:%s stderr:%s error:%v exec %s", stdout.String(), stderr.String(), err, strings.Join(cmd.Args, " "))
+	metrics.ObserveExec(binary, operation, start, err)
+	if err != nil {
+		err = &CommandError{Command: binary + " " + strings.Join(cmd.Args[1:], " "), Stderr: strings.TrimSpace(stderr.String()), Err: err}
+	}
+	tracing.End(span, err)
+	return stdout.Bytes(), err
+}
+
+// notFound ip 命令的错误是否表示对象不存在
+func notFound(err error) bool {
+	var cerr *CommandError
+	if !errors.As(err, &cerr) {
+		return false
+	}
+	return strings.Contains(cerr.Stderr, "Cannot find device") ||
+		strings.Contains(cerr.Stderr, "No such file or directory") ||
+		strings.Contains(cerr.Stderr, "does not exist")
+}
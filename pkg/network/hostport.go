@@ -0,0 +1,132 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/hashicorp/go-multierror"
+	"github.com/tluo-github/cri-impl/pkg/container"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// hostPortChain nat 表中发布端口的 DNAT 规则所在的链
+const hostPortChain = "CRI-IMPL-HOSTPORTS"
+
+// PublishPorts 占用主机端口并添加 DNAT 规则, 把发往主机端口的流量转发到容器的 ip
+// 端口被其他进程或容器占用时返回错误, 失败时释放已经占用的端口和添加的规则
+func (m *Manager) PublishPorts(ctx context.Context, id string, ip net.IP, ports []container.PortMapping) (err error) {
+	if err := m.ensureHostPortChain(ctx); err != nil {
+		return err
+	}
+	// restore 时重新占用守护进程重启前占用的端口
+	m.closeHostPorts(id)
+	defer func() {
+		if err != nil {
+			m.UnpublishPorts(ctx, id, ip, ports)
+		}
+	}()
+	for _, p := range ports {
+		f, err := bindHostPort(p)
+		if err != nil {
+			return err
+		}
+		m.hostPorts[id] = append(m.hostPorts[id], f)
+	}
+	for _, p := range ports {
+		if err := m.ensureRule(ctx, "nat", hostPortChain, hostPortRule(ip, p)...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UnpublishPorts 删除 DNAT 规则并释放主机端口, 可以重复调用
+func (m *Manager) UnpublishPorts(ctx context.Context, id string, ip net.IP, ports []container.PortMapping) error {
+	var result *multierror.Error
+	m.closeHostPorts(id)
+	for _, p := range ports {
+		if err := m.deleteRule(ctx, "nat", hostPortChain, hostPortRule(ip, p)...); err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
+	return result.ErrorOrNil()
+}
+
+// ensureHostPortChain 创建 hostPortChain, 发往本机地址的流量 (主机上访问 127.0.0.0/8 的除外) 经过这个链
+func (m *Manager) ensureHostPortChain(ctx context.Context) error {
+	if _, err := run(ctx, "new chain", m.iptablesPath, "-w", "-t", "nat", "-N", hostPortChain); err != nil && !chainExists(err) {
+		return err
+	}
+	if err := m.ensureRule(ctx, "nat", "PREROUTING", "-m", "addrtype", "--dst-type", "LOCAL", "-j", hostPortChain); err != nil {
+		return err
+	}
+	return m.ensureRule(ctx, "nat", "OUTPUT", "!", "-d", "127.0.0.0/8", "-m", "addrtype", "--dst-type", "LOCAL", "-j", hostPortChain)
+}
+
+// deleteRule 规则存在时删除
+func (m *Manager) deleteRule(ctx context.Context, table string, chain string, rule ...string) error {
+	rule = append(rule, "-m", "comment", "--comment", iptablesComment)
+	check := append([]string{"-w", "-t", table, "-C", chain}, rule...)
+	if _, err := run(ctx, "check", m.iptablesPath, check...); err != nil {
+		return nil
+	}
+	del := append([]string{"-w", "-t", table, "-D", chain}, rule...)
+	_, err := run(ctx, "delete", m.iptablesPath, del...)
+	return err
+}
+
+func (m *Manager) closeHostPorts(id string) {
+	for _, f := range m.hostPorts[id] {
+		f.Close()
+	}
+	delete(m.hostPorts, id)
+}
+
+// hostPortRule 把主机端口转发到容器 ip 的 DNAT 规则
+func hostPortRule(ip net.IP, p container.PortMapping) []string {
+	rule := []string{"-p", p.Protocol}
+	if p.HostIP != "" {
+		rule = append(rule, "-d", p.HostIP)
+	}
+	return append(rule, "--dport", strconv.Itoa(int(p.HostPort)),
+		"-j", "DNAT", "--to-destination", net.JoinHostPort(ip.String(), strconv.Itoa(int(p.ContainerPort))))
+}
+
+// bindHostPort 绑定 (不监听) 主机端口, 防止其他进程占用 DNAT 的端口, 主机上连接 127.0.0.1 的该端口时被拒绝
+func bindHostPort(p container.PortMapping) (*os.File, error) {
+	typ := syscall.SOCK_STREAM
+	if p.Protocol == container.ProtocolUDP {
+		typ = syscall.SOCK_DGRAM
+	}
+	fd, err := syscall.Socket(syscall.AF_INET, typ|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	addr := &syscall.SockaddrInet4{Port: int(p.HostPort)}
+	if p.HostIP != "" {
+		copy(addr.Addr[:], net.ParseIP(p.HostIP).To4())
+	}
+	if err := syscall.Bind(fd, addr); err != nil {
+		syscall.Close(fd)
+		if errors.Is(err, syscall.EADDRINUSE) {
+			return nil, errors.New(fmt.Sprintf("host port %s is already in use", hostPortString(p)))
+		}
+		return nil, errors.New(fmt.Sprintf("can't bind host port %s: %v", hostPortString(p), err))
+	}
+	return os.NewFile(uintptr(fd), hostPortString(p)), nil
+}
+
+// hostPortString 主机端口, 如 0.0.0.0:8080/tcp
+func hostPortString(p container.PortMapping) string {
+	return p.HostAddress() + "/" + p.Protocol
+}
+
+// chainExists iptables -N 的错误是否表示链已经存在
+func chainExists(err error) bool {
+	var cerr *CommandError
+	return errors.As(err, &cerr) && strings.Contains(cerr.Stderr, "Chain already exists")
+}
@@ -0,0 +1,149 @@
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// IPAM 从子网中分配地址, 与 CNI host-local 插件相同, 每个已分配的地址是 dir 下的一个文件, 内容为容器 id
+// 文件用 O_EXCL 创建, 守护进程重启后分配状态保持不变
+type IPAM struct {
+	dir     string
+	subnet  *net.IPNet
+	gateway net.IP
+}
+
+// NewIPAM subnet 的第一个地址作为网关, 网络地址和广播地址不分配
+func NewIPAM(dir string, subnet *net.IPNet) (*IPAM, error) {
+	if subnet.IP.To4() == nil {
+		return nil, errors.New(fmt.Sprintf("Subnet %s is not an IPv4 subnet", subnet))
+	}
+	if ones, bits := subnet.Mask.Size(); bits-ones < 2 {
+		return nil, errors.New(fmt.Sprintf("Subnet %s is too small", subnet))
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	network := subnet.IP.Mask(subnet.Mask).To4()
+	return &IPAM{
+		dir:     dir,
+		subnet:  &net.IPNet{IP: network, Mask: subnet.Mask},
+		gateway: addIP(network, 1),
+	}, nil
+}
+
+// Gateway 子网的网关, 配置在 bridge 上
+func (i *IPAM) Gateway() *net.IPNet {
+	return &net.IPNet{IP: i.gateway, Mask: i.subnet.Mask}
+}
+
+// Allocate 为容器分配第一个空闲的地址
+func (i *IPAM) Allocate(id string) (*net.IPNet, error) {
+	ones, bits := i.subnet.Mask.Size()
+	size := uint32(1) << uint(bits-ones)
+	for n := uint32(2); n < size-1; n++ {
+		ip := addIP(i.subnet.IP, n)
+		ok, err := i.reserve(ip, id)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return &net.IPNet{IP: ip, Mask: i.subnet.Mask}, nil
+		}
+	}
+	return nil, errors.New(fmt.Sprintf("No free address in subnet %s", i.subnet))
+}
+
+// Reserve 为容器保留指定的地址, 用于 restore 恢复已有容器的地址, 已经属于该容器时不报错
+func (i *IPAM) Reserve(ip net.IP, id string) error {
+	if !i.subnet.Contains(ip) || ip.Equal(i.gateway) {
+		return errors.New(fmt.Sprintf("Address %s is not allocatable in subnet %s", ip, i.subnet))
+	}
+	ok, err := i.reserve(ip.To4(), id)
+	if err != nil || ok {
+		return err
+	}
+	owner, err := ioutil.ReadFile(i.path(ip))
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(owner)) != id {
+		return errors.New(fmt.Sprintf("Address %s is already allocated to container %s", ip, owner))
+	}
+	return nil
+}
+
+// Release 释放容器的所有地址
+func (i *IPAM) Release(id string) error {
+	allocated, err := i.List()
+	if err != nil {
+		return err
+	}
+	for ip, owner := range allocated {
+		if owner == id {
+			if err := os.Remove(i.path(net.ParseIP(ip))); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// List 已分配的地址, key 为地址, value 为容器 id
+func (i *IPAM) List() (map[string]string, error) {
+	files, err := ioutil.ReadDir(i.dir)
+	if err != nil {
+		return nil, err
+	}
+	allocated := make(map[string]string)
+	for _, f := range files {
+		ip := net.ParseIP(f.Name())
+		if ip == nil || !i.subnet.Contains(ip) {
+			continue
+		}
+		owner, err := ioutil.ReadFile(filepath.Join(i.dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		allocated[f.Name()] = strings.TrimSpace(string(owner))
+	}
+	return allocated, nil
+}
+
+// reserve 创建地址文件, 地址已经被分配时返回 false
+func (i *IPAM) reserve(ip net.IP, id string) (bool, error) {
+	f, err := os.OpenFile(i.path(ip), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		if os.IsExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	_, err = f.WriteString(id)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return false, err
+	}
+	return true, nil
+}
+
+func (i *IPAM) path(ip net.IP) string {
+	return filepath.Join(i.dir, ip.String())
+}
+
+// addIP 返回 ip 之后第 n 个 IPv4 地址
+func addIP(ip net.IP, n uint32) net.IP {
+	v := binary.BigEndian.Uint32(ip.To4()) + n
+	next := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(next, v)
+	return next
+}
@@ -0,0 +1,118 @@
+package network
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "network")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func newTestIPAM(t *testing.T, cidr string) *IPAM {
+	_, subnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ipam, err := NewIPAM(tempDir(t), subnet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ipam
+}
+
+func TestNewIPAM(t *testing.T) {
+	for _, cidr := range []string{"10.0.0.0/31", "fd00::/64"} {
+		_, subnet, _ := net.ParseCIDR(cidr)
+		if _, err := NewIPAM(tempDir(t), subnet); err == nil {
+			t.Errorf("NewIPAM(%s) succeeded", cidr)
+		}
+	}
+	ipam := newTestIPAM(t, "10.88.0.7/16")
+	if gw := ipam.Gateway().String(); gw != "10.88.0.1/16" {
+		t.Errorf("Gateway = %s, want 10.88.0.1/16", gw)
+	}
+}
+
+func TestAllocate(t *testing.T) {
+	// /29 中除网络地址, 网关和广播地址外有 5 个可分配的地址
+	ipam := newTestIPAM(t, "10.0.0.0/29")
+	for n, id := range []string{"a", "b", "c", "d", "e"} {
+		ip, err := ipam.Allocate(id)
+		if err != nil {
+			t.Fatalf("Allocate(%s): %v", id, err)
+		}
+		if want := addIP(net.IPv4(10, 0, 0, 0), uint32(n+2)).String() + "/29"; ip.String() != want {
+			t.Errorf("Allocate(%s) = %s, want %s", id, ip, want)
+		}
+	}
+	if ip, err := ipam.Allocate("f"); err == nil {
+		t.Errorf("Allocate in an exhausted subnet = %s, want error", ip)
+	}
+
+	// 释放后地址可以再次分配
+	if err := ipam.Release("b"); err != nil {
+		t.Fatal(err)
+	}
+	ip, err := ipam.Allocate("f")
+	if err != nil || ip.IP.String() != "10.0.0.3" {
+		t.Errorf("Allocate after Release = %v, %v, want 10.0.0.3", ip, err)
+	}
+}
+
+func TestReserve(t *testing.T) {
+	ipam := newTestIPAM(t, "10.0.0.0/24")
+	ip := net.ParseIP("10.0.0.9")
+	if err := ipam.Reserve(ip, "a"); err != nil {
+		t.Fatal(err)
+	}
+	// 同一个容器重复保留不报错
+	if err := ipam.Reserve(ip, "a"); err != nil {
+		t.Errorf("Reserve by the same owner: %v", err)
+	}
+	if err := ipam.Reserve(ip, "b"); err == nil {
+		t.Error("Reserve of an address owned by another container succeeded")
+	}
+	for _, s := range []string{"10.0.0.1", "10.0.1.9"} {
+		if err := ipam.Reserve(net.ParseIP(s), "b"); err == nil {
+			t.Errorf("Reserve(%s) succeeded", s)
+		}
+	}
+	allocated, err := ipam.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(allocated) != 1 || allocated["10.0.0.9"] != "a" {
+		t.Errorf("List = %v, want 10.0.0.9 owned by a", allocated)
+	}
+}
+
+func TestRelease(t *testing.T) {
+	ipam := newTestIPAM(t, "10.0.0.0/24")
+	for _, id := range []string{"a", "b", "a"} {
+		if _, err := ipam.Allocate(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ipam.Release("a"); err != nil {
+		t.Fatal(err)
+	}
+	// 没有地址的容器释放时不报错
+	if err := ipam.Release("missing"); err != nil {
+		t.Errorf("Release of a container without addresses: %v", err)
+	}
+	allocated, err := ipam.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(allocated) != 1 || allocated["10.0.0.3"] != "b" {
+		t.Errorf("List = %v, want only 10.0.0.3 owned by b", allocated)
+	}
+}
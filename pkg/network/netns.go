@@ -0,0 +1,61 @@
+package network
+
+import (
+	"context"
+	"github.com/tluo-github/cri-impl/pkg/fsutil"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// NamespaceDir ip netns 创建的命名空间所在的目录
+const NamespaceDir = "/var/run/netns"
+
+// namespacePrefix 守护进程创建的命名空间的名称前缀, 用于清理孤立的命名空间
+const namespacePrefix = "cri-impl-"
+
+// NamespaceName 容器网络命名空间的名称
+func NamespaceName(id string) string {
+	return namespacePrefix + id
+}
+
+// NamespacePath 容器网络命名空间的路径
+func NamespacePath(id string) string {
+	return filepath.Join(NamespaceDir, NamespaceName(id))
+}
+
+// createNamespace 创建容器的网络命名空间并启用 loopback
+func (m *Manager) createNamespace(ctx context.Context, id string) error {
+	if _, err := run(ctx, "netns add", m.ipPath, "netns", "add", NamespaceName(id)); err != nil {
+		return err
+	}
+	_, err := run(ctx, "link up", m.ipPath, "-n", NamespaceName(id), "link", "set", "lo", "up")
+	return err
+}
+
+// deleteNamespace 删除网络命名空间, 其中的 veth 一端被删除时另一端也被删除
+func (m *Manager) deleteNamespace(ctx context.Context, id string) error {
+	if ok, err := fsutil.Exists(NamespacePath(id)); err != nil || !ok {
+		return err
+	}
+	_, err := run(ctx, "netns delete", m.ipPath, "netns", "delete", NamespaceName(id))
+	return err
+}
+
+// namespaces 守护进程创建的所有网络命名空间, 返回容器 id
+func namespaces() ([]string, error) {
+	files, err := ioutil.ReadDir(NamespaceDir)
+	if err != nil {
+		if ok, _ := fsutil.Exists(NamespaceDir); !ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var ids []string
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), namespacePrefix) {
+			ids = append(ids, strings.TrimPrefix(f.Name(), namespacePrefix))
+		}
+	}
+	return ids, nil
+}
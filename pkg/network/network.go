@@ -0,0 +1,272 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/hashicorp/go-multierror"
+	"github.com/tluo-github/cri-impl/pkg/container"
+	"k8s.io/klog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ContainerInterface 容器内网卡的名称
+const ContainerInterface = "eth0"
+
+// Options 容器网络的配置
+type Options struct {
+	// StateDir 保存 IPAM 状态和待重试的 CNI DEL 的目录, 如 <lib-root>/network
+	StateDir string
+	// Bridge 守护进程管理的 Linux bridge 名称
+	Bridge string
+	// Subnet 容器地址所在的 IPv4 子网, 第一个地址配置在 bridge 上作为网关
+	Subnet *net.IPNet
+	// NAT 对离开主机的容器流量做 MASQUERADE
+	NAT bool
+	// CNIConfDir CNI 网络配置文件 (.conflist, .conf, .json) 所在的目录
+	CNIConfDir string
+	// CNIPluginDirs 按顺序查找 CNI 插件可执行文件的目录
+	CNIPluginDirs []string
+	// CNINetwork 使用的 CNI 网络名称, 为空时使用 CNIConfDir 中按文件名排序的第一个网络
+	CNINetwork string
+	// CNIPluginTimeout 每次执行 CNI 插件的超时时间, 为 0 时使用 DefaultCNIPluginTimeout
+	CNIPluginTimeout time.Duration
+}
+
+// Manager 为容器创建网络命名空间, 由 bridge 或 CNI 插件配置命名空间中的网络, 用 DNAT 规则发布容器的端口
+// Manager 不是线程安全的, 由 runtimeService 的 lock 保护
+type Manager struct {
+	ipPath       string
+	iptablesPath string
+	bridge       string
+	nat          bool
+	ipam         *IPAM
+	// ready bridge 和 NAT 规则已经配置, 第一次使用时才配置, 没有容器使用 bridge 网络时不修改主机网络
+	ready bool
+
+	cniConfDir    string
+	cniPluginDirs []string
+	cniNetwork    string
+	cniTimeout    time.Duration
+	// cniStateDir 使用 CNI 网络的容器的网络状态, 用于区分孤立的命名空间属于哪种网络
+	cniStateDir string
+	// pendingDir CNI DEL 失败的容器的网络状态, restore 时重试
+	pendingDir string
+
+	// hostPorts 为 DNAT 规则占用的主机端口, key 为容器 id, 守护进程重启后由 restore 重新占用
+	hostPorts map[string][]*os.File
+}
+
+func NewManager(options Options) (*Manager, error) {
+	if len(options.Bridge) == 0 || len(options.Bridge) > 15 {
+		return nil, errors.New(fmt.Sprintf("Invalid bridge name %q", options.Bridge))
+	}
+	ipam, err := NewIPAM(filepath.Join(options.StateDir, options.Bridge), options.Subnet)
+	if err != nil {
+		return nil, err
+	}
+	timeout := options.CNIPluginTimeout
+	if timeout <= 0 {
+		timeout = DefaultCNIPluginTimeout
+	}
+	return &Manager{
+		ipPath:        "ip",
+		iptablesPath:  "iptables",
+		bridge:        options.Bridge,
+		nat:           options.NAT,
+		ipam:          ipam,
+		cniConfDir:    options.CNIConfDir,
+		cniPluginDirs: options.CNIPluginDirs,
+		cniNetwork:    options.CNINetwork,
+		cniTimeout:    timeout,
+		cniStateDir:   filepath.Join(options.StateDir, "cni"),
+		pendingDir:    filepath.Join(options.StateDir, "cni-pending"),
+		hostPorts:     make(map[string][]*os.File),
+	}, nil
+}
+
+// HostInterface 主机一侧 veth 的名称, 网卡名最长 15 个字符
+func HostInterface(id string) string {
+	if len(id) > 12 {
+		id = id[:12]
+	}
+	return "cri" + id
+}
+
+// Init 准备 mode 网络: bridge 时配置 bridge 和 NAT 规则, CNI 时检查网络配置, 可以重复调用
+func (m *Manager) Init(ctx context.Context, mode string) error {
+	switch mode {
+	case container.NetworkBridge:
+		return m.initBridge(ctx)
+	case container.NetworkCNI:
+		_, err := m.cniConfList()
+		return err
+	}
+	return nil
+}
+
+// Setup 为容器创建 mode 网络, 失败时清理已经创建的部分
+func (m *Manager) Setup(ctx context.Context, id string, mode string) (*container.NetworkStatus, error) {
+	switch mode {
+	case container.NetworkBridge:
+		return m.setupBridge(ctx, id)
+	case container.NetworkCNI:
+		return m.setupCNI(ctx, id)
+	}
+	return nil, errors.New(fmt.Sprintf("Unsupported network mode %q", mode))
+}
+
+// Teardown 删除容器的网络命名空间并释放网络, 可以重复调用
+// CNI DEL 失败时保留网络命名空间并记录网络状态, 由 GarbageCollect 重试
+func (m *Manager) Teardown(ctx context.Context, id string, status *container.NetworkStatus) error {
+	if status != nil && status.Mode == container.NetworkCNI {
+		return m.teardownCNI(ctx, id, status)
+	}
+	return m.teardownBridge(ctx, id)
+}
+
+// Restore 恢复已有容器的网络, 网络命名空间不存在时 (如主机重启后) 重新创建
+// 返回的状态与 status 不同时 (如 MAC 地址) 需要保存
+func (m *Manager) Restore(ctx context.Context, id string, status *container.NetworkStatus) (*container.NetworkStatus, error) {
+	switch status.Mode {
+	case container.NetworkBridge:
+		return m.restoreBridge(ctx, id, status)
+	case container.NetworkCNI:
+		return m.restoreCNI(ctx, id, status)
+	}
+	return nil, errors.New(fmt.Sprintf("Unsupported network mode %q of container %s", status.Mode, id))
+}
+
+// GarbageCollect 重试失败的 CNI DEL, 删除不属于 keep 中容器的网络命名空间和地址, 清理守护进程异常退出时遗留的网络
+// 有 CNI 记录的孤立网络执行 DEL 释放插件分配的地址, 其他的按 bridge 网络删除
+func (m *Manager) GarbageCollect(ctx context.Context, keep map[string]bool) error {
+	var result *multierror.Error
+	pending, err := m.retryPendingCNI(ctx, keep)
+	if err != nil {
+		result = multierror.Append(result, err)
+	}
+	ids, err := namespaces()
+	if err != nil {
+		result = multierror.Append(result, err)
+	}
+	// ADD 失败后 DEL 也失败时命名空间已经删除, 只剩下记录
+	cniIDs, err := cniStateIDs(m.cniStateDir)
+	if err != nil {
+		result = multierror.Append(result, err)
+	}
+	orphans := make(map[string]bool)
+	for _, id := range append(ids, cniIDs...) {
+		if keep[id] || pending[id] || orphans[id] {
+			continue
+		}
+		orphans[id] = true
+		if err := m.collect(ctx, id); err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
+	allocated, err := m.ipam.List()
+	if err != nil {
+		result = multierror.Append(result, err)
+	}
+	for _, owner := range allocated {
+		if !keep[owner] {
+			if err := m.ipam.Release(owner); err != nil {
+				result = multierror.Append(result, err)
+			}
+		}
+	}
+	return result.ErrorOrNil()
+}
+
+// collect 删除孤立的网络, CNI 网络 DEL 失败时保留命名空间和记录, 下次 GarbageCollect 时重试
+func (m *Manager) collect(ctx context.Context, id string) error {
+	status, err := m.readCNIState(m.cniStateDir, id)
+	if err != nil {
+		return err
+	}
+	if status == nil {
+		return m.teardownBridge(ctx, id)
+	}
+	if err := m.cniTeardownOnce(ctx, id, status); err != nil {
+		return errors.New(fmt.Sprintf("tear down CNI network of removed container %s: %v", id, err))
+	}
+	klog.Infof("tore down CNI network of removed container %s", id)
+	return nil
+}
+
+// Check 检查 mode 网络是否可用: bridge 已经启用, 或 CNI 网络配置和插件都存在
+func (m *Manager) Check(ctx context.Context, mode string) error {
+	switch mode {
+	case container.NetworkBridge:
+		return m.checkBridge(ctx)
+	case container.NetworkCNI:
+		return m.checkCNI()
+	}
+	return nil
+}
+
+// Bridge bridge 的名称和网关地址
+func (m *Manager) Bridge() (string, *net.IPNet) {
+	return m.bridge, m.ipam.Gateway()
+}
+
+// attach 创建网络命名空间和 veth, 配置地址和默认路由
+func (m *Manager) attach(ctx context.Context, id string, ip *net.IPNet) (*container.NetworkStatus, error) {
+	if err := m.createNamespace(ctx, id); err != nil {
+		return nil, err
+	}
+	ns, host := NamespaceName(id), HostInterface(id)
+	gateway := m.ipam.Gateway().IP.String()
+	for _, step := range []struct {
+		operation string
+		args      []string
+	}{
+		{"link add", []string{"link", "add", host, "type", "veth", "peer", "name", ContainerInterface, "netns", ns}},
+		{"link set", []string{"link", "set", host, "master", m.bridge, "up"}},
+		{"addr add", []string{"-n", ns, "addr", "add", ip.String(), "dev", ContainerInterface}},
+		{"link up", []string{"-n", ns, "link", "set", ContainerInterface, "up"}},
+		{"route add", []string{"-n", ns, "route", "add", "default", "via", gateway}},
+	} {
+		if _, err := run(ctx, step.operation, m.ipPath, step.args...); err != nil {
+			return nil, err
+		}
+	}
+	out, err := run(ctx, "link show", m.ipPath, "-n", ns, "-o", "link", "show", ContainerInterface)
+	if err != nil {
+		return nil, err
+	}
+	return &container.NetworkStatus{
+		Mode:          container.NetworkBridge,
+		Namespace:     NamespacePath(id),
+		Interface:     ContainerInterface,
+		HostInterface: host,
+		IP:            ip.String(),
+		Gateway:       gateway,
+		MAC:           linkAddress(out),
+		IPs:           []string{ip.String()},
+	}, nil
+}
+
+// linkFlags 返回 ip -o link show 输出中的网卡标志, 如 ",BROADCAST,MULTICAST,UP,"
+func linkFlags(out string) string {
+	start, end := strings.Index(out, "<"), strings.Index(out, ">")
+	if start < 0 || end < start {
+		return ""
+	}
+	return "," + out[start+1:end] + ","
+}
+
+// linkAddress 返回 ip -o link show 输出中的 MAC 地址
+func linkAddress(out string) string {
+	fields := strings.Fields(out)
+	for i, f := range fields {
+		if f == "link/ether" && i+1 < len(fields) {
+			return fields[i+1]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,134 @@
+package network
+
+import (
+	"context"
+	"github.com/tluo-github/cri-impl/pkg/container"
+	"github.com/tluo-github/cri-impl/pkg/fsutil"
+	"net"
+	"os"
+	"os/exec"
+	"testing"
+)
+
+// netnsTestEnv 设置时测试已经在 unshare -n -m 创建的网络和 mount 命名空间中运行
+const netnsTestEnv = "CRI_IMPL_NETNS_TEST"
+
+// inNetworkNamespace 在新的网络命名空间中重新执行当前测试, 不修改主机网络
+// 已经在新的命名空间中时返回 true, 由调用方继续执行测试
+func inNetworkNamespace(t *testing.T) bool {
+	if os.Getenv(netnsTestEnv) == "1" {
+		return true
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("creating network namespaces requires root")
+	}
+	for _, name := range []string{"unshare", "ip"} {
+		if _, err := exec.LookPath(name); err != nil {
+			t.Skipf("%s is not available", name)
+		}
+	}
+	cmd := exec.Command("unshare", "-n", "-m", os.Args[0], "-test.run", "^"+t.Name()+"$", "-test.v")
+	cmd.Env = append(os.Environ(), netnsTestEnv+"=1")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s in a new network namespace: %v\n%s", t.Name(), err, out)
+	}
+	t.Logf("%s", out)
+	return false
+}
+
+func newTestManager(t *testing.T) *Manager {
+	_, subnet, err := net.ParseCIDR("10.99.0.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewManager(Options{StateDir: tempDir(t), Bridge: "critest0", Subnet: subnet})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestBridgeSetupTeardown(t *testing.T) {
+	if !inNetworkNamespace(t) {
+		return
+	}
+	ctx := context.Background()
+	m := newTestManager(t)
+	status, err := m.Setup(ctx, "nettest1", container.NetworkBridge)
+	if err != nil {
+		t.Fatalf("Setup: %v", err)
+	}
+	defer m.Teardown(ctx, "nettest1", status)
+	if status.IP != "10.99.0.2/24" || status.Gateway != "10.99.0.1" || status.MAC == "" {
+		t.Errorf("Setup status = %+v", status)
+	}
+	if err := m.Check(ctx, container.NetworkBridge); err != nil {
+		t.Errorf("Check after Setup: %v", err)
+	}
+	// 网关可以从容器的命名空间访问
+	if _, err := exec.LookPath("ping"); err == nil {
+		if out, err := exec.Command("ip", "netns", "exec", NamespaceName("nettest1"), "ping", "-c", "1", "-W", "2", "10.99.0.1").CombinedOutput(); err != nil {
+			t.Errorf("ping gateway: %v\n%s", err, out)
+		}
+	}
+
+	// 第二个容器分配下一个地址
+	second, err := m.Setup(ctx, "nettest2", container.NetworkBridge)
+	if err != nil {
+		t.Fatalf("Setup second container: %v", err)
+	}
+	if second.IP != "10.99.0.3/24" {
+		t.Errorf("second container IP = %s, want 10.99.0.3/24", second.IP)
+	}
+	if err := m.Teardown(ctx, "nettest2", second); err != nil {
+		t.Fatalf("Teardown: %v", err)
+	}
+	// 重复 Teardown 不报错
+	if err := m.Teardown(ctx, "nettest2", second); err != nil {
+		t.Errorf("second Teardown: %v", err)
+	}
+	if ok, _ := fsutil.Exists(NamespacePath("nettest2")); ok {
+		t.Error("network namespace still exists after Teardown")
+	}
+	if _, err := run(ctx, "link show", "ip", "link", "show", HostInterface("nettest2")); !notFound(err) {
+		t.Errorf("host veth still exists after Teardown: %v", err)
+	}
+	allocated, err := m.ipam.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(allocated) != 1 || allocated["10.99.0.2"] != "nettest1" {
+		t.Errorf("allocated addresses after Teardown = %v", allocated)
+	}
+}
+
+func TestGarbageCollectBridge(t *testing.T) {
+	if !inNetworkNamespace(t) {
+		return
+	}
+	ctx := context.Background()
+	m := newTestManager(t)
+	for _, id := range []string{"gckeep", "gcorphan"} {
+		if _, err := m.Setup(ctx, id, container.NetworkBridge); err != nil {
+			t.Fatalf("Setup %s: %v", id, err)
+		}
+	}
+	defer m.Teardown(ctx, "gckeep", nil)
+	if err := m.GarbageCollect(ctx, map[string]bool{"gckeep": true}); err != nil {
+		t.Fatalf("GarbageCollect: %v", err)
+	}
+	if ok, _ := fsutil.Exists(NamespacePath("gcorphan")); ok {
+		t.Error("orphaned network namespace was not deleted")
+	}
+	if ok, _ := fsutil.Exists(NamespacePath("gckeep")); !ok {
+		t.Error("network namespace of a kept container was deleted")
+	}
+	allocated, err := m.ipam.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(allocated) != 1 || allocated["10.99.0.2"] != "gckeep" {
+		t.Errorf("allocated addresses after GarbageCollect = %v", allocated)
+	}
+}
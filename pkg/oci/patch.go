@@ -0,0 +1,118 @@
+package oci
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// restrictedPatchFields 只有特权调用方可以通过 merge patch 修改的 spec 字段,
+// 它们可以在主机上以 root 执行命令 (hooks), 访问主机文件和设备, 去掉容器的隔离和安全限制,
+// 修改内核参数, 或者绕过守护进程的默认资源限制 (cgroup 和 rlimit)
+var restrictedPatchFields = [][]string{
+	{"hooks"},
+	{"mounts"},
+	{"process", "user"},
+	{"process", "capabilities"},
+	{"process", "noNewPrivileges"},
+	{"process", "apparmorProfile"},
+	{"process", "selinuxLabel"},
+	{"process", "oomScoreAdj"},
+	{"process", "rlimits"},
+	{"linux", "namespaces"},
+	{"linux", "uidMappings"},
+	{"linux", "gidMappings"},
+	{"linux", "seccomp"},
+	{"linux", "devices"},
+	{"linux", "maskedPaths"},
+	{"linux", "readonlyPaths"},
+	{"linux", "cgroupsPath"},
+	{"linux", "resources"},
+	{"linux", "sysctl"},
+}
+
+// MergePatch 按 RFC 7396 (JSON Merge Patch) 将 patch 应用到 spec:
+// patch 中的对象逐个字段合并, null 删除字段, 其他值 (包括数组) 整体替换
+func MergePatch(spec RuntimeSpec, patch []byte) (RuntimeSpec, error) {
+	doc, err := decodeJSON(spec)
+	if err != nil {
+		return nil, err
+	}
+	p, err := decodeJSON(patch)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid merge patch: %v", err))
+	}
+	if _, ok := p.(map[string]interface{}); !ok {
+		return nil, errors.New("Invalid merge patch: must be a JSON object")
+	}
+	return json.Marshal(mergePatch(doc, p))
+}
+
+// RestrictedPatchField 返回 patch 修改的第一个安全相关的字段 (如 linux.seccomp), 没有时返回空字符串
+// 用 null 或非对象的值替换字段的上级对象 (如 "linux": null) 也视为修改了该字段
+func RestrictedPatchField(patch []byte) (string, error) {
+	p, err := decodeJSON(patch)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("Invalid merge patch: %v", err))
+	}
+	if _, ok := p.(map[string]interface{}); !ok {
+		return "", errors.New("Invalid merge patch: must be a JSON object")
+	}
+	for _, field := range restrictedPatchFields {
+		if patchTouches(p, field) {
+			return strings.Join(field, "."), nil
+		}
+	}
+	return "", nil
+}
+
+// patchTouches 判断 patch 是否修改 field
+func patchTouches(patch interface{}, field []string) bool {
+	if len(field) == 0 {
+		return true
+	}
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return true
+	}
+	v, ok := p[field[0]]
+	if !ok {
+		return false
+	}
+	return patchTouches(v, field[1:])
+}
+
+func mergePatch(target interface{}, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = map[string]interface{}{}
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+			continue
+		}
+		t[k] = mergePatch(t[k], v)
+	}
+	return t
+}
+
+// decodeJSON 数字保持为 json.Number, 避免 uint64 (如 rlimits) 损失精度
+func decodeJSON(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, errors.New("unexpected data after the JSON value")
+	}
+	return v, nil
+}
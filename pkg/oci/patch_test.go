@@ -0,0 +1,81 @@
+package oci
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestMergePatch(t *testing.T) {
+	spec := RuntimeSpec(`{"hostname":"a","process":{"args":["sh"],"cwd":"/"},"linux":{"sysctl":{"a":"1"}}}`)
+	got, err := MergePatch(spec, []byte(`{"hostname":"b","process":{"args":["sleep","1"]},"linux":{"sysctl":null}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"hostname":"b","linux":{},"process":{"args":["sleep","1"],"cwd":"/"}}`
+	if normalized := normalizeJSON(t, got); normalized != want {
+		t.Errorf("MergePatch = %s, want %s", normalized, want)
+	}
+	if _, err := MergePatch(spec, []byte(`["hostname"]`)); err == nil {
+		t.Error("MergePatch accepted a patch that is not an object")
+	}
+}
+
+// normalizeJSON 按照 key 排序重新编码
+func normalizeJSON(t *testing.T, data []byte) string {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		t.Fatal(err)
+	}
+	out, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func TestRestrictedPatchField(t *testing.T) {
+	cases := []struct {
+		patch string
+		want  string
+	}{
+		{`{"hostname":"web1","process":{"env":["A=1"],"cwd":"/srv"}}`, ""},
+		{`{"process":{"terminal":true},"annotations":{"a":"b"},"linux":{"rootfsPropagation":"private"}}`, ""},
+		{`{"hooks":{"prestart":[{"path":"/bin/sh","args":["sh","-c","id > /tmp/pwned"]}]}}`, "hooks"},
+		{`{"mounts":[{"destination":"/host","source":"/","type":"bind","options":["rbind"]}]}`, "mounts"},
+		{`{"process":{"capabilities":{"bounding":["CAP_SYS_ADMIN"]}}}`, "process.capabilities"},
+		{`{"process":{"noNewPrivileges":false}}`, "process.noNewPrivileges"},
+		{`{"process":{"apparmorProfile":"unconfined"}}`, "process.apparmorProfile"},
+		{`{"process":{"selinuxLabel":"system_u:system_r:spc_t:s0"}}`, "process.selinuxLabel"},
+		{`{"process":{"user":{"uid":0,"gid":0}}}`, "process.user"},
+		{`{"process":{"oomScoreAdj":-1000}}`, "process.oomScoreAdj"},
+		{`{"process":{"rlimits":[{"type":"RLIMIT_NOFILE","hard":1048576,"soft":1048576}]}}`, "process.rlimits"},
+		{`{"linux":{"namespaces":[{"type":"mount"}]}}`, "linux.namespaces"},
+		{`{"linux":{"uidMappings":[{"containerID":0,"hostID":0,"size":1}]}}`, "linux.uidMappings"},
+		{`{"linux":{"gidMappings":[{"containerID":0,"hostID":0,"size":1}]}}`, "linux.gidMappings"},
+		{`{"linux":{"seccomp":null}}`, "linux.seccomp"},
+		{`{"linux":{"devices":[{"path":"/dev/sda","type":"b","major":8,"minor":0}]}}`, "linux.devices"},
+		{`{"linux":{"maskedPaths":[]}}`, "linux.maskedPaths"},
+		{`{"linux":{"readonlyPaths":[]}}`, "linux.readonlyPaths"},
+		{`{"linux":{"cgroupsPath":"/system.slice/sshd.service"}}`, "linux.cgroupsPath"},
+		{`{"linux":{"resources":{"devices":[{"allow":true,"access":"rwm"}]}}}`, "linux.resources"},
+		{`{"linux":{"resources":{"pids":{"limit":100000}}}}`, "linux.resources"},
+		{`{"linux":{"resources":{"memory":{"limit":null}}}}`, "linux.resources"},
+		{`{"linux":{"sysctl":{"kernel.shm_rmid_forced":"0"}}}`, "linux.sysctl"},
+		// 替换上级对象会删除其中的安全字段
+		{`{"linux":null}`, "linux.namespaces"},
+		{`{"process":{"capabilities":null}}`, "process.capabilities"},
+		{`{"linux":{"resources":null}}`, "linux.resources"},
+	}
+	for _, c := range cases {
+		got, err := RestrictedPatchField([]byte(c.patch))
+		if err != nil {
+			t.Fatalf("RestrictedPatchField(%s): %v", c.patch, err)
+		}
+		if got != c.want {
+			t.Errorf("RestrictedPatchField(%s) = %q, want %q", c.patch, got, c.want)
+		}
+	}
+	if _, err := RestrictedPatchField([]byte(`null`)); err == nil {
+		t.Error("RestrictedPatchField accepted a patch that is not an object")
+	}
+}
@@ -1,18 +1,25 @@
 package oci
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/pkg/errors"
 	"github.com/tluo-github/cri-impl/pkg/container"
+	"github.com/tluo-github/cri-impl/pkg/metrics"
+	"github.com/tluo-github/cri-impl/pkg/shimutil"
 	"github.com/tluo-github/cri-impl/pkg/timeutil"
+	"github.com/tluo-github/cri-impl/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
 	"io/ioutil"
 	"k8s.io/klog"
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -24,20 +31,30 @@ type runcRuntime struct {
 	runtimePath string
 	// container 状态存储目录,eg /run/runc/
 	rootPath string
+	// runtimeArgs 每次执行 runc 都加上的全局参数
+	runtimeArgs []string
 }
 
 func NewRuntime(shimmyPath string,
 	runtimePath string,
 	rootPath string,
+	runtimeArgs []string,
 ) Runtime {
 	return &runcRuntime{
 		shimmyPath:  shimmyPath,
 		runtimePath: runtimePath,
 		rootPath:    rootPath,
+		runtimeArgs: runtimeArgs,
 	}
 }
 
+// globalArgs 在子命令之前加上全局参数 --root 和 handler 配置的参数
+func (r runcRuntime) globalArgs(args ...string) []string {
+	return append(append([]string{"--root", r.rootPath}, r.runtimeArgs...), args...)
+}
+
 func (r runcRuntime) CreateContainer(
+	ctx context.Context,
 	id container.ID,
 	bundleDir string,
 	logfile string,
@@ -49,13 +66,18 @@ func (r runcRuntime) CreateContainer(
 ) (pid int, err error) {
 	cmd := exec.Command(
 		r.shimmyPath,
-		"--shimmy-pidfile", path.Join(bundleDir, "shimmy.pid"),
+		"--shimmy-pidfile", shimPidFile(bundleDir),
 		"--shimmy-log-level", strings.ToUpper("info"),
 		"--runtime", r.runtimePath,
-		fmt.Sprintf("--runtime-arg='--root=%s'", r.rootPath),
+		r.shimRuntimeArg("--root="+r.rootPath),
+	)
+	for _, arg := range r.runtimeArgs {
+		cmd.Args = append(cmd.Args, r.shimRuntimeArg(arg))
+	}
+	cmd.Args = append(cmd.Args,
 		"--bundle", bundleDir,
 		"--container-id", string(id),
-		"--container-pidfile", path.Join(bundleDir, "container.pid"),
+		"--container-pidfile", containerPidFile(bundleDir),
 		"--container-logfile", logfile,
 		"--container-exitfile", exitfile,
 		"--container-attachfile", attachfile,
@@ -81,17 +103,14 @@ func (r runcRuntime) CreateContainer(
 	)
 	// 我们预计 shimmy 的执行几乎是即时的,因为它的主进程只是验证输入参数
 	// fork shim 进程处理,将其  PID 保持在磁盘上,然后退出
-	if _, err := runCommand(cmd); err != nil {
+	if _, err := runCommand(ctx, "create", cmd); err != nil {
 		return 0, err
 	}
 	syncpipeWrite.Close()
 
-	type Report struct {
-		Kind   string `json:"kind"`
-		Status string `json:"status"`
-		Stderr string `json:"stderr"`
-		Pid    int    `json:"pid"`
-	}
+	_, span := tracing.Start(ctx, "shimmy syncpipe wait", tracing.ContainerID(string(id)))
+	defer func() { tracing.End(span, err) }()
+
 	err = timeutil.WithTimeout(timeout, func() error {
 		bytes, err := ioutil.ReadAll(syncpipeRead)
 		if err != nil {
@@ -99,7 +118,7 @@ func (r runcRuntime) CreateContainer(
 		}
 		syncpipeRead.Close()
 
-		report := Report{}
+		report := shimutil.Report{}
 		if err := json.Unmarshal(bytes, &report); err != nil {
 			return errors.Wrap(
 				err,
@@ -107,7 +126,7 @@ func (r runcRuntime) CreateContainer(
 					string(bytes), bytes),
 			)
 		}
-		if report.Kind == "container_pid" && report.Pid > 0 {
+		if report.Kind == shimutil.ReportContainerPid && report.Pid > 0 {
 			pid = report.Pid
 			return nil
 		}
@@ -116,18 +135,27 @@ func (r runcRuntime) CreateContainer(
 	return pid, err
 }
 
-func (r runcRuntime) StartContainer(id container.ID) error {
+// shimRuntimeArg 返回传给 shim 的 --runtime-arg 参数, shimmy 要求参数值带有单引号, cri-impl-shim 直接使用参数值
+func (r runcRuntime) shimRuntimeArg(arg string) string {
+	if strings.HasPrefix(filepath.Base(r.shimmyPath), nativeShimName) {
+		return "--runtime-arg=" + arg
+	}
+	return fmt.Sprintf("--runtime-arg='%s'", arg)
+}
+
+func (r runcRuntime) StartContainer(ctx context.Context, id container.ID) error {
 	cmd := exec.Command(
 		r.runtimePath,
-		"--root", r.rootPath,
-		"start", string(id),
+		r.globalArgs(
+			"start", string(id),
+		)...,
 	)
 
-	_, err := runCommand(cmd)
+	_, err := runCommand(ctx, "start", cmd)
 	return err
 }
 
-func (r runcRuntime) KillContainer(id container.ID, sig os.Signal) error {
+func (r runcRuntime) KillContainer(ctx context.Context, id container.ID, sig os.Signal) error {
 	sigstr, err := sigStr(sig)
 	if err != nil {
 		return err
@@ -135,34 +163,37 @@ func (r runcRuntime) KillContainer(id container.ID, sig os.Signal) error {
 
 	cmd := exec.Command(
 		r.runtimePath,
-		"--root", r.rootPath,
-		"kill",
-		string(id),
-		sigstr,
+		r.globalArgs(
+			"kill",
+			string(id),
+			sigstr,
+		)...,
 	)
-	_, err = runCommand(cmd)
+	_, err = runCommand(ctx, "kill", cmd)
 	return err
 }
 
-func (r runcRuntime) DeleteContainer(id container.ID) error {
+func (r runcRuntime) DeleteContainer(ctx context.Context, id container.ID) error {
 	cmd := exec.Command(
 		r.runtimePath,
-		"--root", r.rootPath,
-		"delete",
-		string(id),
+		r.globalArgs(
+			"delete",
+			string(id),
+		)...,
 	)
-	_, err := runCommand(cmd)
+	_, err := runCommand(ctx, "delete", cmd)
 	return err
 }
 
-func (r runcRuntime) ContainerState(id container.ID) (StateResp, error) {
+func (r runcRuntime) ContainerState(ctx context.Context, id container.ID) (StateResp, error) {
 	cmd := exec.Command(
 		r.runtimePath,
-		"--root", r.rootPath,
-		"state",
-		string(id),
+		r.globalArgs(
+			"state",
+			string(id),
+		)...,
 	)
-	output, err := runCommand(cmd)
+	output, err := runCommand(ctx, "state", cmd)
 	if err != nil {
 		return StateResp{}, err
 	}
@@ -170,10 +201,122 @@ func (r runcRuntime) ContainerState(id container.ID) (StateResp, error) {
 	return resp, json.Unmarshal(output, &resp)
 }
 
-func runCommand(cmd *exec.Cmd) ([]byte, error) {
+func (r runcRuntime) ExecSync(
+	ctx context.Context,
+	id container.ID,
+	command []string,
+	timeout time.Duration,
+) (int, []byte, error) {
+	ctx, span := tracing.Start(ctx, "runc exec", tracing.ContainerID(string(id)))
+	defer span.End()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(
+		ctx,
+		r.runtimePath,
+		r.globalArgs(append([]string{"exec", string(id)}, command...)...)...,
+	)
+	start := time.Now()
+	output, err := cmd.CombinedOutput()
+	debugLog(cmd, output, err)
+	// 被执行命令的非零退出码不算 runc 执行失败,只统计超时
+	metrics.ObserveExec(filepath.Base(cmd.Path), "exec", start, ctx.Err())
+	if ctx.Err() != nil {
+		span.RecordError(ctx.Err())
+		return -1, output, errors.Wrap(ctx.Err(), "exec timed out")
+	}
+	if ee, ok := err.(*exec.ExitError); ok {
+		return ee.ExitCode(), output, nil
+	}
+	return 0, output, wrappedError(err)
+}
+
+func (r runcRuntime) ReopenContainerLog(ctx context.Context, id container.ID, bundleDir string) error {
+	pid, err := readPidFile(shimPidFile(bundleDir))
+	if err != nil {
+		return err
+	}
+	if !ShimReopensLog(pid) {
+		return errors.Errorf("shim of container %s does not support reopening its log", id)
+	}
+	if err := syscall.Kill(pid, syscall.SIGUSR1); err != nil {
+		return errors.Wrapf(err, "can't signal shim of container %s", id)
+	}
+	return nil
+}
+
+func (r runcRuntime) ShimPid(bundleDir string) (int, error) {
+	return readPidFile(shimPidFile(bundleDir))
+}
+
+// ShimAlive 检查 pid 是否仍然是容器 id 的 shim 进程, 通过命令行中的 --container-id 排除 pid 被复用的情况
+func ShimAlive(pid int, id container.ID) bool {
+	cmdline, err := ioutil.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "cmdline"))
+	if err != nil {
+		return false
+	}
+	for _, arg := range strings.Split(string(cmdline), "\x00") {
+		if arg == string(id) || arg == "--container-id="+string(id) {
+			return true
+		}
+	}
+	return false
+}
+
+// nativeShimName 本项目 shim 的文件名前缀
+const nativeShimName = "cri-impl-shim"
+
+// ShimReopensLog 检查 pid 对应的 shim 是否会在收到 SIGUSR1 后重新打开日志文件
+// 只有 cri-impl-shim 处理 SIGUSR1, shimmy 收到 SIGUSR1 会按默认行为退出
+func ShimReopensLog(pid int) bool {
+	cmdline, err := ioutil.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "cmdline"))
+	if err != nil {
+		return false
+	}
+	argv0 := strings.SplitN(string(cmdline), "\x00", 2)[0]
+	return strings.HasPrefix(filepath.Base(argv0), nativeShimName)
+}
+
+// ReadContainerPid 读取 shim 写入的容器主进程 pid
+func ReadContainerPid(bundleDir string) (int, error) {
+	return readPidFile(containerPidFile(bundleDir))
+}
+
+func shimPidFile(bundleDir string) string {
+	return path.Join(bundleDir, "shimmy.pid")
+}
+
+func containerPidFile(bundleDir string) string {
+	return path.Join(bundleDir, "container.pid")
+}
+
+func readPidFile(file string) (int, error) {
+	bytes, err := ioutil.ReadFile(file)
+	if err != nil {
+		return 0, errors.Wrap(err, "can't read pid file")
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(bytes)))
+	if err != nil || pid <= 0 {
+		return 0, errors.Errorf("bad pid file %s content %q", file, string(bytes))
+	}
+	return pid, nil
+}
+
+// runCommand 执行 runc/shimmy 命令, operation 用于指标的标签和 span 名称
+func runCommand(ctx context.Context, operation string, cmd *exec.Cmd) ([]byte, error) {
+	binary := filepath.Base(cmd.Path)
+	_, span := tracing.Start(ctx, binary+" "+operation,
+		attribute.String("exec.binary", binary),
+		attribute.StringSlice("exec.args", cmd.Args[1:]),
+	)
+	start := time.Now()
 	output, err := cmd.Output()
 	debugLog(cmd, output, err)
-	return output, wrappedError(err)
+	metrics.ObserveExec(binary, operation, start, err)
+	err = wrappedError(err)
+	tracing.End(span, err)
+	return output, err
 }
 
 func debugLog(c *exec.Cmd, stdout []byte, err error) {
@@ -187,13 +330,63 @@ func debugLog(c *exec.Cmd, stdout []byte, err error) {
 
 }
 
+// RuntimeError OCI runtime (runc) 执行失败
+type RuntimeError struct {
+	Stderr string
+	Err    error
+}
+
+func (e *RuntimeError) Error() string {
+	msg := "OCI runtime (runc) execution failed"
+	if e.Stderr != "" {
+		msg = fmt.Sprintf("%v,stderr=[%v]", msg, e.Stderr)
+	}
+	return msg + ": " + e.Err.Error()
+}
+
+func (e *RuntimeError) Unwrap() error {
+	return e.Err
+}
+
 func wrappedError(err error) error {
 	if err == nil {
 		return nil
 	}
-	msg := "OCI runtime (runc) execution failed"
+	rerr := &RuntimeError{Err: err}
 	if ee, ok := err.(*exec.ExitError); ok {
-		msg = fmt.Sprintf("%v,stderr=[%v]", msg, string(ee.Stderr))
+		rerr.Stderr = string(ee.Stderr)
+	}
+	return rerr
+}
+
+func (r runcRuntime) Version(ctx context.Context) (*VersionInfo, error) {
+	output, err := runCommand(ctx, "version", exec.Command(r.runtimePath, "--version"))
+	if err != nil {
+		return nil, err
+	}
+	info := &VersionInfo{
+		Name:   filepath.Base(r.runtimePath),
+		Output: strings.TrimSpace(string(output)),
 	}
-	return errors.Wrap(err, msg)
+	// 第一行格式为 "runc version 1.1.4"
+	first := strings.SplitN(info.Output, "\n", 2)[0]
+	if i := strings.LastIndex(first, "version "); i >= 0 {
+		info.Version = strings.TrimSpace(first[i+len("version "):])
+	}
+	return info, nil
+}
+
+func (r runcRuntime) CheckShim() error {
+	fi, err := os.Stat(r.shimmyPath)
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() || fi.Mode().Perm()&0111 == 0 {
+		return errors.New(fmt.Sprintf("%s is not an executable file", r.shimmyPath))
+	}
+	return nil
+}
+
+func (r runcRuntime) RootDir() string {
+	return r.rootPath
 }
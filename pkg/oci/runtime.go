@@ -1,14 +1,17 @@
 package oci
 
 import (
+	"context"
 	"github.com/tluo-github/cri-impl/pkg/container"
 	"os"
 	"time"
 )
 
 // Runtime 代表一个 OCI container runtime 接口
+// ctx 只用于传递 trace,不会中断正在执行的 runc 命令,避免容器状态不一致
 type Runtime interface {
 	CreateContainer(
+		ctx context.Context,
 		id container.ID,
 		bundleDir string,
 		logfile string,
@@ -18,10 +21,31 @@ type Runtime interface {
 		stdinOnce bool,
 		timeout time.Duration,
 	) (pid int, err error)
-	StartContainer(id container.ID) error
-	KillContainer(id container.ID, sig os.Signal) error
-	DeleteContainer(id container.ID) error
-	ContainerState(container.ID) (StateResp, error)
+	StartContainer(ctx context.Context, id container.ID) error
+	KillContainer(ctx context.Context, id container.ID, sig os.Signal) error
+	DeleteContainer(ctx context.Context, id container.ID) error
+	ContainerState(ctx context.Context, id container.ID) (StateResp, error)
+	// ExecSync 在运行中的容器内同步执行命令,返回命令的 exit code 和合并后的输出
+	ExecSync(ctx context.Context, id container.ID, cmd []string, timeout time.Duration) (exitCode int, output []byte, err error)
+	// ReopenContainerLog 通知容器的 shim 重新打开日志文件(SIGUSR1),用于日志轮转之后
+	// shim 不是 cri-impl-shim 时返回错误, 不发送信号
+	ReopenContainerLog(ctx context.Context, id container.ID, bundleDir string) error
+	// Version 执行 runc --version
+	Version(ctx context.Context) (*VersionInfo, error)
+	// CheckShim 检查 shim 可执行文件是否存在并且可以执行
+	CheckShim() error
+	// RootDir OCI 运行时的状态目录
+	RootDir() string
+	// ShimPid 读取 shim 写入 bundle 目录的 pid 文件
+	ShimPid(bundleDir string) (int, error)
+}
+
+// VersionInfo OCI 运行时的版本
+type VersionInfo struct {
+	Name    string
+	Version string
+	// Output runc --version 的完整输出, 包括 commit, spec 和 libseccomp 的版本
+	Output string
 }
 
 type StateResp struct {
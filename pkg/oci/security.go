@@ -0,0 +1,289 @@
+package oci
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/runtime-tools/generate"
+	"github.com/opencontainers/runtime-tools/generate/seccomp"
+	"github.com/opencontainers/runtime-tools/validate"
+	"github.com/syndtr/gocapability/capability"
+	"github.com/tluo-github/cri-impl/pkg/container"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+// ResolveSecurity 合并守护进程的默认值 defaults 和创建容器时的选项 opts, 返回生效的安全配置
+// capability 先应用守护进程的 CapAdd/CapDrop, 再应用 opts 的; 其他选项 opts 优先
+// localhost/ profile 只检查名称, 在检查调用方的权限之后由 NewSpec 读取
+func ResolveSecurity(opts container.SecurityOptions, defaults container.SecurityOptions) (container.SecurityProfile, error) {
+	if err := defaults.Validate(); err != nil {
+		return container.SecurityProfile{}, err
+	}
+	if err := opts.Validate(); err != nil {
+		return container.SecurityProfile{}, err
+	}
+
+	p := container.SecurityProfile{Privileged: opts.Privileged}
+	switch {
+	case opts.NoNewPrivileges != nil:
+		p.NoNewPrivileges = *opts.NoNewPrivileges
+	case defaults.NoNewPrivileges != nil:
+		p.NoNewPrivileges = *defaults.NoNewPrivileges
+	}
+	if p.Privileged {
+		p.Capabilities = allCapabilities()
+		p.Seccomp = container.SeccompUnconfined
+		p.MaskedPaths = []string{}
+		p.ReadonlyPaths = []string{}
+		return p, nil
+	}
+
+	caps, err := applyCapabilities(container.DefaultCapabilities, defaults.CapAdd, defaults.CapDrop)
+	if err != nil {
+		return p, err
+	}
+	if p.Capabilities, err = applyCapabilities(caps, opts.CapAdd, opts.CapDrop); err != nil {
+		return p, err
+	}
+	if p.Capabilities == nil {
+		p.Capabilities = []string{}
+	}
+	p.Seccomp = opts.Seccomp
+	if p.Seccomp == "" {
+		p.Seccomp = defaults.Seccomp
+	}
+	if p.Seccomp == "" {
+		p.Seccomp = container.SeccompRuntimeDefault
+	}
+	p.MaskedPaths = appendUnique(nil, container.DefaultMaskedPaths, defaults.MaskedPaths, opts.MaskedPaths)
+	p.ReadonlyPaths = appendUnique(nil, container.DefaultReadonlyPaths, defaults.ReadonlyPaths, opts.ReadonlyPaths)
+	return p, nil
+}
+
+// EffectiveSecurity 从最终的 spec (应用 spec 模板, patch 和插件之后) 读取实际生效的安全配置
+// linux.seccomp 与 generated (NewSpec 生成的 spec) 中的相同时保留 resolved 的 profile 名称, 被修改时为 custom
+func EffectiveSecurity(spec RuntimeSpec, generated RuntimeSpec, resolved container.SecurityProfile) (container.SecurityProfile, error) {
+	var final, gen specs.Spec
+	if err := json.Unmarshal(spec, &final); err != nil {
+		return container.SecurityProfile{}, err
+	}
+	if err := json.Unmarshal(generated, &gen); err != nil {
+		return container.SecurityProfile{}, err
+	}
+	p := container.SecurityProfile{
+		Capabilities:  []string{},
+		MaskedPaths:   []string{},
+		ReadonlyPaths: []string{},
+	}
+	if final.Process != nil {
+		p.NoNewPrivileges = final.Process.NoNewPrivileges
+		if final.Process.Capabilities != nil {
+			p.Capabilities = append(p.Capabilities, final.Process.Capabilities.Bounding...)
+		}
+	}
+	var seccomp, genSeccomp *specs.LinuxSeccomp
+	if final.Linux != nil {
+		p.MaskedPaths = append(p.MaskedPaths, final.Linux.MaskedPaths...)
+		p.ReadonlyPaths = append(p.ReadonlyPaths, final.Linux.ReadonlyPaths...)
+		seccomp = final.Linux.Seccomp
+	}
+	if gen.Linux != nil {
+		genSeccomp = gen.Linux.Seccomp
+	}
+	switch {
+	case seccomp == nil:
+		p.Seccomp = container.SeccompUnconfined
+	case reflect.DeepEqual(seccomp, genSeccomp):
+		p.Seccomp = resolved.Seccomp
+	default:
+		p.Seccomp = container.SeccompCustom
+	}
+	p.Privileged = p.Seccomp == container.SeccompUnconfined &&
+		len(p.MaskedPaths) == 0 && len(p.ReadonlyPaths) == 0 &&
+		containsAll(p.Capabilities, allCapabilities())
+	return p, nil
+}
+
+// applyCapabilities 在 base 上添加 add 并删除 drop
+// drop 包含 ALL 时只保留 add 中的 capability, add 包含 ALL 时为所有 capability 去掉 drop
+func applyCapabilities(base []string, add []string, drop []string) ([]string, error) {
+	var addAll, dropAll bool
+	var adds, drops []string
+	for _, list := range []struct {
+		names []string
+		all   *bool
+		out   *[]string
+	}{{add, &addAll, &adds}, {drop, &dropAll, &drops}} {
+		for _, name := range list.names {
+			c := container.NormalizeCapability(name)
+			if c == container.CapabilityAll {
+				*list.all = true
+				continue
+			}
+			if err := validate.CapValid(c, false); err != nil {
+				return nil, errors.New(fmt.Sprintf("Invalid capability %q: %v", name, err))
+			}
+			*list.out = append(*list.out, c)
+		}
+	}
+
+	caps := append([]string{}, base...)
+	if dropAll {
+		caps = nil
+	}
+	if addAll {
+		caps = allCapabilities()
+	}
+	caps = appendUnique(caps, adds)
+	if dropAll && !addAll {
+		return caps, nil
+	}
+	var result []string
+	for _, c := range caps {
+		if !contains(drops, c) {
+			result = append(result, c)
+		}
+	}
+	return result, nil
+}
+
+// allCapabilities 当前内核支持的所有 capability
+func allCapabilities() []string {
+	var caps []string
+	last := validate.LastCap()
+	for _, c := range capability.List() {
+		if c > last {
+			continue
+		}
+		caps = append(caps, "CAP_"+strings.ToUpper(c.String()))
+	}
+	return caps
+}
+
+// applySecurity 将生效的安全配置写入 spec, 在其他选项之后调用, 默认 seccomp profile 依赖最终的 capability
+// localhost/ profile 从 profileDir 中读取
+func applySecurity(gen *generate.Generator, p container.SecurityProfile, profileDir string) error {
+	gen.ClearProcessCapabilities()
+	for _, c := range p.Capabilities {
+		if err := gen.AddProcessCapabilityBounding(c); err != nil {
+			return err
+		}
+		if err := gen.AddProcessCapabilityEffective(c); err != nil {
+			return err
+		}
+		if err := gen.AddProcessCapabilityPermitted(c); err != nil {
+			return err
+		}
+	}
+	gen.SetProcessNoNewPrivileges(p.NoNewPrivileges)
+	gen.Config.Linux.MaskedPaths = append([]string{}, p.MaskedPaths...)
+	gen.Config.Linux.ReadonlyPaths = append([]string{}, p.ReadonlyPaths...)
+
+	if p.Privileged {
+		// 与 Docker 相同, 特权容器的 /sys 可写
+		for i, m := range gen.Config.Mounts {
+			if m.Destination == "/sys" {
+				gen.Config.Mounts[i].Options = removeString(m.Options, "ro")
+			}
+		}
+	}
+
+	switch {
+	case p.Seccomp == container.SeccompUnconfined:
+		gen.Config.Linux.Seccomp = nil
+	case p.Seccomp == container.SeccompRuntimeDefault:
+		gen.Config.Linux.Seccomp = seccomp.DefaultProfile(gen.Config)
+	case strings.HasPrefix(p.Seccomp, container.SeccompLocalhostPrefix):
+		profile, err := LoadSeccompProfile(profileDir, p.Seccomp)
+		if err != nil {
+			return err
+		}
+		gen.Config.Linux.Seccomp = profile
+	}
+	return nil
+}
+
+// SeccompProfilePath localhost/<路径> profile 在 dir 中的文件路径, 不能通过 .. 或 dir 之外的绝对路径访问其他文件
+func SeccompProfilePath(dir string, name string) (string, error) {
+	if err := container.ValidateSeccomp(name); err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(name, container.SeccompLocalhostPrefix) {
+		return "", errors.New(fmt.Sprintf("Seccomp profile %q is not a localhost profile", name))
+	}
+	if dir == "" {
+		return "", errors.New("Seccomp profile directory is not configured")
+	}
+	path := strings.TrimPrefix(name, container.SeccompLocalhostPrefix)
+	if filepath.IsAbs(path) {
+		rel, err := filepath.Rel(filepath.Clean(dir), filepath.Clean(path))
+		if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+			return "", errors.New(fmt.Sprintf("Seccomp profile %q is outside the seccomp profile directory %s", name, dir))
+		}
+		path = rel
+	}
+	return filepath.Join(dir, path), nil
+}
+
+// LoadSeccompProfile 从 dir 中读取 OCI 格式 (与 config.json 中的 linux.seccomp 相同) 的 localhost/<路径> profile
+func LoadSeccompProfile(dir string, name string) (*specs.LinuxSeccomp, error) {
+	path, err := SeccompProfilePath(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Failed to read seccomp profile: %v", err))
+	}
+	var profile specs.LinuxSeccomp
+	if err := json.Unmarshal(data, &profile); err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid seccomp profile %s: %v", path, err))
+	}
+	if profile.DefaultAction == "" {
+		return nil, errors.New(fmt.Sprintf("Invalid seccomp profile %s: defaultAction must not be empty", path))
+	}
+	return &profile, nil
+}
+
+func appendUnique(list []string, others ...[]string) []string {
+	for _, other := range others {
+		for _, s := range other {
+			if !contains(list, s) {
+				list = append(list, s)
+			}
+		}
+	}
+	return list
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAll(list []string, others []string) bool {
+	for _, s := range others {
+		if !contains(list, s) {
+			return false
+		}
+	}
+	return true
+}
+
+func removeString(list []string, s string) []string {
+	var result []string
+	for _, v := range list {
+		if v != s {
+			result = append(result, v)
+		}
+	}
+	return result
+}
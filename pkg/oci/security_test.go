@@ -0,0 +1,158 @@
+package oci
+
+import (
+	"encoding/json"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/tluo-github/cri-impl/pkg/container"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func newTestSpec(t *testing.T, opts container.SecurityOptions) (RuntimeSpec, container.SecurityProfile) {
+	resolved, err := ResolveSecurity(opts, container.SecurityOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec, err := NewSpec(SpecOptions{Command: "sh", RootPath: "/rootfs", Security: resolved})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return spec, resolved
+}
+
+func TestEffectiveSecurityUnchangedSpec(t *testing.T) {
+	spec, resolved := newTestSpec(t, container.SecurityOptions{CapDrop: []string{"NET_RAW"}})
+	got, err := EffectiveSecurity(spec, spec, resolved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, resolved) {
+		t.Errorf("EffectiveSecurity = %+v, want the resolved profile %+v", got, resolved)
+	}
+}
+
+func TestEffectiveSecurityAfterPatch(t *testing.T) {
+	spec, resolved := newTestSpec(t, container.SecurityOptions{})
+	privileged, privilegedResolved := newTestSpec(t, container.SecurityOptions{Privileged: true})
+	cases := []struct {
+		name     string
+		spec     RuntimeSpec
+		resolved container.SecurityProfile
+		patch    string
+		check    func(p container.SecurityProfile) bool
+	}{
+		{"seccomp removed", spec, resolved, `{"linux":{"seccomp":null}}`, func(p container.SecurityProfile) bool {
+			return p.Seccomp == container.SeccompUnconfined && !p.Privileged
+		}},
+		{"seccomp replaced", spec, resolved, `{"linux":{"seccomp":{"defaultAction":"SCMP_ACT_ALLOW"}}}`, func(p container.SecurityProfile) bool {
+			return p.Seccomp == container.SeccompCustom
+		}},
+		{"capability added", spec, resolved, `{"process":{"capabilities":{"bounding":["CAP_SYS_ADMIN"]}}}`, func(p container.SecurityProfile) bool {
+			return reflect.DeepEqual(p.Capabilities, []string{"CAP_SYS_ADMIN"})
+		}},
+		{"no_new_privs enabled", spec, resolved, `{"process":{"noNewPrivileges":true}}`, func(p container.SecurityProfile) bool {
+			return p.NoNewPrivileges
+		}},
+		{"privileged container masked", privileged, privilegedResolved, `{"linux":{"maskedPaths":["/proc/kcore"]}}`, func(p container.SecurityProfile) bool {
+			return !p.Privileged && reflect.DeepEqual(p.MaskedPaths, []string{"/proc/kcore"})
+		}},
+		{"everything opened", spec, resolved, `{"linux":{"seccomp":null,"maskedPaths":null,"readonlyPaths":null}}`, func(p container.SecurityProfile) bool {
+			return !p.Privileged
+		}},
+	}
+	for _, c := range cases {
+		patched, err := MergePatch(c.spec, []byte(c.patch))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := EffectiveSecurity(patched, c.spec, c.resolved)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !c.check(got) {
+			t.Errorf("%s: EffectiveSecurity = %+v", c.name, got)
+		}
+	}
+
+	got, err := EffectiveSecurity(privileged, privileged, privilegedResolved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Privileged || got.Seccomp != container.SeccompUnconfined {
+		t.Errorf("privileged container EffectiveSecurity = %+v", got)
+	}
+}
+
+func TestSeccompProfilePath(t *testing.T) {
+	dir := "/etc/cri-impl/seccomp"
+	cases := []struct {
+		name string
+		want string
+	}{
+		{"localhost/web.json", "/etc/cri-impl/seccomp/web.json"},
+		{"localhost/apps/web.json", "/etc/cri-impl/seccomp/apps/web.json"},
+		{"localhost//etc/cri-impl/seccomp/web.json", "/etc/cri-impl/seccomp/web.json"},
+		{"localhost//etc/shadow", ""},
+		{"localhost//etc/cri-impl/seccomp-other/web.json", ""},
+		{"localhost/../../shadow", ""},
+		{"localhost/apps/../../shadow", ""},
+		{"localhost//etc/cri-impl/seccomp/../../shadow", ""},
+		{"localhost/", ""},
+		{container.SeccompRuntimeDefault, ""},
+	}
+	for _, c := range cases {
+		got, err := SeccompProfilePath(dir, c.name)
+		if c.want == "" {
+			if err == nil {
+				t.Errorf("SeccompProfilePath(%q) = %s, want error", c.name, got)
+			}
+			continue
+		}
+		if err != nil || got != c.want {
+			t.Errorf("SeccompProfilePath(%q) = %s, %v, want %s", c.name, got, err, c.want)
+		}
+	}
+}
+
+func TestLoadSeccompProfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seccomp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "allow.json"), []byte(`{"defaultAction":"SCMP_ACT_ALLOW"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "empty.json"), []byte(`{}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	profile, err := LoadSeccompProfile(dir, "localhost/allow.json")
+	if err != nil || profile.DefaultAction != "SCMP_ACT_ALLOW" {
+		t.Errorf("LoadSeccompProfile = %+v, %v", profile, err)
+	}
+	for _, name := range []string{"localhost/empty.json", "localhost/missing.json"} {
+		if _, err := LoadSeccompProfile(dir, name); err == nil {
+			t.Errorf("LoadSeccompProfile(%s) succeeded", name)
+		}
+	}
+
+	// NewSpec 从 profile 目录读取 localhost profile
+	resolved, err := ResolveSecurity(container.SecurityOptions{Seccomp: "localhost/allow.json"}, container.SecurityOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec, err := NewSpec(SpecOptions{Command: "sh", RootPath: "/rootfs", Security: resolved, SeccompProfileDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got specs.Spec
+	if err := json.Unmarshal(spec, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Linux.Seccomp == nil || got.Linux.Seccomp.DefaultAction != "SCMP_ACT_ALLOW" {
+		t.Errorf("linux.seccomp = %+v, want the localhost profile", got.Linux.Seccomp)
+	}
+}
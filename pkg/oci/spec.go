@@ -1,9 +1,19 @@
 package oci
 
 import (
-	"bufio"
 	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hashicorp/go-multierror"
+	"github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/opencontainers/runtime-tools/generate"
+	"github.com/opencontainers/runtime-tools/validate"
+	"github.com/tluo-github/cri-impl/pkg/container"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 )
 
 type RuntimeSpec []byte
@@ -13,6 +23,24 @@ type SpecOptions struct {
 	Args         []string
 	RootPath     string
 	RootReadonly bool
+	// Resources cgroup 资源限制, 为 0 的项不限制
+	Resources container.Resources
+	// Hooks 由 OCI 运行时在容器生命周期中执行的 hooks
+	Hooks specs.Hooks
+	// Security ResolveSecurity 返回的安全配置
+	Security container.SecurityProfile
+	// SeccompProfileDir localhost/ seccomp profile 所在的目录
+	SeccompProfileDir string
+	// UserNamespace 容器的 uid/gid 映射, nil 表示不使用用户命名空间
+	UserNamespace *container.UserNamespace
+	// Rootless 守护进程以非 root 用户运行
+	Rootless bool
+	// CgroupsPath 容器的 cgroup (相对于 cgroup 根目录), 为空时由 OCI 运行时决定
+	CgroupsPath string
+	// NetworkNamespace 容器加入的网络命名空间的路径, 为空时由 OCI 运行时创建新的网络命名空间
+	NetworkNamespace string
+	// UserNamespacePath 容器加入的用户命名空间的路径, 映射仍然使用 UserNamespace
+	UserNamespacePath string
 }
 
 func NewSpec(options SpecOptions) (RuntimeSpec, error) {
@@ -24,12 +52,136 @@ func NewSpec(options SpecOptions) (RuntimeSpec, error) {
 	gen.SetRootPath(options.RootPath)
 	gen.SetRootReadonly(options.RootReadonly)
 	gen.SetProcessArgs(append([]string{options.Command}, options.Args...))
+	r := options.Resources
+	if r.MemoryLimit > 0 {
+		gen.SetLinuxResourcesMemoryLimit(r.MemoryLimit)
+	}
+	if r.CPUMilli > 0 {
+		gen.SetLinuxResourcesCPUPeriod(container.DefaultCPUPeriod)
+		gen.SetLinuxResourcesCPUQuota(r.CPUQuota())
+	}
+	if r.PidsLimit > 0 {
+		gen.SetLinuxResourcesPidsLimit(r.PidsLimit)
+	}
+	if err := applySecurity(&gen, options.Security, options.SeccompProfileDir); err != nil {
+		return nil, err
+	}
+	if err := applyUserNamespace(&gen, options.UserNamespace); err != nil {
+		return nil, err
+	}
+	if options.UserNamespacePath != "" {
+		if err := gen.AddOrReplaceLinuxNamespace(string(specs.UserNamespace), options.UserNamespacePath); err != nil {
+			return nil, err
+		}
+	}
+	if options.NetworkNamespace != "" {
+		if err := gen.AddOrReplaceLinuxNamespace(string(specs.NetworkNamespace), options.NetworkNamespace); err != nil {
+			return nil, err
+		}
+	}
+	if options.CgroupsPath != "" {
+		gen.SetLinuxCgroupsPath(options.CgroupsPath)
+	}
+	if options.Rootless {
+		applyRootless(&gen, options.CgroupsPath)
+	}
+	if hasHooks(options.Hooks) {
+		hooks := options.Hooks
+		gen.Config.Hooks = &hooks
+	}
 
 	var buf bytes.Buffer
 	exprOpts := generate.ExportOptions{}
-	if err := gen.Save(bufio.NewWriter(&buf), exprOpts); err != nil {
+	if err := gen.Save(&buf, exprOpts); err != nil {
 		return nil, err
 	}
 	return buf.Bytes(), nil
 
 }
+
+// SetNamespacePaths 修改 bundle 中 spec 文件已有的命名空间的路径, 用于容器重启前加入新创建的命名空间
+func SetNamespacePaths(specFile string, paths map[specs.LinuxNamespaceType]string) error {
+	blob, err := ioutil.ReadFile(specFile)
+	if err != nil {
+		return err
+	}
+	var s specs.Spec
+	if err := json.Unmarshal(blob, &s); err != nil {
+		return errors.New(fmt.Sprintf("Invalid runtime spec %s: %v", specFile, err))
+	}
+	if s.Linux == nil {
+		return errors.New(fmt.Sprintf("Runtime spec %s has no linux namespaces", specFile))
+	}
+	for i, ns := range s.Linux.Namespaces {
+		if path, ok := paths[ns.Type]; ok {
+			s.Linux.Namespaces[i].Path = path
+		}
+	}
+	if blob, err = json.MarshalIndent(&s, "", "\t"); err != nil {
+		return err
+	}
+	tmpfile := specFile + ".writing"
+	if err := ioutil.WriteFile(tmpfile, blob, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpfile, specFile)
+}
+
+func hasHooks(h specs.Hooks) bool {
+	return len(h.Prestart) > 0 || len(h.CreateRuntime) > 0 || len(h.CreateContainer) > 0 ||
+		len(h.StartContainer) > 0 || len(h.Poststart) > 0 || len(h.Poststop) > 0
+}
+
+// ValidateSpec 在 bundle 写入之前用 runtime-tools 的 validator 检查 spec (可能被 merge patch 或插件修改过),
+// 返回的错误列出所有问题. rootPath 为容器的 rootfs 目录, root.path 不能被修改;
+// 不检查 JSON schema (需要下载 schema) 和 rootfs 目录本身 (写入 bundle 时才复制)
+func ValidateSpec(spec RuntimeSpec, rootPath string) error {
+	var s specs.Spec
+	dec := json.NewDecoder(bytes.NewReader(spec))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&s); err != nil {
+		return errors.New(fmt.Sprintf("Invalid runtime spec: %v", err))
+	}
+
+	var errs []string
+	if s.Root == nil || s.Root.Path != rootPath {
+		errs = append(errs, fmt.Sprintf("root.path must not be changed from %s", rootPath))
+	}
+	v, err := validate.NewValidator(&s, filepath.Dir(rootPath), false, "linux")
+	if err != nil {
+		return err
+	}
+	for _, check := range []func() error{
+		v.CheckPlatform,
+		v.CheckMandatoryFields,
+		v.CheckSemVer,
+		v.CheckMounts,
+		v.CheckProcess,
+		v.CheckLinux,
+		v.CheckAnnotations,
+		v.CheckHooks,
+	} {
+		errs = append(errs, validationErrors(check())...)
+	}
+	if len(errs) > 0 {
+		return errors.New(fmt.Sprintf("Invalid runtime spec:\n  %s", strings.Join(errs, "\n  ")))
+	}
+	return nil
+}
+
+// validationErrors 展开 validator 返回的 multierror
+func validationErrors(err error) []string {
+	if err == nil {
+		return nil
+	}
+	var merr *multierror.Error
+	if errors.As(err, &merr) {
+		var msgs []string
+		for _, e := range merr.Errors {
+			msgs = append(msgs, validationErrors(e)...)
+		}
+		return msgs
+	}
+	// runtime-spec 规范的引用在第二行 (Refer to: ...), 每个错误保持一行
+	return []string{strings.Replace(err.Error(), "\n", " ", -1)}
+}
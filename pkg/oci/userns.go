@@ -0,0 +1,73 @@
+package oci
+
+import (
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/runtime-tools/generate"
+	"github.com/tluo-github/cri-impl/pkg/container"
+	"strconv"
+	"strings"
+)
+
+// applyUserNamespace 添加用户命名空间和 uid/gid 映射, 删除容器内没有映射的 uid=/gid= 挂载选项 (如 devpts 的 gid=5)
+func applyUserNamespace(gen *generate.Generator, ns *container.UserNamespace) error {
+	if ns == nil {
+		return nil
+	}
+	if err := gen.AddOrReplaceLinuxNamespace(string(specs.UserNamespace), ""); err != nil {
+		return err
+	}
+	gen.ClearLinuxUIDMappings()
+	gen.ClearLinuxGIDMappings()
+	for _, m := range ns.UIDMappings {
+		gen.AddLinuxUIDMapping(m.HostID, m.ContainerID, m.Size)
+	}
+	for _, m := range ns.GIDMappings {
+		gen.AddLinuxGIDMapping(m.HostID, m.ContainerID, m.Size)
+	}
+	for i, m := range gen.Config.Mounts {
+		var options []string
+		for _, o := range m.Options {
+			if mapped(o, "uid=", ns.UIDMappings) && mapped(o, "gid=", ns.GIDMappings) {
+				options = append(options, o)
+			}
+		}
+		gen.Config.Mounts[i].Options = options
+	}
+	return nil
+}
+
+// mapped 挂载选项 option 不是 prefix<id> 或者 id 在容器内有映射
+func mapped(option string, prefix string, mappings []container.IDMapping) bool {
+	if !strings.HasPrefix(option, prefix) {
+		return true
+	}
+	id, err := strconv.ParseUint(strings.TrimPrefix(option, prefix), 10, 32)
+	if err != nil {
+		return true
+	}
+	_, ok := container.HostID(mappings, uint32(id))
+	return ok
+}
+
+// applyRootless 非 root 用户不能挂载 sysfs 和修改没有委派的 cgroup:
+// /sys 改为只读的 bind mount, 没有委派 cgroup 时删除所有资源限制
+func applyRootless(gen *generate.Generator, cgroupsPath string) {
+	for i, m := range gen.Config.Mounts {
+		if m.Destination == "/sys" {
+			gen.Config.Mounts[i] = specs.Mount{
+				Destination: "/sys",
+				Type:        "none",
+				Source:      "/sys",
+				Options:     []string{"rbind", "nosuid", "noexec", "nodev", "ro"},
+			}
+		}
+	}
+	if cgroupsPath == "" {
+		gen.Config.Linux.Resources = nil
+		return
+	}
+	// cgroup v2 的 device controller 需要在主机上加载 eBPF 程序, 非 root 用户不能使用
+	if gen.Config.Linux.Resources != nil {
+		gen.Config.Linux.Resources.Devices = nil
+	}
+}
@@ -0,0 +1,345 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/tluo-github/cri-impl/pkg/metrics"
+	"github.com/tluo-github/cri-impl/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"k8s.io/klog"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event 容器生命周期的状态转换
+type Event string
+
+const (
+	Create Event = "create"
+	Start  Event = "start"
+	Stop   Event = "stop"
+	Remove Event = "remove"
+)
+
+// Events 所有事件
+var Events = []Event{Create, Start, Stop, Remove}
+
+// Phase 插件在状态转换之前 (pre) 或之后 (post) 被调用
+type Phase string
+
+const (
+	// Pre 在状态转换之前调用, 插件可以否决转换, create 时还可以修改 spec
+	Pre Phase = "pre"
+	// Post 在状态转换成功之后调用, 只是通知, 插件的错误被记录但不影响结果
+	// 容器自己退出, liveness 强杀以及守护进程关闭时停止容器也会通知 stop post
+	Post Phase = "post"
+)
+
+// ProtocolVersion 请求和响应的格式版本
+const ProtocolVersion = "1"
+
+// DefaultTimeout 插件没有配置超时时间时的默认值
+const DefaultTimeout = 10 * time.Second
+
+// PreBudget 一次状态转换中所有 pre 插件的总时间上限
+// pre 插件在守护进程的全局锁内执行, 期间其它请求都被阻塞, 因此插件的 Timeout 超过剩余预算时按剩余预算计算
+const PreBudget = 2 * time.Second
+
+// maxErrorOutput 错误信息中插件 stderr 的最大长度
+const maxErrorOutput = 4096
+
+// Plugin 一个可执行文件插件
+// 守护进程执行 <path> [args...] <event> <phase>, 在 stdin 写入一个 JSON Request,
+// 插件在 stdout 输出一个 JSON Response (可以为空, 表示同意且不修改), 非 0 退出码表示执行失败
+type Plugin struct {
+	Name string
+	Path string
+	Args []string
+	// Events 插件关注的事件, 为空表示所有事件
+	Events []Event
+	// Timeout 每次调用的超时时间
+	Timeout time.Duration
+	// IgnoreFailure 为 true 时插件执行失败 (超时, 非 0 退出码, 非法的响应) 不影响状态转换; 否决始终生效
+	IgnoreFailure bool
+}
+
+// Container 请求中的容器信息
+type Container struct {
+	ID             string `json:"id"`
+	Name           string `json:"name"`
+	RuntimeHandler string `json:"runtimeHandler"`
+	// Status 状态转换前 (pre) 或转换后 (post) 的容器状态
+	Status   string `json:"status"`
+	Bundle   string `json:"bundle"`
+	ExitCode int32  `json:"exitCode"`
+}
+
+// Request 写入插件 stdin 的请求
+type Request struct {
+	Version   string    `json:"version"`
+	Event     Event     `json:"event"`
+	Phase     Phase     `json:"phase"`
+	Container Container `json:"container"`
+	// Spec 容器的 OCI runtime spec, 只在 create pre 时提供
+	Spec json.RawMessage `json:"spec,omitempty"`
+}
+
+// Response 插件在 stdout 输出的响应
+type Response struct {
+	// Veto 为 true 时拒绝本次状态转换, 只在 pre 时有效
+	Veto   bool   `json:"veto,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	// Spec 修改后的完整 spec, 只在 create pre 时有效, 为空表示不修改
+	Spec json.RawMessage `json:"spec,omitempty"`
+}
+
+// VetoError 插件否决了状态转换
+type VetoError struct {
+	Plugin string
+	Event  Event
+	Reason string
+}
+
+func (e *VetoError) Error() string {
+	msg := fmt.Sprintf("plugin %s vetoed %s", e.Plugin, e.Event)
+	if e.Reason != "" {
+		msg += ": " + e.Reason
+	}
+	return msg
+}
+
+// Manager 按配置的顺序调用插件
+// nil 的 Manager 表示没有插件
+type Manager struct {
+	plugins []Plugin
+
+	// lock 保护通知队列
+	lock sync.Mutex
+	// queue 等待执行的 post 通知, 由一个 goroutine 按顺序执行
+	queue []notification
+	// notifying 是否有 goroutine 在执行 queue 中的通知
+	notifying bool
+	// closed Close 之后不再接受通知
+	closed bool
+	// notified 等待执行通知的 goroutine 退出
+	notified sync.WaitGroup
+}
+
+// notification 一次 post 通知
+type notification struct {
+	ctx       context.Context
+	event     Event
+	container Container
+}
+
+func NewManager(plugins []Plugin) *Manager {
+	if len(plugins) == 0 {
+		return nil
+	}
+	return &Manager{plugins: plugins}
+}
+
+// Pre 在状态转换之前依次调用插件, 每个插件看到的 spec 是前一个插件修改后的结果
+// 返回最终的 spec (req.Spec 为空时也为空); 插件否决时返回 *VetoError
+func (m *Manager) Pre(ctx context.Context, event Event, c Container, spec []byte) ([]byte, error) {
+	if m == nil {
+		return spec, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, PreBudget)
+	defer cancel()
+	for _, p := range m.plugins {
+		if !p.handles(event) {
+			continue
+		}
+		req := Request{Version: ProtocolVersion, Event: event, Phase: Pre, Container: c, Spec: spec}
+		resp, err := p.call(ctx, &req)
+		if err != nil {
+			if p.IgnoreFailure {
+				klog.Warningf("ignore failure of plugin %s on %s %s with err:%v", p.Name, event, Pre, err)
+				continue
+			}
+			return nil, err
+		}
+		if resp.Veto {
+			return nil, &VetoError{Plugin: p.Name, Event: event, Reason: resp.Reason}
+		}
+		if len(resp.Spec) > 0 {
+			if spec == nil {
+				klog.Warningf("plugin %s returned a spec on %s, ignored", p.Name, event)
+				continue
+			}
+			klog.Infof("plugin %s adjusted the spec of container %s", p.Name, c.ID)
+			spec = resp.Spec
+		}
+	}
+	return spec, nil
+}
+
+// Post 把状态转换成功的通知加入队列后立即返回, 队列中的通知在后台按加入的顺序依次通知插件
+// 插件的错误和否决只记录日志; 通知在调用方返回之后执行, 不使用 ctx 的取消和超时
+func (m *Manager) Post(ctx context.Context, event Event, c Container) {
+	if m == nil || !m.handles(event) {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.closed {
+		klog.Warningf("plugin manager is closed, drop %s %s notification of container %s", event, Post, c.ID)
+		return
+	}
+	m.queue = append(m.queue, notification{ctx: tracing.Detach(ctx), event: event, container: c})
+	if !m.notifying {
+		m.notifying = true
+		m.notified.Add(1)
+		go m.notify()
+	}
+}
+
+// Close 停止接受新的通知, 等待队列中的通知执行完成, ctx 结束时不再等待
+func (m *Manager) Close(ctx context.Context) {
+	if m == nil {
+		return
+	}
+	m.lock.Lock()
+	m.closed = true
+	m.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		m.notified.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		m.lock.Lock()
+		klog.Warningf("give up %d pending plugin notifications with err:%v", len(m.queue), ctx.Err())
+		m.lock.Unlock()
+	}
+}
+
+// notify 依次执行队列中的通知, 队列为空时退出
+func (m *Manager) notify() {
+	defer m.notified.Done()
+	for {
+		m.lock.Lock()
+		if len(m.queue) == 0 {
+			m.notifying = false
+			m.lock.Unlock()
+			return
+		}
+		n := m.queue[0]
+		m.queue = m.queue[1:]
+		m.lock.Unlock()
+		m.post(n.ctx, n.event, n.container)
+	}
+}
+
+// post 依次通知关注 event 的插件
+func (m *Manager) post(ctx context.Context, event Event, c Container) {
+	for _, p := range m.plugins {
+		if !p.handles(event) {
+			continue
+		}
+		req := Request{Version: ProtocolVersion, Event: event, Phase: Post, Container: c}
+		resp, err := p.call(ctx, &req)
+		if err != nil {
+			klog.Errorf("plugin %s on %s %s of container %s with err:%v", p.Name, event, Post, c.ID, err)
+			continue
+		}
+		if resp.Veto {
+			klog.Warningf("plugin %s vetoed %s %s of container %s, ignored: %s", p.Name, event, Post, c.ID, resp.Reason)
+		}
+	}
+}
+
+// handles 是否有插件关注 event
+func (m *Manager) handles(event Event) bool {
+	for _, p := range m.plugins {
+		if p.handles(event) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Plugin) handles(event Event) bool {
+	if len(p.Events) == 0 {
+		return true
+	}
+	for _, e := range p.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// call 执行一次插件, 插件必须在 Timeout 内退出
+func (p *Plugin) call(ctx context.Context, req *Request) (*Response, error) {
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	// pre 插件受 PreBudget 限制
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < timeout {
+		timeout = time.Until(deadline).Round(time.Millisecond)
+		if timeout < 0 {
+			timeout = 0
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	input, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	operation := string(req.Event) + " " + string(req.Phase)
+	_, span := tracing.Start(ctx, "plugin "+p.Name+" "+operation,
+		attribute.String("plugin.name", p.Name),
+		tracing.ContainerID(req.Container.ID),
+	)
+
+	args := append(append([]string{}, p.Args...), string(req.Event), string(req.Phase))
+	cmd := exec.CommandContext(ctx, p.Path, args...)
+	cmd.Stdin = bytes.NewReader(input)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	start := time.Now()
+	err = cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = errors.New(fmt.Sprintf("timed out after %v", timeout))
+	}
+	var resp Response
+	if err == nil && len(bytes.TrimSpace(stdout.Bytes())) > 0 {
+		if jerr := json.Unmarshal(stdout.Bytes(), &resp); jerr != nil {
+			err = errors.New(fmt.Sprintf("invalid response: %v", jerr))
+		}
+	}
+	klog.V(2).Infof("plugin %s %s of container %s stdout:%s stderr:%s error:%v",
+		p.Name, operation, req.Container.ID, stdout.String(), stderr.String(), err)
+	metrics.ObserveExec("plugin:"+p.Name, operation, start, err)
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if len(msg) > maxErrorOutput {
+			msg = msg[:maxErrorOutput]
+		}
+		if msg != "" {
+			err = errors.New(fmt.Sprintf("%v, stderr=[%s]", err, msg))
+		}
+		err = errors.New(fmt.Sprintf("plugin %s failed: %v", p.Name, err))
+	}
+	tracing.End(span, err)
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
@@ -0,0 +1,162 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writePlugin 在临时目录中创建一个 sh 脚本插件
+// 脚本把 "<event> <phase>" 追加到 calls 文件, 然后执行 body
+func writePlugin(t *testing.T, dir string, name string, body string) Plugin {
+	path := filepath.Join(dir, name)
+	script := fmt.Sprintf("#!/bin/sh\necho \"%s $1 $2\" >> %s/calls\n%s\n", name, dir, body)
+	if err := ioutil.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return Plugin{Name: name, Path: path}
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func readCalls(t *testing.T, dir string) []string {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "calls"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSpace(string(data)), "\n")
+}
+
+func TestPreModifiesSpecInOrder(t *testing.T) {
+	dir := tempDir(t)
+	// 第一个插件把 spec 中的 hostname 改为 a, 第二个插件看到修改后的 spec 再改为 b
+	first := writePlugin(t, dir, "first", `sed 's/.*"spec":{"hostname":"\([a-z]*\)"}.*/{"spec":{"hostname":"\1-a"}}/'`)
+	second := writePlugin(t, dir, "second", `sed 's/.*"spec":{"hostname":"\([a-z-]*\)"}.*/{"spec":{"hostname":"\1-b"}}/'`)
+	m := NewManager([]Plugin{first, second})
+
+	spec, err := m.Pre(context.Background(), Create, Container{ID: "c1"}, []byte(`{"hostname":"x"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got struct{ Hostname string }
+	if err := json.Unmarshal(spec, &got); err != nil {
+		t.Fatalf("invalid spec %s: %v", spec, err)
+	}
+	if got.Hostname != "x-a-b" {
+		t.Errorf("hostname = %q, want x-a-b", got.Hostname)
+	}
+}
+
+func TestPreVeto(t *testing.T) {
+	dir := tempDir(t)
+	veto := writePlugin(t, dir, "veto", `echo '{"veto":true,"reason":"not today"}'`)
+	after := writePlugin(t, dir, "after", "")
+	m := NewManager([]Plugin{veto, after})
+
+	_, err := m.Pre(context.Background(), Start, Container{ID: "c1"}, nil)
+	var vetoErr *VetoError
+	if !errors.As(err, &vetoErr) || vetoErr.Reason != "not today" {
+		t.Fatalf("Pre returned %v, want veto with reason", err)
+	}
+	if calls := readCalls(t, dir); len(calls) != 1 || calls[0] != "veto start pre" {
+		t.Errorf("calls = %q, want only the vetoing plugin", calls)
+	}
+}
+
+func TestPreFailure(t *testing.T) {
+	dir := tempDir(t)
+	failing := writePlugin(t, dir, "failing", "echo broken >&2; exit 1")
+	m := NewManager([]Plugin{failing})
+	if _, err := m.Pre(context.Background(), Stop, Container{ID: "c1"}, nil); err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Fatalf("Pre returned %v, want failure with stderr", err)
+	}
+
+	failing.IgnoreFailure = true
+	m = NewManager([]Plugin{failing})
+	if _, err := m.Pre(context.Background(), Stop, Container{ID: "c1"}, nil); err != nil {
+		t.Fatalf("Pre with ignoreFailure returned %v", err)
+	}
+}
+
+func TestPreBudget(t *testing.T) {
+	dir := tempDir(t)
+	slow := writePlugin(t, dir, "slow", "exec sleep 10")
+	slow.Timeout = time.Minute
+	m := NewManager([]Plugin{slow})
+
+	start := time.Now()
+	_, err := m.Pre(context.Background(), Remove, Container{ID: "c1"}, nil)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("Pre returned %v, want timeout", err)
+	}
+	// 插件的 Timeout 超过 PreBudget 时按 PreBudget 结束
+	if elapsed := time.Since(start); elapsed > PreBudget+time.Second {
+		t.Errorf("Pre took %v, want at most %v", elapsed, PreBudget)
+	}
+}
+
+func TestPostDoesNotBlock(t *testing.T) {
+	dir := tempDir(t)
+	slow := writePlugin(t, dir, "slow", "sleep 0.5")
+	slow.Events = []Event{Start, Stop}
+	m := NewManager([]Plugin{slow})
+
+	start := time.Now()
+	m.Post(context.Background(), Start, Container{ID: "c1"})
+	m.Post(context.Background(), Stop, Container{ID: "c1"})
+	// 不关注的事件不加入队列
+	m.Post(context.Background(), Remove, Container{ID: "c1"})
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("Post blocked for %v", elapsed)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	m.Close(ctx)
+	want := []string{"slow start post", "slow stop post"}
+	if calls := readCalls(t, dir); strings.Join(calls, ",") != strings.Join(want, ",") {
+		t.Errorf("calls = %q, want %q", calls, want)
+	}
+
+	// Close 之后的通知被丢弃
+	m.Post(context.Background(), Start, Container{ID: "c2"})
+	time.Sleep(100 * time.Millisecond)
+	if calls := readCalls(t, dir); len(calls) != 2 {
+		t.Errorf("calls after Close = %q", calls)
+	}
+}
+
+func TestPostIgnoresRequestCancellation(t *testing.T) {
+	dir := tempDir(t)
+	p := writePlugin(t, dir, "p", "sleep 0.2")
+	m := NewManager([]Plugin{p})
+
+	// 请求返回后 ctx 被取消, 通知仍然执行
+	ctx, cancel := context.WithCancel(context.Background())
+	m.Post(ctx, Stop, Container{ID: "c1"})
+	cancel()
+
+	closeCtx, closeCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer closeCancel()
+	m.Close(closeCtx)
+	if calls := readCalls(t, dir); len(calls) != 1 || calls[0] != "p stop post" {
+		t.Errorf("calls = %q, want the stop notification", calls)
+	}
+}
@@ -0,0 +1,185 @@
+package portproxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/tluo-github/cri-impl/pkg/container"
+	"github.com/tluo-github/cri-impl/pkg/rootless"
+	"github.com/tluo-github/cri-impl/pkg/tracing"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Command 代理进程使用的守护进程子命令
+const Command = "port-proxy"
+
+// startTimeout 等待代理进程占用端口并创建网络命名空间的时间
+const startTimeout = 10 * time.Second
+
+// stopTimeout SIGTERM 之后等待代理进程退出的时间, 超时后发送 SIGKILL
+const stopTimeout = 2 * time.Second
+
+// Proxy 运行中的代理进程
+type Proxy struct {
+	Pid int
+	// NetworkNamespace 代理进程创建的网络命名空间, 转发到容器地址时为空
+	NetworkNamespace string
+	// UserNamespace rootless 时代理进程所在的用户命名空间, 容器以相同的映射加入, 使容器可以加入 NetworkNamespace
+	UserNamespace string
+}
+
+// ready 代理进程准备好之后在 stdout 输出的一行 JSON
+type ready struct {
+	NetworkNamespace string `json:"networkNamespace,omitempty"`
+	Error            string `json:"error,omitempty"`
+}
+
+// Launcher 以守护进程的 port-proxy 子命令启动代理进程
+// 代理进程脱离守护进程运行, 守护进程重启期间发布的端口仍然可用
+type Launcher struct {
+	executable string
+	// dir 代理进程的日志目录
+	dir      string
+	rootless *rootless.Info
+}
+
+func NewLauncher(dir string, rootlessInfo *rootless.Info) (*Launcher, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	return &Launcher{executable: executable, dir: dir, rootless: rootlessInfo}, nil
+}
+
+// Start 启动容器 id 的代理进程, 返回时 ports 已经占用
+// target 为转发到的容器地址; 为空时代理进程创建新的网络命名空间 (rootless 时还有用户命名空间),
+// 容器加入这个命名空间, 代理进程转发到其中的 127.0.0.1
+func (l *Launcher) Start(ctx context.Context, id string, target string, ports []container.PortMapping) (proxy *Proxy, err error) {
+	_, span := tracing.Start(ctx, "portproxy.Start", tracing.ContainerID(id))
+	defer func() { tracing.End(span, err) }()
+
+	args := []string{Command, "--container-id=" + id}
+	if target != "" {
+		args = append(args, "--target="+target)
+	}
+	for _, p := range ports {
+		args = append(args, "--publish="+p.String())
+	}
+	cmd := exec.Command(l.executable, args...)
+	cmd.Dir = "/"
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	newUserns := target == "" && l.rootless != nil
+	if newUserns {
+		// 非 root 用户不能加入其他用户命名空间拥有的网络命名空间, 代理进程和容器使用同一个用户命名空间
+		cmd.SysProcAttr.Cloneflags = syscall.CLONE_NEWUSER
+		cmd.SysProcAttr.UidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: l.rootless.UID, Size: 1}}
+		cmd.SysProcAttr.GidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: l.rootless.GID, Size: 1}}
+		cmd.SysProcAttr.GidMappingsEnableSetgroups = false
+	}
+	logFile, err := os.OpenFile(l.logFile(id), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer logFile.Close()
+	cmd.Stderr = logFile
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	readyc := make(chan ready, 1)
+	go func() {
+		var r ready
+		line, err := bufio.NewReader(stdout).ReadBytes('\n')
+		if err == nil {
+			err = json.Unmarshal(line, &r)
+		}
+		if err != nil {
+			r.Error = fmt.Sprintf("port proxy exited before it was ready, see %s", l.logFile(id))
+		}
+		readyc <- r
+	}()
+	var r ready
+	select {
+	case r = <-readyc:
+	case <-time.After(startTimeout):
+		r.Error = fmt.Sprintf("port proxy wasn't ready after %v", startTimeout)
+	}
+	if r.Error != "" {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, errors.New(r.Error)
+	}
+	// 代理进程退出时回收, 守护进程重启后由 init 回收
+	go cmd.Wait()
+
+	proxy = &Proxy{Pid: cmd.Process.Pid, NetworkNamespace: r.NetworkNamespace}
+	if newUserns {
+		proxy.UserNamespace = fmt.Sprintf("/proc/%d/ns/user", proxy.Pid)
+	}
+	return proxy, nil
+}
+
+// Stop 停止容器 id 的代理进程并释放端口, 进程已经退出时什么都不做
+func (l *Launcher) Stop(pid int, id string) error {
+	if !Alive(pid, id) {
+		return nil
+	}
+	if err := syscall.Kill(pid, syscall.SIGTERM); err != nil {
+		return err
+	}
+	for deadline := time.Now().Add(stopTimeout); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		if !Alive(pid, id) {
+			return nil
+		}
+	}
+	if err := syscall.Kill(pid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+		return err
+	}
+	return nil
+}
+
+// Remove 删除容器 id 的代理进程日志
+func (l *Launcher) Remove(id string) error {
+	if err := os.Remove(l.logFile(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (l *Launcher) logFile(id string) string {
+	return filepath.Join(l.dir, id+".log")
+}
+
+// Alive 检查 pid 是否仍然是容器 id 的代理进程, 通过命令行中的 --container-id 排除 pid 被复用的情况
+func Alive(pid int, id string) bool {
+	if pid <= 0 {
+		return false
+	}
+	cmdline, err := ioutil.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "cmdline"))
+	if err != nil {
+		return false
+	}
+	args := strings.Split(string(cmdline), "\x00")
+	if len(args) < 2 || args[1] != Command {
+		return false
+	}
+	for _, arg := range args {
+		if arg == "--container-id="+id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,91 @@
+package portproxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// namespaceDialer 在新的网络命名空间中建立连接
+// 一个锁定的线程创建网络命名空间并在其中创建所有的 socket, 其他线程留在主机的网络命名空间中监听主机端口;
+// 新的网络命名空间由这个线程持有, 容器通过 path 加入
+type namespaceDialer struct {
+	path     string
+	requests chan dialRequest
+}
+
+type dialRequest struct {
+	network string
+	address string
+	result  chan dialResult
+}
+
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+func newNamespaceDialer() (*namespaceDialer, error) {
+	d := &namespaceDialer{requests: make(chan dialRequest)}
+	errc := make(chan error, 1)
+	go func() {
+		// 不调用 UnlockOSThread, goroutine 退出时线程随之退出, 不会被其他 goroutine 复用
+		runtime.LockOSThread()
+		if err := syscall.Unshare(syscall.CLONE_NEWNET); err != nil {
+			errc <- errors.New(fmt.Sprintf("can't create network namespace: %v", err))
+			return
+		}
+		if err := loopbackUp(); err != nil {
+			errc <- errors.New(fmt.Sprintf("can't bring up loopback: %v", err))
+			return
+		}
+		d.path = fmt.Sprintf("/proc/%d/task/%d/ns/net", os.Getpid(), syscall.Gettid())
+		errc <- nil
+		for req := range d.requests {
+			conn, err := net.DialTimeout(req.network, req.address, dialTimeout)
+			req.result <- dialResult{conn: conn, err: err}
+		}
+	}()
+	if err := <-errc; err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Dial 由锁定的线程建立连接, 连接到容器的 127.0.0.1 很快, 依次处理即可
+func (d *namespaceDialer) Dial(network string, address string) (net.Conn, error) {
+	result := make(chan dialResult, 1)
+	d.requests <- dialRequest{network: network, address: address, result: result}
+	r := <-result
+	return r.conn, r.err
+}
+
+// ifreqFlags struct ifreq 中的 ifr_name 和 ifr_flags
+type ifreqFlags struct {
+	name  [syscall.IFNAMSIZ]byte
+	flags uint16
+	_     [22]byte
+}
+
+// loopbackUp 启用当前线程网络命名空间中的 lo
+func loopbackUp() error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	var ifr ifreqFlags
+	copy(ifr.name[:], "lo")
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCGIFFLAGS, uintptr(unsafe.Pointer(&ifr))); errno != 0 {
+		return errno
+	}
+	ifr.flags |= syscall.IFF_UP
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&ifr))); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+package portproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/tluo-github/cri-impl/pkg/container"
+	"io"
+	"k8s.io/klog"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// dialTimeout 连接容器端口的超时时间
+const dialTimeout = 5 * time.Second
+
+// udpIdleTimeout UDP 会话在没有响应时保留的时间
+const udpIdleTimeout = 90 * time.Second
+
+// ServeOptions 代理进程的参数
+type ServeOptions struct {
+	ContainerID string
+	// Target 转发到的容器地址, 为空时创建新的网络命名空间并转发到其中的 127.0.0.1
+	Target string
+	Ports  []container.PortMapping
+}
+
+type dialFunc func(network string, address string) (net.Conn, error)
+
+// Serve 代理进程的入口: 占用主机端口, 在 stdout 输出一行 JSON 表示已经准备好, 然后转发连接直到收到 SIGTERM
+func Serve(opts ServeOptions) error {
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGTERM, syscall.SIGINT)
+
+	r, listeners, err := setup(opts)
+	if err != nil {
+		r.Error = err.Error()
+	}
+	blob, _ := json.Marshal(r)
+	fmt.Fprintln(os.Stdout, string(blob))
+	os.Stdout.Close()
+	if err != nil {
+		return err
+	}
+	klog.Infof("port proxy of container %s is ready", opts.ContainerID)
+
+	sig := <-sigc
+	klog.Infof("port proxy of container %s received %v, exiting", opts.ContainerID, sig)
+	for _, l := range listeners {
+		l.Close()
+	}
+	return nil
+}
+
+// setup 准备转发到容器的 dial 函数, 并为每个映射占用主机端口
+func setup(opts ServeOptions) (ready, []io.Closer, error) {
+	var r ready
+	dial := func(network string, address string) (net.Conn, error) {
+		return net.DialTimeout(network, address, dialTimeout)
+	}
+	target := opts.Target
+	if target == "" {
+		d, err := newNamespaceDialer()
+		if err != nil {
+			return r, nil, err
+		}
+		r.NetworkNamespace = d.path
+		dial = d.Dial
+		target = "127.0.0.1"
+	}
+
+	var listeners []io.Closer
+	for _, p := range opts.Ports {
+		backend := net.JoinHostPort(target, strconv.Itoa(int(p.ContainerPort)))
+		switch p.Protocol {
+		case container.ProtocolTCP:
+			l, err := net.Listen("tcp4", p.HostAddress())
+			if err != nil {
+				closeAll(listeners)
+				return r, nil, listenError(p, err)
+			}
+			listeners = append(listeners, l)
+			go serveTCP(l, dial, backend)
+		case container.ProtocolUDP:
+			pc, err := net.ListenPacket("udp4", p.HostAddress())
+			if err != nil {
+				closeAll(listeners)
+				return r, nil, listenError(p, err)
+			}
+			listeners = append(listeners, pc)
+			go serveUDP(pc, dial, backend)
+		}
+	}
+	return r, listeners, nil
+}
+
+// serveTCP 接受连接并转发到容器的 backend 地址
+func serveTCP(l net.Listener, dial dialFunc, backend string) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			klog.Warningf("failed to accept connection on %s with err:%v", l.Addr(), err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go forwardTCP(conn, dial, backend)
+	}
+}
+
+func forwardTCP(client net.Conn, dial dialFunc, backend string) {
+	defer client.Close()
+	server, err := dial("tcp", backend)
+	if err != nil {
+		klog.Warningf("failed to connect to %s for %s with err:%v", backend, client.RemoteAddr(), err)
+		return
+	}
+	defer server.Close()
+
+	var wg sync.WaitGroup
+	pipe := func(dst net.Conn, src net.Conn) {
+		defer wg.Done()
+		io.Copy(dst, src)
+		// 一个方向结束后只关闭写端, 另一个方向的数据继续转发
+		if c, ok := dst.(*net.TCPConn); ok {
+			c.CloseWrite()
+		}
+	}
+	wg.Add(2)
+	go pipe(server, client)
+	go pipe(client, server)
+	wg.Wait()
+}
+
+// serveUDP 为每个客户端地址建立一个到容器 backend 地址的会话, 把响应发回客户端
+func serveUDP(pc net.PacketConn, dial dialFunc, backend string) {
+	var lock sync.Mutex
+	sessions := make(map[string]net.Conn)
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				lock.Lock()
+				closeAll(sessionClosers(sessions))
+				lock.Unlock()
+				return
+			}
+			klog.Warningf("failed to read from %s with err:%v", pc.LocalAddr(), err)
+			continue
+		}
+		lock.Lock()
+		server, ok := sessions[addr.String()]
+		if !ok {
+			if server, err = dial("udp", backend); err != nil {
+				lock.Unlock()
+				klog.Warningf("failed to connect to %s for %s with err:%v", backend, addr, err)
+				continue
+			}
+			sessions[addr.String()] = server
+			go replyUDP(pc, server, addr, func() {
+				lock.Lock()
+				delete(sessions, addr.String())
+				lock.Unlock()
+			})
+		}
+		lock.Unlock()
+		if _, err := server.Write(buf[:n]); err != nil {
+			klog.Warningf("failed to write to %s for %s with err:%v", backend, addr, err)
+		}
+	}
+}
+
+// replyUDP 把容器的响应发回客户端, 超过 udpIdleTimeout 没有响应时结束会话
+func replyUDP(pc net.PacketConn, server net.Conn, client net.Addr, done func()) {
+	defer done()
+	defer server.Close()
+	buf := make([]byte, 65535)
+	for {
+		server.SetReadDeadline(time.Now().Add(udpIdleTimeout))
+		n, err := server.Read(buf)
+		if err != nil {
+			return
+		}
+		if _, err := pc.WriteTo(buf[:n], client); err != nil {
+			return
+		}
+	}
+}
+
+func listenError(p container.PortMapping, err error) error {
+	if errors.Is(err, syscall.EADDRINUSE) {
+		return errors.New(fmt.Sprintf("host port %s/%s is already in use", p.HostAddress(), p.Protocol))
+	}
+	return errors.New(fmt.Sprintf("can't listen on host port %s/%s: %v", p.HostAddress(), p.Protocol, err))
+}
+
+func sessionClosers(sessions map[string]net.Conn) []io.Closer {
+	var closers []io.Closer
+	for _, c := range sessions {
+		closers = append(closers, c)
+	}
+	return closers
+}
+
+func closeAll(closers []io.Closer) {
+	for _, c := range closers {
+		c.Close()
+	}
+}
@@ -0,0 +1,143 @@
+package portproxy
+
+import (
+	"bufio"
+	"github.com/tluo-github/cri-impl/pkg/container"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// freePort 返回一个当前没有被 TCP 和 UDP 占用的本地端口
+func freePort(t *testing.T) uint16 {
+	for i := 0; i < 10; i++ {
+		l, err := net.Listen("tcp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := l.Addr().(*net.TCPAddr).Port
+		l.Close()
+		if pc, err := net.ListenPacket("udp4", l.Addr().String()); err == nil {
+			pc.Close()
+			return uint16(port)
+		}
+	}
+	t.Fatal("no free port")
+	return 0
+}
+
+func localAddr(port uint16) string {
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port)))
+}
+
+// echoBackend 在同一个端口上启动 TCP 和 UDP 的 echo 服务, 返回的内容加上 "echo " 前缀
+func echoBackend(t *testing.T) uint16 {
+	port := freePort(t)
+	addr := localAddr(port)
+	l, err := net.Listen("tcp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				line, err := bufio.NewReader(conn).ReadString('\n')
+				if err != nil {
+					return
+				}
+				io.WriteString(conn, "echo "+line)
+			}()
+		}
+	}()
+	pc, err := net.ListenPacket("udp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(append([]byte("echo "), buf[:n]...), from)
+		}
+	}()
+	return port
+}
+
+func TestSetupForwards(t *testing.T) {
+	backend := echoBackend(t)
+	host := freePort(t)
+	opts := ServeOptions{
+		ContainerID: "c1",
+		Target:      "127.0.0.1",
+		Ports: []container.PortMapping{
+			{HostIP: "127.0.0.1", HostPort: host, ContainerPort: backend, Protocol: container.ProtocolTCP},
+			{HostIP: "127.0.0.1", HostPort: host, ContainerPort: backend, Protocol: container.ProtocolUDP},
+		},
+	}
+	r, listeners, err := setup(opts)
+	if err != nil {
+		t.Fatalf("setup: %v", err)
+	}
+	defer closeAll(listeners)
+	if r.NetworkNamespace != "" {
+		t.Errorf("setup with a target created network namespace %s", r.NetworkNamespace)
+	}
+	hostAddr := opts.Ports[0].HostAddress()
+
+	conn, err := net.DialTimeout("tcp", hostAddr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "tcp\n")
+	if reply, err := bufio.NewReader(conn).ReadString('\n'); err != nil || reply != "echo tcp\n" {
+		t.Errorf("TCP reply = %q, %v", reply, err)
+	}
+
+	uconn, err := net.Dial("udp", hostAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uconn.Close()
+	uconn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := uconn.Write([]byte("udp")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1024)
+	if n, err := uconn.Read(buf); err != nil || string(buf[:n]) != "echo udp" {
+		t.Errorf("UDP reply = %q, %v", buf[:n], err)
+	}
+
+	// 端口已经被占用时返回错误, 已经占用的端口被释放
+	second := freePort(t)
+	_, _, err = setup(ServeOptions{
+		ContainerID: "c2",
+		Target:      "127.0.0.1",
+		Ports: []container.PortMapping{
+			{HostIP: "127.0.0.1", HostPort: second, ContainerPort: backend, Protocol: container.ProtocolTCP},
+			{HostIP: "127.0.0.1", HostPort: host, ContainerPort: backend, Protocol: container.ProtocolTCP},
+		},
+	})
+	if err == nil || !strings.Contains(err.Error(), "already in use") {
+		t.Errorf("setup on a used port returned %v", err)
+	}
+	if l, err := net.Listen("tcp4", localAddr(second)); err != nil {
+		t.Errorf("port was not released after a failed setup: %v", err)
+	} else {
+		l.Close()
+	}
+}
@@ -0,0 +1,45 @@
+package probe
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+	"os"
+	"runtime"
+)
+
+// withNetNS 在 pid 所在的网络命名空间中执行 fn
+// setns 只作用于当前线程,fn 在一个锁定的线程中执行,执行完切回原命名空间
+func withNetNS(pid int, fn func() error) error {
+	target, err := os.Open(fmt.Sprintf("/proc/%d/ns/net", pid))
+	if err != nil {
+		return errors.Wrap(err, "can't open container network namespace")
+	}
+	defer target.Close()
+
+	errc := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+
+		origin, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid()))
+		if err != nil {
+			runtime.UnlockOSThread()
+			errc <- errors.Wrap(err, "can't open current network namespace")
+			return
+		}
+		defer origin.Close()
+
+		if err := unix.Setns(int(target.Fd()), unix.CLONE_NEWNET); err != nil {
+			runtime.UnlockOSThread()
+			errc <- errors.Wrap(err, "can't enter container network namespace")
+			return
+		}
+		ferr := fn()
+		// 无法切回时不解锁线程,让该线程随 goroutine 退出而销毁
+		if err := unix.Setns(int(origin.Fd()), unix.CLONE_NEWNET); err == nil {
+			runtime.UnlockOSThread()
+		}
+		errc <- ferr
+	}()
+	return <-errc
+}
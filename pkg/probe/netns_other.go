@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package probe
+
+import "errors"
+
+func withNetNS(pid int, fn func() error) error {
+	return errors.New("network namespace probes are only supported on linux")
+}
@@ -0,0 +1,69 @@
+package probe
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// TCP 在容器 (pid) 的网络命名空间内连接 port,连接成功即认为健康
+func TCP(pid int, port int32, timeout time.Duration) (bool, string, error) {
+	var ok bool
+	var msg string
+	err := withNetNS(pid, func() error {
+		conn, err := net.DialTimeout("tcp", addr(port), timeout)
+		if err != nil {
+			msg = err.Error()
+			return nil
+		}
+		conn.Close()
+		ok = true
+		return nil
+	})
+	return ok, msg, err
+}
+
+// HTTP 在容器 (pid) 的网络命名空间内发起 GET 请求,2xx 和 3xx 认为健康
+func HTTP(pid int, port int32, path string, timeout time.Duration) (bool, string, error) {
+	var ok bool
+	var msg string
+	err := withNetNS(pid, func() error {
+		// socket 在当前线程(容器命名空间)内创建,http.Transport 自己拨号时会在其他线程中进行
+		conn, err := net.DialTimeout("tcp", addr(port), timeout)
+		if err != nil {
+			msg = err.Error()
+			return nil
+		}
+		defer conn.Close()
+
+		client := &http.Client{
+			Timeout: timeout,
+			Transport: &http.Transport{
+				DisableKeepAlives: true,
+				DialContext: func(context.Context, string, string) (net.Conn, error) {
+					return conn, nil
+				},
+			},
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+		resp, err := client.Get(fmt.Sprintf("http://%s%s", addr(port), path))
+		if err != nil {
+			msg = err.Error()
+			return nil
+		}
+		resp.Body.Close()
+		msg = resp.Status
+		ok = resp.StatusCode >= 200 && resp.StatusCode < 400
+		return nil
+	})
+	return ok, msg, err
+}
+
+func addr(port int32) string {
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port)))
+}
@@ -0,0 +1,134 @@
+package probe
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 测试进程的 pid 作为"容器", 探针进入的就是测试自身的网络命名空间
+func requireRoot(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("entering a network namespace requires root")
+	}
+}
+
+func listenerPort(l net.Listener) int32 {
+	return int32(l.Addr().(*net.TCPAddr).Port)
+}
+
+// closedPort 返回一个当前没有监听的端口
+func closedPort(t *testing.T) int32 {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listenerPort(l)
+	l.Close()
+	return port
+}
+
+func TestWithNetNS(t *testing.T) {
+	requireRoot(t)
+
+	called := false
+	if err := withNetNS(os.Getpid(), func() error {
+		called = true
+		return nil
+	}); err != nil || !called {
+		t.Fatalf("withNetNS() = %v, called %v", err, called)
+	}
+
+	ferr := errors.New("probe failed")
+	if err := withNetNS(os.Getpid(), func() error { return ferr }); err != ferr {
+		t.Errorf("withNetNS() = %v, want the error of fn", err)
+	}
+}
+
+func TestWithNetNSMissingProcess(t *testing.T) {
+	called := false
+	err := withNetNS(1<<30, func() error {
+		called = true
+		return nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "can't open container network namespace") {
+		t.Errorf("withNetNS() = %v, want an open error", err)
+	}
+	if called {
+		t.Error("fn called without entering the namespace")
+	}
+}
+
+func TestTCP(t *testing.T) {
+	requireRoot(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	if ok, msg, err := TCP(os.Getpid(), listenerPort(l), time.Second); err != nil || !ok {
+		t.Errorf("TCP() = %v, %q, %v, want healthy", ok, msg, err)
+	}
+	ok, msg, err := TCP(os.Getpid(), closedPort(t), time.Second)
+	if err != nil || ok || !strings.Contains(msg, "connection refused") {
+		t.Errorf("TCP() = %v, %q, %v, want connection refused", ok, msg, err)
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	requireRoot(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/healthz":
+			w.WriteHeader(http.StatusOK)
+		case "/moved":
+			http.Redirect(w, r, "/elsewhere", http.StatusFound)
+		case "/slow":
+			time.Sleep(time.Second)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+	port := listenerPort(srv.Listener)
+
+	tests := []struct {
+		path string
+		ok   bool
+		msg  string
+	}{
+		{"/healthz", true, "200 OK"},
+		// 重定向不跟随,3xx 认为健康
+		{"/moved", true, "302 Found"},
+		{"/broken", false, "500 Internal Server Error"},
+		{"/slow", false, "Client.Timeout exceeded"},
+	}
+	for _, tt := range tests {
+		ok, msg, err := HTTP(os.Getpid(), port, tt.path, 500*time.Millisecond)
+		if err != nil || ok != tt.ok || !strings.Contains(msg, tt.msg) {
+			t.Errorf("HTTP(%s) = %v, %q, %v, want %v, %q", tt.path, ok, msg, err, tt.ok, tt.msg)
+		}
+	}
+
+	ok, msg, err := HTTP(os.Getpid(), closedPort(t), "/", time.Second)
+	if err != nil || ok || !strings.Contains(msg, "connection refused") {
+		t.Errorf("HTTP() = %v, %q, %v, want connection refused", ok, msg, err)
+	}
+}
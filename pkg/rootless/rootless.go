@@ -0,0 +1,147 @@
+package rootless
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const cgroupRoot = "/sys/fs/cgroup"
+
+// CgroupDir 在委派的 cgroup 下为容器创建的子目录
+const CgroupDir = "cri-impl"
+
+// Info 以非 root 用户运行时的信息
+type Info struct {
+	UID int
+	GID int
+	// Cgroup 委派给当前用户的 cgroup v2 子树, nil 表示没有委派, 容器不能限制资源
+	Cgroup *Cgroup
+	// CgroupError 没有委派的原因
+	CgroupError error
+}
+
+// Cgroup 委派给当前用户的 cgroup v2 子树
+type Cgroup struct {
+	// Path 相对于 /sys/fs/cgroup 的路径, 如 /user.slice/user-1000.slice/user@1000.service
+	Path string
+	// Controllers 子树中可用的 controller
+	Controllers []string
+}
+
+// Enabled 守护进程是否以非 root 用户运行
+func Enabled() bool {
+	return os.Geteuid() != 0
+}
+
+// Detect 以 root 运行时返回 nil
+func Detect() *Info {
+	if !Enabled() {
+		return nil
+	}
+	info := &Info{UID: os.Geteuid(), GID: os.Getegid()}
+	info.Cgroup, info.CgroupError = delegatedCgroup(info.UID)
+	return info
+}
+
+// Supports 委派的子树中是否有 controller
+func (c *Cgroup) Supports(controller string) bool {
+	if c == nil {
+		return false
+	}
+	for _, v := range c.Controllers {
+		if v == controller {
+			return true
+		}
+	}
+	return false
+}
+
+// ContainerPath 容器的 cgroupsPath
+func (c *Cgroup) ContainerPath(id string) string {
+	return filepath.Join(c.Path, CgroupDir, id)
+}
+
+// delegatedCgroup 从当前进程所在的 cgroup 向上查找属于 uid 的最上层目录 (如 systemd 的 user@<uid>.service),
+// 只支持 cgroup v2
+func delegatedCgroup(uid int) (*Cgroup, error) {
+	if _, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers")); err != nil {
+		return nil, errors.New("cgroup delegation requires cgroup v2")
+	}
+	own, err := ownCgroup()
+	if err != nil {
+		return nil, err
+	}
+	var delegated string
+	for p := own; p != "/"; p = filepath.Dir(p) {
+		fi, err := os.Stat(filepath.Join(cgroupRoot, p))
+		if err != nil {
+			return nil, err
+		}
+		if st, ok := fi.Sys().(*syscall.Stat_t); !ok || int(st.Uid) != uid {
+			break
+		}
+		delegated = p
+	}
+	if delegated == "" {
+		return nil, errors.New(fmt.Sprintf("cgroup %s is not delegated to uid %d", own, uid))
+	}
+	data, err := ioutil.ReadFile(filepath.Join(cgroupRoot, delegated, "cgroup.controllers"))
+	if err != nil {
+		return nil, err
+	}
+	return &Cgroup{Path: delegated, Controllers: strings.Fields(string(data))}, nil
+}
+
+// ownCgroup 解析 /proc/self/cgroup 中 cgroup v2 的 0::/path 记录
+func ownCgroup() (string, error) {
+	f, err := os.Open("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "0::") {
+			return filepath.Clean(strings.TrimPrefix(scanner.Text(), "0::")), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", errors.New("cgroup v2 path of the daemon not found")
+}
+
+// RuntimeDir $XDG_RUNTIME_DIR, 没有设置时使用 /tmp/cri-impl-<uid>
+func RuntimeDir() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return dir
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("cri-impl-%d", os.Geteuid()))
+}
+
+// DataHome $XDG_DATA_HOME, 默认 ~/.local/share
+func DataHome() string {
+	return xdgHome("XDG_DATA_HOME", ".local", "share")
+}
+
+// StateHome $XDG_STATE_HOME, 默认 ~/.local/state
+func StateHome() string {
+	return xdgHome("XDG_STATE_HOME", ".local", "state")
+}
+
+func xdgHome(env string, defaults ...string) string {
+	if dir := os.Getenv(env); dir != "" {
+		return dir
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = RuntimeDir()
+	}
+	return filepath.Join(append([]string{home}, defaults...)...)
+}
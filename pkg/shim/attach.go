@@ -0,0 +1,108 @@
+package shim
+
+import (
+	"io"
+	"k8s.io/klog"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// attachWriteTimeout 向 attach 客户端写入的超时, 超时的客户端被断开, 不阻塞容器输出
+const attachWriteTimeout = 5 * time.Second
+
+// attachServer 在 attach socket 上接受守护进程的连接 (cri.Attach),
+// 将容器输出广播给所有连接, 并将连接上收到的数据写入容器 stdin
+type attachServer struct {
+	lis *net.UnixListener
+
+	lock  sync.Mutex
+	conns map[*net.UnixConn]struct{}
+
+	stdinLock sync.Mutex
+	// stdin 容器 stdin 的写入端, 容器没有 stdin 或已经关闭时为 nil
+	stdin     *os.File
+	stdinOnce bool
+}
+
+func listenAttach(path string, stdin *os.File, stdinOnce bool) (*attachServer, error) {
+	// 上一次运行留下的 socket
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	lis, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	return &attachServer{
+		lis:       lis,
+		conns:     make(map[*net.UnixConn]struct{}),
+		stdin:     stdin,
+		stdinOnce: stdinOnce,
+	}, nil
+}
+
+func (a *attachServer) Serve() {
+	for {
+		conn, err := a.lis.AcceptUnix()
+		if err != nil {
+			return
+		}
+		a.lock.Lock()
+		a.conns[conn] = struct{}{}
+		a.lock.Unlock()
+		go a.forwardStdin(conn)
+	}
+}
+
+// forwardStdin 将 conn 上的数据写入容器 stdin, 客户端关闭写入端后 conn 仍然接收输出
+// 同一时间只有一个连接写入 stdin, 其他连接等待前一个连接关闭写入端
+func (a *attachServer) forwardStdin(conn *net.UnixConn) {
+	a.stdinLock.Lock()
+	defer a.stdinLock.Unlock()
+	if a.stdin == nil {
+		return
+	}
+	if _, err := io.Copy(a.stdin, conn); err != nil {
+		klog.Warningf("forward attach stdin with err:%v", err)
+	}
+	if a.stdinOnce {
+		a.closeStdinNoLock()
+	}
+}
+
+// Broadcast 将一段容器输出发送给所有连接
+func (a *attachServer) Broadcast(pipeType byte, data []byte) {
+	msg := make([]byte, 0, len(data)+1)
+	msg = append(append(msg, pipeType), data...)
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for conn := range a.conns {
+		conn.SetWriteDeadline(time.Now().Add(attachWriteTimeout))
+		if _, err := conn.Write(msg); err != nil {
+			klog.Infof("attach client disconnected: %v", err)
+			conn.Close()
+			delete(a.conns, conn)
+		}
+	}
+}
+
+func (a *attachServer) closeStdinNoLock() {
+	if a.stdin != nil {
+		a.stdin.Close()
+		a.stdin = nil
+	}
+}
+
+// Close 停止接受连接并断开所有连接, 客户端读到 EOF
+func (a *attachServer) Close() {
+	a.lis.Close()
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for conn := range a.conns {
+		conn.Close()
+		delete(a.conns, conn)
+	}
+}
@@ -0,0 +1,92 @@
+package shim
+
+import (
+	"bytes"
+	"github.com/tluo-github/cri-impl/pkg/logs"
+	"k8s.io/klog"
+	"os"
+	"sync"
+	"time"
+)
+
+// maxLogLineSize 超过这个长度还没有换行的输出写为 partial 行
+const maxLogLineSize = 16 * 1024
+
+// logWriter 将容器输出写为 CRI 格式的日志文件, stdout 和 stderr 两个 goroutine 共用
+type logWriter struct {
+	lock sync.Mutex
+	path string
+	file *os.File
+}
+
+func openLogWriter(path string) (*logWriter, error) {
+	f, err := openLogFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &logWriter{path: path, file: f}, nil
+}
+
+func openLogFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+}
+
+func (w *logWriter) Write(stream string, partial bool, content []byte) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if _, err := w.file.Write(logs.FormatLine(time.Now(), stream, partial, content)); err != nil {
+		klog.Errorf("write container log %s with err:%v", w.path, err)
+	}
+}
+
+// Reopen 在守护进程轮转日志 (重命名 path) 之后重新打开 path
+func (w *logWriter) Reopen() error {
+	f, err := openLogFile(w.path)
+	if err != nil {
+		return err
+	}
+	w.lock.Lock()
+	old := w.file
+	w.file = f
+	w.lock.Unlock()
+	return old.Close()
+}
+
+func (w *logWriter) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.file.Close()
+}
+
+// lineBuffer 将一个 stream 的输出切分为日志行
+type lineBuffer struct {
+	stream  string
+	pending []byte
+}
+
+// Write 写出 data 中所有完整的行, 剩余部分留到下一次
+func (b *lineBuffer) Write(w *logWriter, data []byte) {
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			b.pending = append(b.pending, data...)
+			break
+		}
+		b.pending = append(b.pending, data[:i]...)
+		w.Write(b.stream, false, b.pending)
+		b.pending = b.pending[:0]
+		data = data[i+1:]
+	}
+	for len(b.pending) >= maxLogLineSize {
+		w.Write(b.stream, true, b.pending[:maxLogLineSize])
+		b.pending = append(b.pending[:0], b.pending[maxLogLineSize:]...)
+	}
+}
+
+// Flush stream 结束时写出最后一行没有换行符的输出
+func (b *lineBuffer) Flush(w *logWriter) {
+	if len(b.pending) > 0 {
+		w.Write(b.stream, false, b.pending)
+		b.pending = b.pending[:0]
+	}
+}
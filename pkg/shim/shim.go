@@ -0,0 +1,318 @@
+package shim
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/tluo-github/cri-impl/pkg/logs"
+	"github.com/tluo-github/cri-impl/pkg/shimutil"
+	"io"
+	"io/ioutil"
+	"k8s.io/klog"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// drainTimeout 容器退出后等待 stdout/stderr 读完的最长时间, 容器中残留的进程可能一直持有 pipe
+const drainTimeout = 5 * time.Second
+
+// maxReportStderr sync pipe 报告中 runc 错误输出的最大长度
+const maxReportStderr = 4096
+
+// Options shim 的参数, 与 oci.runcRuntime.CreateContainer 传入的命令行参数一一对应
+type Options struct {
+	// PidFile shim 进程自身的 pid 文件
+	PidFile  string
+	LogLevel string
+	// Runtime runc 可执行文件, RuntimeArgs 为 runc 的全局参数, 如 --root
+	Runtime          string
+	RuntimeArgs      []string
+	Bundle           string
+	ContainerID      string
+	ContainerPidFile string
+	LogFile          string
+	ExitFile         string
+	AttachFile       string
+	Stdin            bool
+	StdinOnce        bool
+	SyncPipeFd       int
+}
+
+// Validate 在 shim 脱离守护进程之前检查参数, 错误直接输出给守护进程
+func (o *Options) Validate() error {
+	var missing []string
+	for name, v := range map[string]string{
+		"--shimmy-pidfile":       o.PidFile,
+		"--runtime":              o.Runtime,
+		"--bundle":               o.Bundle,
+		"--container-id":         o.ContainerID,
+		"--container-pidfile":    o.ContainerPidFile,
+		"--container-logfile":    o.LogFile,
+		"--container-exitfile":   o.ExitFile,
+		"--container-attachfile": o.AttachFile,
+	} {
+		if v == "" {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return errors.New(fmt.Sprintf("Missing required flags %s", strings.Join(missing, ", ")))
+	}
+	if o.SyncPipeFd < 3 {
+		return errors.New(fmt.Sprintf("Invalid sync pipe fd %d", o.SyncPipeFd))
+	}
+	if o.StdinOnce && !o.Stdin {
+		return errors.New("--stdin-once requires --stdin")
+	}
+	if _, err := os.Stat(o.Bundle); err != nil {
+		return err
+	}
+	if _, err := exec.LookPath(o.Runtime); err != nil {
+		return err
+	}
+	return nil
+}
+
+// shim 一个容器的 shim: 持有容器的 stdio, 回收容器主进程并写入 exit file
+type shim struct {
+	opts   Options
+	log    *logWriter
+	attach *attachServer
+
+	copiers sync.WaitGroup
+
+	// createStderr runc create 执行期间 stderr 的内容, 用于失败时的报告
+	createLock   sync.Mutex
+	creating     bool
+	createStderr bytes.Buffer
+}
+
+// Run 是 shim 脱离守护进程之后的主流程: runc create, 通过 sync pipe 报告结果,
+// 转发容器输出直到容器退出, 然后写入 exit file
+func Run(opts Options) error {
+	// 继承的 fd 没有 close-on-exec, 不能泄漏给 runc 和容器进程, 否则守护进程等不到 EOF
+	syscall.CloseOnExec(opts.SyncPipeFd)
+	syncpipe := os.NewFile(uintptr(opts.SyncPipeFd), "syncpipe")
+	defer syncpipe.Close()
+
+	// SIGUSR1 的默认行为是结束进程, 在 runc create 之前就开始处理
+	sigs := make(chan os.Signal, 32)
+	signal.Notify(sigs, syscall.SIGCHLD, syscall.SIGUSR1)
+	defer signal.Stop(sigs)
+
+	s := &shim{opts: opts}
+	pid, err := s.create()
+	if err != nil {
+		klog.Errorf("create container %s with err:%v", opts.ContainerID, err)
+		s.createLock.Lock()
+		stderr := s.createStderr.String()
+		s.createLock.Unlock()
+		writeReport(syncpipe, shimutil.Report{
+			Kind:   shimutil.ReportRuntimeFailure,
+			Status: err.Error(),
+			Stderr: strings.TrimSpace(stderr),
+		})
+		return err
+	}
+	klog.Infof("container %s created with pid %d", opts.ContainerID, pid)
+	writeReport(syncpipe, shimutil.Report{Kind: shimutil.ReportContainerPid, Pid: pid})
+	syncpipe.Close()
+
+	status := s.wait(pid, sigs)
+	// 先写 exit file: runc state 在容器主进程退出后立即返回 stopped, 守护进程随后会读取 exit file
+	if err := shimutil.WriteExitFile(opts.ExitFile, status); err != nil {
+		klog.Errorf("write exit file %s with err:%v", opts.ExitFile, err)
+	}
+	s.drain()
+	klog.Infof("container %s exited", opts.ContainerID)
+	return nil
+}
+
+// create 执行 runc create, 容器的 stdio 为 shim 持有的 pipe, 返回容器主进程的 pid
+func (s *shim) create() (int, error) {
+	if err := setSubreaper(); err != nil {
+		return 0, err
+	}
+
+	var err error
+	if s.log, err = openLogWriter(s.opts.LogFile); err != nil {
+		return 0, err
+	}
+	stdoutR, stdoutW, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	stderrR, stderrW, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	var stdinR, stdinW *os.File
+	if s.opts.Stdin {
+		if stdinR, stdinW, err = os.Pipe(); err != nil {
+			return 0, err
+		}
+	}
+	if s.attach, err = listenAttach(s.opts.AttachFile, stdinW, s.opts.StdinOnce); err != nil {
+		return 0, err
+	}
+	go s.attach.Serve()
+
+	args := append(append([]string{}, s.opts.RuntimeArgs...),
+		"create",
+		"--bundle", s.opts.Bundle,
+		"--pid-file", s.opts.ContainerPidFile,
+		s.opts.ContainerID,
+	)
+	cmd := exec.Command(s.opts.Runtime, args...)
+	cmd.Stdout = stdoutW
+	cmd.Stderr = stderrW
+	if stdinR != nil {
+		cmd.Stdin = stdinR
+	}
+
+	s.creating = true
+	s.copiers.Add(2)
+	go s.copy(stdoutR, logs.Stdout, shimutil.AttachPipeStdout)
+	go s.copy(stderrR, logs.Stderr, shimutil.AttachPipeStderr)
+
+	klog.Infof("exec %s %s", s.opts.Runtime, strings.Join(args, " "))
+	err = cmd.Start()
+	// 写入端只保留在容器进程中, 容器退出后 copy 读到 EOF
+	stdoutW.Close()
+	stderrW.Close()
+	if stdinR != nil {
+		stdinR.Close()
+	}
+	if err == nil {
+		err = cmd.Wait()
+	}
+	if err != nil {
+		s.drain()
+		return 0, err
+	}
+
+	s.createLock.Lock()
+	s.creating = false
+	s.createStderr.Reset()
+	s.createLock.Unlock()
+
+	data, err := ioutil.ReadFile(s.opts.ContainerPidFile)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return 0, errors.New(fmt.Sprintf("Bad container pid file content %q", data))
+	}
+	return pid, nil
+}
+
+// copy 将容器的一个输出 stream 写入日志文件并广播给 attach 连接
+func (s *shim) copy(r *os.File, stream string, pipeType byte) {
+	defer s.copiers.Done()
+	defer r.Close()
+
+	line := &lineBuffer{stream: stream}
+	buf := make([]byte, shimutil.AttachBufSize)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			s.attach.Broadcast(pipeType, buf[:n])
+			line.Write(s.log, buf[:n])
+			if stream == logs.Stderr {
+				s.captureCreateStderr(buf[:n])
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				klog.Errorf("read container %s with err:%v", stream, err)
+			}
+			line.Flush(s.log)
+			return
+		}
+	}
+}
+
+func (s *shim) captureCreateStderr(data []byte) {
+	s.createLock.Lock()
+	defer s.createLock.Unlock()
+	if s.creating && s.createStderr.Len() < maxReportStderr {
+		if left := maxReportStderr - s.createStderr.Len(); len(data) > left {
+			data = data[:left]
+		}
+		s.createStderr.Write(data)
+	}
+}
+
+// wait 回收子进程直到容器主进程退出, 期间处理 SIGUSR1 (重新打开日志文件)
+func (s *shim) wait(pid int, sigs <-chan os.Signal) *shimutil.TerminationStatus {
+	for {
+		// 容器可能在 runc create 返回之后的任何时候退出, 每次都先检查一遍
+		if status := reap(pid); status != nil {
+			return status
+		}
+		if sig := <-sigs; sig == syscall.SIGUSR1 {
+			klog.Infof("received SIGUSR1, reopening %s", s.opts.LogFile)
+			if err := s.log.Reopen(); err != nil {
+				klog.Errorf("reopen container log with err:%v", err)
+			}
+		}
+	}
+}
+
+// reap 回收所有已退出的子进程 (包括被托管到 shim 的容器内进程), 返回容器主进程的退出状态
+func reap(pid int) *shimutil.TerminationStatus {
+	var status *shimutil.TerminationStatus
+	for {
+		var ws syscall.WaitStatus
+		wpid, err := syscall.Wait4(-1, &ws, syscall.WNOHANG, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil || wpid <= 0 {
+			return status
+		}
+		if wpid != pid {
+			continue
+		}
+		switch {
+		case ws.Exited():
+			status = shimutil.Exited(time.Now(), int32(ws.ExitStatus()))
+		case ws.Signaled():
+			status = shimutil.Signaled(time.Now(), int32(ws.Signal()))
+		}
+	}
+}
+
+// drain 等待 stdout/stderr 读完, 然后断开 attach 连接并关闭日志文件
+func (s *shim) drain() {
+	done := make(chan struct{})
+	go func() {
+		s.copiers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(drainTimeout):
+		klog.Warningf("container output is still open %v after exit, giving up", drainTimeout)
+	}
+	if s.attach != nil {
+		s.attach.Close()
+	}
+	if s.log != nil {
+		s.log.Close()
+	}
+}
+
+func writeReport(w io.Writer, report shimutil.Report) {
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		klog.Errorf("write sync pipe report with err:%v", err)
+	}
+}
@@ -0,0 +1,10 @@
+package shim
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// setSubreaper runc create 退出后容器主进程被托管给 shim, shim 才能回收它并得到退出状态
+func setSubreaper() error {
+	return unix.Prctl(unix.PR_SET_CHILD_SUBREAPER, 1, 0, 0, 0)
+}
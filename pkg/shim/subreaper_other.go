@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package shim
+
+import (
+	"errors"
+)
+
+func setSubreaper() error {
+	return errors.New("shim is only supported on linux")
+}
@@ -0,0 +1,23 @@
+package shimutil
+
+// shim 通过 sync pipe 向守护进程报告 runc create 的结果, 内容为一个 JSON 对象
+const (
+	// ReportContainerPid runc create 成功, Pid 为容器主进程的 pid
+	ReportContainerPid = "container_pid"
+	// ReportRuntimeFailure runc create 失败, Status 和 Stderr 为 runc 的退出状态和错误输出
+	ReportRuntimeFailure = "runtime_abnormal_termination"
+)
+
+type Report struct {
+	Kind   string `json:"kind"`
+	Status string `json:"status"`
+	Stderr string `json:"stderr"`
+	Pid    int    `json:"pid"`
+}
+
+// attach socket 上 shim 发送的每条消息为 1 字节的 pipe 类型加上最多 AttachBufSize 字节的输出
+const (
+	AttachPipeStdout = 1
+	AttachPipeStderr = 2
+	AttachBufSize    = 32 * 1024
+)
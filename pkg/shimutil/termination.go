@@ -3,7 +3,9 @@ package shimutil
 import (
 	"encoding/json"
 	"errors"
+	"io/ioutil"
 	"k8s.io/klog"
+	"os"
 	"time"
 )
 
@@ -23,6 +25,29 @@ type attrs struct {
 	Reason   string    `json:"reason"`
 }
 
+// Exited 容器主进程正常退出
+func Exited(at time.Time, exitCode int32) *TerminationStatus {
+	return &TerminationStatus{attrs{At: at, ExitCode: exitCode, Reason: reasonExited}}
+}
+
+// Signaled 容器主进程被信号终止
+func Signaled(at time.Time, signal int32) *TerminationStatus {
+	return &TerminationStatus{attrs{At: at, Signal: signal, Reason: reasonSignoled}}
+}
+
+// WriteExitFile 由 shim 在回收容器主进程后写入 exit file, 先写临时文件再重命名, 守护进程不会读到不完整的内容
+func WriteExitFile(path string, t *TerminationStatus) error {
+	bytes, err := json.Marshal(t.raw)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, bytes, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
 func ParseExitFile(bytes []byte) (*TerminationStatus, error) {
 	raw := attrs{}
 	if err := json.Unmarshal(bytes, &raw); err != nil {
@@ -1,9 +1,11 @@
 package storage
 
 import (
+	"fmt"
 	"github.com/pkg/errors"
 	"github.com/tluo-github/cri-impl/pkg/container"
 	"github.com/tluo-github/cri-impl/pkg/fsutil"
+	"github.com/tluo-github/cri-impl/pkg/idmap"
 	"github.com/tluo-github/cri-impl/pkg/oci"
 	"github.com/tluo-github/cri-impl/pkg/rollback"
 	"io/ioutil"
@@ -23,6 +25,10 @@ type ContainerStore interface {
 
 	CreateContainerBundle(id container.ID, spec oci.RuntimeSpec, rootfs string) error
 
+	// ChownContainerRootfs 按用户命名空间的映射修改 bundle 中 rootfs 的属主,
+	// 并允许映射后的 root 进入容器目录和 bundle 目录 (0711)
+	ChownContainerRootfs(id container.ID, ns container.UserNamespace) error
+
 	GetContainer(id container.ID) (*ContainerHandler, error)
 
 	// DeleteContainer Removes <container_dir>
@@ -66,7 +72,11 @@ func (s *containerStore) CreateContainer(id container.ID, rollback *rollback.Rol
 		}
 		return nil, errors.New(DirAccessFailed)
 	}
-	if err := os.MkdirAll(dir, 0700); err != nil {
+	// 所有容器共用的目录只允许进入, 使用用户命名空间的容器中映射后的 root 需要经过它访问自己的 rootfs
+	if err := os.MkdirAll(s.containersDir(), 0711); err != nil {
+		return nil, errors.New("can't create containers directory")
+	}
+	if err := os.Mkdir(dir, 0700); err != nil {
 		return nil, errors.New("can't create container directory")
 	}
 	return newContainerHandler(id, dir), nil
@@ -95,6 +105,30 @@ func (s *containerStore) CreateContainerBundle(
 	return nil
 }
 
+func (s *containerStore) ChownContainerRootfs(id container.ID, ns container.UserNamespace) error {
+	h, err := s.GetContainer(id)
+	if err != nil {
+		return err
+	}
+	// 不修改所有容器共用的目录, 它在创建时已经允许进入
+	fi, err := os.Stat(s.containersDir())
+	if err != nil {
+		return errors.Wrap(err, DirAccessFailed)
+	}
+	if fi.Mode().Perm()&0001 == 0 {
+		return errors.New(fmt.Sprintf("containers directory %s is not searchable by the user namespace root, run chmod o+x on it", s.containersDir()))
+	}
+	for _, dir := range []string{h.ContainerDir(), h.BundleDir()} {
+		if err := os.Chmod(dir, 0711); err != nil {
+			return errors.Wrap(err, "can't change container directory mode")
+		}
+	}
+	if err := idmap.ChownTree(h.RootfsDir(), ns); err != nil {
+		return errors.Wrap(err, "can't change rootfs owner")
+	}
+	return nil
+}
+
 func (s *containerStore) GetContainer(id container.ID) (*ContainerHandler, error) {
 	dir := s.containerDir(id)
 	ok, err := fsutil.Exists(dir)
@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"github.com/tluo-github/cri-impl/pkg/container"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func mode(t *testing.T, path string) os.FileMode {
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Mode().Perm()
+}
+
+func TestChownContainerRootfs(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing file owners requires root")
+	}
+	dir, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := NewContainerStore(dir).(*containerStore)
+	h, err := s.CreateContainer("c1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := mode(t, s.containersDir()); m != 0711 {
+		t.Errorf("containers directory mode = %v, want 0711", m)
+	}
+	if m := mode(t, h.ContainerDir()); m != 0700 {
+		t.Errorf("container directory mode = %v, want 0700", m)
+	}
+	if err := os.MkdirAll(h.RootfsDir(), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// 管理员修改过的共用目录权限保持不变, 只修改该容器自己的目录
+	if err := os.Chmod(s.containersDir(), 0751); err != nil {
+		t.Fatal(err)
+	}
+	ns := container.UserNamespace{
+		UIDMappings: []container.IDMapping{{ContainerID: 0, HostID: 100000, Size: 65536}},
+		GIDMappings: []container.IDMapping{{ContainerID: 0, HostID: 100000, Size: 65536}},
+	}
+	if err := s.ChownContainerRootfs("c1", ns); err != nil {
+		t.Fatal(err)
+	}
+	if m := mode(t, s.containersDir()); m != 0751 {
+		t.Errorf("containers directory mode changed to %v", m)
+	}
+	for _, path := range []string{h.ContainerDir(), h.BundleDir()} {
+		if m := mode(t, path); m != 0711 {
+			t.Errorf("%s mode = %v, want 0711", path, m)
+		}
+	}
+
+	// 共用目录不允许进入时报错, 不修改它
+	if err := os.Chmod(s.containersDir(), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ChownContainerRootfs("c1", ns); err == nil {
+		t.Error("ChownContainerRootfs succeeded with an unsearchable containers directory")
+	}
+	if m := mode(t, s.containersDir()); m != 0700 {
+		t.Errorf("containers directory mode changed to %v", m)
+	}
+}
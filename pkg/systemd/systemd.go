@@ -0,0 +1,109 @@
+package systemd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// listenFdsStart systemd 传递的第一个文件描述符 (SD_LISTEN_FDS_START)
+const listenFdsStart = 3
+
+// sd_notify 的状态
+const (
+	Ready    = "READY=1"
+	Stopping = "STOPPING=1"
+	Watchdog = "WATCHDOG=1"
+)
+
+// Status 返回 STATUS= 状态, 显示在 systemctl status 中
+func Status(format string, args ...interface{}) string {
+	return "STATUS=" + fmt.Sprintf(format, args...)
+}
+
+// Listeners 返回 socket activation 传入的监听 socket (LISTEN_FDS), 不是由 systemd 启动时返回空
+// 调用后清除相关的环境变量, 避免被子进程继承
+func Listeners() ([]net.Listener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	listeners := make([]net.Listener, 0, n)
+	for fd := listenFdsStart; fd < listenFdsStart+n; fd++ {
+		syscall.CloseOnExec(fd)
+		name := "LISTEN_FD_" + strconv.Itoa(fd)
+		if i := fd - listenFdsStart; i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(fd), name)
+		lis, err := net.FileListener(f)
+		// FileListener 复制了 fd, 原来的 fd 不再需要
+		f.Close()
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Socket %s passed by systemd is not a listener: %v", name, err))
+		}
+		listeners = append(listeners, lis)
+	}
+	return listeners, nil
+}
+
+// Notify 向 NOTIFY_SOCKET 发送状态, 不是由 systemd 启动 (Type=notify) 时返回 false
+func Notify(states ...string) (bool, error) {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return false, nil
+	}
+	// 以 @ 开头的是抽象 socket
+	if addr[0] == '@' {
+		addr = "\x00" + addr[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(strings.Join(states, "\n"))); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// WatchdogInterval 返回 systemd 要求的 watchdog 超时 (WatchdogSec=), 没有开启时返回 0
+// 调用方应当以小于一半超时的间隔发送 WATCHDOG=1
+func WatchdogInterval() (time.Duration, error) {
+	usecStr := os.Getenv("WATCHDOG_USEC")
+	if usecStr == "" {
+		return 0, nil
+	}
+	if pidStr := os.Getenv("WATCHDOG_PID"); pidStr != "" {
+		pid, err := strconv.Atoi(pidStr)
+		if err != nil {
+			return 0, errors.New(fmt.Sprintf("Invalid WATCHDOG_PID %q", pidStr))
+		}
+		if pid != os.Getpid() {
+			return 0, nil
+		}
+	}
+	usec, err := strconv.ParseInt(usecStr, 10, 64)
+	if err != nil || usec <= 0 {
+		return 0, errors.New(fmt.Sprintf("Invalid WATCHDOG_USEC %q", usecStr))
+	}
+	return time.Duration(usec) * time.Microsecond, nil
+}
@@ -0,0 +1,114 @@
+package systemd
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// UnitOptions 生成 unit 文件使用的参数
+type UnitOptions struct {
+	// Name unit 名称, 生成 <Name>.service 和 <Name>.socket
+	Name string
+	// ExecStart 守护进程的命令行
+	ExecStart []string
+	// Socket gRPC UNIX socket 路径, SocketMode SocketGroup 为空时使用 systemd 的默认值
+	Socket      string
+	SocketMode  string
+	SocketGroup string
+	// Watchdog WatchdogSec, 0 表示不开启
+	Watchdog time.Duration
+	// StopTimeout TimeoutStopSec, 应当大于守护进程的关闭超时
+	StopTimeout time.Duration
+	// User 生成 systemd --user 的 unit (rootless 守护进程)
+	User bool
+}
+
+var serviceTemplate = template.Must(template.New("service").Parse(`[Unit]
+Description=cri-impl container manager
+Documentation=https://github.com/tluo-github/cri-impl
+After=network.target {{.Name}}.socket
+Requires={{.Name}}.socket
+
+[Service]
+Type=notify
+NotifyAccess=main
+ExecStart={{.ExecStart}}
+ExecReload=/bin/kill -HUP $MAINPID
+{{- if .Watchdog}}
+WatchdogSec={{.Watchdog}}
+{{- end}}
+TimeoutStopSec={{.StopTimeout}}
+Restart=on-failure
+RestartSec=2
+# 只停止守护进程, shim 和容器进程保持运行, 由 live-restore 接管
+KillMode=process
+Delegate=yes
+LimitNOFILE=1048576
+
+[Install]
+WantedBy={{if .User}}default.target{{else}}multi-user.target{{end}}
+`))
+
+var socketTemplate = template.Must(template.New("socket").Parse(`[Unit]
+Description=cri-impl gRPC socket
+PartOf={{.Name}}.service
+
+[Socket]
+ListenStream={{.Socket}}
+{{- if .SocketMode}}
+SocketMode={{.SocketMode}}
+{{- end}}
+{{- if .SocketGroup}}
+SocketGroup={{.SocketGroup}}
+{{- end}}
+RemoveOnStop=yes
+
+[Install]
+WantedBy=sockets.target
+`))
+
+// Units 生成 service 和 socket unit 文件的内容
+func Units(opts UnitOptions) (service []byte, socket []byte, err error) {
+	data := struct {
+		UnitOptions
+		ExecStart   string
+		Watchdog    string
+		StopTimeout string
+	}{
+		UnitOptions: opts,
+		ExecStart:   quoteCommand(opts.ExecStart),
+		StopTimeout: seconds(opts.StopTimeout),
+	}
+	if opts.Watchdog > 0 {
+		data.Watchdog = seconds(opts.Watchdog)
+	}
+
+	var svc, sock bytes.Buffer
+	if err := serviceTemplate.Execute(&svc, data); err != nil {
+		return nil, nil, err
+	}
+	if err := socketTemplate.Execute(&sock, data); err != nil {
+		return nil, nil, err
+	}
+	return svc.Bytes(), sock.Bytes(), nil
+}
+
+// seconds 以 systemd 的时间格式输出, 如 30s
+func seconds(d time.Duration) string {
+	return strconv.FormatInt(int64(d.Round(time.Second)/time.Second), 10) + "s"
+}
+
+// quoteCommand 为包含空白或引号的参数加上双引号
+func quoteCommand(args []string) string {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		if a == "" || strings.ContainsAny(a, " \t\"'\\") {
+			a = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(a) + `"`
+		}
+		quoted[i] = a
+	}
+	return strings.Join(quoted, " ")
+}
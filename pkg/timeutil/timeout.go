@@ -11,7 +11,7 @@ func WithTimeout(d time.Duration, fn func() error) error {
 	defer cancel()
 
 	ch := make(chan error, 1)
-	func() {
+	go func() {
 		ch <- fn()
 	}()
 
@@ -0,0 +1,108 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+	"os"
+)
+
+const (
+	// None 不导出 span
+	None = "none"
+	// OTLP 通过 OTLP/gRPC 导出到 collector
+	OTLP = "otlp"
+	// Stdout 以 JSON 输出到标准输出,用于测试
+	Stdout = "stdout"
+
+	DefaultOTLPEndpoint = "127.0.0.1:4317"
+
+	instrumentationName = "github.com/tluo-github/cri-impl"
+	serviceName         = "cri-impl"
+)
+
+// Config tracing 配置
+type Config struct {
+	// Exporter none, otlp 或 stdout
+	Exporter string
+	// Endpoint OTLP collector 的 host:port,使用明文 gRPC,只用于本机 collector
+	Endpoint string
+	// SampleRatio 采样比例, 1 表示全部采样
+	SampleRatio float64
+}
+
+// Init 按照 cfg 设置全局的 TracerProvider 和 W3C trace context propagator
+// 返回的 shutdown 在守护进程退出前调用,将缓冲的 span 导出
+func Init(ctx context.Context, cfg Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch cfg.Exporter {
+	case "", None:
+		return func(context.Context) error { return nil }, nil
+	case OTLP:
+		endpoint := cfg.Endpoint
+		if endpoint == "" {
+			endpoint = DefaultOTLPEndpoint
+		}
+		exporter, err = otlptracegrpc.New(ctx,
+			otlptracegrpc.WithEndpoint(endpoint),
+			otlptracegrpc.WithInsecure(),
+		)
+	case Stdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	default:
+		return nil, errors.New(fmt.Sprintf("Unknown trace exporter %q", cfg.Exporter))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res := resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(serviceName))
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// Start 创建一个子 span, 未调用 Init 时返回 no-op span
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End 结束 span, err 不为 nil 时记录错误
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Detach 返回一个不会被取消也没有超时的 context, 保留 ctx 中的 span
+// 用于请求返回或超时之后仍然需要完成的通知和清理
+func Detach(ctx context.Context) context.Context {
+	return trace.ContextWithSpanContext(context.Background(), trace.SpanContextFromContext(ctx))
+}
+
+// ContainerID 容器 ID 属性
+func ContainerID(id string) attribute.KeyValue {
+	return attribute.String("container.id", id)
+}
@@ -0,0 +1,136 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+)
+
+const (
+	remoteTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	remoteSpanID  = "00f067aa0ba902b7"
+)
+
+// exportedSpan stdout exporter 输出的 span 中测试关心的字段
+type exportedSpan struct {
+	Name        string
+	SpanContext struct {
+		TraceID string
+		SpanID  string
+	}
+	Parent struct {
+		TraceID string
+		SpanID  string
+		Remote  bool
+	}
+	Attributes []struct {
+		Key   string
+		Value struct {
+			Value interface{}
+		}
+	}
+	Status struct {
+		Code        string
+		Description string
+	}
+}
+
+// captureStdout 执行 fn, 返回期间写入 os.Stdout 的内容
+func captureStdout(t *testing.T, fn func()) []byte {
+	f, err := ioutil.TempFile("", "tracing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	stdout := os.Stdout
+	os.Stdout = f
+	defer func() { os.Stdout = stdout }()
+	fn()
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestStdoutExporter(t *testing.T) {
+	out := captureStdout(t, func() {
+		shutdown, err := Init(context.Background(), Config{Exporter: Stdout, SampleRatio: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 调用方通过 W3C traceparent 传递的 trace context
+		carrier := propagation.HeaderCarrier(http.Header{})
+		carrier.Set("traceparent", "00-"+remoteTraceID+"-"+remoteSpanID+"-01")
+		ctx := otel.GetTextMapPropagator().Extract(context.Background(), carrier)
+		ctx, parent := Start(ctx, "cri.CreateContainer")
+		_, child := Start(ctx, "runc create", ContainerID("c1"))
+		End(child, errors.New("runc failed"))
+		End(parent, nil)
+		if err := shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	spans := map[string]exportedSpan{}
+	dec := json.NewDecoder(bytes.NewReader(out))
+	for {
+		var s exportedSpan
+		if err := dec.Decode(&s); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("decode exported span: %v\n%s", err, out)
+		}
+		spans[s.Name] = s
+	}
+
+	parent, ok := spans["cri.CreateContainer"]
+	if !ok {
+		t.Fatalf("span cri.CreateContainer not exported:\n%s", out)
+	}
+	child, ok := spans["runc create"]
+	if !ok {
+		t.Fatalf("span runc create not exported:\n%s", out)
+	}
+	if parent.SpanContext.TraceID != remoteTraceID || parent.Parent.SpanID != remoteSpanID || !parent.Parent.Remote {
+		t.Errorf("parent span does not continue the remote trace: %+v", parent)
+	}
+	if child.SpanContext.TraceID != remoteTraceID || child.Parent.SpanID != parent.SpanContext.SpanID {
+		t.Errorf("child span is not a child of cri.CreateContainer: %+v", child)
+	}
+	if child.Status.Code != "Error" || child.Status.Description != "runc failed" {
+		t.Errorf("child span status = %+v, want Error: runc failed", child.Status)
+	}
+	if parent.Status.Code == "Error" {
+		t.Errorf("parent span status = %+v, want not Error", parent.Status)
+	}
+	found := false
+	for _, a := range child.Attributes {
+		if a.Key == "container.id" && a.Value.Value == "c1" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("child span attributes %+v do not contain container.id=c1", child.Attributes)
+	}
+}
+
+func TestInitUnknownExporter(t *testing.T) {
+	if _, err := Init(context.Background(), Config{Exporter: "jaeger"}); err == nil {
+		t.Fatal("Init with unknown exporter succeeded")
+	}
+}
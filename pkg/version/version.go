@@ -0,0 +1,43 @@
+package version
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// 以下变量在构建时通过 -ldflags "-X github.com/tluo-github/cri-impl/pkg/version.GitCommit=..." 设置
+var (
+	Version   = "0.0.1"
+	GitBranch = ""
+	GitCommit = ""
+	BuildDate = ""
+)
+
+// Info 守护进程和 crictl 的构建信息
+type Info struct {
+	Version   string `json:"version"`
+	GitBranch string `json:"gitBranch,omitempty"`
+	GitCommit string `json:"gitCommit,omitempty"`
+	BuildDate string `json:"buildDate,omitempty"`
+	GoVersion string `json:"goVersion"`
+	Platform  string `json:"platform"`
+}
+
+func Get() Info {
+	return Info{
+		Version:   Version,
+		GitBranch: GitBranch,
+		GitCommit: GitCommit,
+		BuildDate: BuildDate,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+}
+
+func (i Info) String() string {
+	commit := i.GitCommit
+	if commit == "" {
+		commit = "unknown"
+	}
+	return fmt.Sprintf("%s (commit %s, built %s, %s, %s)", i.Version, commit, i.BuildDate, i.GoVersion, i.Platform)
+}
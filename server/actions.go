@@ -2,9 +2,18 @@ package server
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"github.com/tluo-github/cri-impl/pkg/authz"
 	"github.com/tluo-github/cri-impl/pkg/container"
 	"github.com/tluo-github/cri-impl/pkg/cri"
+	"github.com/tluo-github/cri-impl/pkg/logdriver"
+	"github.com/tluo-github/cri-impl/pkg/logs"
+	"github.com/tluo-github/cri-impl/pkg/version"
 	criapi "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
+	"k8s.io/klog"
+	"math"
+	"strings"
 
 	"time"
 )
@@ -13,20 +22,63 @@ func (c *criServer) Version(
 	ctx context.Context,
 	req *VersionRequest,
 ) (resp *VersionResponse, err error) {
-	return &VersionResponse{
-		Version:     "0.0.1",
-		RuntimeName: "runc",
-	}, nil
+	info := version.Get()
+	resp = &VersionResponse{
+		Version:   info.Version,
+		GitCommit: info.GitCommit,
+		BuildDate: info.BuildDate,
+		GoVersion: info.GoVersion,
+	}
+	// runc 不可用时仍然返回守护进程的版本, 原因可以通过 Status 查看
+	runtimeVersion, err := c.runtimeSrv.Version(ctx)
+	if err != nil {
+		klog.Warningf("failed to get runtime version with err:%v", err)
+		return resp, nil
+	}
+	resp.RuntimeName = runtimeVersion.Name
+	resp.RuntimeVersion = runtimeVersion.Version
+	resp.RuntimeVersionOutput = runtimeVersion.Output
+	return resp, nil
+}
+
+func (c *criServer) Status(
+	ctx context.Context,
+	req *StatusRequest,
+) (resp *StatusResponse, err error) {
+	status, err := c.runtimeSrv.Status(ctx, req.Verbose)
+	if err != nil {
+		return nil, err
+	}
+	resp = &StatusResponse{
+		Status: &RuntimeStatus{},
+		Info:   status.Info,
+	}
+	for _, cond := range status.Conditions {
+		resp.Status.Conditions = append(resp.Status.Conditions, &RuntimeCondition{
+			Type:    cond.Type,
+			Status:  cond.Status,
+			Reason:  cond.Reason,
+			Message: cond.Message,
+		})
+	}
+	return resp, nil
 }
 
 func (c *criServer) CreateContainer(
 	ctx context.Context,
 	req *CreateContainerRequest,
 ) (resp *CreateContainerResponse, err error) {
-	traceRequest("CreateContainer", req)
-	defer func() { traceResponse("CreateContainer", resp, err) }()
+	restartPolicy, err := container.ParseRestartPolicy(req.RestartPolicy)
+	if err != nil {
+		return nil, cri.WrapError(cri.ErrInvalidArgument, err, "invalid restart policy")
+	}
+	ports, err := fromPbPortMappings(req.Ports)
+	if err != nil {
+		return nil, cri.WrapError(cri.ErrInvalidArgument, err, "invalid port mappings")
+	}
 
 	cont, err := c.runtimeSrv.CreateContainer(
+		ctx,
 		cri.ContainerOptions{
 			Name:            req.Name,
 			Command:         req.Command,
@@ -35,6 +87,27 @@ func (c *criServer) CreateContainer(
 			RootsfsReadOnly: req.RootfsReadonly,
 			Stdin:           false,
 			StdinOnce:       false,
+			RestartPolicy:   restartPolicy,
+			LivenessProbe:   fromPbProbe(req.LivenessProbe),
+			ReadinessProbe:  fromPbProbe(req.ReadinessProbe),
+			LivenessAction:  req.LivenessAction,
+			LogPolicy: container.LogPolicy{
+				MaxSize:  req.LogMaxSize,
+				MaxFiles: req.LogMaxFiles,
+				Driver: logdriver.Config{
+					Type:    req.LogDriver,
+					Address: req.LogDriverAddress,
+					Tag:     req.LogTag,
+				},
+			},
+			RuntimeHandler: req.RuntimeHandler,
+			SpecTemplate:   req.SpecTemplate,
+			SpecPatch:      []byte(req.SpecPatch),
+			Security:       fromPbSecurityOptions(req.Security),
+			UserNamespace:  fromPbUserNamespace(req.UserNamespace),
+			Network:        req.Network,
+			Ports:          ports,
+			Trusted:        authz.FromContext(ctx) == authz.Privileged,
 		},
 	)
 	if err == nil {
@@ -47,10 +120,8 @@ func (c *criServer) StartContainer(
 	ctx context.Context,
 	req *StartContainerRequest,
 ) (resp *StartContainerResponse, err error) {
-	traceRequest("StartContainer", req)
-	defer func() { traceResponse("StartContainer", resp, err) }()
-
 	err = c.runtimeSrv.StartContainer(
+		ctx,
 		container.ID(req.ContainerId),
 	)
 	if err == nil {
@@ -63,10 +134,8 @@ func (c *criServer) StopContainer(
 	ctx context.Context,
 	req *StopContainerRequest,
 ) (resp *StopContainerResponse, err error) {
-	traceRequest("StopContainer", req)
-	defer func() { traceResponse("StopContainer", resp, err) }()
-
 	err = c.runtimeSrv.StopContainer(
+		ctx,
 		container.ID(req.ContainerId),
 		time.Duration(req.Timeout)*time.Second,
 	)
@@ -80,10 +149,8 @@ func (c *criServer) RemoveContainer(
 	ctx context.Context,
 	req *RemoveContainerRequest,
 ) (resp *RemoveContainerResponse, err error) {
-	traceRequest("RemoveContainer", req)
-	defer func() { traceResponse("RemoveContainer", resp, err) }()
-
 	err = c.runtimeSrv.RemoveContainer(
+		ctx,
 		container.ID(req.ContainerId),
 	)
 	if err == nil {
@@ -96,10 +163,7 @@ func (c *criServer) ListContainers(
 	ctx context.Context,
 	req *ListContainersRequest,
 ) (resp *ListContainersResponse, err error) {
-	traceRequest("ListContainers", req)
-	defer func() { traceResponse("ListContainers", resp, err) }()
-
-	cs, err := c.runtimeSrv.ListContainers()
+	cs, err := c.runtimeSrv.ListContainers(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -112,10 +176,8 @@ func (c *criServer) ContainerStatus(
 	ctx context.Context,
 	req *ContainerStatusRequest,
 ) (resp *ContainerStatusResponse, err error) {
-	traceRequest("ContainerStatus", req)
-	defer func() { traceResponse("ContainerStatus", resp, err) }()
-
 	cont, err := c.runtimeSrv.GetContainer(
+		ctx,
 		container.ID(req.ContainerId),
 	)
 	if err != nil {
@@ -124,14 +186,28 @@ func (c *criServer) ContainerStatus(
 
 	return &ContainerStatusResponse{
 		Status: &ContainerStatus{
-			ContainerId:   string(cont.ID()),
-			ContainerName: string(cont.Name()),
-			State:         toPbContainerState(cont.Status()),
-			CreatedAt:     cont.CreatedAtNano(),
-			StartedAt:     cont.StartedAtNano(),
-			FinishedAt:    cont.FinishedAtNano(),
-			ExitCode:      cont.ExitCode(),
-			LogPath:       cont.LogPath(),
+			ContainerId:    string(cont.ID()),
+			ContainerName:  string(cont.Name()),
+			State:          toPbContainerState(cont.Status()),
+			CreatedAt:      cont.CreatedAtNano(),
+			StartedAt:      cont.StartedAtNano(),
+			FinishedAt:     cont.FinishedAtNano(),
+			ExitCode:       cont.ExitCode(),
+			Reason:         cont.Reason(),
+			Message:        cont.Message(),
+			LogPath:        cont.LogPath(),
+			RestartPolicy:  cont.RestartPolicy().String(),
+			RestartCount:   cont.RestartCount(),
+			LastExitCode:   cont.LastExitCode(),
+			LastFinishedAt: cont.LastFinishedAtNano(),
+			RuntimeHandler: cont.RuntimeHandler(),
+			Liveness:       toPbProbeStatus(cont.LivenessProbe(), cont.Liveness()),
+			Readiness:      toPbProbeStatus(cont.ReadinessProbe(), cont.Readiness()),
+			Security:       toPbSecurityProfile(cont.Security()),
+			UserNamespace:  toPbUserNamespace(cont.UserNamespace()),
+			Network:        toPbNetworkStatus(cont.Network()),
+			Ports:          toPbPortMappings(cont.Ports()),
+			PublishedPorts: toPbPublishedPorts(cont.PublishedPorts()),
 		},
 	}, nil
 
@@ -141,9 +217,6 @@ func (c *criServer) Attach(
 	ctx context.Context,
 	req *AttachRequest,
 ) (resp *AttachResponse, err error) {
-	traceRequest("Attach", req)
-	defer func() { traceResponse("Attach", resp, err) }()
-
 	r, err := c.streamingSrv.GetAttach(&criapi.AttachRequest{
 		ContainerId: req.ContainerId,
 		Stdin:       req.Stdin,
@@ -159,8 +232,49 @@ func (c *criServer) Attach(
 	}, err
 }
 
-func (c *criServer) mustEmbedUnimplementedCriServer() {
-	panic("implement me")
+func (c *criServer) ContainerLogs(
+	req *ContainerLogsRequest,
+	stream Cri_ContainerLogsServer,
+) (err error) {
+	id := container.ID(req.ContainerId)
+	cont, err := c.runtimeSrv.GetContainer(stream.Context(), id)
+	if err != nil {
+		return err
+	}
+
+	opts := logs.Options{
+		Follow: req.Follow,
+		Tail:   req.TailLines,
+		Stream: req.Stream,
+		Stopped: func() bool {
+			// follow 期间的轮询不查询 runc, 只检查保存的状态和 exit file
+			return c.runtimeSrv.ContainerExited(id)
+		},
+	}
+	if req.SinceSeconds > 0 {
+		opts.Since = time.Now().Add(-time.Duration(req.SinceSeconds) * time.Second)
+	}
+	return logs.ReadLogs(stream.Context(), cont.LogPath(), opts, func(m *logs.Message) error {
+		return stream.Send(&LogEntry{
+			Timestamp: m.Timestamp.UnixNano(),
+			Stream:    m.Stream,
+			Log:       m.Log,
+		})
+	})
+}
+
+func (c *criServer) ReopenContainerLog(
+	ctx context.Context,
+	req *ReopenContainerLogRequest,
+) (resp *ReopenContainerLogResponse, err error) {
+	err = c.runtimeSrv.ReopenContainerLog(
+		ctx,
+		container.ID(req.ContainerId),
+	)
+	if err == nil {
+		resp = &ReopenContainerLogResponse{}
+	}
+	return
 }
 
 func toPbContainers(cs []*container.Container) (rv []*Container) {
@@ -170,11 +284,165 @@ func toPbContainers(cs []*container.Container) (rv []*Container) {
 			Name:      string(c.Name()),
 			CreatedAt: c.CreatedAtNano(),
 			State:     toPbContainerState(c.Status()),
+			Reason:    c.Reason(),
 		})
 	}
 	return
 }
 
+func fromPbProbe(p *Probe) *container.Probe {
+	if p == nil {
+		return nil
+	}
+	return &container.Probe{
+		Kind:                p.Kind,
+		Command:             p.Command,
+		Port:                p.Port,
+		Path:                p.Path,
+		InitialDelaySeconds: p.InitialDelaySeconds,
+		PeriodSeconds:       p.PeriodSeconds,
+		TimeoutSeconds:      p.TimeoutSeconds,
+		FailureThreshold:    p.FailureThreshold,
+	}
+}
+
+func toPbProbeStatus(p *container.Probe, s container.ProbeState) *ProbeStatus {
+	if p == nil {
+		return nil
+	}
+	return &ProbeStatus{
+		Status:      string(s.StatusOrUnknown()),
+		Failures:    s.Failures,
+		LastProbeAt: s.LastAtNano(),
+		Message:     s.Message,
+	}
+}
+
+func fromPbSecurityOptions(o *SecurityOptions) container.SecurityOptions {
+	if o == nil {
+		return container.SecurityOptions{}
+	}
+	return container.SecurityOptions{
+		Privileged:      o.Privileged,
+		CapAdd:          o.CapAdd,
+		CapDrop:         o.CapDrop,
+		NoNewPrivileges: o.NoNewPrivileges,
+		Seccomp:         o.SeccompProfile,
+		MaskedPaths:     o.MaskedPaths,
+		ReadonlyPaths:   o.ReadonlyPaths,
+	}
+}
+
+func toPbSecurityProfile(p *container.SecurityProfile) *SecurityProfile {
+	if p == nil {
+		return nil
+	}
+	return &SecurityProfile{
+		Privileged:      p.Privileged,
+		Capabilities:    p.Capabilities,
+		NoNewPrivileges: p.NoNewPrivileges,
+		SeccompProfile:  p.Seccomp,
+		MaskedPaths:     p.MaskedPaths,
+		ReadonlyPaths:   p.ReadonlyPaths,
+	}
+}
+
+func fromPbUserNamespace(ns *UserNamespace) container.UserNamespaceOptions {
+	if ns == nil {
+		return container.UserNamespaceOptions{}
+	}
+	return container.UserNamespaceOptions{
+		Auto:        ns.Auto,
+		Size:        ns.Size,
+		UIDMappings: fromPbIDMappings(ns.UidMappings),
+		GIDMappings: fromPbIDMappings(ns.GidMappings),
+	}
+}
+
+func fromPbIDMappings(mappings []*IDMapping) []container.IDMapping {
+	var result []container.IDMapping
+	for _, m := range mappings {
+		result = append(result, container.IDMapping{ContainerID: m.ContainerId, HostID: m.HostId, Size: m.Size})
+	}
+	return result
+}
+
+func toPbUserNamespace(ns *container.UserNamespace) *UserNamespace {
+	if ns == nil {
+		return nil
+	}
+	return &UserNamespace{
+		UidMappings: toPbIDMappings(ns.UIDMappings),
+		GidMappings: toPbIDMappings(ns.GIDMappings),
+	}
+}
+
+func toPbIDMappings(mappings []container.IDMapping) []*IDMapping {
+	var result []*IDMapping
+	for _, m := range mappings {
+		result = append(result, &IDMapping{ContainerId: m.ContainerID, HostId: m.HostID, Size: m.Size})
+	}
+	return result
+}
+
+func toPbNetworkStatus(n *container.NetworkStatus) *NetworkStatus {
+	if n == nil {
+		return nil
+	}
+	return &NetworkStatus{
+		Mode:          n.Mode,
+		Namespace:     n.Namespace,
+		Interface:     n.Interface,
+		HostInterface: n.HostInterface,
+		Ip:            n.IP,
+		Gateway:       n.Gateway,
+		Mac:           n.MAC,
+		Ips:           n.IPs,
+		Name:          n.Name,
+	}
+}
+
+// fromPbPortMappings 协议为空时为 tcp, 端口超出范围时返回错误
+func fromPbPortMappings(mappings []*PortMapping) ([]container.PortMapping, error) {
+	var result []container.PortMapping
+	for _, m := range mappings {
+		if m.ContainerPort > math.MaxUint16 || m.HostPort > math.MaxUint16 {
+			return nil, errors.New(fmt.Sprintf("Invalid port mapping %d:%d, ports must be between 1 and 65535", m.HostPort, m.ContainerPort))
+		}
+		p := container.PortMapping{
+			HostIP:        m.HostIp,
+			HostPort:      uint16(m.HostPort),
+			ContainerPort: uint16(m.ContainerPort),
+			Protocol:      strings.ToLower(m.Protocol),
+		}
+		if p.Protocol == "" {
+			p.Protocol = container.ProtocolTCP
+		}
+		result = append(result, p)
+	}
+	return result, nil
+}
+
+func toPbPortMappings(mappings []container.PortMapping) []*PortMapping {
+	var result []*PortMapping
+	for _, m := range mappings {
+		result = append(result, &PortMapping{
+			Protocol:      m.Protocol,
+			ContainerPort: uint32(m.ContainerPort),
+			HostPort:      uint32(m.HostPort),
+			HostIp:        m.HostIP,
+		})
+	}
+	return result
+}
+
+func toPbPublishedPorts(p *container.PublishedPorts) *PublishedPorts {
+	if p == nil {
+		return nil
+	}
+	return &PublishedPorts{Backend: p.Backend, Ip: p.IP, ProxyPid: int32(p.ProxyPid)}
+}
+
 func toPbContainerState(s container.Status) ContainerState {
 	switch s {
 	case container.Created:
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"context"
+	"github.com/tluo-github/cri-impl/pkg/audit"
+	"github.com/tluo-github/cri-impl/pkg/authz"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"k8s.io/klog"
+	"time"
+)
+
+// auditCall 将一次修改状态的调用写入审计日志, 只读调用和未配置审计日志时不记录
+func (s *criServer) auditCall(ctx context.Context, method string, req interface{}, err error) {
+	if s.opts.Audit == nil || authz.IsReadOnly(method) {
+		return
+	}
+	e := &audit.Entry{
+		Time:      time.Now().UTC(),
+		RequestID: RequestIDFromContext(ctx),
+		Method:    method,
+		Caller:    auditCaller(ctx),
+		Code:      status.Code(err).String(),
+	}
+	if m, ok := req.(proto.Message); ok {
+		if args, merr := protojson.Marshal(m); merr == nil {
+			e.Args = args
+		}
+	}
+	if err != nil {
+		e.Error = status.Convert(err).Message()
+	}
+	if err := s.opts.Audit.Log(e); err != nil {
+		klog.Errorf("failed to write audit log for %s request_id=%s with err:%v", method, e.RequestID, err)
+	}
+}
+
+func auditCaller(ctx context.Context) audit.Caller {
+	var c audit.Caller
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return c
+	}
+	if info, ok := p.AuthInfo.(PeerCredInfo); ok {
+		c.Uid, c.Gid, c.Pid = &info.Uid, &info.Gid, &info.Pid
+		return c
+	}
+	if p.Addr != nil {
+		c.Addr = p.Addr.String()
+	}
+	if cert := peerCertificate(ctx); cert != nil {
+		c.Subject = cert.Subject.String()
+	}
+	return c
+}
+
+func (s *criServer) unaryAuditInterceptor(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	resp, err := handler(ctx, req)
+	s.auditCall(ctx, info.FullMethod, req, err)
+	return resp, err
+}
+
+func (s *criServer) streamAuditInterceptor(
+	srv interface{},
+	ss grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	as := &auditStream{ServerStream: ss}
+	err := handler(srv, as)
+	s.auditCall(ss.Context(), info.FullMethod, as.req, err)
+	return err
+}
+
+// auditStream 记录流式调用收到的第一条请求作为审计参数
+type auditStream struct {
+	grpc.ServerStream
+	req interface{}
+}
+
+func (s *auditStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err == nil && s.req == nil {
+		s.req = m
+	}
+	return err
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/tluo-github/cri-impl/pkg/authz"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"io/ioutil"
+)
+
+// TLSOptions TCP 监听使用的 mTLS 配置
+type TLSOptions struct {
+	CertFile string
+	KeyFile  string
+	// ClientCAFile 用于校验客户端证书的 CA,客户端必须提供由它签发的证书
+	ClientCAFile string
+}
+
+func (o *TLSOptions) serverConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	pem, err := ioutil.ReadFile(o.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New(fmt.Sprintf("No certificates found in %s", o.ClientCAFile))
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// peerCertificate 返回 TLS 调用方已验证的客户端证书, UNIX socket 调用返回 nil
+func peerCertificate(ctx context.Context) *x509.Certificate {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 || len(info.State.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return info.State.VerifiedChains[0][0]
+}
+
+// authorize 检查调用方是否有权限调用 method, 返回调用方的访问级别
+// TLS 调用方按照证书 subject 查询策略; UNIX socket 调用方按照 SO_PEERCRED 的 uid/gid 查询策略
+// 无法获得凭证的调用方只有策略的 unixDefault 级别
+func (s *criServer) authorize(ctx context.Context, method string) (authz.Level, error) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return authz.None, status.Error(codes.PermissionDenied, "unknown caller")
+	}
+	switch info := p.AuthInfo.(type) {
+	case credentials.TLSInfo:
+		cert := peerCertificate(ctx)
+		if cert == nil {
+			return authz.None, status.Error(codes.Unauthenticated, "client certificate required")
+		}
+		level := s.policy().ForCertificate(cert)
+		if !level.Allows(method) {
+			return level, status.Errorf(codes.PermissionDenied, "%q (%s access) is not allowed to call %s", cert.Subject, level, method)
+		}
+		return level, nil
+	case PeerCredInfo:
+		level := s.policy().ForUnixPeer(info.Uid, info.Gid)
+		if !level.Allows(method) {
+			return level, status.Errorf(codes.PermissionDenied, "uid %d (%s access) is not allowed to call %s", info.Uid, level, method)
+		}
+		return level, nil
+	default:
+		// 无法获得调用方的凭证, 不能按照 user/group 授权
+		level := s.policy().ForUnknownPeer()
+		if !level.Allows(method) {
+			return level, status.Errorf(codes.PermissionDenied, "unidentified caller (%s access) is not allowed to call %s", level, method)
+		}
+		return level, nil
+	}
+}
+
+// unaryAuthzInterceptor 检查权限, 并把调用方的访问级别保存在 context 中, 用于 CreateContainer 检查特权选项
+func (s *criServer) unaryAuthzInterceptor(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	level, err := s.authorize(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	return handler(authz.NewContext(ctx, level), req)
+}
+
+func (s *criServer) streamAuthzInterceptor(
+	srv interface{},
+	ss grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	if _, err := s.authorize(ss.Context(), info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
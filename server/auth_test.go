@@ -0,0 +1,282 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/tluo-github/cri-impl/pkg/authz"
+	"github.com/tluo-github/cri-impl/pkg/container"
+	"github.com/tluo-github/cri-impl/pkg/cri"
+	"github.com/tluo-github/cri-impl/pkg/oci"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// stubRuntime 只实现测试调用的 RuntimeService 方法
+type stubRuntime struct {
+	cri.RuntimeService
+	removed []container.ID
+	created []cri.ContainerOptions
+}
+
+func (r *stubRuntime) CreateContainer(ctx context.Context, options cri.ContainerOptions) (*container.Container, error) {
+	r.created = append(r.created, options)
+	return container.New("c1", options.Name, "")
+}
+
+func (r *stubRuntime) Version(ctx context.Context) (*oci.VersionInfo, error) {
+	return &oci.VersionInfo{}, nil
+}
+
+func (r *stubRuntime) RemoveContainer(ctx context.Context, id container.ID) error {
+	r.removed = append(r.removed, id)
+	return nil
+}
+
+// testCA 测试时生成的 CA
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+var serial int64
+
+func newTestCA(t *testing.T, cn string) *testCA {
+	ca := &testCA{}
+	ca.cert, ca.key, ca.pem = issueCert(t, nil, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: cn},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	})
+	return ca
+}
+
+// issue 签发证书, 返回 tls.Certificate 以及证书和私钥的 PEM
+func (ca *testCA) issue(t *testing.T, tmpl *x509.Certificate) (tls.Certificate, []byte, []byte) {
+	_, key, certPEM := issueCert(t, ca, tmpl)
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pair, certPEM, keyPEM
+}
+
+func issueCert(t *testing.T, ca *testCA, tmpl *x509.Certificate) (*x509.Certificate, *ecdsa.PrivateKey, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial++
+	tmpl.SerialNumber = big.NewInt(serial)
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	parent, signer := tmpl, key
+	if ca != nil {
+		parent, signer = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func clientCert(t *testing.T, ca *testCA, cn string) tls.Certificate {
+	pair, _, _ := ca.issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: cn, Organization: []string{"example"}},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	return pair
+}
+
+func writeFile(t *testing.T, dir string, name string, data []byte) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestTCPListenerRequiresAuthorizedClientCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mtls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t, "cri-impl test CA")
+	_, serverCertPEM, serverKeyPEM := ca.issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "cri-impl"},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+	})
+
+	runtime := &stubRuntime{}
+	srv := New(runtime, nil, Options{
+		TLS: &TLSOptions{
+			CertFile:     writeFile(t, dir, "server.crt", serverCertPEM),
+			KeyFile:      writeFile(t, dir, "server.key", serverKeyPEM),
+			ClientCAFile: writeFile(t, dir, "ca.crt", ca.pem),
+		},
+		Policy: &authz.Policy{
+			Certificates: map[string]authz.Level{
+				"CN=ops,O=example": authz.Full,
+				"viewer":           authz.ReadOnly,
+			},
+			UnixDefault: authz.Full,
+		},
+	})
+	lis, err := srv.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- srv.ServeListener("tcp", lis) }()
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+		if err := <-served; err != nil {
+			t.Errorf("ServeListener returned %v", err)
+		}
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	dial := func(certs ...tls.Certificate) CriClient {
+		conn, err := grpc.Dial(lis.Addr().String(), grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{
+			Certificates: certs,
+			RootCAs:      roots,
+			ServerName:   "127.0.0.1",
+		})))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return NewCriClient(conn)
+	}
+	call := func(client CriClient, mutate bool) codes.Code {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if mutate {
+			_, err = client.RemoveContainer(ctx, &RemoveContainerRequest{ContainerId: "c1"})
+		} else {
+			_, err = client.Version(ctx, &VersionRequest{})
+		}
+		return status.Code(err)
+	}
+
+	other := newTestCA(t, "untrusted CA")
+	cases := []struct {
+		name     string
+		client   CriClient
+		readOnly codes.Code
+		mutate   codes.Code
+	}{
+		{"full subject", dial(clientCert(t, ca, "ops")), codes.OK, codes.OK},
+		{"read-only common name", dial(clientCert(t, ca, "viewer")), codes.OK, codes.PermissionDenied},
+		{"unknown subject", dial(clientCert(t, ca, "intruder")), codes.PermissionDenied, codes.PermissionDenied},
+		{"untrusted CA", dial(clientCert(t, other, "ops")), codes.Unavailable, codes.Unavailable},
+		{"no client certificate", dial(), codes.Unavailable, codes.Unavailable},
+	}
+	for _, c := range cases {
+		if got := call(c.client, false); got != c.readOnly {
+			t.Errorf("%s: Version returned %v, want %v", c.name, got, c.readOnly)
+		}
+		if got := call(c.client, true); got != c.mutate {
+			t.Errorf("%s: RemoveContainer returned %v, want %v", c.name, got, c.mutate)
+		}
+	}
+	if len(runtime.removed) != 1 {
+		t.Errorf("RemoveContainer reached the runtime %d times, want 1", len(runtime.removed))
+	}
+}
+
+func TestTCPListenerRequiresTLSOptions(t *testing.T) {
+	srv := New(&stubRuntime{}, nil, Options{})
+	lis, err := srv.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	if err := srv.ServeListener("tcp", lis); err == nil {
+		t.Fatal("ServeListener accepted a TCP listener without TLS options")
+	}
+}
+
+func TestAuthorizeUnidentifiedUnixPeer(t *testing.T) {
+	ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.UnixAddr{Name: "@", Net: "unix"}})
+	const method = "/cri.Cri/RemoveContainer"
+	cases := []struct {
+		name   string
+		policy *authz.Policy
+		want   codes.Code
+	}{
+		{"no policy", nil, codes.OK},
+		{"unix default none", &authz.Policy{Users: map[string]authz.Level{"0": authz.Full}, UnixDefault: authz.None}, codes.PermissionDenied},
+		{"unix default read-only", &authz.Policy{UnixDefault: authz.ReadOnly}, codes.PermissionDenied},
+		{"unix default full", &authz.Policy{UnixDefault: authz.Full}, codes.OK},
+	}
+	for _, c := range cases {
+		srv := New(&stubRuntime{}, nil, Options{Policy: c.policy}).(*criServer)
+		_, err := srv.authorize(ctx, method)
+		if got := status.Code(err); got != c.want {
+			t.Errorf("%s: authorize returned %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestCreateContainerTrustsOnlyPrivilegedCallers(t *testing.T) {
+	runtime := &stubRuntime{}
+	srv := New(runtime, nil, Options{Policy: &authz.Policy{
+		Users:       map[string]authz.Level{"1000": authz.Full, "1001": authz.Privileged},
+		UnixDefault: authz.None,
+	}}).(*criServer)
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.CreateContainer(ctx, req.(*CreateContainerRequest))
+	}
+	info := &grpc.UnaryServerInfo{FullMethod: "/cri.Cri/CreateContainer"}
+	for _, uid := range []uint32{0, 1000, 1001} {
+		ctx := peer.NewContext(context.Background(), &peer.Peer{
+			Addr:     &net.UnixAddr{Name: "@", Net: "unix"},
+			AuthInfo: PeerCredInfo{Uid: uid, Gid: uid},
+		})
+		if _, err := srv.unaryAuthzInterceptor(ctx, &CreateContainerRequest{Name: "c1"}, info, handler); err != nil {
+			t.Fatalf("uid %d: CreateContainer returned %v", uid, err)
+		}
+	}
+	want := []bool{true, false, true}
+	for i, options := range runtime.created {
+		if options.Trusted != want[i] {
+			t.Errorf("call %d: Trusted = %v, want %v", i, options.Trusted, want[i])
+		}
+	}
+}
@@ -19,6 +19,7 @@ const _ = grpc.SupportPackageIsVersion7
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type CriClient interface {
 	Version(ctx context.Context, in *VersionRequest, opts ...grpc.CallOption) (*VersionResponse, error)
+	Status(ctx context.Context, in *StatusRequest, opts ...grpc.CallOption) (*StatusResponse, error)
 	CreateContainer(ctx context.Context, in *CreateContainerRequest, opts ...grpc.CallOption) (*CreateContainerResponse, error)
 	StartContainer(ctx context.Context, in *StartContainerRequest, opts ...grpc.CallOption) (*StartContainerResponse, error)
 	StopContainer(ctx context.Context, in *StopContainerRequest, opts ...grpc.CallOption) (*StopContainerResponse, error)
@@ -26,6 +27,8 @@ type CriClient interface {
 	ListContainers(ctx context.Context, in *ListContainersRequest, opts ...grpc.CallOption) (*ListContainersResponse, error)
 	ContainerStatus(ctx context.Context, in *ContainerStatusRequest, opts ...grpc.CallOption) (*ContainerStatusResponse, error)
 	Attach(ctx context.Context, in *AttachRequest, opts ...grpc.CallOption) (*AttachResponse, error)
+	ContainerLogs(ctx context.Context, in *ContainerLogsRequest, opts ...grpc.CallOption) (Cri_ContainerLogsClient, error)
+	ReopenContainerLog(ctx context.Context, in *ReopenContainerLogRequest, opts ...grpc.CallOption) (*ReopenContainerLogResponse, error)
 }
 
 type criClient struct {
@@ -45,6 +48,15 @@ func (c *criClient) Version(ctx context.Context, in *VersionRequest, opts ...grp
 	return out, nil
 }
 
+func (c *criClient) Status(ctx context.Context, in *StatusRequest, opts ...grpc.CallOption) (*StatusResponse, error) {
+	out := new(StatusResponse)
+	err := c.cc.Invoke(ctx, "/Cri/Status", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (c *criClient) CreateContainer(ctx context.Context, in *CreateContainerRequest, opts ...grpc.CallOption) (*CreateContainerResponse, error) {
 	out := new(CreateContainerResponse)
 	err := c.cc.Invoke(ctx, "/Cri/CreateContainer", in, out, opts...)
@@ -108,11 +120,53 @@ func (c *criClient) Attach(ctx context.Context, in *AttachRequest, opts ...grpc.
 	return out, nil
 }
 
+func (c *criClient) ContainerLogs(ctx context.Context, in *ContainerLogsRequest, opts ...grpc.CallOption) (Cri_ContainerLogsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Cri_ServiceDesc.Streams[0], "/Cri/ContainerLogs", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &criContainerLogsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Cri_ContainerLogsClient interface {
+	Recv() (*LogEntry, error)
+	grpc.ClientStream
+}
+
+type criContainerLogsClient struct {
+	grpc.ClientStream
+}
+
+func (x *criContainerLogsClient) Recv() (*LogEntry, error) {
+	m := new(LogEntry)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *criClient) ReopenContainerLog(ctx context.Context, in *ReopenContainerLogRequest, opts ...grpc.CallOption) (*ReopenContainerLogResponse, error) {
+	out := new(ReopenContainerLogResponse)
+	err := c.cc.Invoke(ctx, "/Cri/ReopenContainerLog", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // CriServer is the server API for Cri service.
 // All implementations must embed UnimplementedCriServer
 // for forward compatibility
 type CriServer interface {
 	Version(context.Context, *VersionRequest) (*VersionResponse, error)
+	Status(context.Context, *StatusRequest) (*StatusResponse, error)
 	CreateContainer(context.Context, *CreateContainerRequest) (*CreateContainerResponse, error)
 	StartContainer(context.Context, *StartContainerRequest) (*StartContainerResponse, error)
 	StopContainer(context.Context, *StopContainerRequest) (*StopContainerResponse, error)
@@ -120,6 +174,8 @@ type CriServer interface {
 	ListContainers(context.Context, *ListContainersRequest) (*ListContainersResponse, error)
 	ContainerStatus(context.Context, *ContainerStatusRequest) (*ContainerStatusResponse, error)
 	Attach(context.Context, *AttachRequest) (*AttachResponse, error)
+	ContainerLogs(*ContainerLogsRequest, Cri_ContainerLogsServer) error
+	ReopenContainerLog(context.Context, *ReopenContainerLogRequest) (*ReopenContainerLogResponse, error)
 	mustEmbedUnimplementedCriServer()
 }
 
@@ -130,6 +186,9 @@ type UnimplementedCriServer struct {
 func (UnimplementedCriServer) Version(context.Context, *VersionRequest) (*VersionResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Version not implemented")
 }
+func (UnimplementedCriServer) Status(context.Context, *StatusRequest) (*StatusResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Status not implemented")
+}
 func (UnimplementedCriServer) CreateContainer(context.Context, *CreateContainerRequest) (*CreateContainerResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method CreateContainer not implemented")
 }
@@ -151,6 +210,12 @@ func (UnimplementedCriServer) ContainerStatus(context.Context, *ContainerStatusR
 func (UnimplementedCriServer) Attach(context.Context, *AttachRequest) (*AttachResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Attach not implemented")
 }
+func (UnimplementedCriServer) ContainerLogs(*ContainerLogsRequest, Cri_ContainerLogsServer) error {
+	return status.Errorf(codes.Unimplemented, "method ContainerLogs not implemented")
+}
+func (UnimplementedCriServer) ReopenContainerLog(context.Context, *ReopenContainerLogRequest) (*ReopenContainerLogResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ReopenContainerLog not implemented")
+}
 func (UnimplementedCriServer) mustEmbedUnimplementedCriServer() {}
 
 // UnsafeCriServer may be embedded to opt out of forward compatibility for this service.
@@ -182,6 +247,24 @@ func _Cri_Version_Handler(srv interface{}, ctx context.Context, dec func(interfa
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Cri_Status_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StatusRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CriServer).Status(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/Cri/Status",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CriServer).Status(ctx, req.(*StatusRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 func _Cri_CreateContainer_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
 	in := new(CreateContainerRequest)
 	if err := dec(in); err != nil {
@@ -308,6 +391,45 @@ func _Cri_Attach_Handler(srv interface{}, ctx context.Context, dec func(interfac
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Cri_ContainerLogs_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ContainerLogsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(CriServer).ContainerLogs(m, &criContainerLogsServer{stream})
+}
+
+type Cri_ContainerLogsServer interface {
+	Send(*LogEntry) error
+	grpc.ServerStream
+}
+
+type criContainerLogsServer struct {
+	grpc.ServerStream
+}
+
+func (x *criContainerLogsServer) Send(m *LogEntry) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Cri_ReopenContainerLog_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReopenContainerLogRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CriServer).ReopenContainerLog(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/Cri/ReopenContainerLog",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CriServer).ReopenContainerLog(ctx, req.(*ReopenContainerLogRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // Cri_ServiceDesc is the grpc.ServiceDesc for Cri service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -319,6 +441,10 @@ var Cri_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "Version",
 			Handler:    _Cri_Version_Handler,
 		},
+		{
+			MethodName: "Status",
+			Handler:    _Cri_Status_Handler,
+		},
 		{
 			MethodName: "CreateContainer",
 			Handler:    _Cri_CreateContainer_Handler,
@@ -347,7 +473,17 @@ var Cri_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "Attach",
 			Handler:    _Cri_Attach_Handler,
 		},
+		{
+			MethodName: "ReopenContainerLog",
+			Handler:    _Cri_ReopenContainerLog_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "ContainerLogs",
+			Handler:       _Cri_ContainerLogs_Handler,
+			ServerStreams: true,
+		},
 	},
-	Streams:  []grpc.StreamDesc{},
 	Metadata: "cri.proto",
 }
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/tluo-github/cri-impl/pkg/cri"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var grpcCodes = map[cri.ErrorCode]codes.Code{
+	cri.ErrUnknown:            codes.Unknown,
+	cri.ErrInvalidArgument:    codes.InvalidArgument,
+	cri.ErrNotFound:           codes.NotFound,
+	cri.ErrAlreadyExists:      codes.AlreadyExists,
+	cri.ErrFailedPrecondition: codes.FailedPrecondition,
+	cri.ErrDeadlineExceeded:   codes.DeadlineExceeded,
+	cri.ErrInternal:           codes.Internal,
+	cri.ErrUnimplemented:      codes.Unimplemented,
+	cri.ErrPermissionDenied:   codes.PermissionDenied,
+}
+
+// toStatusError 将 RuntimeService 返回的错误转换为 gRPC status
+// runc 的 stderr 等附加信息放在 status details 的 DebugInfo 中
+func toStatusError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	if errors.Is(err, context.Canceled) {
+		return status.Error(codes.Canceled, err.Error())
+	}
+	code, details := cri.Classify(err)
+	st := status.New(grpcCodes[code], err.Error())
+	if details != "" {
+		if withDetails, derr := st.WithDetails(&errdetails.DebugInfo{Detail: details}); derr == nil {
+			st = withDetails
+		}
+	}
+	return st.Err()
+}
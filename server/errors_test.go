@@ -0,0 +1,72 @@
+package server
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/tluo-github/cri-impl/pkg/cri"
+	"github.com/tluo-github/cri-impl/pkg/oci"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+)
+
+func TestToStatusError(t *testing.T) {
+	runcErr := &oci.RuntimeError{Stderr: "container_linux.go: permission denied", Err: errors.New("exit status 1")}
+
+	tests := []struct {
+		name    string
+		err     error
+		code    codes.Code
+		details string
+	}{
+		{"invalid argument", cri.Errorf(cri.ErrInvalidArgument, "bad name"), codes.InvalidArgument, ""},
+		{"not found", cri.Errorf(cri.ErrNotFound, "container c1 not found"), codes.NotFound, ""},
+		{"already exists", cri.Errorf(cri.ErrAlreadyExists, "container c1 exists"), codes.AlreadyExists, ""},
+		{"failed precondition", cri.Errorf(cri.ErrFailedPrecondition, "container c1 is running"), codes.FailedPrecondition, ""},
+		{"deadline exceeded", cri.Errorf(cri.ErrDeadlineExceeded, "wait shim"), codes.DeadlineExceeded, ""},
+		{"internal", cri.Errorf(cri.ErrInternal, "create failed"), codes.Internal, ""},
+		{"unimplemented", cri.Errorf(cri.ErrUnimplemented, "checkpoint"), codes.Unimplemented, ""},
+		{"permission denied", cri.Errorf(cri.ErrPermissionDenied, "privileged"), codes.PermissionDenied, ""},
+		{"unknown", cri.Errorf(cri.ErrUnknown, "boom"), codes.Unknown, ""},
+		{"wrapped", errors.Wrap(cri.Errorf(cri.ErrNotFound, "container c1 not found"), "start"), codes.NotFound, ""},
+		{"wrapped runc error", cri.WrapError(cri.ErrFailedPrecondition, runcErr, "start container c1"),
+			codes.FailedPrecondition, runcErr.Stderr},
+		{"bare runc error", runcErr, codes.Internal, runcErr.Stderr},
+		{"deadline", errors.Wrap(context.DeadlineExceeded, "wait"), codes.DeadlineExceeded, ""},
+		{"canceled", errors.Wrap(context.Canceled, "wait"), codes.Canceled, ""},
+		{"unclassified", errors.New("boom"), codes.Unknown, ""},
+	}
+	for _, tt := range tests {
+		err := toStatusError(tt.err)
+		st, ok := status.FromError(err)
+		if !ok {
+			t.Errorf("%s: %v is not a status error", tt.name, err)
+			continue
+		}
+		if st.Code() != tt.code {
+			t.Errorf("%s: code %v, want %v", tt.name, st.Code(), tt.code)
+		}
+		if st.Message() != tt.err.Error() {
+			t.Errorf("%s: message %q, want %q", tt.name, st.Message(), tt.err.Error())
+		}
+		var details string
+		for _, d := range st.Details() {
+			if info, ok := d.(*errdetails.DebugInfo); ok {
+				details = info.Detail
+			}
+		}
+		if details != tt.details {
+			t.Errorf("%s: details %q, want %q", tt.name, details, tt.details)
+		}
+	}
+
+	// 已经是 gRPC status 的错误原样返回
+	unauthenticated := status.Error(codes.Unauthenticated, "no token")
+	if err := toStatusError(unauthenticated); err != unauthenticated {
+		t.Errorf("toStatusError(%v) = %v, want it unchanged", unauthenticated, err)
+	}
+	if err := toStatusError(nil); err != nil {
+		t.Errorf("toStatusError(nil) = %v, want nil", err)
+	}
+}
@@ -0,0 +1,362 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/satori/go.uuid"
+	"github.com/tluo-github/cri-impl/pkg/metrics"
+	"github.com/tluo-github/cri-impl/pkg/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+	"runtime/debug"
+	"time"
+)
+
+// RequestIDHeader 请求 ID 的 metadata key,客户端传入时沿用,否则由守护进程生成
+const RequestIDHeader = "x-request-id"
+
+type requestIDKey struct{}
+
+// RequestIDFromContext 返回拦截器为当前调用分配的请求 ID
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// unaryInterceptors 拦截器从外到内依次为:
+// 请求 ID -> trace -> 访问日志 -> 指标 -> 审计 -> 错误转换 -> 鉴权 -> 最大超时 -> panic 恢复 -> handler
+func (s *criServer) unaryInterceptors() []grpc.UnaryServerInterceptor {
+	return []grpc.UnaryServerInterceptor{
+		unaryRequestIDInterceptor,
+		unaryTracingInterceptor,
+		unaryAccessLogInterceptor,
+		unaryMetricsInterceptor,
+		s.unaryAuditInterceptor,
+		unaryErrorInterceptor,
+		s.unaryAuthzInterceptor,
+		unaryDeadlineInterceptor(s.opts.MaxDeadline),
+		unaryRecoveryInterceptor,
+	}
+}
+
+// streamInterceptors 与 unaryInterceptors 相同,但不限制超时: follow 日志等流式调用是长连接,
+// 守护进程关闭时由 streamShutdownInterceptor 结束
+func (s *criServer) streamInterceptors() []grpc.StreamServerInterceptor {
+	return []grpc.StreamServerInterceptor{
+		streamRequestIDInterceptor,
+		streamTracingInterceptor,
+		streamAccessLogInterceptor,
+		streamMetricsInterceptor,
+		s.streamAuditInterceptor,
+		streamErrorInterceptor,
+		s.streamAuthzInterceptor,
+		s.streamShutdownInterceptor,
+		streamRecoveryInterceptor,
+	}
+}
+
+func withRequestID(ctx context.Context) (context.Context, string) {
+	var id string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if vals := md.Get(RequestIDHeader); len(vals) > 0 && vals[0] != "" {
+			id = vals[0]
+		}
+	}
+	if id == "" {
+		id = uuid.NewV4().String()
+	}
+	return context.WithValue(ctx, requestIDKey{}, id), id
+}
+
+func unaryRequestIDInterceptor(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	ctx, id := withRequestID(ctx)
+	if err := grpc.SetHeader(ctx, metadata.Pairs(RequestIDHeader, id)); err != nil {
+		klog.Warningf("failed to set request id header with err:%v", err)
+	}
+	return handler(ctx, req)
+}
+
+func streamRequestIDInterceptor(
+	srv interface{},
+	ss grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	ctx, id := withRequestID(ss.Context())
+	if err := ss.SetHeader(metadata.Pairs(RequestIDHeader, id)); err != nil {
+		klog.Warningf("failed to set request id header with err:%v", err)
+	}
+	return handler(srv, &serverStream{ServerStream: ss, ctx: ctx})
+}
+
+// metadataCarrier 将 gRPC metadata 适配为 propagation.TextMapCarrier
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	if vals := metadata.MD(c).Get(key); len(vals) > 0 {
+		return vals[0]
+	}
+	return ""
+}
+
+func (c metadataCarrier) Set(key string, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// startServerSpan 从 metadata 中提取调用方的 trace context,并创建服务端 span
+func startServerSpan(ctx context.Context, method string) (context.Context, trace.Span) {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		ctx = otel.GetTextMapPropagator().Extract(ctx, metadataCarrier(md))
+	}
+	return otel.Tracer("github.com/tluo-github/cri-impl/server").Start(ctx, method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("rpc.system", "grpc"),
+			attribute.String("rpc.method", method),
+			attribute.String("request.id", RequestIDFromContext(ctx)),
+		),
+	)
+}
+
+func endServerSpan(span trace.Span, err error) {
+	if err != nil {
+		span.SetAttributes(attribute.String("rpc.grpc.status_code", status.Code(err).String()))
+	}
+	tracing.End(span, err)
+}
+
+func unaryTracingInterceptor(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	ctx, span := startServerSpan(ctx, info.FullMethod)
+	resp, err := handler(ctx, req)
+	endServerSpan(span, err)
+	return resp, err
+}
+
+func streamTracingInterceptor(
+	srv interface{},
+	ss grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	ctx, span := startServerSpan(ss.Context(), info.FullMethod)
+	err := handler(srv, &serverStream{ServerStream: ss, ctx: ctx})
+	endServerSpan(span, err)
+	return err
+}
+
+// logAccess 每个调用输出一行 key=value 格式的访问日志
+func logAccess(ctx context.Context, method string, start time.Time, err error) {
+	line := fmt.Sprintf("grpc access method=%s request_id=%s caller=%s duration=%s code=%s",
+		method,
+		RequestIDFromContext(ctx),
+		callerOf(ctx),
+		time.Since(start),
+		status.Code(err),
+	)
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		line += " trace_id=" + sc.TraceID().String()
+	}
+	if err != nil {
+		line += fmt.Sprintf(" error=%q", status.Convert(err).Message())
+	}
+	klog.Info(line)
+}
+
+// callerOf 返回调用方的描述, TLS 调用方为地址和证书 subject, UNIX socket 调用方为进程凭证
+func callerOf(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return "unix"
+	}
+	if info, ok := p.AuthInfo.(PeerCredInfo); ok {
+		return "unix(" + info.String() + ")"
+	}
+	if p.Addr == nil || p.Addr.String() == "" {
+		return "unix"
+	}
+	if cert := peerCertificate(ctx); cert != nil {
+		return fmt.Sprintf("%s(%s)", p.Addr, cert.Subject)
+	}
+	return p.Addr.String()
+}
+
+func unaryAccessLogInterceptor(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	logAccess(ctx, info.FullMethod, start, err)
+	return resp, err
+}
+
+func streamAccessLogInterceptor(
+	srv interface{},
+	ss grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	start := time.Now()
+	err := handler(srv, ss)
+	logAccess(ss.Context(), info.FullMethod, start, err)
+	return err
+}
+
+func observeRequest(method string, start time.Time, err error) {
+	metrics.GrpcRequests.WithLabelValues(method, status.Code(err).String()).Inc()
+	metrics.GrpcLatency.WithLabelValues(method).Observe(time.Since(start).Seconds())
+}
+
+func unaryMetricsInterceptor(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	observeRequest(info.FullMethod, start, err)
+	return resp, err
+}
+
+func streamMetricsInterceptor(
+	srv interface{},
+	ss grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	start := time.Now()
+	err := handler(srv, ss)
+	observeRequest(info.FullMethod, start, err)
+	return err
+}
+
+// unaryErrorInterceptor 转换 unary 调用返回的错误
+func unaryErrorInterceptor(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	resp, err := handler(ctx, req)
+	return resp, toStatusError(err)
+}
+
+// streamErrorInterceptor 转换 stream 调用返回的错误
+func streamErrorInterceptor(
+	srv interface{},
+	ss grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	return toStatusError(handler(srv, ss))
+}
+
+// unaryDeadlineInterceptor 将调用的超时限制在 max 以内, max <= 0 表示不限制
+// RuntimeService 只在等待公共 lock 时感知超时: 超时前没有开始的调用返回 DeadlineExceeded,
+// 已经开始的调用会执行完成并返回真实结果, 避免调用方看到失败而操作实际上已经成功
+func unaryDeadlineInterceptor(max time.Duration) grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		if max <= 0 {
+			return handler(ctx, req)
+		}
+		ctx, cancel := context.WithTimeout(ctx, max)
+		defer cancel()
+		return handler(ctx, req)
+	}
+}
+
+// streamShutdownInterceptor 在守护进程关闭时取消流式调用的 ctx, 避免长连接阻塞关闭
+func (s *criServer) streamShutdownInterceptor(
+	srv interface{},
+	ss grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	ctx, cancel := context.WithCancel(ss.Context())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.stopping:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return handler(srv, &serverStream{ServerStream: ss, ctx: ctx})
+}
+
+// unaryRecoveryInterceptor 将 handler 中的 panic 转换为 codes.Internal,避免守护进程退出
+func unaryRecoveryInterceptor(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (resp interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = recovered(ctx, info.FullMethod, r)
+		}
+	}()
+	return handler(ctx, req)
+}
+
+func streamRecoveryInterceptor(
+	srv interface{},
+	ss grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = recovered(ss.Context(), info.FullMethod, r)
+		}
+	}()
+	return handler(srv, ss)
+}
+
+func recovered(ctx context.Context, method string, r interface{}) error {
+	klog.Errorf("grpc method=%s request_id=%s panic:%v\n%s", method, RequestIDFromContext(ctx), r, debug.Stack())
+	return status.Errorf(codes.Internal, "panic in %s: %v", method, r)
+}
+
+// serverStream 替换 grpc.ServerStream 的 context
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"context"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/tluo-github/cri-impl/pkg/container"
+	"github.com/tluo-github/cri-impl/pkg/cri"
+	"github.com/tluo-github/cri-impl/pkg/metrics"
+	"github.com/tluo-github/cri-impl/pkg/oci"
+	"github.com/tluo-github/cri-impl/pkg/storage"
+	"google.golang.org/grpc"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// nopOCIRuntime 没有容器时 RuntimeService 不会调用 runc
+type nopOCIRuntime struct {
+	oci.Runtime
+}
+
+func TestMetricsAfterRPC(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// NewRuntimeService 把容器状态的 collector 注册到 metrics.Registry
+	runtime, err := cri.NewRuntimeService(
+		map[string]oci.Runtime{"runc": &nopOCIRuntime{}}, "runc",
+		storage.NewContainerStore(filepath.Join(dir, "containers")),
+		filepath.Join(dir, "logs"), filepath.Join(dir, "exits"), filepath.Join(dir, "attach"),
+		container.LogPolicy{}, container.Resources{}, container.SecurityOptions{},
+		"", specs.Hooks{}, nil, nil, "", 0, nil, nil, container.NetworkNone, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	defer runtime.Shutdown(ctx, false)
+
+	addr := filepath.Join(dir, "cri-impl.sock")
+	srv := New(runtime, nil, Options{})
+	lis, err := srv.Listen("unix", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- srv.ServeListener("unix", lis) }()
+	defer func() {
+		srv.Shutdown(ctx)
+		<-served
+	}()
+
+	conn, err := grpc.DialContext(ctx, addr, grpc.WithInsecure(), grpc.WithBlock(),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", addr)
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := NewCriClient(conn).ListContainers(ctx, &ListContainersRequest{}); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		`cri_impl_grpc_requests_total{code="OK",method="/Cri/ListContainers"} 1`,
+		`cri_impl_grpc_request_duration_seconds_bucket{method="/Cri/ListContainers",le="+Inf"} 1`,
+		`cri_impl_grpc_request_duration_seconds_count{method="/Cri/ListContainers"} 1`,
+		`cri_impl_containers{status="created"} 0`,
+		`cri_impl_containers{status="running"} 0`,
+		`cri_impl_containers{status="stopped"} 0`,
+	} {
+		if !strings.Contains(body, want+"\n") {
+			t.Errorf("metrics do not contain %s", want)
+		}
+	}
+}
@@ -0,0 +1,22 @@
+package server
+
+import (
+	"fmt"
+	"google.golang.org/grpc/credentials"
+)
+
+// PeerCredInfo UNIX socket 调用方的进程凭证,由内核在连接建立时记录 (SO_PEERCRED)
+type PeerCredInfo struct {
+	credentials.CommonAuthInfo
+	Uid uint32
+	Gid uint32
+	Pid int32
+}
+
+func (PeerCredInfo) AuthType() string {
+	return "peercred"
+}
+
+func (i PeerCredInfo) String() string {
+	return fmt.Sprintf("uid=%d,gid=%d,pid=%d", i.Uid, i.Gid, i.Pid)
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"google.golang.org/grpc/credentials"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPeerCredentialsHandshake(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peercred")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	lis, err := net.Listen("unix", filepath.Join(dir, "sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	client, err := net.Dial("unix", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := lis.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, auth, err := newPeerCredentials().ServerHandshake(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, ok := auth.(PeerCredInfo)
+	if !ok {
+		t.Fatalf("auth info is %T, want PeerCredInfo", auth)
+	}
+	if int(info.Uid) != os.Getuid() || int(info.Gid) != os.Getgid() || int(info.Pid) != os.Getpid() {
+		t.Errorf("peer credentials = %v, want uid=%d,gid=%d,pid=%d", info, os.Getuid(), os.Getgid(), os.Getpid())
+	}
+	// UNIX socket 不加密
+	if info.SecurityLevel != credentials.NoSecurity {
+		t.Errorf("security level = %v, want NoSecurity", info.SecurityLevel)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package server
+
+import "google.golang.org/grpc/credentials"
+
+// newPeerCredentials 其他平台不支持 SO_PEERCRED, UNIX socket 调用方只由文件权限控制
+func newPeerCredentials() credentials.TransportCredentials {
+	return nil
+}
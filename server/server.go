@@ -1,49 +1,208 @@
 package server
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"github.com/tluo-github/cri-impl/pkg/audit"
+	"github.com/tluo-github/cri-impl/pkg/authz"
 	"github.com/tluo-github/cri-impl/pkg/cri"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"io/ioutil"
 	"k8s.io/klog"
 	"k8s.io/kubernetes/pkg/kubelet/cri/streaming"
 	"net"
 	"os"
+	"os/user"
 	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
 )
 
 type Server interface {
 	CriServer
 	Serve(network, addr string) error
+	// Listen 创建 network (unix 或 tcp) 监听, 由 Listen 创建的 UNIX socket 在 Shutdown 时删除
+	Listen(network, addr string) (net.Listener, error)
+	// ServeListener 在已经创建的监听上提供服务, 如 systemd socket activation 传入的 socket
+	ServeListener(network string, lis net.Listener) error
+	// SetPolicy 替换访问策略, 对之后的调用生效
+	SetPolicy(policy *authz.Policy)
+	// Shutdown 停止接受新的调用并结束进行中的流式调用, 等待 unary 调用完成后删除 UNIX socket
+	// ctx 结束时强制关闭剩余的连接
+	Shutdown(ctx context.Context)
 }
+
+// Options gRPC 服务的配置
+type Options struct {
+	// MaxDeadline unary 调用的最大超时时间, 0 表示不限制
+	MaxDeadline time.Duration
+	// TLS tcp 监听使用的 mTLS 配置, tcp 监听必须设置
+	TLS *TLSOptions
+	// Policy TLS 客户端和 UNIX socket 调用方的访问策略
+	Policy *authz.Policy
+	// Audit 修改状态的调用写入的审计日志, nil 表示不记录
+	Audit *audit.Logger
+	// SocketMode UNIX socket 文件的权限, 0 表示保持 umask 决定的默认权限
+	SocketMode os.FileMode
+	// SocketGroup UNIX socket 文件的属组 (组名或 gid), 为空表示不修改
+	SocketGroup string
+}
+
 type criServer struct {
+	UnimplementedCriServer
+
 	runtimeSrv   cri.RuntimeService
 	streamingSrv streaming.Server
+	opts         Options
+
+	// policyLock 保护 opts.Policy, 策略可以在运行时重新加载
+	policyLock sync.RWMutex
+
+	// lock 保护 servers 和 sockets
+	lock    sync.Mutex
+	servers []*grpc.Server
+	sockets []string
+	// stopping 关闭开始时被关闭, 用于结束 follow 日志等长时间的流式调用
+	stopping chan struct{}
 }
 
 func New(
 	runtimeSrv cri.RuntimeService,
 	streamingSrv streaming.Server,
+	opts Options,
 ) Server {
 	return &criServer{
 		runtimeSrv:   runtimeSrv,
 		streamingSrv: streamingSrv,
+		opts:         opts,
+		stopping:     make(chan struct{}),
 	}
 }
 
+func (s *criServer) SetPolicy(policy *authz.Policy) {
+	s.policyLock.Lock()
+	defer s.policyLock.Unlock()
+	s.opts.Policy = policy
+}
+
+func (s *criServer) policy() *authz.Policy {
+	s.policyLock.RLock()
+	defer s.policyLock.RUnlock()
+	return s.opts.Policy
+}
+
+// Serve 在 network (unix 或 tcp) 上提供服务, tcp 监听只接受 mTLS 连接
+// unix 和 tcp 可以分别调用 Serve 同时监听
 func (s *criServer) Serve(network, addr string) error {
-	lis, err := listen(network, addr)
+	lis, err := s.Listen(network, addr)
 	if err != nil {
 		return err
 	}
+	return s.ServeListener(network, lis)
+}
+
+func (s *criServer) Listen(network, addr string) (net.Listener, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.stoppingNoLock() {
+		return nil, errors.New("Server is shutting down")
+	}
+	lis, err := s.listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if network == "unix" {
+		s.sockets = append(s.sockets, addr)
+	}
+	return lis, nil
+}
 
-	gsrv := grpc.NewServer()
+func (s *criServer) ServeListener(network string, lis net.Listener) error {
+	opts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(s.unaryInterceptors()...),
+		grpc.ChainStreamInterceptor(s.streamInterceptors()...),
+	}
+	if network == "tcp" {
+		if s.opts.TLS == nil {
+			return errors.New("TCP listener requires TLS options")
+		}
+		tlsCfg, err := s.opts.TLS.serverConfig()
+		if err != nil {
+			return err
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsCfg)))
+	} else if creds := newPeerCredentials(); creds != nil {
+		opts = append(opts, grpc.Creds(creds))
+	}
+	gsrv := grpc.NewServer(opts...)
 	RegisterCriServer(gsrv, s)
+
+	s.lock.Lock()
+	if s.stoppingNoLock() {
+		s.lock.Unlock()
+		lis.Close()
+		return errors.New("Server is shutting down")
+	}
+	s.servers = append(s.servers, gsrv)
+	s.lock.Unlock()
+
 	return gsrv.Serve(lis)
 }
 
-func listen(network, addr string) (net.Listener, error) {
-	if network != "unix" {
-		return nil, errors.New("Only UNIX sockets supported")
+func (s *criServer) stoppingNoLock() bool {
+	select {
+	case <-s.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *criServer) Shutdown(ctx context.Context) {
+	s.lock.Lock()
+	close(s.stopping)
+	servers := s.servers
+	sockets := s.sockets
+	s.lock.Unlock()
+
+	var wg sync.WaitGroup
+	for _, gsrv := range servers {
+		wg.Add(1)
+		go func(gsrv *grpc.Server) {
+			defer wg.Done()
+			stopped := make(chan struct{})
+			go func() {
+				gsrv.GracefulStop()
+				close(stopped)
+			}()
+			select {
+			case <-stopped:
+			case <-ctx.Done():
+				klog.Warningf("grpc calls still running at shutdown timeout, closing connections")
+				gsrv.Stop()
+			}
+		}(gsrv)
+	}
+	wg.Wait()
+
+	for _, sock := range sockets {
+		if err := os.Remove(sock); err != nil && !os.IsNotExist(err) {
+			klog.Warningf("failed to remove socket %s with err:%v", sock, err)
+		}
+	}
+}
+
+func (s *criServer) listen(network, addr string) (net.Listener, error) {
+	switch network {
+	case "tcp":
+		return net.Listen("tcp", addr)
+	case "unix":
+	default:
+		return nil, errors.New(fmt.Sprintf("Unsupported network %q", network))
 	}
 	if err := os.MkdirAll(filepath.Dir(addr), 0755); err != nil {
 		return nil, err
@@ -51,13 +210,66 @@ func listen(network, addr string) (net.Listener, error) {
 	if err := os.Remove(addr); err != nil && !os.IsNotExist(err) {
 		return nil, err
 	}
-	return net.Listen("unix", addr)
+	// 先在只有守护进程能访问的临时目录中创建 socket 并设置权限, 再重命名为 addr,
+	// 避免 socket 在设置权限之前以 umask 决定的默认权限出现在 addr
+	tmpDir, err := ioutil.TempDir(filepath.Dir(addr), "."+filepath.Base(addr))
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+	tmp := filepath.Join(tmpDir, "sock")
+	lis, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+	// socket 文件由 Shutdown 按照 addr 删除
+	lis.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err := s.setSocketPermissions(tmp); err != nil {
+		lis.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmp, addr); err != nil {
+		lis.Close()
+		return nil, err
+	}
+	return &unixListener{Listener: lis, addr: &net.UnixAddr{Name: addr, Net: "unix"}}, nil
 }
 
-func traceRequest(name string, req interface{}) {
-	klog.Infof("Request [%s], body:%v", name, req)
+// unixListener 重命名之后的 UNIX socket 监听, Addr 返回重命名后的路径
+type unixListener struct {
+	net.Listener
+	addr net.Addr
 }
 
-func traceResponse(name string, resp interface{}, err error) {
-	klog.Infof("Response [%s], body:%s with err:%v", name, resp, err)
+func (l *unixListener) Addr() net.Addr {
+	return l.addr
+}
+
+// setSocketPermissions 设置 UNIX socket 文件的属组和权限,只有属组成员才能连接时再由策略细分权限
+func (s *criServer) setSocketPermissions(addr string) error {
+	if s.opts.SocketGroup != "" {
+		gid, err := lookupGid(s.opts.SocketGroup)
+		if err != nil {
+			return err
+		}
+		if err := os.Chown(addr, -1, gid); err != nil {
+			return err
+		}
+	}
+	if s.opts.SocketMode != 0 {
+		return os.Chmod(addr, s.opts.SocketMode)
+	}
+	return nil
+}
+
+// lookupGid 将组名或数字 gid 解析为 gid
+func lookupGid(group string) (int, error) {
+	if gid, err := strconv.Atoi(group); err == nil {
+		return gid, nil
+	}
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(g.Gid)
 }
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"context"
+	"google.golang.org/grpc"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestListenUnixSetsPermissionsBeforeExposingSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addr := filepath.Join(dir, "cri-impl.sock")
+
+	srv := New(&stubRuntime{}, nil, Options{SocketMode: 0660, SocketGroup: "0"})
+	lis, err := srv.Listen("unix", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := lis.Addr().String(); got != addr {
+		t.Errorf("Addr() = %s, want %s", got, addr)
+	}
+	fi, err := os.Stat(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 || fi.Mode().Perm() != 0660 {
+		t.Errorf("socket mode = %v, want socket with 0660", fi.Mode())
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("listen left temporary files in %s: %d entries", dir, len(entries))
+	}
+
+	served := make(chan error, 1)
+	go func() { served <- srv.ServeListener("unix", lis) }()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, addr, grpc.WithInsecure(), grpc.WithBlock(),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", addr)
+		}))
+	if err != nil {
+		t.Fatalf("dial renamed socket: %v", err)
+	}
+	if _, err := NewCriClient(conn).Version(ctx, &VersionRequest{}); err != nil {
+		t.Errorf("Version over unix socket: %v", err)
+	}
+	conn.Close()
+
+	srv.Shutdown(ctx)
+	if err := <-served; err != nil {
+		t.Errorf("ServeListener returned %v", err)
+	}
+	if _, err := os.Stat(addr); !os.IsNotExist(err) {
+		t.Errorf("socket %s still exists after shutdown", addr)
+	}
+}